@@ -3,15 +3,20 @@ package agi
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
+	"maps"
+	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"github.com/pkg/errors"
 )
 
 // AgiSession represents an AGI session
@@ -19,14 +24,106 @@ type AgiSession struct {
 	reader     *bufio.Reader
 	writer     io.Writer
 	env        map[string]string
-	mutex      sync.Mutex
+	mutex      commandLock
 	variables  map[string]string
 	debugMode  bool
 	timeout    time.Duration
 	ctx        context.Context
 	cancelFunc context.CancelFunc
+
+	maxLineSize    int
+	maxDataDigits  int
+	envTransformed bool
+
+	envOrder   []string
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	// conn is the connection responses are read from, used for read
+	// deadlines. It is nil for process AGI sessions.
+	conn   net.Conn
+	faults *FaultInjection
+	sent   int
+	limits commandLimits
+
+	// deadline replaces the response timeout of the command in progress
+	// when hasDeadline is set; see CommandWithDeadline
+	deadline    time.Duration
+	hasDeadline bool
+
+	start        time.Time
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+
+	// cleanups are the OnClose callbacks, run once by finish, and deferred
+	// the Defer commands, run once by runDeferred
+	closeMu     sync.Mutex
+	cleanups    []func(err error)
+	closed      bool
+	deferred    [][]DeferredCommand
+	deferredRan bool
+
+	language         string
+	skipTZValidation bool
+	gotoPrecheck     bool
+	promptMetrics    PromptMetrics
+
+	soundsDir      string
+	soundFormats   []string
+	soundCache     map[string]bool
+	strictPrompts  bool
+	promptResolver PromptResolver
+	promptWarmer   PromptWarmer
+	clk            Clock
+
+	latency           latencies
+	degradationPolicy DegradationPolicy
+	flowStateVar      string
+	commandValidation func(s *AgiSession, command string, err error)
+	readCache         *readCache
+
+	errorPolicy        ErrorPolicy
+	appliedErrorPolicy *ErrorPolicy
+	audio              io.Reader
+
+	variableEscaping bool
+	transcript       *transcript
+	flags            map[string]bool
+	tenant           string
+	externals        *ExternalRegistry
+	hungUp           atomic.Bool
+	sensitive        atomic.Int32
+	serverPolicy     CommandPolicy
+	commandPolicy    CommandPolicy
+	onCommandDenied  func(s *AgiSession, cmd PolicyCommand)
+	bargeIn          BargeInPolicy
+	hotkeys          map[string]HotkeyAction
+	hotkeysOff       bool
+	resultPrefix     string
+	staged           map[string]string
+	varSetter        VariableSetter
+	onHeartbeat      func(s *AgiSession, b Beat)
+
+	// historySize is the ring size for RecentExchanges: zero means
+	// DefaultHistorySize and a negative size disables it
+	historySize int
+	history     history
+	redactor    func(Exchange) Exchange
+
+	callStore     CallStateStore
+	callKey       func(s *AgiSession) string
+	callState     *CallState
+	callStateOnce sync.Once
+
+	// escaped is set once a goroutine or callback that can outlive the
+	// handler holds the session, such as a heartbeat or a hangup watch;
+	// releaseSession then leaves it to the garbage collector
+	escaped atomic.Bool
 }
 
+// DefaultMaxLineSize is the default limit for a single line received from Asterisk
+const DefaultMaxLineSize = 64 * 1024
+
 // AgiResponse represents an AGI response
 type AgiResponse struct {
 	Status  int
@@ -36,6 +133,17 @@ type AgiResponse struct {
 	EndPos  int
 	Digits  string
 	Timeout bool
+
+	// HasEndPos reports whether the response carried an endpos= value
+	HasEndPos bool
+	// Annotation is the known annotation following the result, if any;
+	// see ParseAnnotation
+	Annotation Annotation
+	// ResultText is the result exactly as Asterisk sent it, such as the
+	// digits GET DATA collected with their leading zeros. Result is 0 when
+	// it is a string of keys that is not a number, such as "*12" or more
+	// digits than an int holds.
+	ResultText string
 }
 
 // NewAgiSession creates a new AGI session
@@ -45,11 +153,23 @@ func NewAgiSession() (*AgiSession, error) {
 
 // NewWithContext creates a new AGISession with a context
 func NewWithContext(ctx context.Context) (*AgiSession, error) {
+	s, err := NewSession(ctx, os.Stdin, os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	s.openEAGIAudio()
+	return s, nil
+}
+
+// NewSession creates an AGI session that reads the environment and responses
+// from r and writes commands to w. When r is a net.Conn each command's
+// response must arrive within the session timeout; see SetTimeout.
+func NewSession(ctx context.Context, r io.Reader, w io.Writer) (*AgiSession, error) {
 	ctx, cancel := context.WithCancel(ctx)
 
 	s := &AgiSession{
-		reader:     bufio.NewReader(os.Stdin),
-		writer:     os.Stdout,
+		reader:     bufio.NewReader(r),
+		writer:     w,
 		env:        make(map[string]string),
 		variables:  make(map[string]string),
 		debugMode:  false,
@@ -57,10 +177,14 @@ func NewWithContext(ctx context.Context) (*AgiSession, error) {
 		ctx:        ctx,
 		cancelFunc: cancel,
 	}
+	s.start = s.clock().Now()
+	if conn, ok := r.(net.Conn); ok {
+		s.conn = conn
+	}
 
 	if err := s.readEnvironment(); err != nil {
 		cancel()
-		return nil, errors.Wrap(err, "failed to read AGI environment")
+		return nil, fmt.Errorf("failed to read AGI environment: %w", err)
 	}
 
 	return s, nil
@@ -68,52 +192,160 @@ func NewWithContext(ctx context.Context) (*AgiSession, error) {
 
 // readEnvironment reads the AGI environment variables
 func (s *AgiSession) readEnvironment() error {
+	return readEnvBlock(s.readLine, s.setEnv)
+}
+
+// setEnv stores an environment entry, remembering the order keys arrived in
+func (s *AgiSession) setEnv(key, value string) {
+	if _, ok := s.env[key]; !ok {
+		s.envOrder = append(s.envOrder, key)
+	}
+	s.env[key] = value
+}
+
+// readEnvBlock reads "key: value" lines from next, passing each entry to set,
+// until the blank line that ends the AGI environment. Values keep everything
+// after the first colon, so SIP URIs such as "sip:100@host:5060" survive intact.
+// Sessions and ParseAGIEnv share its leniency: blank lines before the block
+// are skipped, and a malformed line is skipped too, the block read to its
+// end and the first such line returned as an error wrapping
+// ErrInvalidEnvironment, so both see the same entries.
+func readEnvBlock(next func() (string, error), set func(key, value string)) error {
+	var malformed error
+	started := false
 	for {
-		line, err := s.reader.ReadString('\n')
+		line, err := next()
 		if err != nil {
-			return errors.Wrap(err, "failed to read environment line")
+			if malformed != nil {
+				return malformed
+			}
+			return fmt.Errorf("failed to read environment line: %w", err)
 		}
 
 		line = strings.TrimSpace(line)
 		if line == "" {
-			break
+			if started {
+				return malformed
+			}
+			continue
 		}
+		started = true
 
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			return errors.Errorf("invalid environment line: %s", line)
+		key, value, err := parseEnvLine(line)
+		if err != nil {
+			if malformed == nil {
+				malformed = err
+			}
+			continue
 		}
+		set(key, value)
+	}
+}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-		s.env[key] = value
+// parseEnvLine splits a single environment line into its key and value
+func parseEnvLine(line string) (string, string, error) {
+	key, value, ok := strings.Cut(line, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("%w: %s", ErrInvalidEnvironment, line)
 	}
+	return key, strings.TrimSpace(value), nil
+}
 
-	return nil
+// transformEnv replaces the environment with the result of fn, recording
+// whether fn changed anything
+func (s *AgiSession) transformEnv(fn func(env map[string]string) map[string]string) {
+	env := fn(maps.Clone(s.env))
+	s.envTransformed = !maps.Equal(env, s.env)
+
+	// Keep received keys in order, then append added keys sorted
+	order := s.envOrder[:0]
+	for _, key := range s.envOrder {
+		if _, ok := env[key]; ok {
+			order = append(order, key)
+		}
+	}
+	var added []string
+	for key := range env {
+		if _, ok := s.env[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	slices.Sort(added)
+	s.envOrder = append(order, added...)
+
+	clear(s.env)
+	maps.Copy(s.env, env)
 }
 
 // channel functions
 
 // GetVariable gets a channel variable
 func (s *AgiSession) GetVariable(name string) (string, error) {
-	resp, err := s.execute(fmt.Sprintf("GET VARIABLE %s", name))
-	if err != nil {
-		return "", err
-	}
+	return s.cachedVariable(name, func() (string, error) {
+		resp, err := s.execute(fmt.Sprintf("GET VARIABLE %s", name))
+		if err != nil {
+			return "", err
+		}
 
-	if resp.Status != 1 {
-		return "", nil
-	}
+		if resp.Result != 1 {
+			return "", nil
+		}
+
+		return s.decodeValue(resp.value()), nil
+	})
+}
+
+// GetFullVariable evaluates an expression such as "${CALLERID(num)}" with
+// the dialplan's variable and function substitution
+func (s *AgiSession) GetFullVariable(expression string) (string, error) {
+	read := func() (string, error) {
+		resp, err := s.execute(fmt.Sprintf("GET FULL VARIABLE \"%s\"", EscapeString(expression)))
+		if err != nil {
+			return "", err
+		}
+
+		if resp.Result != 1 {
+			return "", nil
+		}
 
-	return resp.Data, nil
+		return s.decodeValue(resp.value()), nil
+	}
+	if name, ok := fullVariableName(expression); ok {
+		return s.cachedVariable(name, read)
+	}
+	return read()
 }
 
-// SetVariable sets a channel variable
+// SetVariable sets a channel variable. Quotes and backslashes in value are
+// escaped for the AGI command parser; see SetVariableEscaping for newlines.
 func (s *AgiSession) SetVariable(name, value string) error {
-	_, err := s.execute(fmt.Sprintf("SET VARIABLE %s \"%s\"", name, value))
+	if s.variableEscaping {
+		value = escapeControl(value)
+	}
+	_, err := s.execute(fmt.Sprintf("SET VARIABLE %s \"%s\"", name, EscapeString(value)))
 	return err
 }
 
+// SetVariableEscaping makes SetVariable write newlines, tabs and carriage
+// returns as \n, \t and \r sequences, with backslashes doubled, and makes
+// GetVariable and GetFullVariable turn those sequences back into the
+// characters. A raw newline would end the AGI command, so multi-line values
+// such as formatted JSON need this, as do values the dialplan writes with
+// literal \n sequences. With it enabled, a lone backslash in a value read
+// back is kept unless it starts one of those sequences.
+func (s *AgiSession) SetVariableEscaping(enabled bool) {
+	s.variableEscaping = enabled
+}
+
+// decodeValue applies SetVariableEscaping to a value read from Asterisk
+func (s *AgiSession) decodeValue(value string) string {
+	if !s.variableEscaping {
+		return value
+	}
+	return unescapeControl(value)
+}
+
 // Answer answers the channel
 func (s *AgiSession) Answer() error {
 	_, err := s.execute("ANSWER")
@@ -126,95 +358,548 @@ func (s *AgiSession) Hangup() error {
 	return err
 }
 
-// StreamFile plays a sound file
+// StreamFile plays a sound file. Pass DefaultEscapeDigits to let the
+// session's barge-in policy decide which keys interrupt it. Use
+// StreamFileFrom to learn which key interrupted playback and where.
 func (s *AgiSession) StreamFile(filename string, escapeDigits string) error {
-	_, err := s.execute(fmt.Sprintf("STREAM FILE %s \"%s\"", filename, escapeDigits))
+	_, err := s.streamFile(filename, escapeDigits)
 	return err
 }
 
-// WaitForDigit waits for a DTMF digit
+// streamFile plays a sound file and returns the digit that interrupted
+// playback, or an empty string when playback completed
+func (s *AgiSession) streamFile(filename string, escapeDigits string) (string, error) {
+	digit, _, err := s.StreamFileFrom(filename, escapeDigits, 0)
+	return digit, err
+}
+
+// StreamFileFrom plays a sound file from a sample offset, zero being the
+// start, and returns the digit that interrupted playback, empty when it
+// played to the end, and the offset playback stopped at, from which a later
+// call can resume it. Asterisk reports a hangup and a file it cannot play,
+// such as a missing one, alike with result -1: the result is ErrHangup,
+// with the offset reached, once the session has seen the hangup and an
+// error wrapping ErrPlaybackFailed otherwise.
+func (s *AgiSession) StreamFileFrom(filename string, escapeDigits string, offset int) (string, int, error) {
+	escapeDigits = s.escapeDigits(escapeDigits)
+	resp, err := s.promptCommand(filename, true, func(file string) string {
+		cmd := fmt.Sprintf("STREAM FILE %s \"%s\"", file, escapeDigits)
+		if offset > 0 {
+			cmd += fmt.Sprintf(" %d", offset)
+		}
+		return cmd
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	switch {
+	case resp.Result == -1 && s.HungUp():
+		return "", resp.EndPos, ErrHangup
+	case resp.Result == -1:
+		return "", resp.EndPos, fmt.Errorf("%w: %s", ErrPlaybackFailed, filename)
+	case resp.Result == 0:
+		return "", resp.EndPos, nil
+	}
+
+	return string(rune(resp.Result)), resp.EndPos, nil
+}
+
+// DefaultControlSkip is how far, in milliseconds, ControlStreamFile skips
+// when no skipms is given, as Asterisk does
+const DefaultControlSkip = 3000
+
+// ControlStreamFile plays a sound file the caller can control: ffChar skips
+// forward and rewChar back by skipms milliseconds, and pauseChar pauses and
+// resumes playback. Empty control keys and a skipms of zero or less keep
+// Asterisk's defaults, # and * with DefaultControlSkip and no pause key. It
+// returns the digit of escapeDigits that stopped playback, empty when it
+// played to the end, and the offset playback stopped at. Asterisk reports
+// a hangup and a file it cannot play alike; the result is ErrHangup once
+// the session has seen the hangup and an error wrapping ErrPlaybackFailed
+// otherwise.
+func (s *AgiSession) ControlStreamFile(filename, escapeDigits string, skipms int, ffChar, rewChar, pauseChar string) (string, int, error) {
+	escapeDigits = s.escapeDigits(escapeDigits)
+	if skipms <= 0 {
+		skipms = DefaultControlSkip
+	}
+	// Asterisk reads the options by position, and an empty key keeps its
+	// default, so only trailing empty keys can be left out
+	keys := []string{ffChar, rewChar, pauseChar}
+	for len(keys) > 0 && keys[len(keys)-1] == "" {
+		keys = keys[:len(keys)-1]
+	}
+	resp, err := s.promptCommand(filename, true, func(file string) string {
+		cmd := fmt.Sprintf("CONTROL STREAM FILE %s \"%s\"", file, escapeDigits)
+		if len(keys) > 0 || skipms != DefaultControlSkip {
+			cmd += fmt.Sprintf(" %d", skipms)
+		}
+		for _, key := range keys {
+			cmd += fmt.Sprintf(" \"%s\"", key)
+		}
+		return cmd
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	switch {
+	case resp.Result == -1 && s.HungUp():
+		return "", resp.EndPos, ErrHangup
+	case resp.Result == -1:
+		return "", resp.EndPos, fmt.Errorf("%w: %s", ErrPlaybackFailed, filename)
+	case resp.Result == 0:
+		return "", resp.EndPos, nil
+	}
+	return string(rune(resp.Result)), resp.EndPos, nil
+}
+
+// WaitForDigit waits up to timeout milliseconds for a DTMF digit, returning
+// an empty string when no digit was pressed and ErrHangup when the channel
+// hung up
 func (s *AgiSession) WaitForDigit(timeout int) (string, error) {
 	resp, err := s.execute(fmt.Sprintf("WAIT FOR DIGIT %d", timeout))
 	if err != nil {
 		return "", err
 	}
 
-	if resp.Status == 0 {
-		return "", nil
+	switch {
+	case resp.Result == -1:
+		return "", ErrHangup
+	case resp.Result == 0:
+		return "", nil // Timeout
 	}
 
-	return string(resp.Result), nil
+	return string(rune(resp.Result)), nil
 }
 
-// GetData gets data from the user
+// DefaultMaxDataDigits is the largest maxDigits GetData and GetDataMulti
+// accept unless SetMaxDataDigits says otherwise, the size of the buffer
+// Asterisk collects GET DATA input in
+const DefaultMaxDataDigits = 1024
+
+// GetData plays filename and collects up to maxDigits keys, waiting up to
+// timeout milliseconds after each one. The keys are returned exactly as
+// entered, so leading zeros and * are kept. A maxDigits of zero or less
+// lets Asterisk apply its own limit; one above the session's cap, see
+// SetMaxDataDigits, fails with ErrInvalidLimit before anything is sent.
+// ErrHangup is returned when the channel hangs up.
 func (s *AgiSession) GetData(filename string, timeout, maxDigits int) (string, error) {
-	resp, err := s.execute(fmt.Sprintf("GET DATA %s %d %d", filename, timeout, maxDigits))
-	if err != nil {
-		return "", err
+	digits, _, err := s.getData(filename, timeout, maxDigits)
+	return digits, err
+}
+
+// SetMaxDataDigits sets the largest maxDigits GetData and GetDataMulti
+// accept. Older Asterisk versions collect at most 255 digits, so lower it
+// to 255 for them. A value of zero or less restores DefaultMaxDataDigits.
+func (s *AgiSession) SetMaxDataDigits(n int) {
+	s.maxDataDigits = n
+}
+
+// getDataEscapeDigits are the keys that interrupt the leading prompts of
+// GetDataMulti, matching what GET DATA itself accepts
+const getDataEscapeDigits = "0123456789*#"
+
+// bargeInPrompt is played by GetDataMulti to collect the rest of the input
+// once the caller has interrupted a leading prompt
+const bargeInPrompt = "silence/1"
+
+// checkDataDigits fails with ErrInvalidLimit when GET DATA cannot be asked
+// for maxDigits digits
+func (s *AgiSession) checkDataDigits(maxDigits int) error {
+	limit := s.maxDataDigits
+	if limit <= 0 {
+		limit = DefaultMaxDataDigits
+	}
+	if maxDigits > limit {
+		return fmt.Errorf("%w: maxDigits %d above %d", ErrInvalidLimit, maxDigits, limit)
+	}
+	return nil
+}
+
+// isKeys reports whether s is made of DTMF keys only
+func isKeys(s string) bool {
+	return strings.Trim(s, getDataEscapeDigits) == ""
+}
+
+// GetDataMulti plays several prompts and collects up to maxDigits digits,
+// with the caller able to start typing during any of them. The leading files
+// are streamed with every key as an escape digit; a digit pressed there is
+// kept and the remaining prompts are skipped while GET DATA collects the
+// rest. The bool reports whether input ended because of the timeout rather
+// than the caller pressing # or reaching maxDigits. A maxDigits of zero or
+// less lets Asterisk apply its own limit. The leading files are optional and skipped
+// while the session's DegradationPolicy says so.
+func (s *AgiSession) GetDataMulti(files []string, timeout time.Duration, maxDigits int) (string, bool, error) {
+	if len(files) == 0 {
+		return "", false, ErrNoPrompts
+	}
+	if timeout < 0 {
+		return "", false, fmt.Errorf("timeout must not be negative: %v", timeout)
+	}
+	if err := s.checkDataDigits(maxDigits); err != nil {
+		return "", false, err
 	}
+	ms := int(timeout / time.Millisecond)
+	if s.Degradation().SkipOptionalPrompts {
+		files = files[len(files)-1:]
+	}
+
+	for _, file := range files[:len(files)-1] {
+		digit, err := s.streamFile(file, getDataEscapeDigits)
+		if err != nil {
+			return "", false, err
+		}
+		switch {
+		case digit == "":
+			continue
+		case digit == "#":
+			return "", false, nil
+		case maxDigits == 1:
+			return digit, false, nil
+		}
+
+		remaining := 0
+		if maxDigits > 0 {
+			remaining = maxDigits - 1
+		}
+		rest, timedOut, err := s.getData(bargeInPrompt, ms, remaining)
+		if err != nil {
+			return "", false, err
+		}
+		return digit + rest, timedOut, nil
+	}
+
+	return s.getData(files[len(files)-1], ms, maxDigits)
+}
 
-	return resp.Data, nil
+// getData issues GET DATA and returns the digits exactly as Asterisk sent
+// them, so leading zeros survive, along with whether input timed out.
+// A maxDigits of zero or less omits the limit.
+func (s *AgiSession) getData(filename string, timeout, maxDigits int) (string, bool, error) {
+	if err := s.checkDataDigits(maxDigits); err != nil {
+		return "", false, err
+	}
+	resp, err := s.promptCommand(filename, false, func(file string) string {
+		cmd := fmt.Sprintf("GET DATA %s %d", file, timeout)
+		if maxDigits > 0 {
+			cmd += fmt.Sprintf(" %d", maxDigits)
+		}
+		return cmd
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if resp.Result == -1 {
+		return "", false, ErrHangup
+	}
+	return resp.ResultText, resp.Timeout, nil
 }
 
 // execute sends a command to Asterisk and waits for the response
 func (s *AgiSession) execute(command string) (*AgiResponse, error) {
+	return s.executeWithin(command, 0, false)
+}
+
+// executeWithin is execute waiting up to timeout for the response when
+// override is set, instead of the command's CommandDeadline
+func (s *AgiSession) executeWithin(command string, timeout time.Duration, override bool) (*AgiResponse, error) {
+	if err := s.checkPolicy(command); err != nil {
+		return nil, &CommandError{
+			Verb:     commandVerb(command),
+			UniqueID: s.env["agi_uniqueid"],
+			Err:      err,
+			ErrCode:  ErrorCode(err),
+		}
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if override {
+		s.deadline, s.hasDeadline = timeout, true
+		defer func() { s.hasDeadline = false }()
+	}
+	return s.send(command)
+}
 
+// send exchanges a command that passed the policy check and is within the
+// command limits, recording it in the history and transcript. The caller must hold the session mutex.
+func (s *AgiSession) send(command string) (*AgiResponse, error) {
+	if err := s.checkLimits(); err != nil {
+		return nil, &CommandError{
+			Verb:     commandVerb(command),
+			UniqueID: s.env["agi_uniqueid"],
+			Err:      err,
+			ErrCode:  ErrorCode(err),
+		}
+	}
+	s.validateCommand(command)
+	start := s.clock().Now()
+	resp, err := s.exchange(command)
+	s.invalidateReads(command)
+	record := Exchange{Time: start, Command: command, Elapsed: since(s.clock(), start), Err: err, Sensitive: s.sensitive.Load() > 0}
+	if resp != nil {
+		record.Response = resp.Raw
+	}
+	s.recordExchange(record)
+	s.writeTranscript(record)
+	if err == nil {
+		s.latency.observe(ClassifyVerb(commandVerb(command)), record.Elapsed)
+	}
+
+	if err != nil {
+		return nil, &CommandError{
+			Verb:     commandVerb(command),
+			UniqueID: s.env["agi_uniqueid"],
+			Elapsed:  record.Elapsed,
+			Err:      err,
+			ErrCode:  ErrorCode(err),
+			Recent:   s.RecentExchanges(),
+		}
+	}
+	return resp, nil
+}
+
+// exchange writes a single command and reads its response
+func (s *AgiSession) exchange(command string) (*AgiResponse, error) {
 	if s.debugMode {
 		fmt.Fprintf(os.Stderr, "AGI Command: %s\n", command)
 	}
 
 	if _, err := fmt.Fprintf(s.writer, "%s\n", command); err != nil {
-		return nil, errors.Wrap(err, "failed to send command")
+		return nil, s.ioError("failed to send command", err)
 	}
+	s.sent++
 
-	line, err := s.reader.ReadString('\n')
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to read response")
+	timeout := CommandDeadline(command, s.timeout)
+	if s.hasDeadline {
+		timeout = s.deadline
+	}
+	if s.conn != nil && timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(timeout))
+		defer s.conn.SetReadDeadline(time.Time{})
+	}
+	// A deadline set above must not undo the abort of a cancelled server
+	// session; see FastAGIServer.handleConnection
+	if s.conn != nil && s.ctx != nil && s.ctx.Err() != nil {
+		s.conn.SetDeadline(time.Now())
+	}
+	if s.faults != nil && s.sent == 1 {
+		if err := s.injectFaults(); err != nil {
+			return nil, err
+		}
 	}
 
-	if s.debugMode {
-		fmt.Fprintf(os.Stderr, "AGI Response: %s", line)
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return nil, s.ioError("failed to read response", err)
+		}
+
+		if s.debugMode {
+			shown := line
+			if s.sensitive.Load() > 0 {
+				shown = redactResponse(line) + "\n"
+			}
+			fmt.Fprintf(os.Stderr, "AGI Response: %s", shown)
+		}
+
+		// FastAGI announces a hangup with a bare HANGUP line ahead of the
+		// response to the command in progress
+		if strings.TrimSpace(line) == "HANGUP" {
+			s.hungUp.Store(true)
+			continue
+		}
+
+		resp, err := parseResponse(line)
+		if errors.Is(err, ErrHangup) {
+			s.hungUp.Store(true)
+		}
+		// Other commands can return "(timeout)" as data, such as the value
+		// of a variable
+		if resp != nil && !timeoutVerbs[commandVerb(command)] {
+			resp.Timeout = false
+		}
+		return resp, err
+	}
+}
+
+// abortCause returns the error of the session's context in place of err
+// when err is the deadline a cancelled server session sets to interrupt
+// blocked reads and writes
+func (s *AgiSession) abortCause(err error) error {
+	if err == nil || s.conn == nil || s.ctx == nil || s.ctx.Err() == nil {
+		return err
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return s.ctx.Err()
+	}
+	return err
+}
+
+// ioError classifies err from sending a command or reading its response.
+// A connection that is broken, reset or already closed, which is how a
+// caller hanging up usually shows, wraps ErrHangup, or ErrSessionClosed
+// once the session was closed locally, and an expired deadline wraps
+// ErrTimeout. Other errors are wrapped alone, so errors.Unwrap returns the
+// underlying I/O error.
+func (s *AgiSession) ioError(op string, err error) error {
+	err = s.abortCause(err)
+	switch {
+	case s.isClosed() && (connectionLost(err) || errors.Is(err, context.Canceled)):
+		return fmt.Errorf("%s: %w: %w", op, ErrSessionClosed, err)
+	case connectionLost(err):
+		s.hungUp.Store(true)
+		return fmt.Errorf("%s: %w: %w", op, ErrHangup, err)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Errorf("%s: %w: %w", op, ErrTimeout, err)
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// connectionLost reports whether err means the connection to Asterisk is
+// gone: the peer reset it or closed it before a write, or it was closed
+func connectionLost(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// HungUp reports whether Asterisk has told the session that the channel
+// hung up, either with a HANGUP notice or by rejecting a command on a dead
+// channel
+func (s *AgiSession) HungUp() bool {
+	return s.hungUp.Load()
+}
+
+// value returns the value Asterisk places in parentheses in the response
+// data, such as the contents of a variable in "result=1 (value)"
+func (r *AgiResponse) value() string {
+	if !strings.HasPrefix(r.Data, "(") {
+		return ""
 	}
+	end := strings.LastIndex(r.Data, ")")
+	if end < 0 {
+		return ""
+	}
+	return r.Data[1:end]
+}
+
+// readLine reads a single newline-terminated line, failing with
+// ErrLineTooLong once more than the maximum line size arrives without a newline
+func (s *AgiSession) readLine() (string, error) {
+	limit := s.maxLineSize
+	if limit <= 0 {
+		limit = DefaultMaxLineSize
+	}
+
+	var line []byte
+	for {
+		chunk, err := s.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", newReadError(line, ErrLineTooLong)
+		}
 
-	return parseResponse(line)
+		switch err {
+		case nil:
+			return string(line), nil
+		case bufio.ErrBufferFull:
+			continue
+		default:
+			return "", newReadError(line, err)
+		}
+	}
 }
 
 // parseResponse parses an AGI response
 func parseResponse(line string) (*AgiResponse, error) {
 	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "511") {
+		return nil, fmt.Errorf("%w: status %s", ErrHangup, responseStatus(line))
+	}
 	if !strings.HasPrefix(line, "200") {
-		return nil, errors.Errorf("invalid response: %s", line)
+		return nil, fmt.Errorf("%w: status %s", ErrInvalidResponse, responseStatus(line))
 	}
 
-	parts := strings.SplitN(line[4:], " ", 2)
-	if len(parts) != 2 {
-		return nil, errors.Errorf("invalid response format: %s", line)
+	rest := strings.TrimSpace(line[3:])
+	if !strings.HasPrefix(rest, "result=") {
+		return nil, fmt.Errorf("%w: status 200 without a result", ErrInvalidResponse)
 	}
 
-	result, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse result")
+	parts := strings.SplitN(strings.TrimPrefix(rest, "result="), " ", 2)
+	// GET DATA answers "200 result= (timeout)" when no digit was entered,
+	// and with the keys as entered, which need not fit an int
+	result := 0
+	if parts[0] != "" {
+		var err error
+		if result, err = strconv.Atoi(parts[0]); err != nil && !isKeys(parts[0]) {
+			// The cause stays reachable, without the result it quotes
+			if numErr, ok := err.(*strconv.NumError); ok {
+				numErr.Num = redactedValue
+			}
+			return nil, fmt.Errorf("%w: failed to parse result: %w", ErrInvalidResponse, err)
+		}
+		if err != nil {
+			result = 0
+		}
 	}
 
 	resp := &AgiResponse{
-		Status: 1,
-		Result: result,
-		Raw:    line,
+		Status:     1,
+		Result:     result,
+		ResultText: parts[0],
+		Raw:        line,
 	}
 
 	if len(parts) > 1 {
 		resp.Data = strings.TrimSpace(parts[1])
+		resp.Annotation = ParseAnnotation(resp.Data)
+		resp.Timeout = resp.Annotation == AnnotationTimeout
+		for _, field := range strings.Fields(resp.Data) {
+			if v, ok := strings.CutPrefix(field, "endpos="); ok {
+				if endpos, err := strconv.Atoi(v); err == nil {
+					resp.EndPos = endpos
+					resp.HasEndPos = true
+				}
+			}
+		}
 	}
 
 	return resp, nil
 }
 
-// Close closes the AGI session
+// responseStatus returns the status code of a response line for error
+// messages, which leave out the rest of the line since it can carry
+// collected digits or variable values
+func responseStatus(line string) string {
+	code, _, _ := strings.Cut(line, " ")
+	if code == "" || len(code) > 3 || strings.ContainsFunc(code, func(r rune) bool { return r < '0' || r > '9' }) {
+		return "unknown"
+	}
+	return code
+}
+
+// Close closes the AGI session: it runs the commands queued with Defer,
+// runs the OnClose callbacks with a nil error and cancels its context. It
+// returns the failures of the deferred commands.
 func (s *AgiSession) Close() error {
-	s.cancelFunc()
-	return nil
+	err := s.runDeferred()
+	s.finish(nil)
+	if s.cancelFunc != nil {
+		s.cancelFunc()
+	}
+	return err
+}
+
+// Context returns the session's context. On FastAGI sessions it is the
+// context passed to the handler, or its parent when a HangupMonitor is
+// configured, and is cancelled by Close, by the server's context or when
+// the handler returns.
+func (s *AgiSession) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
 }
 
 // SetDebug enables or disables debug mode
@@ -222,12 +907,69 @@ func (s *AgiSession) SetDebug(enabled bool) {
 	s.debugMode = enabled
 }
 
-// SetTimeout sets the timeout for AGI operations
+// SetTimeout sets how long to wait for the response to each command on
+// FastAGI and other network sessions. Commands listed in CommandDeadlines,
+// such as RECORD FILE, may wait longer. Zero disables the limit.
 func (s *AgiSession) SetTimeout(timeout time.Duration) {
 	s.timeout = timeout
 }
 
+// SetMaxLineSize sets the maximum size of a line received from Asterisk.
+// A value of zero or less restores DefaultMaxLineSize.
+func (s *AgiSession) SetMaxLineSize(size int) {
+	s.maxLineSize = size
+}
+
+// EnvTransformed reports whether a server environment transformer modified
+// the environment received from Asterisk
+func (s *AgiSession) EnvTransformed() bool {
+	return s.envTransformed
+}
+
+// RemoteAddr returns the address of the Asterisk server for FastAGI
+// sessions, or nil for process AGI sessions
+func (s *AgiSession) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+// LocalAddr returns the local address the FastAGI connection was accepted
+// on, or nil for process AGI sessions
+func (s *AgiSession) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+// IsNetwork reports whether the session is FastAGI rather than process AGI,
+// based on the transport and the agi_network environment variable
+func (s *AgiSession) IsNetwork() bool {
+	return s.remoteAddr != nil || s.env["agi_network"] == "yes"
+}
+
 // GetEnv gets an environment variable
 func (s *AgiSession) GetEnv(key string) string {
 	return s.env[key]
 }
+
+// EnvSeq iterates over the AGI environment in the order Asterisk sent it.
+// Entries added by an environment transformer follow in sorted key order.
+func (s *AgiSession) EnvSeq() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, key := range s.envOrder {
+			if !yield(key, s.env[key]) {
+				return
+			}
+		}
+	}
+}
+
+// ArgsSeq iterates over the AGI script arguments agi_arg_1, agi_arg_2 and so
+// on, stopping at the first missing argument
+func (s *AgiSession) ArgsSeq() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for i := 1; ; i++ {
+			arg, ok := s.env["agi_arg_"+strconv.Itoa(i)]
+			if !ok || !yield(arg) {
+				return
+			}
+		}
+	}
+}
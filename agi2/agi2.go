@@ -0,0 +1,318 @@
+// Package agi2 is the next version of the session API, available alongside
+// the current one for incremental migration. Every command takes a context
+// and returns a typed result, and the commands whose signatures or result
+// handling the agi package cannot change without breaking callers are
+// corrected: timeouts are time.Durations, GET DATA keeps leading zeros and
+// reports a timeout, GET VARIABLE tells an empty value from an unset one,
+// and a hangup is ErrHangup rather than an empty result.
+//
+// A Session is a thin layer over an *agi.AgiSession and sends its commands
+// with AgiSession.Command, so command policies, limits, validation,
+// history, transcripts and the read deadline apply to both APIs alike, and
+// both can drive the same call:
+//
+//	func handle(ctx context.Context, s *agi.AgiSession) error {
+//		account, err := agi2.New(s).GetData(ctx, "enter-account", 5*time.Second, 4)
+//		...
+//		return s.SetResult(...) // code not migrated yet
+//	}
+//
+// Helpers that sit above the commands in the agi package, such as prompt
+// fallbacks, the barge-in policy, variable escaping and the read cache, are
+// not applied.
+package agi2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// Session sends AGI commands over an *agi.AgiSession
+type Session struct {
+	v1 *agi.AgiSession
+}
+
+// New returns the v2 API of s
+func New(s *agi.AgiSession) *Session {
+	return &Session{v1: s}
+}
+
+// V1 returns the session's *agi.AgiSession, for code not migrated yet
+func (s *Session) V1() *agi.AgiSession {
+	return s.v1
+}
+
+// HandlerFunc is a FastAGI handler written against the v2 API
+type HandlerFunc func(ctx context.Context, s *Session) error
+
+// Handle implements agi.Handler, so a HandlerFunc can be served by
+// agi.FastAGIServer or registered with agi.Mux
+func (f HandlerFunc) Handle(ctx context.Context, s *agi.AgiSession) error {
+	return f(ctx, New(s))
+}
+
+// PlayResult is the outcome of a prompt
+type PlayResult struct {
+	// Digit is the key that interrupted the prompt, empty when it played to
+	// the end or, for GetOption, nothing was pressed in time
+	Digit string
+	// EndPos is the sample offset playback stopped at
+	EndPos int
+}
+
+// DataResult is the input collected by GetData
+type DataResult struct {
+	// Digits are the keys pressed, exactly as entered, so leading zeros and
+	// * are kept
+	Digits string
+	// TimedOut reports that input ended because the caller stopped typing,
+	// rather than pressing # or reaching the maximum
+	TimedOut bool
+}
+
+// RecordResult is the outcome of RecordFile
+type RecordResult struct {
+	// Digit is the key that ended the recording, if any
+	Digit string
+	// EndPos is the length of the recording in samples
+	EndPos int
+	// Annotation is how the recording ended, such as agi.AnnotationTimeout
+	Annotation agi.Annotation
+}
+
+// command sends cmd once ctx allows it. When ctx has a deadline the
+// response is awaited until then, in place of the session's own deadline
+// for the command; cancelling ctx without a deadline does not interrupt a
+// command already sent.
+func (s *Session) command(ctx context.Context, cmd string) (*agi.AgiResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return s.v1.Command(cmd)
+	}
+	resp, err := s.v1.CommandWithDeadline(cmd, max(time.Until(deadline), time.Nanosecond))
+	// The read deadline can fire just before ctx notices its own
+	if errors.Is(err, agi.ErrTimeout) && !time.Now().Before(deadline) {
+		return nil, fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+	}
+	return resp, err
+}
+
+// Answer answers the channel, returning an error wrapping
+// agi.ErrCommandFailed when Asterisk could not
+func (s *Session) Answer(ctx context.Context) error {
+	resp, err := s.command(ctx, "ANSWER")
+	if err == nil && resp.Result == -1 {
+		return fmt.Errorf("%w: %s", agi.ErrCommandFailed, resp.Raw)
+	}
+	return err
+}
+
+// Hangup hangs up the channel
+func (s *Session) Hangup(ctx context.Context) error {
+	_, err := s.command(ctx, "HANGUP")
+	return err
+}
+
+// StreamFile plays file, interrupted by any of escapeDigits. It returns
+// agi.ErrPromptNotFound when Asterisk could not play the file.
+func (s *Session) StreamFile(ctx context.Context, file, escapeDigits string) (PlayResult, error) {
+	resp, err := s.command(ctx, fmt.Sprintf("STREAM FILE %s \"%s\"", file, escapeDigits))
+	if err != nil {
+		return PlayResult{}, err
+	}
+	return playResult(resp)
+}
+
+// GetOption plays file like StreamFile, then waits up to timeout for one
+// of escapeDigits
+func (s *Session) GetOption(ctx context.Context, file, escapeDigits string, timeout time.Duration) (PlayResult, error) {
+	if timeout < 0 {
+		return PlayResult{}, fmt.Errorf("invalid timeout %v: must not be negative", timeout)
+	}
+	resp, err := s.command(ctx, fmt.Sprintf("GET OPTION %s \"%s\" %d", file, escapeDigits, timeout.Milliseconds()))
+	if err != nil {
+		return PlayResult{}, err
+	}
+	return playResult(resp)
+}
+
+// playResult interprets the response to STREAM FILE or GET OPTION
+func playResult(resp *agi.AgiResponse) (PlayResult, error) {
+	switch {
+	case resp.Result == -1:
+		return PlayResult{}, agi.ErrHangup
+	case resp.Result == 0 && resp.HasEndPos && resp.EndPos == 0:
+		return PlayResult{}, agi.ErrPromptNotFound
+	case resp.Result == 0:
+		return PlayResult{EndPos: resp.EndPos}, nil
+	}
+	return PlayResult{Digit: string(rune(resp.Result)), EndPos: resp.EndPos}, nil
+}
+
+// GetData plays file and collects up to maxDigits keys, waiting up to
+// timeout after each one. A maxDigits of zero or less lets Asterisk apply
+// its own limit.
+func (s *Session) GetData(ctx context.Context, file string, timeout time.Duration, maxDigits int) (DataResult, error) {
+	if timeout < 0 {
+		return DataResult{}, fmt.Errorf("invalid timeout %v: must not be negative", timeout)
+	}
+	cmd := fmt.Sprintf("GET DATA %s %d", file, timeout.Milliseconds())
+	if maxDigits > 0 {
+		cmd += fmt.Sprintf(" %d", maxDigits)
+	}
+	resp, err := s.command(ctx, cmd)
+	if err != nil {
+		return DataResult{}, err
+	}
+	if resp.Result == -1 {
+		return DataResult{}, agi.ErrHangup
+	}
+	return DataResult{Digits: resp.ResultText, TimedOut: resp.Timeout}, nil
+}
+
+// WaitForDigit waits up to timeout for a key, returning an empty string
+// when none was pressed. A negative timeout waits without limit.
+func (s *Session) WaitForDigit(ctx context.Context, timeout time.Duration) (string, error) {
+	ms := int64(-1)
+	if timeout >= 0 {
+		ms = timeout.Milliseconds()
+	}
+	resp, err := s.command(ctx, fmt.Sprintf("WAIT FOR DIGIT %d", ms))
+	if err != nil {
+		return "", err
+	}
+	switch resp.Result {
+	case -1:
+		return "", agi.ErrHangup
+	case 0:
+		return "", nil
+	}
+	return string(rune(resp.Result)), nil
+}
+
+// GetVariable returns the value of a channel variable and whether it is
+// set, so an empty value can be told from an unset variable
+func (s *Session) GetVariable(ctx context.Context, name string) (string, bool, error) {
+	resp, err := s.command(ctx, fmt.Sprintf("GET VARIABLE %s", name))
+	if err != nil {
+		return "", false, err
+	}
+	if resp.Result != 1 {
+		return "", false, nil
+	}
+	var value string
+	if rest, ok := strings.CutPrefix(resp.Data, "("); ok {
+		if end := strings.LastIndex(rest, ")"); end >= 0 {
+			value = rest[:end]
+		}
+	}
+	return value, true, nil
+}
+
+// SetVariable sets a channel variable. Quotes and backslashes in value are
+// escaped.
+func (s *Session) SetVariable(ctx context.Context, name, value string) error {
+	_, err := s.command(ctx, fmt.Sprintf("SET VARIABLE %s \"%s\"", name, agi.EscapeString(value)))
+	return err
+}
+
+// RecordFile records the caller to file, configured by the same options
+// as agi.AgiSession.RecordFileAtomic. The format defaults to wav. It
+// returns agi.ErrHangup when the caller hung up and an error wrapping
+// agi.ErrRecordFailed when Asterisk could not record.
+func (s *Session) RecordFile(ctx context.Context, file string, opts agi.RecordOptions) (RecordResult, error) {
+	if opts.Format == "" {
+		opts.Format = "wav"
+	}
+	timeout := int64(-1)
+	if opts.Timeout > 0 {
+		timeout = opts.Timeout.Milliseconds()
+	}
+	cmd := fmt.Sprintf("RECORD FILE %s %s \"%s\" %d %d", file, opts.Format, opts.EscapeDigits, timeout, opts.Offset)
+	if opts.Beep {
+		cmd += " BEEP"
+	}
+	if opts.Silence > 0 {
+		cmd += fmt.Sprintf(" s=%d", int(opts.Silence.Seconds()))
+	}
+
+	resp, err := s.command(ctx, cmd)
+	if err != nil {
+		return RecordResult{}, err
+	}
+	result := RecordResult{EndPos: resp.EndPos, Annotation: resp.Annotation}
+	switch {
+	case resp.Annotation == agi.AnnotationHangup:
+		return result, agi.ErrHangup
+	case resp.Result < 0:
+		return result, fmt.Errorf("%w: %s", agi.ErrRecordFailed, resp.Raw)
+	case resp.Result > 0:
+		result.Digit = string(rune(resp.Result))
+	}
+	return result, nil
+}
+
+// Exec runs a dialplan application with args, escaped and joined with
+// commas, and returns its result. It returns an error wrapping
+// agi.ErrAppNotFound when Asterisk has no such application and one
+// wrapping agi.ErrAppFailed when the application failed.
+func (s *Session) Exec(ctx context.Context, app string, args ...string) (int, error) {
+	cmd := "EXEC " + app
+	if len(args) > 0 {
+		cmd += fmt.Sprintf(" \"%s\"", agi.EscapeString(strings.Join(args, ",")))
+	}
+	resp, err := s.command(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case resp.Result == -2:
+		return resp.Result, fmt.Errorf("%w: %s", agi.ErrAppNotFound, app)
+	case resp.Result < 0:
+		return resp.Result, fmt.Errorf("%w: %s returned %d", agi.ErrAppFailed, app, resp.Result)
+	}
+	return resp.Result, nil
+}
+
+// Verbose writes message to the Asterisk verbose log at level. Quotes and
+// backslashes in message are escaped.
+func (s *Session) Verbose(ctx context.Context, message string, level int) error {
+	_, err := s.command(ctx, fmt.Sprintf("VERBOSE \"%s\" %d", agi.EscapeString(message), level))
+	return err
+}
+
+// SayNumber says number, interrupted by any of escapeDigits, and returns
+// the key that interrupted it
+func (s *Session) SayNumber(ctx context.Context, number int, escapeDigits string) (string, error) {
+	resp, err := s.command(ctx, fmt.Sprintf("SAY NUMBER %d \"%s\"", number, escapeDigits))
+	if err != nil {
+		return "", err
+	}
+	switch resp.Result {
+	case -1:
+		return "", agi.ErrHangup
+	case 0:
+		return "", nil
+	}
+	return string(rune(resp.Result)), nil
+}
+
+// ChannelStatus returns the state of the channel
+func (s *Session) ChannelStatus(ctx context.Context) (agi.ChannelState, error) {
+	resp, err := s.command(ctx, "CHANNEL STATUS")
+	if err != nil {
+		return 0, err
+	}
+	if resp.Result == -1 {
+		return 0, agi.ErrChannelGone
+	}
+	return agi.ChannelState(resp.Result), nil
+}
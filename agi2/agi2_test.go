@@ -0,0 +1,192 @@
+package agi2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agitest"
+)
+
+// fakeSession returns a v2 session answered by responses
+func fakeSession(t *testing.T, responses ...string) (*Session, *agitest.Fake) {
+	t.Helper()
+	fake := agitest.NewFake(responses)
+	t.Cleanup(func() { fake.Close() })
+	session, err := fake.Session(context.Background())
+	require.NoError(t, err)
+	return New(session), fake
+}
+
+// TestWireCompatibility drives each command through both APIs and checks
+// that Asterisk receives the same command
+func TestWireCompatibility(t *testing.T) {
+	record := agi.RecordOptions{Format: "gsm", EscapeDigits: "#", Timeout: 30 * time.Second, Beep: true, Silence: 3 * time.Second}
+	tests := []struct {
+		name     string
+		response string
+		v1       func(s *agi.AgiSession) error
+		v2       func(ctx context.Context, s *Session) error
+	}{
+		{"answer", "200 result=0",
+			func(s *agi.AgiSession) error { return s.Answer() },
+			func(ctx context.Context, s *Session) error { return s.Answer(ctx) }},
+		{"hangup", "200 result=1",
+			func(s *agi.AgiSession) error { return s.Hangup() },
+			func(ctx context.Context, s *Session) error { return s.Hangup(ctx) }},
+		{"stream file", "200 result=0 endpos=8000",
+			func(s *agi.AgiSession) error { return s.StreamFile("welcome", "12") },
+			func(ctx context.Context, s *Session) error { _, err := s.StreamFile(ctx, "welcome", "12"); return err }},
+		{"get data", "200 result=0042",
+			func(s *agi.AgiSession) error { _, err := s.GetData("enter-pin", 5000, 4); return err },
+			func(ctx context.Context, s *Session) error {
+				_, err := s.GetData(ctx, "enter-pin", 5*time.Second, 4)
+				return err
+			}},
+		{"get option", "200 result=49 endpos=100",
+			func(s *agi.AgiSession) error { _, err := s.GetOption("menu", "12", 3*time.Second); return err },
+			func(ctx context.Context, s *Session) error {
+				_, err := s.GetOption(ctx, "menu", "12", 3*time.Second)
+				return err
+			}},
+		{"wait for digit", "200 result=0",
+			func(s *agi.AgiSession) error { _, err := s.WaitForDigit(2000); return err },
+			func(ctx context.Context, s *Session) error { _, err := s.WaitForDigit(ctx, 2*time.Second); return err }},
+		{"get variable", "200 result=1 (1234)",
+			func(s *agi.AgiSession) error { _, err := s.GetVariable("ACCOUNT"); return err },
+			func(ctx context.Context, s *Session) error { _, _, err := s.GetVariable(ctx, "ACCOUNT"); return err }},
+		{"set variable", "200 result=1",
+			func(s *agi.AgiSession) error { return s.SetVariable("NOTE", `say "hi"`) },
+			func(ctx context.Context, s *Session) error { return s.SetVariable(ctx, "NOTE", `say "hi"`) }},
+		{"record file", "200 result=0 (timeout) endpos=24000",
+			func(s *agi.AgiSession) error {
+				_, err := s.RecordFileWithProgress(context.Background(), "msg", record, nil)
+				return err
+			},
+			func(ctx context.Context, s *Session) error { _, err := s.RecordFile(ctx, "msg", record); return err }},
+		{"exec", "200 result=0",
+			func(s *agi.AgiSession) error { return s.Execute("Dial", "PJSIP/100", "30") },
+			func(ctx context.Context, s *Session) error {
+				_, err := s.Exec(ctx, "Dial", "PJSIP/100", "30")
+				return err
+			}},
+		{"verbose", "200 result=1",
+			func(s *agi.AgiSession) error { return s.Verbose("call started", 3) },
+			func(ctx context.Context, s *Session) error { return s.Verbose(ctx, "call started", 3) }},
+		{"say number", "200 result=0",
+			func(s *agi.AgiSession) error { _, err := s.SayNumber(42, "#"); return err },
+			func(ctx context.Context, s *Session) error { _, err := s.SayNumber(ctx, 42, "#"); return err }},
+		{"channel status", "200 result=6",
+			func(s *agi.AgiSession) error { _, err := s.ChannelStatus(); return err },
+			func(ctx context.Context, s *Session) error { _, err := s.ChannelStatus(ctx); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v1, v1Fake := fakeSession(t, tt.response)
+			require.NoError(t, tt.v1(v1.V1()))
+			v2, v2Fake := fakeSession(t, tt.response)
+			require.NoError(t, tt.v2(context.Background(), v2))
+
+			require.Len(t, v1Fake.Commands(), 1)
+			assert.Equal(t, v1Fake.Commands(), v2Fake.Commands())
+		})
+	}
+}
+
+func TestTypedResults(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("get data keeps leading zeros", func(t *testing.T) {
+		s, _ := fakeSession(t, "200 result=0042 (timeout)")
+		data, err := s.GetData(ctx, "enter-pin", 5*time.Second, 6)
+		require.NoError(t, err)
+		assert.Equal(t, DataResult{Digits: "0042", TimedOut: true}, data)
+	})
+
+	t.Run("get variable tells unset from empty", func(t *testing.T) {
+		s, _ := fakeSession(t, "200 result=1 ()", "200 result=0")
+		value, ok, err := s.GetVariable(ctx, "EMPTY")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Empty(t, value)
+		_, ok, err = s.GetVariable(ctx, "UNSET")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("prompts", func(t *testing.T) {
+		s, _ := fakeSession(t, "200 result=50 endpos=1200", "200 result=0 endpos=0", "200 result=-1 endpos=0")
+		played, err := s.StreamFile(ctx, "menu", "12")
+		require.NoError(t, err)
+		assert.Equal(t, PlayResult{Digit: "2", EndPos: 1200}, played)
+		_, err = s.StreamFile(ctx, "missing", "")
+		assert.ErrorIs(t, err, agi.ErrPromptNotFound)
+		_, err = s.GetOption(ctx, "menu", "12", time.Second)
+		assert.ErrorIs(t, err, agi.ErrHangup)
+	})
+
+	t.Run("record file", func(t *testing.T) {
+		s, fake := fakeSession(t, "200 result=35 (dtmf) endpos=16000", "200 result=-1 (hangup) endpos=800")
+		rec, err := s.RecordFile(ctx, "msg", agi.RecordOptions{EscapeDigits: "#"})
+		require.NoError(t, err)
+		assert.Equal(t, RecordResult{Digit: "#", EndPos: 16000, Annotation: agi.AnnotationDTMF}, rec)
+		_, err = s.RecordFile(ctx, "msg", agi.RecordOptions{})
+		assert.ErrorIs(t, err, agi.ErrHangup)
+		assert.Equal(t, `RECORD FILE msg wav "#" -1 0`, fake.Commands()[0])
+	})
+
+	t.Run("exec and say", func(t *testing.T) {
+		s, _ := fakeSession(t, "200 result=-2", "200 result=-1", "200 result=3")
+		_, err := s.Exec(ctx, "NoSuchApp")
+		assert.ErrorIs(t, err, agi.ErrAppNotFound)
+		_, err = s.SayNumber(ctx, 7, "")
+		assert.ErrorIs(t, err, agi.ErrHangup)
+		state, err := s.ChannelStatus(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, agi.ChannelDialing, state)
+	})
+}
+
+func TestContext(t *testing.T) {
+	t.Run("done context sends nothing", func(t *testing.T) {
+		s, fake := fakeSession(t, "200 result=0")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.ErrorIs(t, s.Answer(ctx), context.Canceled)
+		assert.Empty(t, fake.Commands())
+	})
+
+	t.Run("deadline bounds the response", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=0"},
+			agitest.WithResponseDelay(func(string) time.Duration { return 200 * time.Millisecond }))
+		t.Cleanup(func() { fake.Close() })
+		session, err := fake.Session(context.Background())
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err = New(session).WaitForDigit(ctx, -1)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorIs(t, err, agi.ErrTimeout)
+	})
+}
+
+func TestHandlerFunc(t *testing.T) {
+	fake := agitest.NewFake([]string{"200 result=0", "200 result=1"})
+	t.Cleanup(func() { fake.Close() })
+	session, err := fake.Session(context.Background())
+	require.NoError(t, err)
+
+	var handler agi.Handler = HandlerFunc(func(ctx context.Context, s *Session) error {
+		if err := s.Answer(ctx); err != nil {
+			return err
+		}
+		return s.V1().SetVariable("DONE", "1")
+	})
+	require.NoError(t, handler.Handle(context.Background(), session))
+	assert.Equal(t, []string{"ANSWER", `SET VARIABLE DONE "1"`}, fake.Commands())
+}
@@ -4,12 +4,29 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/Shubham-Thakur06/go-asterisk-agi/audio"
 )
 
 type mockIO struct {
@@ -24,6 +41,22 @@ func newMockIO(input string) *mockIO {
 	}
 }
 
+// newTestSession returns a session whose responses are read from input
+func newTestSession(input string) (*AgiSession, *mockIO) {
+	mock := newMockIO(input)
+	session := &AgiSession{
+		reader:    bufio.NewReader(mock.reader),
+		writer:    mock.writer,
+		env:       make(map[string]string),
+		variables: make(map[string]string),
+		debugMode: false,
+		timeout:   30 * time.Second,
+
+		commandValidation: PanicOnMalformedCommand,
+	}
+	return session, mock
+}
+
 func TestNewSession(t *testing.T) {
 	// Test successful session creation
 	t.Run("successful creation", func(t *testing.T) {
@@ -127,30 +160,6 @@ func TestAGICommands(t *testing.T) {
 	}
 }
 
-func TestFastAGIServer(t *testing.T) {
-	t.Run("server lifecycle", func(t *testing.T) {
-		handler := HandlerFunc(func(ctx context.Context, s *AgiSession) error {
-			return s.Answer()
-		})
-
-		server, err := NewFastAGIServer(":0", handler)
-		require.NoError(t, err)
-
-		// Start server in goroutine
-		go func() {
-			err := server.Serve()
-			require.NoError(t, err)
-		}()
-
-		// Allow server to start
-		time.Sleep(100 * time.Millisecond)
-
-		// Stop server
-		err = server.Stop()
-		require.NoError(t, err)
-	})
-}
-
 func TestResponseParsing(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -162,23 +171,67 @@ func TestResponseParsing(t *testing.T) {
 			name:  "simple response",
 			input: "200 result=1",
 			want: &AgiResponse{
-				Status: 1,
-				Result: 1,
-				Raw:    "200 result=1",
+				Status:     1,
+				Result:     1,
+				ResultText: "1",
+				Raw:        "200 result=1",
 			},
 			wantErr: false,
 		},
 		{
 			name:  "response with data",
 			input: "200 result=1 (data)",
+			want: &AgiResponse{
+				Status:     1,
+				Result:     1,
+				ResultText: "1",
+				Data:       "(data)",
+				Raw:        "200 result=1 (data)",
+			},
+			wantErr: false,
+		},
+		{
+			name:  "get data without digits",
+			input: "200 result= (timeout)",
 			want: &AgiResponse{
 				Status: 1,
-				Result: 1,
-				Data:   "(data)",
-				Raw:    "200 result=1 (data)",
+				Result: 0,
+				Data:   "(timeout)",
+				Raw:    "200 result= (timeout)",
 			},
 			wantErr: false,
 		},
+		{
+			name:  "get data with leading zeros",
+			input: "200 result=0012349 (timeout)",
+			want: &AgiResponse{
+				Status:     1,
+				Result:     12349,
+				ResultText: "0012349",
+				Data:       "(timeout)",
+				Raw:        "200 result=0012349 (timeout)",
+			},
+		},
+		{
+			name:  "get data beyond int range",
+			input: "200 result=004111111111111111111111",
+			want: &AgiResponse{
+				Status:     1,
+				Result:     0,
+				ResultText: "004111111111111111111111",
+				Raw:        "200 result=004111111111111111111111",
+			},
+		},
+		{
+			name:  "get data with star",
+			input: "200 result=*72",
+			want: &AgiResponse{
+				Status:     1,
+				Result:     0,
+				ResultText: "*72",
+				Raw:        "200 result=*72",
+			},
+		},
 		{
 			name:    "invalid response",
 			input:   "invalid",
@@ -199,8 +252,5177 @@ func TestResponseParsing(t *testing.T) {
 			require.NoError(t, err)
 			assert.Equal(t, tt.want.Status, got.Status)
 			assert.Equal(t, tt.want.Result, got.Result)
+			assert.Equal(t, tt.want.ResultText, got.ResultText)
 			assert.Equal(t, tt.want.Data, got.Data)
 			assert.Equal(t, tt.want.Raw, got.Raw)
 		})
 	}
 }
+
+func TestDialplanValidation(t *testing.T) {
+	t.Run("valid values are sent", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n200 result=0\n200 result=0\n200 result=0\n")
+
+		require.NoError(t, session.SetContext("from-internal_2.x"))
+		require.NoError(t, session.SetExtension("_NXX*#"))
+		require.NoError(t, session.SetPriority(1))
+		require.NoError(t, session.SetPriorityLabel("hangup"))
+
+		assert.Equal(t, "SET CONTEXT from-internal_2.x\nSET EXTENSION _NXX*#\nSET PRIORITY 1\nSET PRIORITY hangup\n", mock.writer.String())
+	})
+
+	tests := []struct {
+		name string
+		call func(s *AgiSession) error
+	}{
+		{"context with space", func(s *AgiSession) error { return s.SetContext("default 1") }},
+		{"context with newline", func(s *AgiSession) error { return s.SetContext("default\nHANGUP") }},
+		{"empty context", func(s *AgiSession) error { return s.SetContext("") }},
+		{"extension with space", func(s *AgiSession) error { return s.SetExtension("100 200") }},
+		{"extension with newline", func(s *AgiSession) error { return s.SetExtension("100\nHANGUP") }},
+		{"zero priority", func(s *AgiSession) error { return s.SetPriority(0) }},
+		{"negative priority", func(s *AgiSession) error { return s.SetPriority(-1) }},
+		{"label with space", func(s *AgiSession) error { return s.SetPriorityLabel("my label") }},
+		{"label with newline", func(s *AgiSession) error { return s.SetPriorityLabel("n\nHANGUP") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, mock := newTestSession("200 result=0\n")
+
+			require.Error(t, tt.call(session))
+			assert.Empty(t, mock.writer.String(), "invalid values must not reach Asterisk")
+		})
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	handler := HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+		entered <- struct{}{}
+		<-release
+		return nil
+	})
+
+	rejected := make(chan struct{}, 1)
+	server, err := NewFastAGIServer("127.0.0.1:0", handler,
+		WithWorkerPool(1),
+		WithQueueLength(1),
+		WithQueueFullHandler(func(conn net.Conn) { rejected <- struct{}{} }),
+	)
+	require.NoError(t, err)
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	addr := server.listener.Addr().String()
+
+	// First connection occupies the only worker
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busy.Close()
+	_, err = busy.Write([]byte("agi_network: yes\n\n"))
+	require.NoError(t, err)
+	<-entered
+
+	// Second connection waits in the queue
+	queued, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer queued.Close()
+	assert.Eventually(t, func() bool { return server.Stats().QueueDepth == 1 }, time.Second, 5*time.Millisecond)
+
+	// Third connection finds the queue full
+	extra, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer extra.Close()
+
+	select {
+	case <-rejected:
+	case <-time.After(time.Second):
+		t.Fatal("connection was not rejected")
+	}
+
+	stats := server.Stats()
+	assert.Equal(t, int64(3), stats.Accepted)
+	assert.Equal(t, int64(1), stats.Rejected)
+	assert.Equal(t, 1, stats.QueueCapacity)
+
+	close(release)
+	queued.Close()
+	require.NoError(t, server.Stop())
+	require.NoError(t, <-served)
+}
+
+func TestLineSizeLimit(t *testing.T) {
+	t.Run("oversized response", func(t *testing.T) {
+		session, _ := newTestSession("200 result=1 (" + strings.Repeat("x", 1<<20))
+
+		_, err := session.execute("GET VARIABLE huge")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrLineTooLong))
+
+		var readErr *ReadError
+		require.True(t, errors.As(err, &readErr))
+		assert.Greater(t, readErr.Received, DefaultMaxLineSize)
+		assert.Less(t, readErr.Received, DefaultMaxLineSize+8192, "read must stop near the limit")
+		assert.True(t, strings.HasPrefix(readErr.Prefix, "200 result=1 (x"))
+		assert.Less(t, len(err.Error()), 512)
+	})
+
+	t.Run("configured limit on environment", func(t *testing.T) {
+		session, _ := newTestSession("agi_request: " + strings.Repeat("y", 100) + "\n\n")
+		session.SetMaxLineSize(64)
+
+		err := session.readEnvironment()
+		assert.True(t, errors.Is(err, ErrLineTooLong))
+	})
+
+	t.Run("partial read reports received bytes", func(t *testing.T) {
+		session, _ := newTestSession("200 resu")
+
+		_, err := session.execute("NOOP")
+		require.Error(t, err)
+
+		var readErr *ReadError
+		require.True(t, errors.As(err, &readErr))
+		assert.Equal(t, 8, readErr.Received)
+		assert.Equal(t, "200 resu", readErr.Prefix)
+		assert.Contains(t, err.Error(), "after 8 bytes")
+	})
+
+	t.Run("truncated reply stays out of the message", func(t *testing.T) {
+		session, _ := newTestSession("200 result=4111")
+
+		_, err := session.GetData("enter-card", 5000, 16)
+		var cmdErr *CommandError
+		require.True(t, errors.As(err, &cmdErr))
+		var readErr *ReadError
+		require.True(t, errors.As(err, &readErr))
+		assert.Equal(t, "200 result=4111", readErr.Prefix)
+		assert.NotContains(t, err.Error(), "4111")
+		assert.NotContains(t, fmt.Sprintf("%+v", err), "4111")
+	})
+}
+
+func TestHealthAndProbes(t *testing.T) {
+	server, err := NewFastAGIServer("127.0.0.1:0", HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+		return nil
+	}))
+	require.NoError(t, err)
+	assert.False(t, server.Ready())
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	assert.Eventually(t, server.Ready, time.Second, 5*time.Millisecond)
+	assert.True(t, server.Healthy())
+
+	// A connection that closes without sending anything is a probe
+	probe, err := net.Dial("tcp", server.listener.Addr().String())
+	require.NoError(t, err)
+	probe.Close()
+	assert.Eventually(t, func() bool { return server.Stats().Probes == 1 }, time.Second, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	require.NoError(t, <-served)
+
+	assert.False(t, server.Ready())
+	assert.False(t, server.Healthy())
+}
+
+// startTestServer serves handler on a loopback port until the test ends
+func startTestServer(t *testing.T, handler Handler, opts ...ServerOption) *FastAGIServer {
+	t.Helper()
+	opts = append([]ServerOption{WithCommandValidation(PanicOnMalformedCommand)}, opts...)
+	server, err := NewFastAGIServer("127.0.0.1:0", handler, opts...)
+	require.NoError(t, err)
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	t.Cleanup(func() {
+		assert.NoError(t, server.Stop())
+		assert.NoError(t, <-served)
+	})
+	return server
+}
+
+// dialTestServer connects to server and sends env as the AGI environment
+func dialTestServer(t *testing.T, server *FastAGIServer, env string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Write([]byte(env + "\n"))
+	require.NoError(t, err)
+	return conn
+}
+
+func TestEnvTransformer(t *testing.T) {
+	type seen struct {
+		canary      string
+		uniqueid    string
+		transformed bool
+	}
+	results := make(chan seen, 2)
+	handler := HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+		results <- seen{s.GetEnv("x_canary"), s.GetEnv("agi_uniqueid"), s.EnvTransformed()}
+		return nil
+	})
+
+	server := startTestServer(t, handler, WithEnvTransformer(func(env map[string]string) map[string]string {
+		if env["agi_uniqueid"] == "1700000000.1" {
+			env["x_canary"] = "true"
+		}
+		return env
+	}))
+
+	dialTestServer(t, server, "agi_uniqueid: 1700000000.1\n")
+	assert.Equal(t, seen{"true", "1700000000.1", true}, <-results)
+
+	dialTestServer(t, server, "agi_uniqueid: 1700000000.2\n")
+	assert.Equal(t, seen{"", "1700000000.2", false}, <-results)
+}
+
+func TestSessionAddresses(t *testing.T) {
+	t.Run("fastagi session", func(t *testing.T) {
+		type seen struct {
+			remote, local string
+			network       bool
+		}
+		results := make(chan seen, 1)
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			results <- seen{s.RemoteAddr().String(), s.LocalAddr().String(), s.IsNetwork()}
+			return nil
+		}))
+
+		conn := dialTestServer(t, server, "agi_network: yes\n")
+		got := <-results
+		assert.Equal(t, conn.LocalAddr().String(), got.remote)
+		assert.Equal(t, conn.RemoteAddr().String(), got.local)
+		assert.True(t, got.network)
+	})
+
+	t.Run("process session", func(t *testing.T) {
+		session, _ := newTestSession("")
+		assert.Nil(t, session.RemoteAddr())
+		assert.Nil(t, session.LocalAddr())
+		assert.False(t, session.IsNetwork())
+	})
+}
+
+func TestGetOption(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		response string
+		command  string
+		want     string
+		wantErr  error
+	}{
+		{"digit pressed", 5 * time.Second, "200 result=49 endpos=8000\n", "GET OPTION menu \"12\" 5000\n", "1", nil},
+		{"zero timeout", 0, "200 result=0 endpos=16000\n", "GET OPTION menu \"12\" 0\n", "", nil},
+		{"prompt not found", time.Second, "200 result=0 endpos=0\n", "GET OPTION menu \"12\" 1000\n", "", ErrPromptNotFound},
+		{"hangup", time.Second, "HANGUP\n200 result=-1 endpos=4000\n", "GET OPTION menu \"12\" 1000\n", "", ErrHangup},
+		{"failure", time.Second, "200 result=-1 endpos=0\n", "GET OPTION menu \"12\" 1000\n", "", ErrPlaybackFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, mock := newTestSession(tt.response)
+
+			got, err := session.GetOption("menu", "12", tt.timeout)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.command, mock.writer.String())
+		})
+	}
+
+	t.Run("negative timeout", func(t *testing.T) {
+		session, mock := newTestSession("")
+		_, err := session.GetOption("menu", "12", -time.Second)
+		require.Error(t, err)
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestStreamFileFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		offset   int
+		response string
+		command  string
+		digit    string
+		endpos   int
+		wantErr  error
+	}{
+		{"interrupted", 0, "200 result=50 endpos=12000\n", "STREAM FILE menu \"12#\"\n", "2", 12000, nil},
+		{"completed", 0, "200 result=0 endpos=24000\n", "STREAM FILE menu \"12#\"\n", "", 24000, nil},
+		{"resumed", 12000, "200 result=35 endpos=20000\n", "STREAM FILE menu \"12#\" 12000\n", "#", 20000, nil},
+		{"hangup", 0, "HANGUP\n200 result=-1 endpos=800\n", "STREAM FILE menu \"12#\"\n", "", 800, ErrHangup},
+		{"missing file", 0, "200 result=-1 endpos=0\n", "STREAM FILE menu \"12#\"\n", "", 0, ErrPlaybackFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, mock := newTestSession(tt.response)
+
+			digit, endpos, err := session.StreamFileFrom("menu", "12#", tt.offset)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.digit, digit)
+			assert.Equal(t, tt.endpos, endpos)
+			assert.Equal(t, tt.command, mock.writer.String())
+		})
+	}
+}
+
+func TestControlStreamFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		skipms   int
+		keys     [3]string
+		response string
+		command  string
+		digit    string
+		endpos   int
+		wantErr  error
+	}{
+		{"asterisk defaults", 0, [3]string{}, "200 result=0 endpos=48000\n",
+			"CONTROL STREAM FILE msg \"1\"\n", "", 48000, nil},
+		{"all controls", 5000, [3]string{"6", "4", "5"}, "200 result=49 endpos=16000\n",
+			"CONTROL STREAM FILE msg \"1\" 5000 \"6\" \"4\" \"5\"\n", "1", 16000, nil},
+		{"pause only", 0, [3]string{"", "", "0"}, "200 result=0 endpos=8000\n",
+			"CONTROL STREAM FILE msg \"1\" 3000 \"\" \"\" \"0\"\n", "", 8000, nil},
+		{"skip only", 10000, [3]string{}, "200 result=0 endpos=8000\n",
+			"CONTROL STREAM FILE msg \"1\" 10000\n", "", 8000, nil},
+		{"failure", 0, [3]string{}, "200 result=-1 endpos=0\n",
+			"CONTROL STREAM FILE msg \"1\"\n", "", 0, ErrPlaybackFailed},
+		{"hangup", 0, [3]string{}, "HANGUP\n200 result=-1 endpos=4000\n",
+			"CONTROL STREAM FILE msg \"1\"\n", "", 4000, ErrHangup},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, mock := newTestSession(tt.response)
+
+			digit, endpos, err := session.ControlStreamFile("msg", "1", tt.skipms, tt.keys[0], tt.keys[1], tt.keys[2])
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.digit, digit)
+			assert.Equal(t, tt.endpos, endpos)
+			assert.Equal(t, tt.command, mock.writer.String())
+		})
+	}
+}
+
+// digitResponses scripts one WAIT FOR DIGIT response per digit
+func digitResponses(digits string) string {
+	var b strings.Builder
+	for _, d := range digits {
+		fmt.Fprintf(&b, "200 result=%d\n", d)
+	}
+	return b.String()
+}
+
+func TestCollectDigitsInteractive(t *testing.T) {
+	t.Run("two backspaces then submit", func(t *testing.T) {
+		session, mock := newTestSession(digitResponses("12*34*#"))
+
+		got, err := session.CollectDigitsInteractive(context.Background(), CollectOptions{Timeout: 3 * time.Second})
+		require.NoError(t, err)
+		assert.Equal(t, CollectResult{Digits: "13", End: CollectSubmitted}, got)
+		assert.Equal(t, strings.Repeat("WAIT FOR DIGIT 3000\n", 7), mock.writer.String())
+	})
+
+	t.Run("backspace on empty buffer plays tick", func(t *testing.T) {
+		session, mock := newTestSession(digitResponses("*") + "200 result=0 endpos=800\n" + digitResponses("5#"))
+
+		got, err := session.CollectDigitsInteractive(context.Background(), CollectOptions{BackspaceSound: "beep"})
+		require.NoError(t, err)
+		assert.Equal(t, "5", got.Digits)
+		assert.Contains(t, mock.writer.String(), "STREAM FILE beep \"\"\n")
+	})
+
+	t.Run("max digits", func(t *testing.T) {
+		session, _ := newTestSession(digitResponses("9876"))
+
+		got, err := session.CollectDigitsInteractive(context.Background(), CollectOptions{MaxDigits: 3})
+		require.NoError(t, err)
+		assert.Equal(t, CollectResult{Digits: "987", End: CollectMaxDigits}, got)
+	})
+
+	t.Run("inactivity timeout", func(t *testing.T) {
+		session, _ := newTestSession(digitResponses("4") + "200 result=0\n")
+
+		got, err := session.CollectDigitsInteractive(context.Background(), CollectOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, CollectResult{Digits: "4", End: CollectTimeout}, got)
+	})
+
+	t.Run("hangup", func(t *testing.T) {
+		session, _ := newTestSession(digitResponses("4") + "200 result=-1\n")
+
+		got, err := session.CollectDigitsInteractive(context.Background(), CollectOptions{})
+		assert.True(t, errors.Is(err, ErrHangup))
+		assert.Equal(t, "4", got.Digits)
+	})
+}
+
+func TestRecordFileAtomic(t *testing.T) {
+	opts := RecordOptions{Timeout: time.Minute, EscapeDigits: "#", Beep: true, Silence: 3 * time.Second}
+
+	t.Run("records then renames", func(t *testing.T) {
+		session, mock := newTestSession("200 result=35 (dtmf) endpos=48000\n200 result=0\n200 result=1 (SUCCESS)\n")
+
+		name, err := session.RecordFileAtomic("/tmp/msg", opts)
+		require.NoError(t, err)
+		assert.Equal(t, "/tmp/msg", name)
+		assert.Equal(t, "RECORD FILE /tmp/msg.part wav \"#\" 60000 0 BEEP s=3\n"+
+			"EXEC System \"mv /tmp/msg.part.wav /tmp/msg.wav\"\n"+
+			"GET VARIABLE SYSTEMSTATUS\n", mock.writer.String())
+	})
+
+	t.Run("hostile name is shell-quoted", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0 (timeout) endpos=48000\n200 result=0\n200 result=1 (SUCCESS)\n")
+
+		_, err := session.RecordFileAtomic(`/tmp/x; rm -rf / $(id) 'q' "d"`, RecordOptions{})
+		require.NoError(t, err)
+		exec := strings.Split(mock.writer.String(), "\n")[1]
+		assert.Equal(t, `EXEC System "mv '/tmp/x; rm -rf / $(id) '\\''q'\\'' \"d\".part.wav' '/tmp/x; rm -rf / $(id) '\\''q'\\'' \"d\".wav'"`, exec)
+		assert.Equal(t, `mv '/tmp/x; rm -rf / $(id) '\''q'\'' "d".part.wav' '/tmp/x; rm -rf / $(id) '\''q'\'' "d".wav'`,
+			SplitCommand(strings.TrimPrefix(exec, "EXEC System "))[0])
+	})
+
+	t.Run("hangup leaves part file", func(t *testing.T) {
+		session, mock := newTestSession("200 result=-1 (hangup) endpos=12000\n")
+
+		_, err := session.RecordFileAtomic("/tmp/msg", opts)
+		var recErr *RecordError
+		require.True(t, errors.As(err, &recErr))
+		assert.Equal(t, "/tmp/msg.part", recErr.PartialFile)
+		assert.True(t, errors.Is(err, ErrHangup))
+		assert.NotContains(t, mock.writer.String(), "EXEC System")
+	})
+
+	t.Run("rename failure", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0 (timeout) endpos=48000\n200 result=0\n200 result=1 (APPERROR)\n")
+
+		_, err := session.RecordFileAtomic("/tmp/msg", RecordOptions{Format: "gsm", RenameCommand: "/usr/local/bin/finish {part} {final}"})
+		assert.True(t, errors.Is(err, ErrRenameFailed))
+		assert.False(t, errors.Is(err, ErrRecordFailed))
+		assert.Contains(t, err.Error(), "APPERROR")
+	})
+
+	t.Run("hangup during rename", func(t *testing.T) {
+		for name, input := range map[string]string{
+			"exec":   "200 result=0 (timeout) endpos=48000\n511 Command Not Permitted on a dead channel or intercept routine\n",
+			"status": "200 result=0 (timeout) endpos=48000\n200 result=0\n511 Command Not Permitted on a dead channel or intercept routine\n",
+		} {
+			t.Run(name, func(t *testing.T) {
+				session, _ := newTestSession(input)
+
+				_, err := session.RecordFileAtomic("/tmp/msg", opts)
+				assert.True(t, errors.Is(err, ErrRenameFailed))
+				assert.True(t, errors.Is(err, ErrHangup))
+			})
+		}
+	})
+}
+
+// answerCommands plays the Asterisk side of conn: for each command/response
+// pair it reads the next command, checks it and writes the response
+func answerCommands(t *testing.T, conn net.Conn, script ...string) {
+	t.Helper()
+	reader := bufio.NewReader(conn)
+	for i := 0; i+1 < len(script); i += 2 {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, script[i], strings.TrimSpace(line))
+		_, err = conn.Write([]byte(script[i+1] + "\n"))
+		require.NoError(t, err)
+	}
+}
+
+func TestAutoAnswer(t *testing.T) {
+	handled := make(chan string, 1)
+	var reported []error
+	var mu sync.Mutex
+	server := startTestServer(t,
+		HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			handled <- s.GetEnv("agi_uniqueid")
+			return nil
+		}),
+		WithAutoAnswer(true),
+		WithErrorHandler(func(s *AgiSession, err error) {
+			mu.Lock()
+			reported = append(reported, err)
+			mu.Unlock()
+		}),
+	)
+
+	t.Run("answers ringing channel", func(t *testing.T) {
+		conn := dialTestServer(t, server, "agi_uniqueid: 1\n")
+		answerCommands(t, conn, "CHANNEL STATUS", "200 result=4", "ANSWER", "200 result=0")
+		assert.Equal(t, "1", <-handled)
+	})
+
+	t.Run("skips channel already up", func(t *testing.T) {
+		conn := dialTestServer(t, server, "agi_uniqueid: 2\n")
+		answerCommands(t, conn, "CHANNEL STATUS", "200 result=6")
+		assert.Equal(t, "2", <-handled)
+	})
+
+	t.Run("skips h extension", func(t *testing.T) {
+		dialTestServer(t, server, "agi_uniqueid: 3\nagi_extension: h\n")
+		assert.Equal(t, "3", <-handled)
+	})
+
+	t.Run("failure skips handler", func(t *testing.T) {
+		conn := dialTestServer(t, server, "agi_uniqueid: 4\n")
+		answerCommands(t, conn, "CHANNEL STATUS", "200 result=4", "ANSWER", "510 Invalid or unknown command")
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(reported) == 1
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, int64(1), server.Stats().AutoAnswerFailures)
+		select {
+		case id := <-handled:
+			t.Fatalf("handler ran for session %s", id)
+		default:
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, reported, 1)
+		assert.Contains(t, reported[0].Error(), "auto answer failed")
+	})
+
+	t.Run("url parameter turns it off", func(t *testing.T) {
+		dialTestServer(t, server, "agi_uniqueid: 5\nagi_network: yes\nagi_request: agi://pbx/ivr?autoanswer=no\n")
+		assert.Equal(t, "5", <-handled)
+	})
+}
+
+func TestRouteAutoAnswer(t *testing.T) {
+	handled := make(chan string, 1)
+	record := func(ctx context.Context, s *AgiSession) error {
+		handled <- RouteName(s.env)
+		return nil
+	}
+	mux := NewMux()
+	mux.HandleFunc("ivr", record, WithRouteAutoAnswer(true))
+	mux.HandleFunc("hangup-report", record, WithRouteAutoAnswer(false))
+	mux.HandleFunc("default", record)
+	server := startTestServer(t, mux.Handler(), WithAutoAnswer(true))
+
+	env := func(request string) string {
+		return "agi_network: yes\nagi_request: " + request + "\n"
+	}
+
+	t.Run("route enables", func(t *testing.T) {
+		conn := dialTestServer(t, server, env("agi://pbx/ivr"))
+		answerCommands(t, conn, "CHANNEL STATUS", "200 result=4", "ANSWER", "200 result=0")
+		assert.Equal(t, "ivr", <-handled)
+	})
+
+	t.Run("route disables", func(t *testing.T) {
+		dialTestServer(t, server, env("agi://pbx/hangup-report"))
+		assert.Equal(t, "hangup-report", <-handled)
+	})
+
+	t.Run("server setting without route option", func(t *testing.T) {
+		conn := dialTestServer(t, server, env("agi://pbx/default"))
+		answerCommands(t, conn, "CHANNEL STATUS", "200 result=4", "ANSWER", "200 result=0")
+		assert.Equal(t, "default", <-handled)
+	})
+
+	t.Run("url parameter overrides route", func(t *testing.T) {
+		dialTestServer(t, server, env("agi://pbx/ivr?autoanswer=0"))
+		assert.Equal(t, "ivr", <-handled)
+
+		conn := dialTestServer(t, server, env("agi://pbx/hangup-report?autoanswer=yes"))
+		answerCommands(t, conn, "CHANNEL STATUS", "200 result=4", "ANSWER", "200 result=0")
+		assert.Equal(t, "hangup-report", <-handled)
+	})
+}
+
+func TestCommandError(t *testing.T) {
+	session, _ := newTestSession("")
+	session.env["agi_uniqueid"] = "1700000000.42"
+
+	err := session.SetVariable("PIN", "918273")
+	require.Error(t, err)
+
+	var cmdErr *CommandError
+	require.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, "SET VARIABLE", cmdErr.Verb)
+	assert.Equal(t, "1700000000.42", cmdErr.UniqueID)
+	assert.True(t, errors.Is(err, io.EOF))
+
+	assert.Contains(t, err.Error(), "SET VARIABLE")
+	assert.Contains(t, err.Error(), "1700000000.42")
+	assert.NotContains(t, err.Error(), "918273")
+	assert.NotContains(t, err.Error(), "PIN")
+}
+
+func TestCommandVerb(t *testing.T) {
+	tests := map[string]string{
+		"ANSWER":                             "ANSWER",
+		"GET FULL VARIABLE ${CALLERID(num)}": "GET FULL VARIABLE",
+		"GET VARIABLE ACCOUNT":               "GET VARIABLE",
+		"DATABASE DELTREE cache":             "DATABASE DELTREE",
+		"DATABASE DEL cache key":             "DATABASE DEL",
+		"SAY DATE 0 \"\"":                    "SAY DATE",
+		"SAY DATETIME 0 \"\" A UTC":          "SAY DATETIME",
+		"exec Dial \"PJSIP/100\"":            "EXEC",
+		"CUSTOM thing":                       "CUSTOM",
+	}
+	for command, want := range tests {
+		assert.Equal(t, want, commandVerb(command), command)
+	}
+}
+
+func TestSelectLanguage(t *testing.T) {
+	opts := LanguageSelectOptions{
+		Options: []LanguageOption{
+			{Digit: "1", Language: "en", Prompt: "for-english"},
+			{Digit: "2", Language: "es", Prompt: "para-espanol"},
+		},
+		Timeout: 3 * time.Second,
+	}
+
+	t.Run("barge in on second prompt", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1\n200 result=0 endpos=8000\n200 result=1\n200 result=50 endpos=2000\n200 result=1\n")
+
+		lang, err := session.SelectLanguage(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, "es", lang)
+		assert.Equal(t, "es", session.Language())
+		assert.Equal(t, "SET VARIABLE CHANNEL(language) \"en\"\n"+
+			"STREAM FILE for-english \"12\"\n"+
+			"SET VARIABLE CHANNEL(language) \"es\"\n"+
+			"STREAM FILE para-espanol \"12\"\n"+
+			"SET VARIABLE CHANNEL(language) \"es\"\n", mock.writer.String())
+	})
+
+	t.Run("retry then default", func(t *testing.T) {
+		prompts := "200 result=1\n200 result=0 endpos=8000\n200 result=1\n200 result=0 endpos=8000\n"
+		session, mock := newTestSession(prompts + "200 result=57\n" + prompts + "200 result=0\n200 result=1\n")
+
+		opts := opts
+		opts.Retries = 1
+		opts.Default = "es"
+		lang, err := session.SelectLanguage(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, "es", lang)
+		assert.Equal(t, 2, strings.Count(mock.writer.String(), "WAIT FOR DIGIT 3000\n"))
+		assert.True(t, strings.HasSuffix(mock.writer.String(), "SET VARIABLE CHANNEL(language) \"es\"\n"))
+	})
+
+	t.Run("no options", func(t *testing.T) {
+		session, _ := newTestSession("")
+		_, err := session.SelectLanguage(context.Background(), LanguageSelectOptions{})
+		assert.True(t, errors.Is(err, ErrNoOptions))
+	})
+}
+
+func TestSessionPool(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	session := acquireSession(context.Background(), server)
+	session.env["agi_uniqueid"] = "1700000000.1"
+	session.variables["ACCOUNT"] = "1234"
+	session.language = "es"
+	session.envTransformed = true
+	releaseSession(session)
+
+	for i := 0; i < 10; i++ {
+		recycled := acquireSession(context.Background(), server)
+		assert.Empty(t, recycled.env)
+		assert.Empty(t, recycled.variables)
+		assert.Empty(t, recycled.Language())
+		assert.False(t, recycled.EnvTransformed())
+		assert.Equal(t, server.RemoteAddr(), recycled.RemoteAddr())
+		releaseSession(recycled)
+	}
+}
+
+// variableSetterFunc adapts a function to VariableSetter
+type variableSetterFunc func(channel, name, value string) error
+
+func (f variableSetterFunc) SetChannelVariable(channel, name, value string) error {
+	return f(channel, name, value)
+}
+
+func TestSessionPoolHeartbeat(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		channels = map[string]int{}
+	)
+	setter := variableSetterFunc(func(channel, name, value string) error {
+		mu.Lock()
+		channels[channel]++
+		mu.Unlock()
+		return nil
+	})
+	beating := make(chan *AgiSession, 2)
+	var stops []func()
+	server := startTestServer(t,
+		HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			beats := make(chan struct{}, 1)
+			s.SetHeartbeatHook(func(*AgiSession, Beat) {
+				select {
+				case beats <- struct{}{}:
+				default:
+				}
+			})
+			// The heartbeat is left running after the handler returns
+			stop := s.Heartbeat(context.Background(), time.Millisecond)
+			mu.Lock()
+			stops = append(stops, stop)
+			mu.Unlock()
+			<-beats
+			beating <- s
+			return nil
+		}),
+		WithVariableSetter(setter),
+	)
+	t.Cleanup(func() {
+		mu.Lock()
+		running := stops
+		mu.Unlock()
+		for _, stop := range running {
+			stop()
+		}
+	})
+
+	dialTestServer(t, server, "agi_channel: PJSIP/100-00000001\n")
+	first := <-beating
+	dialTestServer(t, server, "agi_channel: PJSIP/200-00000002\n")
+	second := <-beating
+	assert.NotSame(t, first, second)
+
+	// Let both heartbeats run past the release of their sessions
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotContains(t, channels, "")
+	assert.Positive(t, channels["PJSIP/100-00000001"])
+	assert.Positive(t, channels["PJSIP/200-00000002"])
+}
+
+const benchEnv = "agi_request: agi://127.0.0.1/ivr\nagi_channel: PJSIP/100-00000001\nagi_language: en\n" +
+	"agi_type: PJSIP\nagi_uniqueid: 1700000000.1\nagi_callerid: 100\nagi_context: default\n" +
+	"agi_extension: 200\nagi_priority: 1\n\n"
+
+// pipeConn is a net.Conn that reads the benchmark environment
+type pipeConn struct {
+	net.Conn
+	r *strings.Reader
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func BenchmarkSessionSetup(b *testing.B) {
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			conn := &pipeConn{r: strings.NewReader(benchEnv)}
+			session := &AgiSession{
+				reader:    bufio.NewReader(conn),
+				writer:    conn,
+				env:       make(map[string]string),
+				variables: make(map[string]string),
+				timeout:   30 * time.Second,
+			}
+			if err := session.readEnvironment(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		for i := 0; i < b.N; i++ {
+			conn := &pipeConn{Conn: server, r: strings.NewReader(benchEnv)}
+			session := acquireSession(context.Background(), conn)
+			if err := session.readEnvironment(); err != nil {
+				b.Fatal(err)
+			}
+			releaseSession(session)
+		}
+	})
+}
+
+func TestEnvironmentParsing(t *testing.T) {
+	var block strings.Builder
+	block.WriteString("agi_request: agi://10.0.0.5:4573/ivr?tenant=a\n")
+	block.WriteString("agi_dnid: sip:100@host:5060\n")
+	block.WriteString("agi_callerid: \"Alice\" <100>\n")
+	for i := 1; i <= 12; i++ {
+		fmt.Fprintf(&block, "agi_arg_%d: value:%d\n", i, i)
+	}
+	block.WriteString("\n")
+
+	want := map[string]string{
+		"agi_request":  "agi://10.0.0.5:4573/ivr?tenant=a",
+		"agi_dnid":     "sip:100@host:5060",
+		"agi_callerid": "\"Alice\" <100>",
+	}
+	for i := 1; i <= 12; i++ {
+		want[fmt.Sprintf("agi_arg_%d", i)] = fmt.Sprintf("value:%d", i)
+	}
+
+	session, _ := newTestSession(block.String())
+	require.NoError(t, session.readEnvironment())
+
+	assert.Equal(t, want, session.env)
+	assert.Equal(t, want, ParseAGIEnv(block.String()))
+
+	t.Run("CRLF and missing terminator", func(t *testing.T) {
+		env := ParseAGIEnv("agi_network: yes\r\nagi_dnid: sip:100@host:5060\r\n")
+		assert.Equal(t, map[string]string{"agi_network": "yes", "agi_dnid": "sip:100@host:5060"}, env)
+	})
+
+	// Sessions and ParseAGIEnv read the same entries from the same input
+	same := func(t *testing.T, input string, want map[string]string) error {
+		t.Helper()
+		session, _ := newTestSession(input)
+		err := session.readEnvironment()
+		assert.Equal(t, want, session.env)
+		assert.Equal(t, session.env, ParseAGIEnv(input))
+		return err
+	}
+
+	t.Run("malformed line", func(t *testing.T) {
+		err := same(t, "agi_network: yes\ngarbage\nagi_extension: 100\n\n",
+			map[string]string{"agi_network": "yes", "agi_extension": "100"})
+		assert.ErrorIs(t, err, ErrInvalidEnvironment)
+		assert.ErrorContains(t, err, "garbage")
+	})
+
+	t.Run("leading blank lines", func(t *testing.T) {
+		err := same(t, "\n\r\nagi_network: yes\nagi_extension: 100\n\nagi_after: block\n",
+			map[string]string{"agi_network": "yes", "agi_extension": "100"})
+		assert.NoError(t, err)
+	})
+}
+
+func TestEnv(t *testing.T) {
+	// Environments as sent by Asterisk 20 for a PJSIP call and an SS7 call
+	// on DAHDI, and by Asterisk 1.4, which had no version or thread ID
+	pjsip := "agi_request: agi://127.0.0.1/ivr\nagi_channel: PJSIP/100-00000001\nagi_language: en\n" +
+		"agi_type: PJSIP\nagi_uniqueid: 1700000000.1\nagi_version: 20.5.0\nagi_callerid: 100\n" +
+		"agi_calleridname: Alice\nagi_callingpres: 0\nagi_callingani2: 0\nagi_callington: 0\n" +
+		"agi_callingtns: 0\nagi_dnid: 200\nagi_rdnis: unknown\nagi_context: default\n" +
+		"agi_extension: 200\nagi_priority: 2\nagi_enhanced: 0.0\nagi_accountcode: \n" +
+		"agi_threadid: 140536179128064\n\n"
+	dahdi := "agi_request: /usr/local/bin/route\nagi_channel: DAHDI/i1/5551234-5\nagi_language: en\n" +
+		"agi_type: DAHDI\nagi_uniqueid: 1700000000.2\nagi_version: 18.20.0\nagi_callerid: 5551234\n" +
+		"agi_calleridname: unknown\nagi_callingpres: 35\nagi_callingani2: 61\nagi_callington: 33\n" +
+		"agi_callingtns: 2\nagi_dnid: 8005550100\nagi_rdnis: unknown\nagi_context: from-pstn\n" +
+		"agi_extension: 8005550100\nagi_priority: 1\nagi_enhanced: 1.0\nagi_accountcode: \n" +
+		"agi_threadid: 18446744073709551615\n\n"
+	legacy := "agi_request: route\nagi_channel: Zap/1-1\nagi_callingpres: 1\nagi_priority: 1\n" +
+		"agi_enhanced: 0.0\n\n"
+
+	tests := []struct {
+		name  string
+		input string
+		want  Env
+	}{
+		{"pjsip", pjsip, Env{Priority: 2, ThreadID: 140536179128064}},
+		{"dahdi", dahdi, Env{Priority: 1, Enhanced: true, ThreadID: 18446744073709551615,
+			CallingPres: 35, CallingANI2: 61, CallingTON: 33, CallingTNS: 2}},
+		{"asterisk 1.4", legacy, Env{Priority: 1, CallingPres: 1}},
+		{"priority label", "agi_priority: retry\nagi_threadid: -1\nagi_callingpres: restricted\n\n",
+			Env{PriorityLabel: "retry"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, _ := newTestSession(tt.input)
+			require.NoError(t, session.readEnvironment())
+			env := session.Env()
+			assert.Equal(t, session.env, env.Raw)
+			env.Raw = nil
+			assert.Equal(t, tt.want, env)
+		})
+	}
+
+	t.Run("raw values are kept", func(t *testing.T) {
+		env := ParseEnv(map[string]string{"agi_callingpres": "restricted"})
+		assert.Zero(t, env.CallingPres)
+		assert.Equal(t, "restricted", env.Raw["agi_callingpres"])
+		assert.NotNil(t, ParseEnv(nil).Raw)
+	})
+
+	t.Run("calling presentation", func(t *testing.T) {
+		pres := CallingPres(35)
+		assert.Equal(t, PresRestricted, pres.Presentation())
+		assert.Equal(t, ScreenNetwork, pres.Screening())
+		assert.False(t, pres.Allowed())
+		assert.True(t, CallingPres(1).Allowed())
+		assert.Equal(t, ScreenUserPassed, CallingPres(1).Screening())
+		assert.Equal(t, PresUnavailable, CallingPres(67).Presentation())
+	})
+}
+
+func TestRTPStats(t *testing.T) {
+	const qos = "ssrc=1234;themssrc=5678;lp=2;rxjitter=0.003000;rxcount=1500;txjitter=0.001500;txcount=1498;rlp=1;rtt=0.042000"
+
+	t.Run("pjsip", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (" + qos + ")\n")
+		session.env["agi_type"] = "PJSIP"
+
+		stats, err := session.RTPStats()
+		require.NoError(t, err)
+		assert.Equal(t, "GET VARIABLE CHANNEL(rtcp,all)\n", mock.writer.String())
+		assert.Equal(t, 0.003, stats.RxJitter)
+		assert.Equal(t, 0.0015, stats.TxJitter)
+		assert.Equal(t, 0.042, stats.RTT)
+		assert.Equal(t, 1500, stats.RxCount)
+		assert.Equal(t, 1498, stats.TxCount)
+		assert.Equal(t, 2, stats.RxPacketLoss)
+		assert.Equal(t, 1, stats.TxPacketLoss)
+		assert.Equal(t, "5678", stats.Raw["themssrc"])
+	})
+
+	t.Run("chan_sip falls back to rtpqos", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n200 result=1 (" + qos + ")\n")
+		session.env["agi_channel"] = "SIP/trunk-00000001"
+
+		stats, err := session.RTPStats()
+		require.NoError(t, err)
+		assert.Equal(t, "GET VARIABLE RTPAUDIOQOS\nGET VARIABLE CHANNEL(rtpqos,audio,all)\n", mock.writer.String())
+		assert.Equal(t, 1500, stats.RxCount)
+	})
+
+	t.Run("no stats", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n")
+		session.env["agi_type"] = "PJSIP"
+		_, err := session.RTPStats()
+		assert.True(t, errors.Is(err, ErrNoStats))
+
+		session, mock := newTestSession("")
+		session.env["agi_type"] = "DAHDI"
+		_, err = session.RTPStats()
+		assert.True(t, errors.Is(err, ErrNoStats))
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestSentinelErrors(t *testing.T) {
+	t.Run("invalid response", func(t *testing.T) {
+		session, _ := newTestSession("520 Invalid command syntax\n")
+		err := session.Noop()
+		assert.True(t, errors.Is(err, ErrInvalidResponse))
+
+		var cmdErr *CommandError
+		assert.True(t, errors.As(err, &cmdErr))
+	})
+
+	t.Run("unparseable result", func(t *testing.T) {
+		_, err := parseResponse("200 result=abc")
+		assert.True(t, errors.Is(err, ErrInvalidResponse))
+
+		var numErr *strconv.NumError
+		assert.True(t, errors.As(err, &numErr), "the strconv cause must stay reachable")
+		assert.NotContains(t, err.Error(), "abc")
+	})
+
+	t.Run("response lines stay out of messages", func(t *testing.T) {
+		for _, line := range []string{"200 4321", "4321)", "511 result=4321", "520 1234"} {
+			_, err := parseResponse(line)
+			require.Error(t, err, line)
+			assert.NotContains(t, err.Error(), "4321", line)
+			assert.NotContains(t, err.Error(), "1234", line)
+		}
+		_, err := parseResponse("511 Command Not Permitted on a dead channel or intercept routine")
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.EqualError(t, err, "channel hung up: status 511")
+	})
+
+	t.Run("invalid environment", func(t *testing.T) {
+		session, _ := newTestSession("not an env line\n\n")
+		assert.True(t, errors.Is(session.readEnvironment(), ErrInvalidEnvironment))
+	})
+
+	t.Run("environment read failure", func(t *testing.T) {
+		session, _ := newTestSession("agi_network: yes\n")
+		assert.True(t, errors.Is(session.readEnvironment(), io.EOF))
+	})
+}
+
+func TestCallerID(t *testing.T) {
+	t.Run("normalize", func(t *testing.T) {
+		tests := []struct {
+			input   string
+			lenient bool
+			want    string
+			wantErr bool
+		}{
+			{"+15550100100", false, "+15550100100", false},
+			{"+1 (555) 010-0100", true, "+15550100100", false},
+			{"+44.20.7946.0018", true, "+442079460018", false},
+			{"+1 555 010 0100", false, "", true},
+			{"15550100100", true, "", true},
+			{"+0123", false, "", true},
+			{"+1234567890123456", false, "", true},
+			{"+1555abc", true, "", true},
+		}
+		for _, tt := range tests {
+			got, err := NormalizeE164(tt.input, tt.lenient)
+			if tt.wantErr {
+				assert.Error(t, err, tt.input)
+				continue
+			}
+			require.NoError(t, err, tt.input)
+			assert.Equal(t, tt.want, got)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1\n200 result=1\n200 result=1\n")
+
+		require.NoError(t, session.SetCallerIDE164("+44 20 7946 0018", true))
+		require.NoError(t, session.SetCallerID(FormatCallerID("Front \"Desk\"", "+442079460018")))
+		require.NoError(t, session.SetCallerID(FormatCallerID("", "100")))
+		assert.Equal(t, "SET CALLERID +442079460018\n"+
+			"SET CALLERID \"\\\"Front Desk\\\" <+442079460018>\"\n"+
+			"SET CALLERID <100>\n", mock.writer.String())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		for _, callerID := range []string{"", "100 200", "Front Desk <100>", "\"Front\" <1 00>", "100\nHANGUP", "\"A\" <100"} {
+			session, mock := newTestSession("200 result=1\n")
+			assert.Error(t, session.SetCallerID(callerID), callerID)
+			assert.Empty(t, mock.writer.String())
+		}
+
+		session, _ := newTestSession("")
+		assert.Error(t, session.SetCallerIDE164("5550100", false))
+	})
+}
+
+func TestSequence(t *testing.T) {
+	var ran []string
+	step := func(name string, err error) Handler {
+		return HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			ran = append(ran, name)
+			return err
+		})
+	}
+	session, _ := newTestSession("")
+	errBlocked := errors.New("blocked")
+
+	t.Run("early termination", func(t *testing.T) {
+		ran = nil
+		err := Sequence(step("blacklist", ErrNextHandler), step("hours", nil), step("ivr", nil)).Handle(context.Background(), session)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"blacklist", "hours"}, ran)
+	})
+
+	t.Run("error propagation", func(t *testing.T) {
+		ran = nil
+		err := Sequence(step("blacklist", errBlocked), step("ivr", nil)).Handle(context.Background(), session)
+		assert.Equal(t, errBlocked, err)
+		assert.Equal(t, []string{"blacklist"}, ran)
+	})
+
+	t.Run("end of chain", func(t *testing.T) {
+		ran = nil
+		err := Sequence(step("blacklist", ErrNextHandler), step("hours", ErrNextHandler)).Handle(context.Background(), session)
+		assert.True(t, errors.Is(err, ErrNextHandler))
+		assert.Equal(t, []string{"blacklist", "hours"}, ran)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		ran = nil
+		h := SequenceWithFallback(step("fallback", nil), step("blacklist", ErrNextHandler), step("hours", ErrNextHandler))
+		require.NoError(t, h.Handle(context.Background(), session))
+		assert.Equal(t, []string{"blacklist", "hours", "fallback"}, ran)
+	})
+
+	t.Run("nested and wrapped delegation", func(t *testing.T) {
+		ran = nil
+		inner := Sequence(step("a", ErrNextHandler), step("b", fmt.Errorf("skip: %w", ErrNextHandler)))
+		require.NoError(t, Sequence(inner, step("c", nil)).Handle(context.Background(), session))
+		assert.Equal(t, []string{"a", "b", "c"}, ran)
+	})
+}
+
+func TestEnvSeq(t *testing.T) {
+	block := "agi_request: ivr\nagi_channel: PJSIP/100-00000001\nagi_arg_1: first\nagi_uniqueid: 1700000000.1\nagi_arg_2: second\nagi_callerid: 100\n\n"
+	session, _ := newTestSession(block)
+	require.NoError(t, session.readEnvironment())
+
+	var keys []string
+	for key, value := range session.EnvSeq() {
+		keys = append(keys, key)
+		assert.Equal(t, session.GetEnv(key), value)
+	}
+	assert.Equal(t, []string{"agi_request", "agi_channel", "agi_arg_1", "agi_uniqueid", "agi_arg_2", "agi_callerid"}, keys)
+
+	var args []string
+	for arg := range session.ArgsSeq() {
+		args = append(args, arg)
+	}
+	assert.Equal(t, []string{"first", "second"}, args)
+
+	t.Run("early break", func(t *testing.T) {
+		var first []string
+		for key := range session.EnvSeq() {
+			first = append(first, key)
+			if len(first) == 2 {
+				break
+			}
+		}
+		assert.Equal(t, []string{"agi_request", "agi_channel"}, first)
+	})
+
+	t.Run("after transform", func(t *testing.T) {
+		session.transformEnv(func(env map[string]string) map[string]string {
+			delete(env, "agi_arg_1")
+			env["z_tier"] = "gold"
+			env["x_canary"] = "true"
+			return env
+		})
+
+		keys = nil
+		for key := range session.EnvSeq() {
+			keys = append(keys, key)
+		}
+		assert.Equal(t, []string{"agi_request", "agi_channel", "agi_uniqueid", "agi_arg_2", "agi_callerid", "x_canary", "z_tier"}, keys)
+		for range session.ArgsSeq() {
+			t.Fatal("agi_arg_1 was removed, so no arguments remain")
+		}
+	})
+}
+
+func TestOriginate(t *testing.T) {
+	t.Run("variables with commas", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n200 result=1 (SUCCESS)\n")
+
+		res, err := session.Originate(OriginateOptions{
+			TechData:  "PJSIP/supervisor",
+			Type:      "exten",
+			Arg1:      "notify",
+			Arg2:      "s",
+			Arg3:      "1",
+			Timeout:   30 * time.Second,
+			CallerID:  "+15550100",
+			Variables: map[string]string{"QUEUE": "sales,eu", "NOTE": "vip, callback"},
+			Async:     true,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, OriginateSuccess, res.Status)
+		assert.Equal(t, `EXEC Originate "PJSIP/supervisor,exten,notify,s,1,30,ac(+15550100)v(NOTE=vip\\, callback^QUEUE=sales\\,eu)"`+"\n"+
+			"GET VARIABLE ORIGINATE_STATUS\n", mock.writer.String())
+
+		// Asterisk's AGI parser turns the command back into the application data
+		parts := SplitCommand(strings.Split(mock.writer.String(), "\n")[0])
+		assert.Equal(t, `PJSIP/supervisor,exten,notify,s,1,30,ac(+15550100)v(NOTE=vip\, callback^QUEUE=sales\,eu)`, parts[2])
+	})
+
+	t.Run("app without options", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n200 result=1 (BUSY)\n")
+
+		res, err := session.Originate(OriginateOptions{TechData: "PJSIP/100", Type: "app", Arg1: "Playback", Arg2: "tt-monkeys"})
+		require.NoError(t, err)
+		assert.Equal(t, OriginateBusy, res.Status)
+		assert.Equal(t, "EXEC Originate \"PJSIP/100,app,Playback,tt-monkeys\"\n", strings.SplitAfter(mock.writer.String(), "\n")[0])
+	})
+
+	t.Run("trailing escaped comma", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n200 result=1 (SUCCESS)\n")
+
+		_, err := session.Originate(OriginateOptions{TechData: "PJSIP/100", Type: "app", Arg1: "SendText", Arg2: "hello,"})
+		require.NoError(t, err)
+		assert.Equal(t, `EXEC Originate "PJSIP/100,app,SendText,hello\\,"`+"\n", strings.SplitAfter(mock.writer.String(), "\n")[0])
+	})
+
+	t.Run("unknown status", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n200 result=0\n")
+		res, err := session.Originate(OriginateOptions{TechData: "PJSIP/100", Type: "app", Arg1: "Wait", Arg2: "1"})
+		require.NoError(t, err)
+		assert.Equal(t, OriginateUnknown, res.Status)
+	})
+
+	t.Run("invalid type", func(t *testing.T) {
+		session, mock := newTestSession("")
+		_, err := session.Originate(OriginateOptions{TechData: "PJSIP/100", Type: "dial"})
+		require.Error(t, err)
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestSayAlpha(t *testing.T) {
+	t.Run("completed", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n")
+		digit, err := session.SayAlpha(`AB-12 "x\y"`, "#")
+		require.NoError(t, err)
+		assert.Empty(t, digit)
+		assert.Equal(t, `SAY ALPHA "AB-12 \"x\\y\"" "#"`+"\n", mock.writer.String())
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		session, _ := newTestSession("200 result=42\n")
+		digit, err := session.SayAlpha("XK7Q", DefaultEscapeDigits)
+		require.NoError(t, err)
+		assert.Equal(t, "*", digit)
+	})
+
+	t.Run("hangup", func(t *testing.T) {
+		session, _ := newTestSession("HANGUP\n200 result=-1\n")
+		_, err := session.SayAlpha("XK7Q", "")
+		assert.ErrorIs(t, err, ErrHangup)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		session, _ := newTestSession("200 result=-1\n")
+		_, err := session.SayAlpha("XK7Q", "")
+		assert.ErrorIs(t, err, ErrCommandFailed)
+	})
+
+	t.Run("dead channel", func(t *testing.T) {
+		session, _ := newTestSession("511 Command Not Permitted on a dead channel or intercept routine\n")
+		_, err := session.SayAlpha("XK7Q", "")
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.True(t, session.HungUp())
+	})
+}
+
+func TestSayDateAndTime(t *testing.T) {
+	appointment := time.Date(2026, time.March, 9, 14, 30, 0, 0, time.UTC)
+	commands := []struct {
+		verb string
+		say  func(s *AgiSession, t time.Time, escapeDigits string) (string, error)
+	}{
+		{"SAY DATE", (*AgiSession).SayDate},
+		{"SAY TIME", (*AgiSession).SayTime},
+	}
+	for _, c := range commands {
+		t.Run(c.verb, func(t *testing.T) {
+			session, mock := newTestSession("200 result=0\n200 result=49\n200 result=-1\n")
+			digit, err := c.say(session, appointment, "#")
+			require.NoError(t, err)
+			assert.Empty(t, digit)
+
+			digit, err = c.say(session, appointment, "12")
+			require.NoError(t, err)
+			assert.Equal(t, "1", digit)
+
+			_, err = c.say(session, appointment, "")
+			assert.ErrorIs(t, err, ErrCommandFailed)
+
+			assert.Equal(t, c.verb+" 1773066600 \"#\"\n"+
+				c.verb+" 1773066600 \"12\"\n"+
+				c.verb+" 1773066600 \"\"\n", mock.writer.String())
+		})
+	}
+}
+
+func TestSayResults(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	says := map[string]func(s *AgiSession) (string, error){
+		"SAY NUMBER":   func(s *AgiSession) (string, error) { return s.SayNumber(42, "#") },
+		"SAY DIGITS":   func(s *AgiSession) (string, error) { return s.SayDigits("42", "#") },
+		"SAY ALPHA":    func(s *AgiSession) (string, error) { return s.SayAlpha("AB", "#") },
+		"SAY DATE":     func(s *AgiSession) (string, error) { return s.SayDate(now, "#") },
+		"SAY TIME":     func(s *AgiSession) (string, error) { return s.SayTime(now, "#") },
+		"SAY DATETIME": func(s *AgiSession) (string, error) { return s.SayDateTime(now.Unix(), "#", "", "") },
+	}
+	for verb, say := range says {
+		t.Run(verb, func(t *testing.T) {
+			session, mock := newTestSession("200 result=0\n200 result=35\n200 result=-1\nHANGUP\n200 result=-1\n")
+			digit, err := say(session)
+			require.NoError(t, err)
+			assert.Empty(t, digit)
+			digit, err = say(session)
+			require.NoError(t, err)
+			assert.Equal(t, "#", digit)
+			_, err = say(session)
+			assert.ErrorIs(t, err, ErrCommandFailed)
+			_, err = say(session)
+			assert.ErrorIs(t, err, ErrHangup)
+			assert.True(t, strings.HasPrefix(mock.writer.String(), verb+" "))
+		})
+	}
+}
+
+func TestSayDateTime(t *testing.T) {
+	golden := []struct {
+		name     string
+		format   string
+		timezone string
+		command  string
+	}{
+		{"default format", "", "", `SAY DATETIME 1700000000 "#" "ABdY 'digits/at' IMp"`},
+		{"date only", "ABdY", "America/New_York", `SAY DATETIME 1700000000 "#" "ABdY" America/New_York`},
+		{"time only", "IMp", "Europe/London", `SAY DATETIME 1700000000 "#" "IMp" Europe/London`},
+		{"24 hour", "HM", "UTC", `SAY DATETIME 1700000000 "#" "HM" UTC`},
+		{"relative day", "Q 'digits/at' IMp", "Asia/Kolkata", `SAY DATETIME 1700000000 "#" "Q 'digits/at' IMp" Asia/Kolkata`},
+	}
+	for _, tt := range golden {
+		t.Run(tt.name, func(t *testing.T) {
+			session, mock := newTestSession("200 result=0\n")
+			digit, err := session.SayDateTime(1700000000, "#", tt.format, tt.timezone)
+			require.NoError(t, err)
+			assert.Empty(t, digit)
+			assert.Equal(t, tt.command+"\n", mock.writer.String())
+		})
+	}
+
+	t.Run("interrupted", func(t *testing.T) {
+		session, _ := newTestSession("200 result=35\n")
+		digit, err := session.SayDateTime(1700000000, "#", "", "")
+		require.NoError(t, err)
+		assert.Equal(t, "#", digit)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		session, _ := newTestSession("200 result=-1\n")
+		_, err := session.SayDateTime(1700000000, "#", "", "")
+		assert.True(t, errors.Is(err, ErrCommandFailed))
+	})
+
+	t.Run("invalid timezone", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n")
+		_, err := session.SayDateTime(1700000000, "#", "", "Mars/Olympus_Mons")
+		require.Error(t, err)
+		assert.Empty(t, mock.writer.String())
+
+		session.SetTimezoneValidation(false)
+		_, err = session.SayDateTime(1700000000, "#", "", "Mars/Olympus_Mons")
+		require.NoError(t, err)
+		assert.Equal(t, `SAY DATETIME 1700000000 "#" "ABdY 'digits/at' IMp" Mars/Olympus_Mons`+"\n", mock.writer.String())
+	})
+}
+
+func TestGetDataMulti(t *testing.T) {
+	files := []string{"you-have", "vm-INBOX", "press-1"}
+
+	t.Run("no barge-in", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0 endpos=8000\n200 result=0 endpos=8000\n200 result=0123\n")
+		digits, timedOut, err := session.GetDataMulti(files, 5*time.Second, 4)
+		require.NoError(t, err)
+		assert.Equal(t, "0123", digits)
+		assert.False(t, timedOut)
+		assert.Equal(t, "STREAM FILE you-have \"0123456789*#\"\n"+
+			"STREAM FILE vm-INBOX \"0123456789*#\"\n"+
+			"GET DATA press-1 5000 4\n", mock.writer.String())
+	})
+
+	t.Run("barge-in on first file with one digit", func(t *testing.T) {
+		session, mock := newTestSession("200 result=53 endpos=1200\n")
+		digits, timedOut, err := session.GetDataMulti(files, 5*time.Second, 1)
+		require.NoError(t, err)
+		assert.Equal(t, "5", digits)
+		assert.False(t, timedOut)
+		assert.Equal(t, "STREAM FILE you-have \"0123456789*#\"\n", mock.writer.String())
+	})
+
+	t.Run("barge-in carries into collection", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0 endpos=8000\n200 result=53 endpos=1200\n200 result=67 (timeout)\n")
+		digits, timedOut, err := session.GetDataMulti(files, 3*time.Second, 4)
+		require.NoError(t, err)
+		assert.Equal(t, "567", digits)
+		assert.True(t, timedOut)
+		assert.Equal(t, "STREAM FILE you-have \"0123456789*#\"\n"+
+			"STREAM FILE vm-INBOX \"0123456789*#\"\n"+
+			"GET DATA silence/1 3000 3\n", mock.writer.String())
+	})
+
+	t.Run("barge-in without limit", func(t *testing.T) {
+		session, mock := newTestSession("200 result=48 endpos=100\n200 result=12\n")
+		digits, _, err := session.GetDataMulti(files, time.Second, 0)
+		require.NoError(t, err)
+		assert.Equal(t, "012", digits)
+		assert.Contains(t, mock.writer.String(), "GET DATA silence/1 1000\n")
+	})
+
+	t.Run("pound submits", func(t *testing.T) {
+		session, mock := newTestSession("200 result=35 endpos=100\n")
+		digits, timedOut, err := session.GetDataMulti(files, time.Second, 4)
+		require.NoError(t, err)
+		assert.Empty(t, digits)
+		assert.False(t, timedOut)
+		assert.Equal(t, 1, strings.Count(mock.writer.String(), "\n"))
+	})
+
+	t.Run("hangup", func(t *testing.T) {
+		session, _ := newTestSession("HANGUP\n200 result=-1 endpos=0\n")
+		_, _, err := session.GetDataMulti(files, time.Second, 4)
+		assert.ErrorIs(t, err, ErrHangup)
+
+		session, _ = newTestSession("200 result=0 endpos=8000\n200 result=0 endpos=8000\n200 result=-1\n")
+		_, _, err = session.GetDataMulti(files, time.Second, 4)
+		assert.ErrorIs(t, err, ErrHangup)
+	})
+
+	t.Run("no files", func(t *testing.T) {
+		session, _ := newTestSession("")
+		_, _, err := session.GetDataMulti(nil, time.Second, 4)
+		assert.ErrorIs(t, err, ErrNoPrompts)
+	})
+
+	t.Run("max digits above cap", func(t *testing.T) {
+		session, mock := newTestSession("")
+		_, _, err := session.GetDataMulti(files, time.Second, DefaultMaxDataDigits+1)
+		assert.ErrorIs(t, err, ErrInvalidLimit)
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestGetData(t *testing.T) {
+	t.Run("leading zeros survive", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0012349\n200 result=0012349 (timeout)\n")
+		digits, err := session.GetData("enter-card", 5000, 7)
+		require.NoError(t, err)
+		assert.Equal(t, "0012349", digits)
+		digits, err = session.GetData("enter-card", 5000, 10)
+		require.NoError(t, err)
+		assert.Equal(t, "0012349", digits)
+		assert.Equal(t, "GET DATA enter-card 5000 7\nGET DATA enter-card 5000 10\n", mock.writer.String())
+	})
+
+	t.Run("card number beyond int range", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0049927398716000000001\n")
+		digits, err := session.GetData("enter-card", 5000, 22)
+		require.NoError(t, err)
+		assert.Equal(t, "0049927398716000000001", digits)
+	})
+
+	t.Run("star is kept", func(t *testing.T) {
+		session, _ := newTestSession("200 result=*0\n")
+		digits, err := session.GetData("enter-code", 5000, 4)
+		require.NoError(t, err)
+		assert.Equal(t, "*0", digits)
+	})
+
+	t.Run("nothing entered", func(t *testing.T) {
+		session, mock := newTestSession("200 result= (timeout)\n")
+		digits, err := session.GetData("enter-code", 5000, 0)
+		require.NoError(t, err)
+		assert.Empty(t, digits)
+		assert.Equal(t, "GET DATA enter-code 5000\n", mock.writer.String())
+	})
+
+	t.Run("hangup", func(t *testing.T) {
+		session, _ := newTestSession("200 result=-1\n")
+		_, err := session.GetData("enter-code", 5000, 4)
+		assert.ErrorIs(t, err, ErrHangup)
+	})
+
+	t.Run("max digits cap", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1\n")
+		_, err := session.GetData("enter-code", 5000, DefaultMaxDataDigits+1)
+		assert.ErrorIs(t, err, ErrInvalidLimit)
+
+		session.SetMaxDataDigits(255)
+		_, err = session.GetData("enter-code", 5000, 256)
+		assert.ErrorIs(t, err, ErrInvalidLimit)
+		assert.Empty(t, mock.writer.String())
+		_, err = session.GetData("enter-code", 5000, 255)
+		require.NoError(t, err)
+		assert.Equal(t, "GET DATA enter-code 5000 255\n", mock.writer.String())
+	})
+}
+
+func TestSetMusic(t *testing.T) {
+	tests := []struct {
+		on      bool
+		class   string
+		command string
+	}{
+		{false, "", "SET MUSIC OFF"},
+		{true, "", "SET MUSIC ON"},
+		{true, MusicClassDefault, "SET MUSIC ON default"},
+		{true, "sales queue", `SET MUSIC ON "sales queue"`},
+	}
+	for _, tt := range tests {
+		session, mock := newTestSession("200 result=0\n")
+		require.NoError(t, session.SetMusic(tt.on, tt.class))
+		assert.Equal(t, tt.command+"\n", mock.writer.String())
+	}
+}
+
+func TestWithMusicClass(t *testing.T) {
+	session, mock := newTestSession("200 result=1 (default)\n200 result=1\n200 result=1\n")
+	var ran bool
+	err := session.WithMusicClass("holiday", func() error {
+		ran = true
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, ran)
+	assert.Equal(t, "GET VARIABLE CHANNEL(musicclass)\n"+
+		`SET VARIABLE CHANNEL(musicclass) "holiday"`+"\n"+
+		`SET VARIABLE CHANNEL(musicclass) "default"`+"\n", mock.writer.String())
+
+	session, mock = newTestSession("200 result=0\n200 result=1\n200 result=1\n")
+	failure := errors.New("transfer failed")
+	err = session.WithMusicClass("holiday", func() error { return failure })
+	assert.ErrorIs(t, err, failure)
+	assert.True(t, strings.HasSuffix(mock.writer.String(), `SET VARIABLE CHANNEL(musicclass) ""`+"\n"))
+}
+
+func TestRecentExchanges(t *testing.T) {
+	t.Run("ring wraps", func(t *testing.T) {
+		session, _ := newTestSession(strings.Repeat("200 result=0\n", 5))
+		session.SetHistorySize(3)
+		for i := range 5 {
+			require.NoError(t, session.Verbose(fmt.Sprintf("step %d", i), 1))
+		}
+
+		recent := session.RecentExchanges()
+		require.Len(t, recent, 3)
+		for i, x := range recent {
+			assert.Equal(t, fmt.Sprintf(`VERBOSE "step %d" 1`, i+2), x.Command)
+			assert.Equal(t, "200 result=0", x.Response)
+			assert.False(t, x.Time.IsZero())
+		}
+	})
+
+	t.Run("redaction", func(t *testing.T) {
+		session, _ := newTestSession("200 result=1\n200 result=4321\n200 result=-1\n")
+		require.NoError(t, session.SetVariable("PIN", "1234"))
+		_, err := session.GetData("enter-pin", 5000, 4)
+		require.NoError(t, err)
+		_, err = session.WaitForDigit(1000)
+		require.ErrorIs(t, err, ErrHangup)
+
+		recent := session.RecentExchanges()
+		require.Len(t, recent, 3)
+		assert.Equal(t, "SET VARIABLE PIN ***", recent[0].Command)
+		assert.Equal(t, "200 result=1", recent[0].Response)
+		assert.Equal(t, "GET DATA enter-pin 5000 4", recent[1].Command)
+		assert.Equal(t, "200 result=***", recent[1].Response)
+		assert.Equal(t, "200 result=-1", recent[2].Response)
+
+		session.SetExchangeRedactor(func(x Exchange) Exchange { return x })
+		assert.Equal(t, `SET VARIABLE PIN "1234"`, session.RecentExchanges()[0].Command)
+	})
+
+	t.Run("said numbers", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n200 result=35\n200 result=0\n")
+		_, err := session.SayDigits("4111111111111111", "")
+		require.NoError(t, err)
+		_, err = session.SayNumber(1234, "#")
+		require.NoError(t, err)
+		_, err = session.SayAlpha("X7K9", "")
+		require.NoError(t, err)
+
+		recent := session.RecentExchanges()
+		require.Len(t, recent, 3)
+		for _, e := range recent {
+			assert.NotRegexp(t, `\d{4}|X7K9`, e.Command)
+			assert.Equal(t, "200 result=***", e.Response)
+		}
+		assert.Equal(t, "SAY NUMBER ***", recent[1].Command)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n")
+		session.SetHistorySize(0)
+		require.NoError(t, session.Answer())
+		assert.Nil(t, session.RecentExchanges())
+	})
+
+	t.Run("included in command errors", func(t *testing.T) {
+		session, _ := newTestSession("200 result=1\n")
+		require.NoError(t, session.SetVariable("PIN", "1234"))
+		err := session.Answer()
+
+		var cmdErr *CommandError
+		require.ErrorAs(t, err, &cmdErr)
+		require.Len(t, cmdErr.Recent, 2)
+		assert.Equal(t, "ANSWER", cmdErr.Recent[1].Command)
+		assert.Error(t, cmdErr.Recent[1].Err)
+
+		verbose := fmt.Sprintf("%+v", err)
+		assert.Contains(t, verbose, "SET VARIABLE PIN *** -> 200 result=1")
+		assert.Contains(t, verbose, "ANSWER -> error:")
+		assert.NotContains(t, verbose, "1234")
+		assert.Equal(t, err.Error(), fmt.Sprintf("%v", err))
+	})
+}
+
+func TestCallState(t *testing.T) {
+	t.Run("shared across sessions", func(t *testing.T) {
+		type seen struct {
+			extension string
+			state     map[string]string
+			err       error
+		}
+		results := make(chan seen, 3)
+		store := NewMemoryCallStateStore(time.Minute)
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			state := s.CallState()
+			var err error
+			switch s.GetEnv("agi_extension") {
+			case "s":
+				err = state.Set("route", "sales")
+			case "feature":
+				route, ok, _ := state.Get("route")
+				if !ok {
+					err = errors.New("route not carried over")
+				}
+				err = errors.Join(err, state.Set("transferred_from", route), state.Delete("route"))
+			}
+			all, allErr := state.All()
+			results <- seen{s.GetEnv("agi_extension"), all, errors.Join(err, allErr)}
+			return nil
+		}), WithCallState(store))
+
+		for _, ext := range []string{"s", "feature", "h"} {
+			dialTestServer(t, server, "agi_uniqueid: 1700000000.7\nagi_extension: "+ext+"\n")
+			got := <-results
+			require.NoError(t, got.err)
+			assert.Equal(t, ext, got.extension)
+			switch ext {
+			case "s":
+				assert.Equal(t, map[string]string{"route": "sales"}, got.state)
+			default:
+				assert.Equal(t, map[string]string{"transferred_from": "sales"}, got.state)
+			}
+		}
+
+		dialTestServer(t, server, "agi_uniqueid: 1700000000.8\nagi_extension: h\n")
+		assert.Empty(t, (<-results).state)
+		assert.Equal(t, 1, store.Len())
+	})
+
+	t.Run("custom key", func(t *testing.T) {
+		keys := make(chan string, 1)
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			keys <- s.CallState().Key()
+			return nil
+		}), WithCallState(nil), WithCallStateKey(func(s *AgiSession) string {
+			return s.GetEnv("agi_arg_1")
+		}))
+		dialTestServer(t, server, "agi_uniqueid: 1\nagi_arg_1: linked-42\n")
+		assert.Equal(t, "linked-42", <-keys)
+	})
+
+	t.Run("expires after ttl", func(t *testing.T) {
+		now := time.Unix(1700000000, 0)
+		store := NewMemoryCallStateStore(time.Minute)
+		store.now = func() time.Time { return now }
+
+		require.NoError(t, store.Set("a", "k", "v"))
+		now = now.Add(30 * time.Second)
+		require.NoError(t, store.Set("b", "k", "v"))
+
+		now = now.Add(45 * time.Second)
+		_, ok, err := store.Get("a", "k")
+		require.NoError(t, err)
+		assert.False(t, ok)
+		value, ok, err := store.Get("b", "k")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "v", value)
+
+		now = now.Add(time.Hour)
+		assert.Equal(t, 0, store.Len())
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		session, _ := newTestSession("")
+		state := session.CallState()
+		assert.Nil(t, state)
+		assert.ErrorIs(t, state.Set("k", "v"), ErrNoCallState)
+		_, _, err := state.Get("k")
+		assert.ErrorIs(t, err, ErrNoCallState)
+	})
+}
+
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		digits  string
+		want    bool
+	}{
+		{"NXXNXXXXXX", "2125551234", true},
+		{"NXXNXXXXXX", "1125551234", false},
+		{"NXXNXXXXXX", "2121551234", false},
+		{"NXXNXXXXXX", "212555123", false},
+		{"NXXNXXXXXX", "21255512345", false},
+		{"1NXXNXXXXXX", "12125551234", true},
+		{"1NXXNXXXXXX", "22125551234", false},
+		{"_NXXNXXXXXX", "2125551234", true},
+		{"nxxnxxxxxx", "2125551234", true},
+		{"Z", "0", false},
+		{"Z", "1", true},
+		{"Z", "9", true},
+		{"N", "1", false},
+		{"N", "2", true},
+		{"X", "0", true},
+		{"X", "*", false},
+		{"X{4,6}", "123", false},
+		{"X{4,6}", "1234", true},
+		{"X{4,6}", "123456", true},
+		{"X{4,6}", "1234567", false},
+		{"9X{3}", "9123", true},
+		{"9X{3}", "91234", false},
+		{"ZX{0,2}", "5", true},
+		{"ZX{0,2}", "500", true},
+		{"[1-3]X", "29", true},
+		{"[1-3]X", "49", false},
+		{"[15-7]", "6", true},
+		{"[15-7]", "2", false},
+		{"011.", "011", false},
+		{"011.", "01144", true},
+		{"011!", "011", true},
+		{"*X{2}", "*72", true},
+		{"X{2}#", "12#", true},
+	}
+	for _, tt := range tests {
+		p, err := CompilePattern(tt.pattern)
+		require.NoError(t, err, tt.pattern)
+		assert.Equal(t, tt.want, p.Match(tt.digits), "%s ~ %s", tt.pattern, tt.digits)
+		assert.Equal(t, tt.want, MatchPattern(tt.pattern, tt.digits), "%s ~ %s", tt.pattern, tt.digits)
+	}
+
+	invalid := []string{"", "_", "X{", "{2}", "X{a}", "X{3,2}", "X{0}", ".{2}", "X{2}{3}", "[", "[]", "[9-1]", "[a]", "NXXA", "X-1"}
+	for _, pattern := range invalid {
+		_, err := CompilePattern(pattern)
+		assert.ErrorIs(t, err, ErrInvalidPattern, pattern)
+		assert.False(t, MatchPattern(pattern, "1"), pattern)
+	}
+	assert.Panics(t, func() { MustCompilePattern("X{") })
+	assert.Equal(t, "NXX", MustCompilePattern("NXX").String())
+}
+
+func TestCollectDigitsPattern(t *testing.T) {
+	session, _ := newTestSession(digitResponses("2125551234"))
+	result, err := session.CollectDigitsInteractive(context.Background(), CollectOptions{
+		Pattern: MustCompilePattern("NXXNXXXXXX"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, CollectResult{Digits: "2125551234", End: CollectMaxDigits}, result)
+
+	session, _ = newTestSession(digitResponses("1125551234"))
+	result, err = session.CollectDigitsInteractive(context.Background(), CollectOptions{
+		Pattern: MustCompilePattern("NXXNXXXXXX"),
+	})
+	assert.ErrorIs(t, err, ErrPatternMismatch)
+	assert.Equal(t, "1125551234", result.Digits)
+}
+
+func TestCollectMaskedDigits(t *testing.T) {
+	t.Run("feedback and masking", func(t *testing.T) {
+		// 1 after a wait, 2 during the first tone, 3 after another wait
+		session, mock := newTestSession("200 result=49\n200 result=50 endpos=200\n200 result=0 endpos=800\n" +
+			"200 result=51\n200 result=0 endpos=800\n")
+		session.SetExchangeRedactor(func(e Exchange) Exchange { return e })
+		var out bytes.Buffer
+		session.SetTranscript(&out, TranscriptText)
+
+		pin, err := session.CollectMaskedDigits(context.Background(), MaskedDigitsOptions{Length: 3})
+		require.NoError(t, err)
+		assert.Equal(t, "123", pin.Reveal())
+		assert.Equal(t, "WAIT FOR DIGIT 5000\n"+
+			"STREAM FILE beep \"0123456789*#\"\n"+
+			"STREAM FILE beep \"0123456789*#\"\n"+
+			"WAIT FOR DIGIT 5000\n"+
+			"STREAM FILE beep \"0123456789*#\"\n", mock.writer.String())
+
+		assert.NotRegexp(t, `result=(49|50|51)`, out.String())
+		assert.Equal(t, 5, strings.Count(out.String(), "< 200 result=***"))
+		for _, e := range session.RecentExchanges() {
+			assert.True(t, e.Sensitive)
+			assert.Equal(t, "200 result=***", e.Response)
+		}
+
+		// Later commands are not sensitive
+		session, _ = newTestSession("200 result=49\n")
+		_, err = session.WaitForDigit(1000)
+		require.NoError(t, err)
+		session.SetExchangeRedactor(func(e Exchange) Exchange { return e })
+		assert.False(t, session.RecentExchanges()[0].Sensitive)
+		assert.Equal(t, "200 result=49", session.RecentExchanges()[0].Response)
+	})
+
+	t.Run("printing", func(t *testing.T) {
+		pin := SecretDigits{"4321"}
+		assert.Equal(t, "****", fmt.Sprint(pin))
+		assert.Equal(t, `agi.SecretDigits("****")`, fmt.Sprintf("%#v", pin))
+		data, err := json.Marshal(map[string]SecretDigits{"pin": pin})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"pin": "****"}`, string(data))
+		assert.Equal(t, 4, pin.Len())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		session, _ := newTestSession("200 result=55\n200 result=0 endpos=800\n200 result=0\n")
+		pin, err := session.CollectMaskedDigits(context.Background(), MaskedDigitsOptions{Length: 4, FeedbackTone: "tick", Timeout: time.Second})
+		require.NoError(t, err)
+		assert.Equal(t, "7", pin.Reveal())
+	})
+
+	t.Run("invalid length", func(t *testing.T) {
+		session, mock := newTestSession("")
+		_, err := session.CollectMaskedDigits(context.Background(), MaskedDigitsOptions{})
+		assert.Error(t, err)
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string
+		protocol string
+		want     TransferResult
+	}{
+		{"success", "200 result=1 (SUCCESS)", "200 result=1 (202)", TransferResult{TransferSuccess, "202"}},
+		{"failure", "200 result=1 (FAILURE)", "200 result=1 (603)", TransferResult{TransferFailure, "603"}},
+		{"unsupported", "200 result=1 (UNSUPPORTED)", "200 result=0", TransferResult{TransferUnsupported, ""}},
+		{"not permitted", "200 result=1 (NOTPERMITTED)", "200 result=0", TransferResult{TransferNotPermitted, ""}},
+		{"unset", "200 result=0", "200 result=0", TransferResult{TransferUnknown, ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, mock := newTestSession("200 result=0\n" + tt.status + "\n" + tt.protocol + "\n")
+			result, err := session.Transfer("PJSIP/1000@pbx,opts")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, result)
+			assert.Equal(t, "EXEC Transfer \"PJSIP/1000@pbx\\\\,opts\"\n"+
+				"GET VARIABLE TRANSFERSTATUS\n"+
+				"GET VARIABLE TRANSFERSTATUSPROTOCOL\n", mock.writer.String())
+		})
+	}
+
+	session, mock := newTestSession("")
+	_, err := session.Transfer("")
+	assert.Error(t, err)
+	assert.Empty(t, mock.writer.String())
+}
+
+func TestSendMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   string
+		body   string
+		set    string
+		status string
+		want   MessageStatus
+	}{
+		{"quotes", "sip:ivr@pbx", `your code is "42", see C:\docs`,
+			`SET VARIABLE MESSAGE(body) "your code is \"42\", see C:\\docs"`, "SUCCESS", MessageSuccess},
+		{"utf-8", "", "Merci, à bientôt ✓",
+			`SET VARIABLE MESSAGE(body) "Merci, à bientôt ✓"`, "FAILURE", MessageFailure},
+		{"newlines", "", "Your link:\nhttps://example.com/r?a=1&b=(2)",
+			`GET FULL VARIABLE "${LEN(${SET(MESSAGE(body)=${BASE64_DECODE(WW91ciBsaW5rOgpodHRwczovL2V4YW1wbGUuY29tL3I/YT0xJmI9KDIp)})})}"`,
+			"INVALID_PROTOCOL", MessageInvalidProtocol},
+		{"unknown status", "", "hi", `SET VARIABLE MESSAGE(body) "hi"`, "", MessageUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, mock := newTestSession("200 result=1\n200 result=0\n200 result=1 (" + tt.status + ")\n")
+			status, err := session.SendMessage("pjsip:100@pbx", tt.from, tt.body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, status)
+
+			send := `EXEC MessageSend "pjsip:100@pbx"`
+			if tt.from != "" {
+				send = `EXEC MessageSend "pjsip:100@pbx,` + tt.from + `"`
+			}
+			assert.Equal(t, tt.set+"\n"+send+"\nGET VARIABLE MESSAGE_SEND_STATUS\n", mock.writer.String())
+		})
+	}
+
+	t.Run("long body", func(t *testing.T) {
+		body := strings.Repeat(`"`, MaxMessageLength)
+		session, mock := newTestSession("200 result=1\n200 result=0\n200 result=1 (SUCCESS)\n")
+		_, err := session.SendMessage("pjsip:100@pbx", "", body)
+		require.NoError(t, err)
+		set, _, _ := strings.Cut(mock.writer.String(), "\n")
+		require.NoError(t, ValidateCommand(set))
+		assert.Less(t, len(set), 2048)
+
+		_, err = session.SendMessage("pjsip:100@pbx", "", body+"x")
+		assert.ErrorContains(t, err, "exceeds")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		session, mock := newTestSession("")
+		_, err := session.SendMessage("pjsip:100@pbx", "", "\xff\xfe")
+		assert.ErrorContains(t, err, "UTF-8")
+		_, err = session.SendMessage("", "", "hi")
+		assert.Error(t, err)
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestTransferInfo(t *testing.T) {
+	t.Run("blind", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (PJSIP/alice-00000001)\n")
+		info, err := session.TransferInfo()
+		require.NoError(t, err)
+		assert.Equal(t, TransferInfo{Blind: true, By: "PJSIP/alice-00000001"}, info)
+		assert.True(t, info.Transferred())
+		assert.Equal(t, "GET VARIABLE BLINDTRANSFER\n", mock.writer.String())
+	})
+
+	t.Run("attended", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n200 result=1 (PJSIP/bob-00000002)\n")
+		info, err := session.TransferInfo()
+		require.NoError(t, err)
+		assert.Equal(t, TransferInfo{Attended: true, By: "PJSIP/bob-00000002"}, info)
+	})
+
+	t.Run("not transferred", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n200 result=0\n")
+		info, err := session.TransferInfo()
+		require.NoError(t, err)
+		assert.False(t, info.Transferred())
+	})
+}
+
+func TestDialplanExists(t *testing.T) {
+	t.Run("present", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (1)\n")
+		exists, err := session.DialplanExists("from-internal", "_X.", 1)
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, `GET FULL VARIABLE "${DIALPLAN_EXISTS(from-internal,_X.,1)}"`+"\n", mock.writer.String())
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		session, _ := newTestSession("200 result=1 (0)\n")
+		exists, err := session.DialplanExists("from-internal", "9999", 1)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("valid extension", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (1)\n")
+		exists, err := session.ValidExtension("ivr", "#")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, `GET FULL VARIABLE "${DIALPLAN_EXISTS(ivr,#)}"`+"\n", mock.writer.String())
+	})
+
+	t.Run("invalid names", func(t *testing.T) {
+		session, mock := newTestSession("")
+		_, err := session.ValidExtension("ivr", "1)}${SHELL(id)")
+		assert.Error(t, err)
+		_, err = session.DialplanExists("ivr", "1", 0)
+		assert.Error(t, err)
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestGoto(t *testing.T) {
+	t.Run("without precheck", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n200 result=0\n200 result=0\n")
+		require.NoError(t, session.Goto("sales", "100", 1))
+		assert.Equal(t, "SET CONTEXT sales\nSET EXTENSION 100\nSET PRIORITY 1\n", mock.writer.String())
+	})
+
+	t.Run("precheck present", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (1)\n200 result=0\n200 result=0\n200 result=0\n")
+		session.SetGotoPrecheck(true)
+		require.NoError(t, session.Goto("sales", "100", 1))
+		assert.Equal(t, `GET FULL VARIABLE "${DIALPLAN_EXISTS(sales,100,1)}"`+"\n"+
+			"SET CONTEXT sales\nSET EXTENSION 100\nSET PRIORITY 1\n", mock.writer.String())
+	})
+
+	t.Run("precheck absent", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (0)\n")
+		session.SetGotoPrecheck(true)
+		err := session.Goto("sales", "100", 1)
+		assert.ErrorIs(t, err, ErrDialplanNotFound)
+		assert.NotContains(t, mock.writer.String(), "SET CONTEXT")
+	})
+
+	t.Run("invalid target sends nothing", func(t *testing.T) {
+		session, mock := newTestSession("")
+		assert.Error(t, session.Goto("sales", "bad ext", 1))
+		assert.Error(t, session.Goto("sales", "100", 0))
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+type promptReport struct {
+	file        string
+	endpos      int64
+	interrupted bool
+	digit       string
+}
+
+type promptRecorder []promptReport
+
+func (r *promptRecorder) OnPromptComplete(file string, endpos int64, interrupted bool, digit string) {
+	*r = append(*r, promptReport{file, endpos, interrupted, digit})
+}
+
+func TestPromptMetrics(t *testing.T) {
+	session, _ := newTestSession("200 result=0 endpos=24000\n" +
+		"200 result=50 endpos=9600\n" +
+		"200 result=51 endpos=16000\n" +
+		"200 result=0 endpos=0\n" +
+		"200 result=0\n")
+	var reports promptRecorder
+	session.SetPromptMetrics(&reports)
+
+	require.NoError(t, session.StreamFile("welcome", "12"))
+	require.NoError(t, session.StreamFile("main-menu", "12"))
+	digit, err := session.GetOption("submenu", "123", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "3", digit)
+	_, err = session.GetOption("missing", "1", 0)
+	assert.ErrorIs(t, err, ErrPromptNotFound)
+	_, err = session.WaitForDigit(100)
+	require.NoError(t, err)
+
+	assert.Equal(t, promptRecorder{
+		{"welcome", 24000, false, ""},
+		{"main-menu", 9600, true, "2"},
+		{"submenu", 16000, true, "3"},
+		{"missing", 0, false, ""},
+	}, reports)
+}
+
+func TestSoundExists(t *testing.T) {
+	t.Run("language and base directory", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (1)\n")
+		session.env["agi_language"] = "fr"
+		session.SetSoundFormats("wav", "gsm")
+
+		exists, err := session.SoundExists("welcome")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, `GET FULL VARIABLE "$[${STAT(e,/var/lib/asterisk/sounds/fr/welcome.wav)} | `+
+			`${STAT(e,/var/lib/asterisk/sounds/fr/welcome.gsm)} | `+
+			`${STAT(e,/var/lib/asterisk/sounds/welcome.wav)} | `+
+			`${STAT(e,/var/lib/asterisk/sounds/welcome.gsm)}]"`+"\n", mock.writer.String())
+
+		exists, err = session.SoundExists("welcome")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, 1, strings.Count(mock.writer.String(), "\n"), "result should be cached")
+	})
+
+	t.Run("absolute name and custom directory", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (0)\n200 result=1 (0)\n")
+		session.SetSoundFormats("sln")
+		session.SetSoundsDir("/srv/sounds")
+
+		exists, err := session.SoundExists("/tmp/recording")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		_, err = session.SoundExists("custom/menu")
+		require.NoError(t, err)
+		assert.Equal(t, `GET FULL VARIABLE "$[${STAT(e,/tmp/recording.sln)}]"`+"\n"+
+			`GET FULL VARIABLE "$[${STAT(e,/srv/sounds/custom/menu.sln)}]"`+"\n", mock.writer.String())
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		session, mock := newTestSession("")
+		_, err := session.SoundExists("x)}${SHELL(id)")
+		assert.Error(t, err)
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestStrictPrompts(t *testing.T) {
+	session, mock := newTestSession("200 result=1 (0)\n200 result=1 (1)\n200 result=0 endpos=8000\n")
+	session.SetStrictPrompts(true)
+
+	err := session.StreamFile("missing", "")
+	assert.ErrorIs(t, err, ErrPromptNotFound)
+	_, err = session.GetOption("missing", "1", 0)
+	assert.ErrorIs(t, err, ErrPromptNotFound)
+	_, err = session.GetData("missing", 1000, 4)
+	assert.ErrorIs(t, err, ErrPromptNotFound)
+
+	require.NoError(t, session.StreamFile("welcome", ""))
+	assert.NotContains(t, mock.writer.String(), "STREAM FILE missing")
+	assert.Contains(t, mock.writer.String(), "STREAM FILE welcome")
+}
+
+func TestPromptResolver(t *testing.T) {
+	t.Run("candidates", func(t *testing.T) {
+		assert.Equal(t, []string{"es/welcome", "welcome"}, DefaultPromptResolver("welcome", "es"))
+		assert.Equal(t, []string{"welcome"}, DefaultPromptResolver("welcome", ""))
+		assert.Equal(t, []string{"/tmp/msg"}, DefaultPromptResolver("/tmp/msg", "es"))
+		assert.Equal(t, []string{"es/welcome", "en/welcome", "welcome"}, FallbackLanguages("en", "es")("welcome", "es"))
+	})
+
+	t.Run("first candidate missing", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0 endpos=0\n200 result=0 endpos=8000\n")
+		session.env["agi_language"] = "es"
+		session.SetPromptResolver(DefaultPromptResolver)
+		var reports promptRecorder
+		session.SetPromptMetrics(&reports)
+
+		require.NoError(t, session.StreamFile("welcome", ""))
+		assert.Equal(t, `STREAM FILE es/welcome ""`+"\n"+`STREAM FILE welcome ""`+"\n", mock.writer.String())
+		assert.Equal(t, promptRecorder{{"welcome", 8000, false, ""}}, reports)
+	})
+
+	t.Run("all candidates missing", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0 endpos=0\n200 result=0 endpos=0\n")
+		session.env["agi_language"] = "es"
+		session.SetPromptResolver(DefaultPromptResolver)
+		var reports promptRecorder
+		session.SetPromptMetrics(&reports)
+
+		_, err := session.GetOption("main-menu", "12", 0)
+		assert.ErrorIs(t, err, ErrPromptNotFound)
+		assert.ErrorContains(t, err, "es/main-menu, main-menu")
+		assert.Equal(t, 2, strings.Count(mock.writer.String(), "GET OPTION"))
+		assert.Empty(t, reports)
+	})
+
+	t.Run("strict check skips missing candidates", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (0)\n200 result=1 (1)\n200 result=0042\n")
+		session.env["agi_language"] = "es"
+		session.SetStrictPrompts(true)
+		session.SetSoundFormats("wav")
+		session.SetPromptResolver(DefaultPromptResolver)
+
+		digits, _, err := session.GetDataMulti([]string{"enter-pin"}, time.Second, 4)
+		require.NoError(t, err)
+		assert.Equal(t, "0042", digits)
+		assert.NotContains(t, mock.writer.String(), "GET DATA es/enter-pin")
+		assert.Contains(t, mock.writer.String(), "GET DATA enter-pin 1000 4\n")
+	})
+
+	t.Run("strict all candidates missing", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (0)\n200 result=1 (0)\n")
+		session.env["agi_language"] = "es"
+		session.SetStrictPrompts(true)
+		session.SetPromptResolver(DefaultPromptResolver)
+
+		_, err := session.GetData("enter-pin", 1000, 4)
+		assert.ErrorIs(t, err, ErrPromptNotFound)
+		assert.NotContains(t, mock.writer.String(), "GET DATA")
+	})
+}
+
+func TestVariableEscaping(t *testing.T) {
+	session, mock := newTestSession("200 result=1\n200 result=1 (line one\\nline\\ttwo \\\\ C:\\dir)\n")
+	session.SetVariableEscaping(true)
+
+	require.NoError(t, session.SetVariable("NOTE", "line one\nline\ttwo \\ \"quoted\""))
+	assert.Equal(t, `SET VARIABLE NOTE "line one\\nline\\ttwo \\\\ \"quoted\""`+"\n", mock.writer.String())
+
+	value, err := session.GetVariable("NOTE")
+	require.NoError(t, err)
+	assert.Equal(t, "line one\nline\ttwo \\ C:\\dir", value)
+
+	session, _ = newTestSession("200 result=1 (a\\nb)\n")
+	value, err = session.GetVariable("RAW")
+	require.NoError(t, err)
+	assert.Equal(t, "a\\nb", value, "values are returned verbatim unless escaping is enabled")
+}
+
+func TestTranscript(t *testing.T) {
+	t.Run("json", func(t *testing.T) {
+		session, _ := newTestSession("200 result=1\n200 result=1234\n")
+		session.env["agi_uniqueid"] = "1700000000.5"
+		var out bytes.Buffer
+		session.SetTranscript(&out, TranscriptJSON)
+
+		require.NoError(t, session.SetVariable("PIN", "1234"))
+		_, err := session.GetData("enter-pin", 5000, 4)
+		require.NoError(t, err)
+		assert.Error(t, session.Answer())
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		require.Len(t, lines, 3)
+		assert.NotContains(t, out.String(), "1234\"")
+
+		var raw map[string]any
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &raw))
+		keys := make([]string, 0, len(raw))
+		for k := range raw {
+			keys = append(keys, k)
+		}
+		assert.ElementsMatch(t, []string{"time", "uniqueid", "direction", "verb", "args", "code", "result", "data", "duration_ms"}, keys)
+
+		var records []TranscriptRecord
+		for _, line := range lines {
+			var r TranscriptRecord
+			require.NoError(t, json.Unmarshal([]byte(line), &r))
+			records = append(records, r)
+		}
+		assert.Equal(t, "1700000000.5", records[0].UniqueID)
+		assert.Equal(t, "out", records[0].Direction)
+		assert.Equal(t, "SET VARIABLE", records[0].Verb)
+		assert.Equal(t, "PIN ***", records[0].Args)
+		assert.Equal(t, 200, records[0].Code)
+		assert.Equal(t, "1", records[0].Result)
+		assert.Equal(t, "GET DATA", records[1].Verb)
+		assert.Equal(t, "enter-pin 5000 4", records[1].Args)
+		assert.Equal(t, "***", records[1].Result)
+		assert.Equal(t, "ANSWER", records[2].Verb)
+		assert.Equal(t, 0, records[2].Code)
+		assert.NotEmpty(t, records[2].Error)
+
+		again, err := json.Marshal(records[0])
+		require.NoError(t, err)
+		assert.JSONEq(t, lines[0], string(again))
+	})
+
+	t.Run("text", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n")
+		var out bytes.Buffer
+		session.SetTranscript(&out, TranscriptText)
+		require.NoError(t, session.Answer())
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		require.Len(t, lines, 2)
+		assert.Regexp(t, `^\S+ - \S+ > ANSWER$`, lines[0])
+		assert.Regexp(t, `^\S+ - \S+ < 200 result=0$`, lines[1])
+	})
+
+	t.Run("server", func(t *testing.T) {
+		var mu sync.Mutex
+		var out bytes.Buffer
+		done := make(chan struct{})
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			defer close(done)
+			return s.Answer()
+		}), WithTranscript(writerFunc(func(p []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return out.Write(p)
+		})), WithTranscriptFormat(TranscriptJSON))
+
+		conn := dialTestServer(t, server, "agi_uniqueid: 42\n")
+		answerCommands(t, conn, "ANSWER", "200 result=0")
+		<-done
+
+		mu.Lock()
+		defer mu.Unlock()
+		var r TranscriptRecord
+		require.NoError(t, json.Unmarshal(out.Bytes(), &r))
+		assert.Equal(t, "42", r.UniqueID)
+		assert.Equal(t, "ANSWER", r.Verb)
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "accept: too many open files" }
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
+
+// flakyListener fails the first failures calls to Accept with err
+type flakyListener struct {
+	net.Listener
+	mu       sync.Mutex
+	failures int
+	err      error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.failures > 0 {
+		l.failures--
+		l.mu.Unlock()
+		return nil, l.err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	t.Run("temporary errors", func(t *testing.T) {
+		handled := make(chan string, 1)
+		var reported atomic.Int64
+		server, err := NewFastAGIServer("127.0.0.1:0", HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			handled <- s.GetEnv("agi_uniqueid")
+			return nil
+		}), WithErrorHandler(func(s *AgiSession, err error) {
+			if s == nil {
+				reported.Add(1)
+			}
+		}))
+		require.NoError(t, err)
+		server.listener = &flakyListener{Listener: server.listener, failures: 3, err: fmt.Errorf("accept tcp: %w", syscall.EMFILE)}
+
+		served := make(chan error, 1)
+		go func() { served <- server.Serve() }()
+		defer func() {
+			require.NoError(t, server.Stop())
+			require.NoError(t, <-served)
+		}()
+
+		dialTestServer(t, server, "agi_uniqueid: 7\n")
+		assert.Equal(t, "7", <-handled)
+		assert.Equal(t, int64(3), server.Stats().AcceptBackoffs)
+		assert.Equal(t, int64(3), reported.Load())
+	})
+
+	t.Run("temporary interface", func(t *testing.T) {
+		assert.True(t, isTemporaryAcceptError(temporaryError{}))
+		assert.True(t, isTemporaryAcceptError(fmt.Errorf("accept: %w", syscall.ENFILE)))
+		assert.False(t, isTemporaryAcceptError(net.ErrClosed))
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		server, err := NewFastAGIServer("127.0.0.1:0", HandlerFunc(func(ctx context.Context, s *AgiSession) error { return nil }))
+		require.NoError(t, err)
+		defer server.listener.Close()
+		server.listener = &flakyListener{Listener: server.listener, failures: 1, err: errors.New("listener broken")}
+		assert.ErrorContains(t, server.Serve(), "listener broken")
+		assert.Equal(t, int64(0), server.Stats().AcceptBackoffs)
+	})
+
+	t.Run("stop during backoff", func(t *testing.T) {
+		server, err := NewFastAGIServer("127.0.0.1:0", HandlerFunc(func(ctx context.Context, s *AgiSession) error { return nil }),
+			WithErrorHandler(func(*AgiSession, error) {}))
+		require.NoError(t, err)
+		server.listener = &flakyListener{Listener: server.listener, failures: 1000, err: temporaryError{}}
+
+		served := make(chan error, 1)
+		go func() { served <- server.Serve() }()
+		assert.Eventually(t, func() bool { return server.Stats().AcceptBackoffs >= 5 }, 2*time.Second, time.Millisecond)
+		require.NoError(t, server.Stop())
+		select {
+		case err := <-served:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Serve did not return after Stop")
+		}
+	})
+}
+
+func TestFeatureFlags(t *testing.T) {
+	t.Run("custom evaluator", func(t *testing.T) {
+		type seen struct{ newMenu, beta bool }
+		results := make(chan seen, 2)
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			results <- seen{s.Flag("new_menu"), s.Flag("beta_tts")}
+			return nil
+		}), WithFeatureFlags(func(env map[string]string) map[string]bool {
+			return map[string]bool{"new_menu": strings.HasSuffix(env["agi_callerid"], "7")}
+		}))
+
+		dialTestServer(t, server, "agi_callerid: 5551237\n")
+		assert.Equal(t, seen{true, false}, <-results)
+		dialTestServer(t, server, "agi_callerid: 5551238\n")
+		assert.Equal(t, seen{false, false}, <-results)
+	})
+
+	t.Run("from url", func(t *testing.T) {
+		flags := make(chan map[string]bool, 1)
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			flags <- s.Flags()
+			return nil
+		}), WithFeatureFlags(nil))
+
+		dialTestServer(t, server, "agi_network_script: ivr?flags=new_menu,beta_tts&lang=en\n")
+		assert.Equal(t, map[string]bool{"new_menu": true, "beta_tts": true}, <-flags)
+	})
+
+	tests := []struct {
+		env  map[string]string
+		want map[string]bool
+	}{
+		{map[string]string{"agi_network_script": "ivr"}, nil},
+		{map[string]string{"agi_network_script": "ivr?flags="}, map[string]bool{}},
+		{map[string]string{"agi_network_script": "ivr?flags=a&flags=b,%20c"}, map[string]bool{"a": true, "b": true, "c": true}},
+		{map[string]string{"agi_request": "agi://pbx:4573/ivr?flags=a"}, map[string]bool{"a": true}},
+		{map[string]string{"agi_network_script": "ivr?flags=%zz"}, nil},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, FlagsFromURL(tt.env), tt.env)
+	}
+
+	session, _ := newTestSession("")
+	assert.False(t, session.Flag("new_menu"))
+}
+
+func TestWaitForVariable(t *testing.T) {
+	t.Run("set after polling", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n200 result=1 ()\n200 result=1 (ready)\n")
+		value, err := session.WaitForVariable(context.Background(), "ROUTE", time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, "ready", value)
+		assert.Equal(t, 3, strings.Count(mock.writer.String(), "GET VARIABLE ROUTE\n"))
+	})
+
+	t.Run("context expires", func(t *testing.T) {
+		session, _ := newTestSession(strings.Repeat("200 result=0\n", 100))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := session.WaitForVariable(ctx, "ROUTE", 5*time.Millisecond)
+		assert.ErrorIs(t, err, ErrTimeout)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.NotErrorIs(t, err, ErrHangup)
+	})
+
+	t.Run("full variable", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (sales)\n")
+		value, err := session.WaitForVariableWith(context.Background(), "${SHARED(ROUTE)}", WaitVariableOptions{Full: true})
+		require.NoError(t, err)
+		assert.Equal(t, "sales", value)
+		assert.Equal(t, `GET FULL VARIABLE "${SHARED(ROUTE)}"`+"\n", mock.writer.String())
+	})
+
+	t.Run("hangup notice", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\nHANGUP\n200 result=0\n")
+		_, err := session.WaitForVariable(context.Background(), "ROUTE", time.Millisecond)
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.True(t, session.HungUp())
+		assert.Equal(t, 2, strings.Count(mock.writer.String(), "\n"))
+	})
+
+	t.Run("dead channel", func(t *testing.T) {
+		session, _ := newTestSession("511 Command Not Permitted on a dead channel or intercept routine\n")
+		_, err := session.WaitForVariable(context.Background(), "ROUTE", time.Millisecond)
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.True(t, session.HungUp())
+	})
+}
+
+func TestWatchVariable(t *testing.T) {
+	t.Run("hold until predicate matches", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1\n200 result=1 (pending)\n200 result=1 (pending)\n200 result=1 (done)\n200 result=1\n")
+		var value string
+		err := session.WithMusicOnHold("", func() (err error) {
+			value, err = session.WatchVariable(context.Background(), "JOB", Equals("done"), WatchOptions{Interval: time.Millisecond})
+			return err
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "done", value)
+		assert.Equal(t, "SET MUSIC ON\n"+strings.Repeat("GET VARIABLE JOB\n", 3)+"SET MUSIC OFF\n", mock.writer.String())
+	})
+
+	t.Run("default predicate", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n200 result=1 (ready)\n")
+		value, err := session.WatchVariable(context.Background(), "ROUTE", nil, WatchOptions{Interval: time.Millisecond})
+		require.NoError(t, err)
+		assert.Equal(t, "ready", value)
+	})
+
+	t.Run("cancel stops music", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1\n" + strings.Repeat("200 result=1 (pending)\n", 100))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := session.WithMusicOnHold("hold", func() error {
+			_, err := session.WatchVariable(ctx, "JOB", Equals("done"), WatchOptions{Interval: time.Millisecond, MaxInterval: 4 * time.Millisecond})
+			return err
+		})
+		assert.ErrorIs(t, err, ErrTimeout)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.True(t, strings.HasPrefix(mock.writer.String(), "SET MUSIC ON hold\nGET VARIABLE JOB\n"))
+		assert.True(t, strings.HasSuffix(mock.writer.String(), "SET MUSIC OFF\n"))
+	})
+
+	t.Run("hangup stops polling", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1\n200 result=1 (pending)\nHANGUP\n200 result=1 (pending)\n")
+		err := session.WithMusicOnHold("", func() error {
+			_, err := session.WatchVariable(context.Background(), "JOB", Equals("done"), WatchOptions{Interval: time.Millisecond})
+			return err
+		})
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.Equal(t, "SET MUSIC ON\n"+strings.Repeat("GET VARIABLE JOB\n", 2), mock.writer.String())
+	})
+
+	t.Run("backoff and jitter", func(t *testing.T) {
+		assert.Equal(t, 8*time.Millisecond, watchDelay(8*time.Millisecond, false))
+		for range 100 {
+			d := watchDelay(8*time.Millisecond, true)
+			assert.GreaterOrEqual(t, d, 4*time.Millisecond)
+			assert.Less(t, d, 8*time.Millisecond)
+		}
+	})
+}
+
+func TestQueueReaders(t *testing.T) {
+	t.Run("counts", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (3)\n200 result=1 (5)\n")
+		waiting, err := session.QueueWaitingCount("support")
+		require.NoError(t, err)
+		assert.Equal(t, 3, waiting)
+		logged, err := session.QueueMemberCount("support", "logged")
+		require.NoError(t, err)
+		assert.Equal(t, 5, logged)
+		assert.Equal(t, `GET FULL VARIABLE "${QUEUE_WAITING_COUNT(support)}"`+"\n"+
+			`GET FULL VARIABLE "${QUEUE_MEMBER(support,logged)}"`+"\n", mock.writer.String())
+
+		_, err = session.QueueMemberCount("support", "bogus")
+		assert.Error(t, err)
+		_, err = session.QueueWaitingCount("support)}")
+		assert.Error(t, err)
+	})
+
+	t.Run("batch read", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (1|4|6|2|1|1|8)\n")
+		info, err := session.QueueVariables("support")
+		require.NoError(t, err)
+		assert.Equal(t, QueueInfo{Queue: "support", Exists: true, Waiting: 4, Logged: 6, Free: 2, Ready: 1, Paused: 1, Total: 8}, info)
+		assert.Equal(t, 1, strings.Count(mock.writer.String(), "\n"))
+	})
+
+	t.Run("older asterisk", func(t *testing.T) {
+		session, _ := newTestSession("200 result=1 (|4|6|2||1|8)\n")
+		info, err := session.QueueVariables("support")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"QUEUE_EXISTS", "QUEUE_MEMBER(ready)"}, info.Missing)
+		assert.Equal(t, 4, info.Waiting)
+		assert.Equal(t, 0, info.Ready)
+	})
+
+	t.Run("announce position", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (2)\n200 result=0 endpos=100\n200 result=0\n200 result=0 endpos=100\n")
+		require.NoError(t, session.AnnounceQueuePosition("support"))
+		assert.Equal(t, `GET FULL VARIABLE "${QUEUE_WAITING_COUNT(support)}"`+"\n"+
+			"STREAM FILE queue-thereare \"\"\n"+
+			"SAY NUMBER 2 \"\"\n"+
+			"STREAM FILE queue-callswaiting \"\"\n", mock.writer.String())
+
+		session, mock = newTestSession("200 result=1 (0)\n200 result=0 endpos=100\n")
+		require.NoError(t, session.AnnounceQueuePosition("support"))
+		assert.Contains(t, mock.writer.String(), "STREAM FILE queue-youarenext")
+	})
+}
+
+func TestConsentAndRecord(t *testing.T) {
+	opts := ConsentOptions{
+		Resolver: PrefixConsentResolver(map[string]ConsentMode{"1415": ConsentExplicit, "1": ConsentImplicit}, ConsentExplicit),
+		Prompts: map[ConsentMode]string{
+			ConsentExplicit: "consent-press-1",
+			ConsentImplicit: "call-may-be-recorded",
+		},
+		DeclinedPrompt: "not-recorded",
+		Recording:      MixMonitorOptions{Filename: "calls/1.wav", Options: "b"},
+	}
+	newSession := func(callerID, script string) (*AgiSession, *mockIO) {
+		session, mock := newTestSession(script)
+		session.env["agi_callerid"] = callerID
+		return session, mock
+	}
+
+	t.Run("explicit accepted during prompt", func(t *testing.T) {
+		session, mock := newSession("+14155550100", "200 result=49 endpos=4000\n200 result=1\n200 result=0\n")
+		result, err := session.ConsentAndRecord(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, ConsentRecorded, result)
+		assert.Equal(t, "STREAM FILE consent-press-1 \"0123456789*#\"\n"+
+			`SET VARIABLE RECORDING_CONSENT "accepted"`+"\n"+
+			`EXEC MixMonitor "calls/1.wav,b"`+"\n", mock.writer.String())
+	})
+
+	t.Run("explicit accepted after prompt", func(t *testing.T) {
+		session, mock := newSession("14155550100", "200 result=0 endpos=16000\n200 result=49\n200 result=1\n200 result=0\n")
+		result, err := session.ConsentAndRecord(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, ConsentRecorded, result)
+		assert.Contains(t, mock.writer.String(), "WAIT FOR DIGIT 5000\n")
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		session, mock := newSession("14155550100", "200 result=50 endpos=4000\n200 result=1\n200 result=0 endpos=8000\n")
+		result, err := session.ConsentAndRecord(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, ConsentDeclinedNotRecorded, result)
+		assert.Contains(t, mock.writer.String(), `SET VARIABLE RECORDING_CONSENT "declined"`)
+		assert.Contains(t, mock.writer.String(), "STREAM FILE not-recorded")
+		assert.NotContains(t, mock.writer.String(), "MixMonitor")
+	})
+
+	t.Run("no answer declines", func(t *testing.T) {
+		session, mock := newSession("14155550100", "200 result=0 endpos=16000\n200 result=0\n200 result=1\n200 result=0 endpos=8000\n")
+		result, err := session.ConsentAndRecord(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, ConsentDeclinedNotRecorded, result)
+		assert.NotContains(t, mock.writer.String(), "MixMonitor")
+	})
+
+	t.Run("implicit", func(t *testing.T) {
+		session, mock := newSession("12125550100", "200 result=0 endpos=16000\n200 result=1\n200 result=0\n")
+		result, err := session.ConsentAndRecord(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, ConsentImplicitRecorded, result)
+		assert.Equal(t, "STREAM FILE call-may-be-recorded \"\"\n"+
+			`SET VARIABLE RECORDING_CONSENT "implicit"`+"\n"+
+			`EXEC MixMonitor "calls/1.wav,b"`+"\n", mock.writer.String())
+	})
+
+	t.Run("hangup during consent", func(t *testing.T) {
+		session, mock := newSession("14155550100", "HANGUP\n200 result=-1 endpos=2000\n")
+		_, err := session.ConsentAndRecord(context.Background(), opts)
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.NotContains(t, mock.writer.String(), "SET VARIABLE")
+		assert.NotContains(t, mock.writer.String(), "MixMonitor")
+	})
+
+	t.Run("hangup waiting for key", func(t *testing.T) {
+		session, mock := newSession("14155550100", "200 result=0 endpos=16000\n200 result=-1\n")
+		_, err := session.ConsentAndRecord(context.Background(), opts)
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.NotContains(t, mock.writer.String(), "MixMonitor")
+	})
+
+	t.Run("missing prompt", func(t *testing.T) {
+		session, _ := newSession("12125550100", "")
+		o := opts
+		o.Prompts = map[ConsentMode]string{ConsentExplicit: "consent-press-1"}
+		_, err := session.ConsentAndRecord(context.Background(), o)
+		assert.ErrorContains(t, err, "implicit")
+	})
+}
+
+func TestMixMonitor(t *testing.T) {
+	session, mock := newTestSession("200 result=0\n200 result=0\n")
+	require.NoError(t, session.MixMonitorStart(MixMonitorOptions{Filename: "a,b.wav", Command: "/usr/bin/upload ^{MIXMONITOR_FILENAME}"}))
+	require.NoError(t, session.MixMonitorStop())
+	assert.Equal(t, `EXEC MixMonitor "a\\,b.wav,,/usr/bin/upload \\^{MIXMONITOR_FILENAME}"`+"\n"+
+		"EXEC StopMixMonitor\n", mock.writer.String())
+
+	session, mock = newTestSession("200 result=0\n")
+	require.NoError(t, session.MixMonitorStart(MixMonitorOptions{Filename: "a,"}))
+	assert.Equal(t, `EXEC MixMonitor "a\\,"`+"\n", mock.writer.String())
+}
+
+func TestSpeechSpeak(t *testing.T) {
+	t.Run("ssml with both quote types", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n")
+		err := session.SpeechSpeak(&MRCPSynth{
+			Text: `<speak version="1.0">It's <say-as interpret-as='date'>2024-01-02</say-as>` + "\n</speak>",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, `SPEECH SYNTHESIZE "<speak version=\"1.0\">It's <say-as interpret-as='date'>2024-01-02</say-as> </speak>"`+"\n", mock.writer.String())
+	})
+
+	t.Run("stable option order", func(t *testing.T) {
+		synth := &MRCPSynth{
+			Text:      "Hello",
+			Params:    []SpeechParam{{Name: "voice", Value: "en-US Wavenet"}, {Name: "rate", Value: "fast"}},
+			Options:   map[string]string{"volume": "loud", "pitch": "high", "language": "en-US", "gender": "female"},
+			ResultVar: "synth_result",
+		}
+		want := `SPEECH SYNTHESIZE "Hello" voice="en-US Wavenet" rate=fast gender=female language=en-US pitch=high volume=loud "synth_result"` + "\n"
+		for i := 0; i < 20; i++ {
+			session, mock := newTestSession("200 result=0\n")
+			require.NoError(t, session.SpeechSpeak(synth))
+			require.Equal(t, want, mock.writer.String())
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		session, mock := newTestSession("")
+		assert.Error(t, session.SpeechSpeak(nil))
+		assert.ErrorContains(t, session.SpeechSpeak(&MRCPSynth{Text: " \n"}), "empty")
+		assert.Error(t, session.SpeechSpeak(&MRCPSynth{Text: "Hi", Params: []SpeechParam{{Name: "a b", Value: "c"}}}))
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestMediaControl(t *testing.T) {
+	t.Run("pjsip", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1\n200 result=1\n200 result=1 (no)\n200 result=1 (g722,ulaw)\n")
+		session.env["agi_type"] = "PJSIP"
+
+		require.NoError(t, session.SetDirectMedia(false))
+		require.NoError(t, session.ForceCodec("g722,ulaw"))
+		enabled, set, err := session.DirectMedia()
+		require.NoError(t, err)
+		assert.True(t, set)
+		assert.False(t, enabled)
+		codec, err := session.ForcedCodec()
+		require.NoError(t, err)
+		assert.Equal(t, "g722,ulaw", codec)
+
+		assert.Equal(t, `SET VARIABLE CHANNEL(direct_media) "no"`+"\n"+
+			`SET VARIABLE PJSIP_MEDIA_OFFER(audio) "g722,ulaw"`+"\n"+
+			"GET VARIABLE CHANNEL(direct_media)\n"+
+			"GET VARIABLE PJSIP_MEDIA_OFFER(audio)\n", mock.writer.String())
+	})
+
+	t.Run("chan_sip", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1\n200 result=1\n200 result=0\n")
+		session.env["agi_channel"] = "SIP/trunk-00000001"
+
+		require.NoError(t, session.SetDirectMedia(true))
+		require.NoError(t, session.ForceCodec("ulaw"))
+		_, set, err := session.DirectMedia()
+		require.NoError(t, err)
+		assert.False(t, set)
+
+		assert.Equal(t, `SET VARIABLE CHANNEL(directmedia) "yes"`+"\n"+
+			`SET VARIABLE SIP_CODEC "ulaw"`+"\n"+
+			"GET VARIABLE CHANNEL(directmedia)\n", mock.writer.String())
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		session, mock := newTestSession("")
+		session.env["agi_channel"] = "DAHDI/1-1"
+
+		assert.ErrorIs(t, session.SetDirectMedia(false), ErrUnsupportedChannelTech)
+		assert.ErrorIs(t, session.ForceCodec("ulaw"), ErrUnsupportedChannelTech)
+		_, _, err := session.DirectMedia()
+		assert.ErrorIs(t, err, ErrUnsupportedChannelTech)
+		_, err = session.ForcedCodec()
+		assert.ErrorIs(t, err, ErrUnsupportedChannelTech)
+		assert.Empty(t, mock.writer.String())
+	})
+
+	t.Run("invalid codec", func(t *testing.T) {
+		session, mock := newTestSession("")
+		session.env["agi_type"] = "PJSIP"
+		assert.Error(t, session.ForceCodec(""))
+		assert.Error(t, session.ForceCodec("ulaw alaw"))
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestRecordFileWithProgress(t *testing.T) {
+	// newDelayedSession returns a session whose response to the first
+	// command is written after delay
+	newDelayedSession := func(delay time.Duration, response string) (*AgiSession, *bytes.Buffer) {
+		pr, pw := io.Pipe()
+		writer := &bytes.Buffer{}
+		session := &AgiSession{
+			reader:    bufio.NewReader(pr),
+			writer:    writer,
+			env:       make(map[string]string),
+			variables: make(map[string]string),
+			timeout:   30 * time.Second,
+		}
+		go func() {
+			time.Sleep(delay)
+			io.WriteString(pw, response)
+		}()
+		t.Cleanup(func() { pw.Close() })
+		return session, writer
+	}
+	opts := RecordOptions{EscapeDigits: "#", ProgressInterval: 10 * time.Millisecond}
+
+	t.Run("reports progress until the command returns", func(t *testing.T) {
+		session, writer := newDelayedSession(100*time.Millisecond, "200 result=35 (dtmf) endpos=800\n")
+
+		var mu sync.Mutex
+		var calls []time.Duration
+		var returned atomic.Bool
+		late := make(chan struct{}, 1)
+		digit, err := session.RecordFileWithProgress(context.Background(), "/tmp/dictation", opts, func(elapsed time.Duration) {
+			if returned.Load() {
+				late <- struct{}{}
+			}
+			mu.Lock()
+			calls = append(calls, elapsed)
+			mu.Unlock()
+		})
+		returned.Store(true)
+		require.NoError(t, err)
+		assert.Equal(t, "#", digit)
+		assert.Equal(t, "RECORD FILE /tmp/dictation wav \"#\" -1 0\n", writer.String())
+
+		mu.Lock()
+		got := slices.Clone(calls)
+		mu.Unlock()
+		require.NotEmpty(t, got)
+		assert.True(t, slices.IsSorted(got))
+
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		assert.Len(t, calls, len(got), "progress reported after return")
+		mu.Unlock()
+		select {
+		case <-late:
+			t.Fatal("progress reported after return")
+		default:
+		}
+	})
+
+	t.Run("context cancel stops progress", func(t *testing.T) {
+		session, _ := newDelayedSession(100*time.Millisecond, "200 result=0 (timeout) endpos=800\n")
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var count atomic.Int32
+		digit, err := session.RecordFileWithProgress(ctx, "/tmp/dictation", opts, func(time.Duration) {
+			if count.Add(1) == 2 {
+				cancel()
+			}
+		})
+		require.NoError(t, err)
+		assert.Empty(t, digit)
+		assert.Equal(t, int32(2), count.Load())
+	})
+
+	t.Run("hangup during recording", func(t *testing.T) {
+		session, _ := newDelayedSession(30*time.Millisecond, "200 result=-1 (hangup) endpos=800\n")
+		_, err := session.RecordFileWithProgress(context.Background(), "/tmp/dictation", opts, func(time.Duration) {})
+		assert.ErrorIs(t, err, ErrHangup)
+	})
+
+	t.Run("done context sends nothing", func(t *testing.T) {
+		session, mock := newTestSession("")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := session.RecordFileWithProgress(ctx, "/tmp/dictation", opts, func(time.Duration) {
+			t.Error("unexpected progress")
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestHangupMonitor(t *testing.T) {
+	t.Run("cancels the session context", func(t *testing.T) {
+		events := NewHangupEvents()
+		session, _ := newTestSession("")
+		session.env["agi_uniqueid"] = "1700000000.1"
+
+		ctx, stop := session.MonitorHangup(context.Background(), events)
+		assert.Equal(t, 1, events.Watching())
+		events.Hangup("1700000000.2")
+		assert.NoError(t, ctx.Err())
+
+		events.Hangup("1700000000.1")
+		assert.ErrorIs(t, context.Cause(ctx), ErrHangup)
+		assert.True(t, session.HungUp())
+		assert.Equal(t, 0, events.Watching())
+		stop()
+	})
+
+	t.Run("stop releases the watch", func(t *testing.T) {
+		events := NewHangupEvents()
+		session, _ := newTestSession("")
+		session.env["agi_uniqueid"] = "1700000000.1"
+
+		ctx, stop := session.MonitorHangup(context.Background(), events)
+		stop()
+		assert.Equal(t, 0, events.Watching())
+		events.Hangup("1700000000.1")
+		assert.False(t, session.HungUp())
+		assert.NotErrorIs(t, context.Cause(ctx), ErrHangup)
+	})
+
+	t.Run("hangup mid-command", func(t *testing.T) {
+		type outcome struct {
+			err    error
+			cause  error
+			hungUp bool
+		}
+		events := NewHangupEvents()
+		results := make(chan outcome, 1)
+		handler := HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			_, err := s.WaitForVariable(ctx, "DIALSTATUS", time.Minute)
+			results <- outcome{err, context.Cause(ctx), s.HungUp()}
+			return nil
+		})
+		server := startTestServer(t, handler, WithHangupMonitor(events))
+		conn := dialTestServer(t, server, "agi_uniqueid: 1700000000.1\n")
+
+		reader := bufio.NewReader(conn)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "GET VARIABLE DIALSTATUS\n", line)
+
+		// The caller hangs up while the command is outstanding
+		events.Hangup("1700000000.1")
+		_, err = conn.Write([]byte("200 result=0\n"))
+		require.NoError(t, err)
+
+		select {
+		case got := <-results:
+			assert.ErrorIs(t, got.err, ErrHangup)
+			assert.ErrorIs(t, got.cause, ErrHangup)
+			assert.True(t, got.hungUp)
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler did not return after hangup")
+		}
+		assert.Eventually(t, func() bool { return events.Watching() == 0 }, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestCommandPolicy(t *testing.T) {
+	t.Run("exec application matching", func(t *testing.T) {
+		policy := DenyCommands("exec system", "DATABASE DELTREE", "Set Context")
+		cases := []struct {
+			command string
+			denied  bool
+		}{
+			{`EXEC System "rm -rf /"`, true},
+			{`exec SYSTEM "rm -rf /"`, true},
+			{`EXEC "system" "id"`, true},
+			{"EXEC TrySystem \"id\"", false},
+			{`EXEC Playback "hello"`, false},
+			{"DATABASE DELTREE cidname", true},
+			{"database deltree cidname", true},
+			{"DATABASE DEL cidname 100", false},
+			{"SET CONTEXT default", true},
+			{"SET EXTENSION 100", false},
+			// Asterisk skips leading whitespace and splits on runs of
+			// spaces and tabs, so none of these hide the verb
+			{` EXEC System "id"`, true},
+			{"EXEC\tSystem \"id\"", true},
+			{"EXEC  System \"id\"", true},
+			{"DATABASE  DELTREE cidname", true},
+			{"database\tdeltree cidname", true},
+			{`"DATABASE" DELTREE cidname`, true},
+			{"SET \t CONTEXT default", true},
+		}
+		for _, tc := range cases {
+			err := policy(nil, ParseCommand(tc.command))
+			assert.Equal(t, tc.denied, err != nil, tc.command)
+		}
+
+		cmd := ParseCommand(" exec\tSystem  \"id\" ")
+		assert.Equal(t, "EXEC", cmd.Verb)
+		assert.Equal(t, "SYSTEM", cmd.App)
+		assert.Equal(t, `"id"`, cmd.Args)
+		assert.Equal(t, "GET FULL VARIABLE", ParseCommand("GET  FULL\tVARIABLE ${X}").Verb)
+
+		denyAllApps := DenyCommands("EXEC")
+		assert.Error(t, denyAllApps(nil, ParseCommand(`EXEC Dial "PJSIP/100"`)))
+		assert.NoError(t, denyAllApps(nil, ParseCommand("ANSWER")))
+	})
+
+	t.Run("allow list", func(t *testing.T) {
+		policy := AllowCommands("ANSWER", "STREAM FILE", "exec playback")
+		assert.NoError(t, policy(nil, ParseCommand("ANSWER")))
+		assert.NoError(t, policy(nil, ParseCommand(`EXEC PLAYBACK "hello"`)))
+		assert.Error(t, policy(nil, ParseCommand(`EXEC Dial "PJSIP/100"`)))
+		assert.Error(t, policy(nil, ParseCommand("HANGUP")))
+	})
+
+	t.Run("denied commands are not sent", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n")
+		var audited []string
+		session.SetCommandPolicy(DenyCommands("EXEC System"))
+		session.onCommandDenied = func(_ *AgiSession, cmd PolicyCommand) { audited = append(audited, cmd.Name()) }
+
+		err := session.Execute("system", "id")
+		assert.ErrorIs(t, err, ErrCommandDenied)
+		var cmdErr *CommandError
+		require.ErrorAs(t, err, &cmdErr)
+		assert.Equal(t, "EXEC", cmdErr.Verb)
+		assert.Empty(t, mock.writer.String())
+		assert.Equal(t, []string{"EXEC SYSTEM"}, audited)
+
+		require.NoError(t, session.Execute("Playback", "hello"))
+		assert.Contains(t, mock.writer.String(), "EXEC Playback")
+	})
+
+	t.Run("server policy", func(t *testing.T) {
+		type outcome struct {
+			denied, override error
+		}
+		results := make(chan outcome, 1)
+		audits := make(chan string, 2)
+		handler := HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			var o outcome
+			o.denied = s.SetContext("admin")
+			s.SetCommandPolicy(nil)
+			o.override = s.SetContext("admin")
+			results <- o
+			return nil
+		})
+		server := startTestServer(t, handler,
+			WithCommandPolicy(DenyCommands("SET CONTEXT")),
+			WithCommandDeniedHandler(func(s *AgiSession, cmd PolicyCommand) {
+				audits <- s.GetEnv("agi_uniqueid") + " " + cmd.Name()
+			}))
+		dialTestServer(t, server, "agi_uniqueid: 1700000000.1\n")
+
+		select {
+		case got := <-results:
+			assert.ErrorIs(t, got.denied, ErrCommandDenied)
+			assert.ErrorIs(t, got.override, ErrCommandDenied)
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler did not finish")
+		}
+		assert.Equal(t, "1700000000.1 SET CONTEXT", <-audits)
+		assert.Equal(t, "1700000000.1 SET CONTEXT", <-audits)
+		assert.Equal(t, int64(2), server.Stats().CommandsDenied)
+	})
+}
+
+func TestVerbClasses(t *testing.T) {
+	for _, verb := range agiVerbs {
+		_, ok := VerbClasses[verb]
+		assert.True(t, ok, verb)
+	}
+	assert.Equal(t, VerbMedia, ClassifyVerb("stream file"))
+	assert.Equal(t, VerbMutating, ClassifyVerb("FROBNICATE"))
+
+	cmd := ParseCommand(`EXEC Dial "PJSIP/100,30"`)
+	assert.Equal(t, PolicyCommand{Verb: "EXEC", App: "DIAL", Args: `"PJSIP/100,30"`, Class: VerbMutating, Command: `EXEC Dial "PJSIP/100,30"`}, cmd)
+	assert.True(t, cmd.Matches("exec  dial"))
+	assert.True(t, cmd.Matches("EXEC"))
+	assert.Equal(t, "ACCOUNT", ParseCommand("GET VARIABLE ACCOUNT").Args)
+
+	session, mock := newTestSession("200 result=1 (1234)\n200 result=0 endpos=8000\n")
+	session.SetCommandPolicy(DenyMutatingCommands())
+	_, err := session.GetVariable("ACCOUNT")
+	require.NoError(t, err)
+	require.NoError(t, session.StreamFile("hello", ""))
+	assert.ErrorIs(t, session.Answer(), ErrCommandDenied)
+	assert.ErrorIs(t, session.Execute("Dial", "PJSIP/100"), ErrCommandDenied)
+	_, err = session.GetFullVariable("${SHELL(rm -rf /tmp/x)}")
+	assert.ErrorIs(t, err, ErrCommandDenied)
+	_, err = session.GetVariable("SHELL(id)")
+	assert.ErrorIs(t, err, ErrCommandDenied)
+	assert.NotContains(t, mock.writer.String(), "ANSWER")
+	assert.NotContains(t, mock.writer.String(), "SHELL")
+	assert.Equal(t, VerbMutating, ParseCommand(`GET FULL VARIABLE "${LEN(${SET(MESSAGE(body)=x)})}"`).Class)
+	assert.Equal(t, VerbReadOnly, ParseCommand(`GET FULL VARIABLE "${CALLERID}"`).Class)
+	for _, read := range []string{"GET VARIABLE CALLERID(num)", "GET VARIABLE CHANNEL(language)",
+		`GET FULL VARIABLE "${CHANNEL(rtcp,all)}"`, `GET FULL VARIABLE "${STAT(e,/var/lib/asterisk/sounds/en/hello.wav)}"`} {
+		assert.Equal(t, VerbReadOnly, ParseCommand(read).Class, read)
+	}
+	assert.Equal(t, VerbMutating, ParseCommand(`GET FULL VARIABLE "${LEN(${shell(id)})}"`).Class)
+}
+
+func TestMux(t *testing.T) {
+	t.Run("route names", func(t *testing.T) {
+		assert.Equal(t, "tts-menu", RouteName(map[string]string{"agi_network_script": "/tts-menu/?flags=beta"}))
+		assert.Equal(t, "billing/pay", RouteName(map[string]string{"agi_request": "agi://10.0.0.1:4573/billing/pay"}))
+		assert.Empty(t, RouteName(map[string]string{}))
+	})
+
+	t.Run("request shapes", func(t *testing.T) {
+		mux := NewMux()
+		mux.HandleFunc("/", func(ctx context.Context, s *AgiSession) error { return s.SetVariable("ROUTE", "root") })
+		mux.HandleFunc("tts-menu", func(ctx context.Context, s *AgiSession) error { return s.SetVariable("ROUTE", "tts-menu") })
+
+		tests := []struct {
+			name string
+			env  string
+			want string
+			root bool
+			path string
+		}{
+			{"fastagi path", "agi_network: yes\nagi_network_script: tts-menu\nagi_request: agi://pbx:4573/tts-menu\n", "tts-menu", false, "/tts-menu"},
+			{"fastagi root", "agi_network: yes\nagi_request: agi://pbx:4573\n", "root", true, ""},
+			{"process agi", "agi_request: /var/lib/asterisk/agi-bin/tts-menu\n", "tts-menu", false, "/var/lib/asterisk/agi-bin/tts-menu"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				session, mock := newTestSession(tt.env + "\n200 result=1\n")
+				require.NoError(t, session.readEnvironment())
+				require.NoError(t, mux.Handler().Handle(context.Background(), session))
+				assert.Equal(t, fmt.Sprintf("SET VARIABLE ROUTE %q\n", tt.want), mock.writer.String())
+				assert.Equal(t, tt.root, session.Info().RootRequest)
+
+				u, err := session.RequestURL()
+				require.NoError(t, err)
+				assert.Equal(t, tt.path, u.Path)
+			})
+		}
+	})
+
+	t.Run("no root route", func(t *testing.T) {
+		session, _ := newTestSession("agi_network: yes\nagi_request: agi://pbx:4573\n\n")
+		require.NoError(t, session.readEnvironment())
+		err := NewMux().Handler().Handle(context.Background(), session)
+		assert.ErrorIs(t, err, ErrRouteNotFound)
+		assert.ErrorContains(t, err, "no path")
+	})
+
+	t.Run("dispatch and not found", func(t *testing.T) {
+		mux := NewMux()
+		mux.HandleFunc("/billing", func(ctx context.Context, s *AgiSession) error {
+			return s.Answer()
+		})
+
+		session, mock := newTestSession("200 result=0\n")
+		session.env["agi_network_script"] = "billing"
+		require.NoError(t, mux.Handler().Handle(context.Background(), session))
+		assert.Equal(t, "ANSWER\n", mock.writer.String())
+
+		session.env["agi_network_script"] = "sales"
+		assert.ErrorIs(t, mux.Handler().Handle(context.Background(), session), ErrRouteNotFound)
+
+		mux.NotFound(HandlerFunc(func(context.Context, *AgiSession) error { return nil }))
+		assert.NoError(t, mux.Handler().Handle(context.Background(), session))
+	})
+}
+
+func TestRouteConcurrency(t *testing.T) {
+	const limit = 2
+	started := make(chan string, limit)
+	release := make(chan struct{})
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	mux := NewMux()
+	mux.HandleFunc("tts-menu", func(ctx context.Context, s *AgiSession) error {
+		started <- s.GetEnv("agi_uniqueid")
+		<-release
+		return nil
+	}, WithRouteConcurrency(limit, OnLimitBusyPrompt("all-circuits-busy")))
+	mux.HandleFunc("other", func(context.Context, *AgiSession) error { return nil })
+
+	server := startTestServer(t, mux.Handler(), WithErrorHandler(func(*AgiSession, error) {}))
+	env := func(id int) string {
+		return fmt.Sprintf("agi_network_script: tts-menu\nagi_uniqueid: %d\n", id)
+	}
+
+	for i := 1; i <= limit; i++ {
+		dialTestServer(t, server, env(i))
+	}
+	for i := 0; i < limit; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("handler did not start")
+		}
+	}
+	stats := server.Stats().Routes["tts-menu"]
+	assert.Equal(t, limit, stats.Active)
+	assert.Equal(t, limit, stats.Limit)
+
+	// Sessions over the limit hear the busy prompt and are hung up
+	const extra = 3
+	for i := 0; i < extra; i++ {
+		conn := dialTestServer(t, server, env(10+i))
+		answerCommands(t, conn,
+			`STREAM FILE all-circuits-busy ""`, "200 result=0 endpos=8000",
+			"HANGUP", "200 result=1")
+	}
+	assert.Eventually(t, func() bool {
+		return server.Stats().Routes["tts-menu"].Busy == extra
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Empty(t, started)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		stats := server.Stats().Routes["tts-menu"]
+		return stats.Active == 0 && stats.Served == limit
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, RouteStats{}, server.Stats().Routes["other"])
+}
+
+func TestRouteConcurrencyPolicies(t *testing.T) {
+	blocking := func(entered chan<- struct{}, release <-chan struct{}) Handler {
+		return HandlerFunc(func(context.Context, *AgiSession) error {
+			entered <- struct{}{}
+			<-release
+			return nil
+		})
+	}
+
+	t.Run("wait for a slot", func(t *testing.T) {
+		entered := make(chan struct{}, 2)
+		release := make(chan struct{})
+		r := &route{handler: blocking(entered, release)}
+		WithRouteConcurrency(1, OnLimitWait(time.Second))(r)
+
+		done := make(chan error, 2)
+		for range 2 {
+			go func() {
+				session, _ := newTestSession("")
+				done <- r.limit.run(context.Background(), session, "tts", r)
+			}()
+		}
+		<-entered
+		assert.Eventually(t, func() bool { return r.limit.waiting.Load() == 1 }, time.Second, time.Millisecond)
+		release <- struct{}{}
+		<-entered
+		close(release)
+		require.NoError(t, <-done)
+		require.NoError(t, <-done)
+		assert.Equal(t, int64(2), r.served.Load())
+		assert.Zero(t, r.limit.busy.Load())
+	})
+
+	t.Run("fallback and default", func(t *testing.T) {
+		entered := make(chan struct{}, 1)
+		release := make(chan struct{})
+		defer close(release)
+		var fellBack atomic.Bool
+		r := &route{handler: blocking(entered, release)}
+		WithRouteConcurrency(1, OnLimitWait(time.Millisecond), OnLimitFallback(HandlerFunc(func(context.Context, *AgiSession) error {
+			fellBack.Store(true)
+			return nil
+		})))(r)
+
+		go r.limit.run(context.Background(), &AgiSession{}, "tts", r)
+		<-entered
+
+		session, mock := newTestSession("")
+		require.NoError(t, r.limit.run(context.Background(), session, "tts", r))
+		assert.True(t, fellBack.Load())
+		assert.Empty(t, mock.writer.String())
+		assert.Equal(t, int64(1), r.limit.fallbacks.Load())
+
+		r.limit.fallback = nil
+		session, mock = newTestSession("200 result=1\n")
+		assert.ErrorIs(t, r.limit.run(context.Background(), session, "tts", r), ErrRouteBusy)
+		assert.Equal(t, "HANGUP\n", mock.writer.String())
+	})
+}
+
+func TestHotkeys(t *testing.T) {
+	// operator records that the action ran and takes over the call
+	operator := func(calls *int) HotkeyAction {
+		return func(ctx context.Context, s *AgiSession) error {
+			*calls++
+			return AbortFlow
+		}
+	}
+
+	t.Run("register validates digit", func(t *testing.T) {
+		session, _ := newTestSession("")
+		assert.Error(t, session.RegisterHotkey("12", operator(new(int))))
+		assert.Error(t, session.RegisterHotkey("A", operator(new(int))))
+		require.NoError(t, session.RegisterHotkey("0", operator(new(int))))
+		require.NoError(t, session.RegisterHotkey("0", nil))
+		assert.Empty(t, session.activeHotkeys(""))
+	})
+
+	t.Run("resume continues from endpos", func(t *testing.T) {
+		session, mock := newTestSession("200 result=57 endpos=4000\n200 result=0 endpos=8000\n200 result=0 endpos=12000\n")
+		require.NoError(t, session.RegisterHotkey("9", func(ctx context.Context, s *AgiSession) error {
+			if err := s.StreamFile("please-hold", ""); err != nil {
+				return err
+			}
+			return ResumePrompt
+		}))
+
+		digit, err := session.PlayPrompt(context.Background(), "main-menu", "12")
+		require.NoError(t, err)
+		assert.Empty(t, digit)
+		assert.Equal(t, `STREAM FILE main-menu "129"`+"\n"+
+			`STREAM FILE please-hold ""`+"\n"+
+			`STREAM FILE main-menu "129" 4000`+"\n", mock.writer.String())
+	})
+
+	t.Run("restart replays from the start", func(t *testing.T) {
+		session, mock := newTestSession("200 result=57 endpos=4000\n200 result=49 endpos=2000\n")
+		require.NoError(t, session.RegisterHotkey("9", func(context.Context, *AgiSession) error {
+			return RestartPrompt
+		}))
+
+		digit, err := session.PlayPrompt(context.Background(), "main-menu", "12")
+		require.NoError(t, err)
+		assert.Equal(t, "1", digit)
+		assert.Equal(t, strings.Repeat(`STREAM FILE main-menu "129"`+"\n", 2), mock.writer.String())
+	})
+
+	t.Run("abort ends the flow", func(t *testing.T) {
+		session, _ := newTestSession("200 result=48 endpos=1000\n")
+		calls := 0
+		require.NoError(t, session.RegisterHotkey("0", operator(&calls)))
+
+		_, err := session.PlayPrompt(context.Background(), "main-menu", "12")
+		assert.ErrorIs(t, err, AbortFlow)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("get option honours hotkeys while waiting", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0 endpos=8000\n200 result=57\n200 result=0 endpos=8000\n200 result=50\n")
+		require.NoError(t, session.RegisterHotkey("9", func(context.Context, *AgiSession) error {
+			return RestartPrompt
+		}))
+
+		digit, err := session.GetOption("main-menu", "12", 3*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "2", digit)
+		assert.Equal(t, 2, strings.Count(mock.writer.String(), `STREAM FILE main-menu "129"`))
+		assert.NotContains(t, mock.writer.String(), "GET OPTION")
+	})
+
+	t.Run("menu digits win over hotkeys", func(t *testing.T) {
+		session, mock := newTestSession("200 result=48 endpos=1000\n")
+		calls := 0
+		require.NoError(t, session.RegisterHotkey("0", operator(&calls)))
+
+		digit, err := session.GetOption("main-menu", "0123", 0)
+		require.NoError(t, err)
+		assert.Equal(t, "0", digit)
+		assert.Zero(t, calls)
+		assert.Equal(t, `GET OPTION main-menu "0123" 0`+"\n", mock.writer.String())
+	})
+
+	t.Run("without hotkeys", func(t *testing.T) {
+		session, mock := newTestSession("200 result=48 endpos=1000\n")
+		calls := 0
+		require.NoError(t, session.RegisterHotkey("0", operator(&calls)))
+
+		err := session.WithoutHotkeys(func() error {
+			_, err := session.PlayPrompt(context.Background(), "enter-account", "0123456789")
+			return err
+		})
+		require.NoError(t, err)
+		assert.Zero(t, calls)
+		assert.Equal(t, `STREAM FILE enter-account "0123456789"`+"\n", mock.writer.String())
+		assert.Equal(t, "0", session.activeHotkeys(""))
+	})
+
+	t.Run("actions do not trigger hotkeys", func(t *testing.T) {
+		session, mock := newTestSession("200 result=57 endpos=100\n200 result=0 endpos=500\n200 result=0 endpos=8000\n")
+		require.NoError(t, session.RegisterHotkey("9", func(ctx context.Context, s *AgiSession) error {
+			_, err := s.PlayPrompt(ctx, "repeating", "")
+			return err
+		}))
+
+		_, err := session.PlayPrompt(context.Background(), "main-menu", "")
+		require.NoError(t, err)
+		assert.Contains(t, mock.writer.String(), `STREAM FILE repeating ""`+"\n")
+	})
+
+	collect := []struct {
+		name   string
+		scope  HotkeyScope
+		input  string
+		digits string
+		calls  int
+	}{
+		{"off collects hotkeys", HotkeysOff, "0120#", "0120", 0},
+		{"first digit fires", HotkeysFirstDigit, "0", "", 1},
+		{"first digit only", HotkeysFirstDigit, "10#", "10", 0},
+		{"always fires", HotkeysAlways, "10", "1", 1},
+	}
+	for _, tt := range collect {
+		t.Run("collect "+tt.name, func(t *testing.T) {
+			session, _ := newTestSession(digitResponses(tt.input))
+			calls := 0
+			require.NoError(t, session.RegisterHotkey("0", operator(&calls)))
+
+			got, err := session.CollectDigitsInteractive(context.Background(), CollectOptions{Hotkeys: tt.scope})
+			if tt.calls > 0 {
+				assert.ErrorIs(t, err, AbortFlow)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.digits, got.Digits)
+			assert.Equal(t, tt.calls, calls)
+		})
+	}
+
+	t.Run("collect restart clears digits", func(t *testing.T) {
+		session, _ := newTestSession(digitResponses("12945#"))
+		require.NoError(t, session.RegisterHotkey("9", func(context.Context, *AgiSession) error {
+			return RestartPrompt
+		}))
+
+		got, err := session.CollectDigitsInteractive(context.Background(), CollectOptions{Hotkeys: HotkeysAlways})
+		require.NoError(t, err)
+		assert.Equal(t, "45", got.Digits)
+	})
+}
+
+func TestBargeIn(t *testing.T) {
+	session, mock := newTestSession(strings.Repeat("200 result=0 endpos=8000\n", 3) + strings.Repeat("200 result=0\n", 3))
+	assert.Equal(t, BargeInDisabled, session.BargeIn())
+
+	require.NoError(t, session.StreamFile("welcome", DefaultEscapeDigits))
+	session.SetBargeIn(BargeInAllDigits)
+	require.NoError(t, session.StreamFile("menu", DefaultEscapeDigits))
+	require.NoError(t, session.StreamFile("legal", ""))
+	session.SetBargeIn(BargeInPolicy("#"))
+	_, err := session.SayNumber(42, DefaultEscapeDigits)
+	require.NoError(t, err)
+	_, err = session.SayDigits("123", "5")
+	require.NoError(t, err)
+	_, err = session.SayDateTime(1700000000, DefaultEscapeDigits, "", "")
+	require.NoError(t, err)
+
+	assert.Equal(t, BargeInPolicy("#"), session.BargeIn())
+	assert.Equal(t, "STREAM FILE welcome \"\"\n"+
+		"STREAM FILE menu \"0123456789*#\"\n"+
+		"STREAM FILE legal \"\"\n"+
+		"SAY NUMBER 42 \"#\"\n"+
+		"SAY DIGITS 123 \"5\"\n"+
+		"SAY DATETIME 1700000000 \"#\" \"ABdY 'digits/at' IMp\"\n", mock.writer.String())
+}
+
+func TestSetResult(t *testing.T) {
+	t.Run("writes staged and given values sorted", func(t *testing.T) {
+		session, mock := newTestSession(strings.Repeat("200 result=1\n", 3))
+		session.StageResult("TIER", "gold")
+		session.StageResult("ROUTE", "sales")
+
+		require.NoError(t, session.SetResult(map[string]string{"LANG": "fr", "ROUTE": "support"}))
+		assert.Equal(t, `SET VARIABLE AGIRESULT_LANG "fr"`+"\n"+
+			`SET VARIABLE AGIRESULT_ROUTE "support"`+"\n"+
+			`SET VARIABLE AGIRESULT_TIER "gold"`+"\n", mock.writer.String())
+		assert.Empty(t, session.staged)
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		session, mock := newTestSession("")
+		assert.Error(t, session.SetResult(map[string]string{"ROUTE TARGET": "x"}))
+		assert.Empty(t, mock.writer.String())
+	})
+
+	t.Run("server writes staged values after the handler", func(t *testing.T) {
+		done := make(chan error, 1)
+		handler := HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			s.StageResult("ROUTE", "sales")
+			s.StageResult("LANG", "en")
+			s.StageResult("TIER", "silver")
+			return nil
+		})
+		server := startTestServer(t, handler, WithResultPrefix("IVR_"), WithErrorHandler(func(_ *AgiSession, err error) {
+			done <- err
+		}))
+		conn := dialTestServer(t, server, "agi_uniqueid: 1700000000.1\n")
+
+		answerCommands(t, conn,
+			`SET VARIABLE IVR_LANG "en"`, "200 result=1",
+			`SET VARIABLE IVR_ROUTE "sales"`, "200 result=1",
+			`SET VARIABLE IVR_TIER "silver"`, "200 result=1",
+		)
+		_, err := bufio.NewReader(conn).ReadString('\n')
+		assert.ErrorIs(t, err, io.EOF)
+		select {
+		case err := <-done:
+			t.Fatalf("unexpected error: %v", err)
+		default:
+		}
+	})
+
+	t.Run("server skips values already written", func(t *testing.T) {
+		handler := HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			s.StageResult("ROUTE", "sales")
+			return s.SetResult(nil)
+		})
+		server := startTestServer(t, handler, WithResultPrefix("IVR_"))
+		conn := dialTestServer(t, server, "agi_uniqueid: 1700000000.1\n")
+
+		answerCommands(t, conn, `SET VARIABLE IVR_ROUTE "sales"`, "200 result=1")
+		_, err := bufio.NewReader(conn).ReadString('\n')
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestWaitForChannelState(t *testing.T) {
+	want := []ChannelState{ChannelUp, ChannelBusy}
+
+	t.Run("returns first matching state", func(t *testing.T) {
+		session, mock := newTestSession("200 result=4\n200 result=5\n200 result=6\n")
+		state, err := session.WaitForChannelState(context.Background(), "PJSIP/200-00000002", want, time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, ChannelUp, state)
+		assert.Equal(t, strings.Repeat("CHANNEL STATUS PJSIP/200-00000002\n", 3), mock.writer.String())
+	})
+
+	t.Run("own channel", func(t *testing.T) {
+		session, mock := newTestSession("200 result=7\n")
+		state, err := session.WaitForChannelState(context.Background(), "", want, time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, ChannelBusy, state)
+		assert.Equal(t, "CHANNEL STATUS\n", mock.writer.String())
+	})
+
+	t.Run("channel disappears", func(t *testing.T) {
+		session, _ := newTestSession("200 result=5\n200 result=-1\n")
+		_, err := session.WaitForChannelState(context.Background(), "PJSIP/200-00000002", want, time.Millisecond)
+		assert.ErrorIs(t, err, ErrChannelGone)
+		assert.ErrorContains(t, err, "PJSIP/200-00000002")
+	})
+
+	t.Run("own channel hangs up", func(t *testing.T) {
+		session, _ := newTestSession("200 result=4\n511 Command Not Permitted on a dead channel or intercept routine\n")
+		session.env["agi_channel"] = "PJSIP/100-00000001"
+		_, err := session.WaitForChannelState(context.Background(), "", want, time.Millisecond)
+		assert.ErrorIs(t, err, ErrChannelGone)
+		assert.ErrorIs(t, err, ErrHangup)
+	})
+
+	t.Run("hangup while watching another channel", func(t *testing.T) {
+		session, _ := newTestSession("511 Command Not Permitted on a dead channel or intercept routine\n")
+		session.env["agi_channel"] = "PJSIP/100-00000001"
+		_, err := session.WaitForChannelState(context.Background(), "PJSIP/200-00000002", want, time.Millisecond)
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.NotErrorIs(t, err, ErrChannelGone)
+	})
+
+	t.Run("query error", func(t *testing.T) {
+		session, _ := newTestSession("520 Invalid command syntax.  Proper usage not available.\n")
+		_, err := session.WaitForChannelState(context.Background(), "PJSIP/200-00000002", want, time.Millisecond)
+		assert.ErrorIs(t, err, ErrInvalidResponse)
+		assert.NotErrorIs(t, err, ErrChannelGone)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		session, _ := newTestSession(strings.Repeat("200 result=5\n", 100))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		state, err := session.WaitForChannelState(ctx, "PJSIP/200-00000002", want, 5*time.Millisecond)
+		assert.ErrorIs(t, err, ErrTimeout)
+		assert.Equal(t, ChannelRinging, state)
+		assert.Equal(t, "Ringing", state.String())
+	})
+}
+
+func TestServerValidate(t *testing.T) {
+	noop := HandlerFunc(func(ctx context.Context, s *AgiSession) error { return nil })
+	emptyMux := NewMux()
+	badMux := NewMux()
+	badMux.Handle("tts", nil)
+	badMux.Handle("menu", noop, WithRouteConcurrency(0))
+
+	tests := []struct {
+		name    string
+		handler Handler
+		opts    []ServerOption
+		want    []error
+	}{
+		{"valid", noop, []ServerOption{WithWorkerPool(4), WithQueueLength(8), WithResultPrefix("IVR_")}, nil},
+		{"nil handler", nil, nil, []error{ErrNilHandler}},
+		{"nil handler func", HandlerFunc(nil), nil, []error{ErrNilHandler}},
+		{"negative workers", noop, []ServerOption{WithWorkerPool(-1)}, []error{ErrInvalidLimit}},
+		{"queue without pool", noop, []ServerOption{WithQueueLength(8)}, []error{ErrConflictingOptions}},
+		{"queue handler without pool", noop, []ServerOption{WithQueueFullHandler(func(net.Conn) {})}, []error{ErrConflictingOptions}},
+		{"negative line size", noop, []ServerOption{WithMaxLineSize(-1)}, []error{ErrInvalidLimit}},
+		{"negative data digits", noop, []ServerOption{WithMaxDataDigits(-1)}, []error{ErrInvalidLimit}},
+		{"negative env read timeout", noop, []ServerOption{WithEnvReadTimeout(-time.Second)}, []error{ErrInvalidLimit}},
+		{"negative command limit", noop, []ServerOption{WithMaxCommandsPerSession(-1)}, []error{ErrInvalidLimit}},
+		{"negative command rate", noop, []ServerOption{WithMaxCommandRate(-0.5)}, []error{ErrInvalidLimit}},
+		{"terminate without limit", noop, []ServerOption{WithTerminateOnCommandLimit(true)}, []error{ErrConflictingOptions}},
+		{"negative fault delay", noop, []ServerOption{WithFaultInjection(FaultInjection{FirstResponseDelay: -time.Second})}, []error{ErrInvalidOption}},
+		{"bad result prefix", noop, []ServerOption{WithResultPrefix("IVR-")}, []error{ErrInvalidOption}},
+		{"transcript format without writer", noop, []ServerOption{WithTranscriptFormat(TranscriptJSON)}, []error{ErrConflictingOptions}},
+		{"error policy hangs up and continues", noop, []ServerOption{WithErrorPolicy(ErrorPolicy{Hangup: true, ContinueAt: &DialplanLocation{"ivr", "s", 1}})}, []error{ErrConflictingOptions}},
+		{"call state key without store", noop, []ServerOption{WithCallStateKey(func(*AgiSession) string { return "" })}, []error{ErrConflictingOptions}},
+		{"tenant without resolver", noop, []ServerOption{WithTenant("acme", TenantConfig{})}, []error{ErrConflictingOptions}},
+		{"resolver without tenants", noop, []ServerOption{WithTenantResolver(TenantFromQuery("tenant"))}, []error{ErrNoRoutes}},
+		{"negative tenant limit", noop, []ServerOption{WithTenantResolver(TenantFromQuery("tenant")),
+			WithTenant("acme", TenantConfig{CommandRate: -1})}, []error{ErrInvalidLimit}},
+		{"empty mux", emptyMux.Handler(), nil, []error{ErrNoRoutes}},
+		{"bad mux routes", badMux.Handler(), nil, []error{ErrNilHandler, ErrInvalidLimit}},
+		{"several problems", nil, []ServerOption{WithWorkerPool(-2), WithMaxLineSize(-1), WithResultPrefix("a b")},
+			[]error{ErrNilHandler, ErrInvalidLimit, ErrInvalidOption}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := NewFastAGIServer("127.0.0.1:0", tt.handler, tt.opts...)
+			require.NoError(t, err)
+			defer server.listener.Close()
+
+			err = server.Validate()
+			if tt.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+			for _, want := range tt.want {
+				assert.ErrorIs(t, err, want)
+			}
+		})
+	}
+
+	t.Run("reports every problem", func(t *testing.T) {
+		server, err := NewFastAGIServer("127.0.0.1:0", noop, WithWorkerPool(-1), WithMaxLineSize(-1))
+		require.NoError(t, err)
+		defer server.listener.Close()
+
+		err = server.Validate()
+		assert.ErrorContains(t, err, "WithWorkerPool(-1)")
+		assert.ErrorContains(t, err, "WithMaxLineSize(-1)")
+	})
+
+	t.Run("serve refuses invalid configuration", func(t *testing.T) {
+		server, err := NewFastAGIServer("127.0.0.1:0", nil)
+		require.NoError(t, err)
+		defer server.listener.Close()
+
+		err = server.Serve()
+		assert.ErrorIs(t, err, ErrNilHandler)
+		assert.False(t, server.Healthy())
+	})
+}
+
+func TestCollectSequence(t *testing.T) {
+	codes := FeatureCodes("*9", "*98", "*72", "#")
+	opts := SequenceOptions{InterDigit: 1500 * time.Millisecond, Match: codes}
+
+	t.Run("feature code matcher", func(t *testing.T) {
+		assert.Equal(t, PartialMatch, codes("*"))
+		assert.Equal(t, AmbiguousMatch, codes("*9"))
+		assert.Equal(t, ExactMatch, codes("*98"))
+		assert.Equal(t, ExactMatch, codes("#"))
+		assert.Equal(t, NoMatch, codes("*5"))
+		assert.Equal(t, NoMatch, codes(""))
+	})
+
+	t.Run("match required", func(t *testing.T) {
+		session, mock := newTestSession(digitResponses("*72"))
+		_, err := session.CollectSequence(context.Background(), SequenceOptions{})
+		require.Error(t, err)
+		assert.Empty(t, mock.writer.String())
+	})
+
+	t.Run("exact match returns at once", func(t *testing.T) {
+		session, mock := newTestSession(digitResponses("*72"))
+		result, err := session.CollectSequence(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, SequenceResult{Digits: "*72", State: ExactMatch}, result)
+		assert.Equal(t, strings.Repeat("WAIT FOR DIGIT 1500\n", 3), mock.writer.String())
+	})
+
+	t.Run("ambiguous prefix followed by longer code", func(t *testing.T) {
+		session, mock := newTestSession(digitResponses("*98"))
+		result, err := session.CollectSequence(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, SequenceResult{Digits: "*98", State: ExactMatch}, result)
+		assert.Equal(t, 3, strings.Count(mock.writer.String(), "WAIT FOR DIGIT"))
+	})
+
+	t.Run("ambiguous prefix settles after inter-digit timeout", func(t *testing.T) {
+		session, mock := newTestSession(digitResponses("*9") + "200 result=0\n")
+		result, err := session.CollectSequence(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, SequenceResult{Digits: "*9", State: ExactMatch}, result)
+		assert.Equal(t, strings.Repeat("WAIT FOR DIGIT 1500\n", 3), mock.writer.String())
+	})
+
+	t.Run("ambiguous prefix then unknown digit", func(t *testing.T) {
+		session, _ := newTestSession(digitResponses("*97"))
+		result, err := session.CollectSequence(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, SequenceResult{Digits: "*97", State: NoMatch}, result)
+	})
+
+	t.Run("no match ends early", func(t *testing.T) {
+		session, mock := newTestSession(digitResponses("*5"))
+		result, err := session.CollectSequence(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, SequenceResult{Digits: "*5", State: NoMatch}, result)
+		assert.Equal(t, 2, strings.Count(mock.writer.String(), "WAIT FOR DIGIT"))
+	})
+
+	t.Run("partial times out", func(t *testing.T) {
+		session, _ := newTestSession(digitResponses("*") + "200 result=0\n")
+		result, err := session.CollectSequence(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, SequenceResult{Digits: "*", State: NoMatch}, result)
+	})
+
+	t.Run("max digits", func(t *testing.T) {
+		session, _ := newTestSession(digitResponses("*9"))
+		result, err := session.CollectSequence(context.Background(), SequenceOptions{Max: 2, Match: codes})
+		require.NoError(t, err)
+		assert.Equal(t, SequenceResult{Digits: "*9", State: ExactMatch}, result)
+	})
+
+	t.Run("hangup", func(t *testing.T) {
+		session, _ := newTestSession(digitResponses("*") + "200 result=-1\n")
+		result, err := session.CollectSequence(context.Background(), opts)
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.Equal(t, "*", result.Digits)
+	})
+}
+
+func TestShutdownInterruptsBlockedCommand(t *testing.T) {
+	errs := make(chan error, 1)
+	handler := HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+		_, err := s.GetVariable("NEVER_ANSWERED")
+		return err
+	})
+	server, err := NewFastAGIServer("127.0.0.1:0", handler, WithErrorHandler(func(_ *AgiSession, err error) {
+		errs <- err
+	}))
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	conn := dialTestServer(t, server, "agi_uniqueid: 1700000000.1\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "GET VARIABLE NEVER_ANSWERED\n", line)
+
+	// The fake Asterisk never replies, so only the drain deadline ends the handler
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.NotErrorIs(t, err, ErrTimeout)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still blocked after Shutdown")
+	}
+	require.NoError(t, <-served)
+	server.wg.Wait()
+}
+
+func TestEnvReadTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	report := WithErrorHandler(func(_ *AgiSession, err error) { errs <- err })
+
+	t.Run("timeout", func(t *testing.T) {
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			t.Error("handler ran without an environment")
+			return nil
+		}), WithEnvReadTimeout(20*time.Millisecond), report)
+
+		// The environment never ends with a blank line
+		dialTestServer(t, server, "agi_uniqueid: 1700000000.1")
+		select {
+		case err := <-errs:
+			assert.Contains(t, err.Error(), "failed to read environment")
+		case <-time.After(5 * time.Second):
+			t.Fatal("environment read did not time out")
+		}
+	})
+
+	t.Run("shutdown deadline ends the read", func(t *testing.T) {
+		server, err := NewFastAGIServer("127.0.0.1:0", HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			return nil
+		}), WithEnvReadTimeout(time.Minute), report)
+		require.NoError(t, err)
+		served := make(chan error, 1)
+		go func() { served <- server.Serve() }()
+
+		dialTestServer(t, server, "agi_uniqueid: 1700000000.1")
+		require.Eventually(t, func() bool { return server.Stats().Accepted == 1 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(5 * time.Second):
+			t.Fatal("environment read outlived the Shutdown deadline")
+		}
+		require.NoError(t, <-served)
+		server.wg.Wait()
+	})
+}
+
+func TestAnnotations(t *testing.T) {
+	// Responses res_agi sends with each annotation
+	tests := []struct {
+		line string
+		want Annotation
+	}{
+		{"200 result= (timeout)", AnnotationTimeout},
+		{"200 result=0 (timeout) endpos=16000", AnnotationTimeout},
+		{"200 result=35 (dtmf) endpos=8000", AnnotationDTMF},
+		{"200 result=-1 (hangup) endpos=4000", AnnotationHangup},
+		{"200 result=-1 (randomerror) endpos=4000", AnnotationRandomError},
+		{"200 result=-1 (writefile)", AnnotationWriteFile},
+		{"200 result=-1 (waitfor) endpos=0", AnnotationWaitFor},
+		{"200 result=1 (speech) endpos=3200 results=1 95 hello world", AnnotationSpeech},
+		{"200 result=1 (digit) digit=5 endpos=1600", AnnotationDigit},
+		{"200 result=0 endpos=8000", AnnotationNone},
+		{"200 result=1 (SUCCESS)", AnnotationNone},
+		{"200 result=1", AnnotationNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			resp, err := parseResponse(tt.line)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, resp.Annotation)
+			assert.Equal(t, tt.want == AnnotationTimeout, resp.Timeout)
+		})
+	}
+
+	assert.Equal(t, AnnotationNone, ParseAnnotation("(timeout"))
+	assert.Equal(t, AnnotationNone, ParseAnnotation("timeout"))
+	assert.Equal(t, AnnotationHangup, ParseAnnotation(" (hangup) endpos=0"))
+
+	t.Run("raw command", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0 (timeout) endpos=48000\n")
+		resp, err := session.Command(`RECORD FILE /tmp/msg wav "#" 5000`)
+		require.NoError(t, err)
+		assert.Equal(t, AnnotationTimeout, resp.Annotation)
+		assert.True(t, resp.Timeout)
+		assert.Equal(t, 48000, resp.EndPos)
+		assert.Equal(t, "RECORD FILE /tmp/msg wav \"#\" 5000\n", mock.writer.String())
+	})
+
+	t.Run("value looking like a timeout", func(t *testing.T) {
+		session, _ := newTestSession("200 result=1 (timeout)\n")
+		resp, err := session.Command("GET VARIABLE LAST_STATUS")
+		require.NoError(t, err)
+		assert.Equal(t, "(timeout)", resp.Data)
+		assert.False(t, resp.Timeout)
+	})
+}
+
+func TestSessionCompleted(t *testing.T) {
+	// startRecordingServer returns a server whose completed sessions are
+	// sent to the returned channel
+	startRecordingServer := func(t *testing.T, handler Handler, opts ...ServerOption) (*FastAGIServer, chan SessionInfo) {
+		infos := make(chan SessionInfo, 4)
+		server := startTestServer(t, handler, append([]ServerOption{
+			WithErrorHandler(func(*AgiSession, error) {}),
+			WithSessionCompleted(func(info SessionInfo) { infos <- info }),
+		}, opts...)...)
+		return server, infos
+	}
+	// once returns the only completion, failing if a second one arrives
+	once := func(t *testing.T, infos chan SessionInfo) SessionInfo {
+		t.Helper()
+		var info SessionInfo
+		select {
+		case info = <-infos:
+		case <-time.After(2 * time.Second):
+			t.Fatal("session completed callback not called")
+		}
+		select {
+		case <-infos:
+			t.Fatal("session completed callback called twice")
+		case <-time.After(20 * time.Millisecond):
+		}
+		return info
+	}
+	env := "agi_network_script: billing\nagi_uniqueid: 1700000000.7\nagi_callerid: 5551234\n"
+
+	t.Run("handler returns", func(t *testing.T) {
+		server, infos := startRecordingServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			if err := s.Answer(); err != nil {
+				return err
+			}
+			return errors.New("no route")
+		}),
+			WithFeatureFlags(nil),
+			WithEnvTransformer(func(env map[string]string) map[string]string {
+				env["agi_callerid"] = "+1" + env["agi_callerid"]
+				return env
+			}))
+		env := strings.Replace(env, "billing", "billing?flags=new_menu", 1)
+		conn := dialTestServer(t, server, env)
+		answerCommands(t, conn, "ANSWER", "200 result=0")
+
+		info := once(t, infos)
+		assert.Equal(t, "billing?flags=new_menu", info.Script)
+		assert.Equal(t, "1700000000.7", info.UniqueID)
+		assert.Equal(t, "+15551234", info.CallerID)
+		assert.Equal(t, conn.LocalAddr().String(), info.RemoteAddr.String())
+		assert.Equal(t, conn.RemoteAddr().String(), info.LocalAddr.String())
+		assert.Equal(t, map[string]bool{"new_menu": true}, info.Flags)
+		assert.True(t, info.EnvTransformed)
+		require.Len(t, info.RecentExchanges, 1)
+		assert.Equal(t, "ANSWER", info.RecentExchanges[0].Command)
+		assert.ErrorContains(t, info.Err, "no route")
+		assert.Equal(t, 1, info.Commands)
+		assert.Equal(t, int64(len(env)+1+len("200 result=0\n")), info.BytesRead)
+		assert.Equal(t, int64(len("ANSWER\n")), info.BytesWritten)
+		assert.False(t, info.Start.IsZero())
+		assert.False(t, info.End.Before(info.Start))
+	})
+
+	t.Run("handler panics", func(t *testing.T) {
+		server, infos := startRecordingServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			panic("nil map")
+		}))
+		dialTestServer(t, server, env)
+
+		info := once(t, infos)
+		assert.ErrorIs(t, info.Err, ErrHandlerPanic)
+		assert.Equal(t, "handler_panic", info.ErrCode)
+		assert.ErrorContains(t, info.Err, "nil map")
+		assert.Equal(t, "1700000000.7", info.UniqueID)
+
+		// The server keeps serving after the panic
+		dialTestServer(t, server, env)
+		once(t, infos)
+	})
+
+	t.Run("environment read fails", func(t *testing.T) {
+		server, infos := startRecordingServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			t.Error("handler called without an environment")
+			return nil
+		}))
+		conn := dialTestServer(t, server, "agi_uniqueid: 1700000000.9\nnot an env line")
+		conn.(*net.TCPConn).CloseWrite()
+
+		info := once(t, infos)
+		assert.ErrorIs(t, info.Err, ErrInvalidEnvironment)
+		assert.Equal(t, "1700000000.9", info.UniqueID)
+		assert.Zero(t, info.Commands)
+		assert.Positive(t, info.BytesRead)
+	})
+
+	t.Run("probe", func(t *testing.T) {
+		server, infos := startRecordingServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error { return nil }))
+		conn, err := net.Dial("tcp", server.listener.Addr().String())
+		require.NoError(t, err)
+		conn.Close()
+
+		assert.Eventually(t, func() bool { return server.Stats().Probes == 1 }, time.Second, time.Millisecond)
+		select {
+		case <-infos:
+			t.Fatal("probe reported as a session")
+		case <-time.After(20 * time.Millisecond):
+		}
+	})
+}
+
+func TestListenAddress(t *testing.T) {
+	noop := HandlerFunc(func(ctx context.Context, s *AgiSession) error { return nil })
+
+	t.Run("IPv6 literal", func(t *testing.T) {
+		server, err := NewFastAGIServer("[::1]:0", noop)
+		require.NoError(t, err)
+		defer server.listener.Close()
+		addr := server.Addr().(*net.TCPAddr)
+		assert.True(t, addr.IP.Equal(net.IPv6loopback))
+	})
+
+	invalid := []struct {
+		name    string
+		address string
+		network string
+		hint    string
+	}{
+		{"IPv6 without brackets", "::1:4573", "tcp", "need brackets"},
+		{"missing port", "localhost", "tcp", "missing port"},
+		{"port out of range", "127.0.0.1:70000", "tcp", "out of range"},
+		{"unknown service", "127.0.0.1:nosuchservice", "tcp", "unknown port"},
+		{"IPv6 on tcp4", "[::1]:0", "tcp4", "IPv6 address on network tcp4"},
+		{"IPv4 on tcp6", "127.0.0.1:0", "tcp6", "IPv4 address on network tcp6"},
+		{"unsupported network", "127.0.0.1:0", "udp", "unsupported network"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFastAGIServer(tt.address, noop, WithNetwork(tt.network))
+			assert.ErrorIs(t, err, ErrInvalidAddress)
+			assert.ErrorContains(t, err, tt.hint)
+		})
+	}
+
+	t.Run("port in use", func(t *testing.T) {
+		first, err := NewFastAGIServer("127.0.0.1:0", noop)
+		require.NoError(t, err)
+		defer first.listener.Close()
+
+		_, err = NewFastAGIServer(first.Addr().String(), noop)
+		assert.ErrorIs(t, err, syscall.EADDRINUSE)
+		assert.ErrorContains(t, err, "already listening on "+first.Addr().String())
+	})
+}
+
+func TestLoopbackServer(t *testing.T) {
+	handled := make(chan string, 2)
+	handler := HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+		handled <- s.GetEnv("agi_uniqueid")
+		return nil
+	})
+
+	t.Run("binds both loopback addresses", func(t *testing.T) {
+		server, err := NewLoopbackServer(0, handler)
+		require.NoError(t, err)
+		served := make(chan error, 1)
+		go func() { served <- server.Serve() }()
+		defer func() {
+			require.NoError(t, server.Stop())
+			require.NoError(t, <-served)
+		}()
+
+		addrs := server.Addrs()
+		require.Len(t, addrs, 2)
+		v4, v6 := addrs[0].(*net.TCPAddr), addrs[1].(*net.TCPAddr)
+		assert.True(t, v4.IP.Equal(net.IPv4(127, 0, 0, 1)))
+		assert.True(t, v6.IP.Equal(net.IPv6loopback))
+		assert.Equal(t, v4.Port, v6.Port)
+
+		for i, addr := range addrs {
+			conn, err := net.Dial("tcp", addr.String())
+			require.NoError(t, err)
+			defer conn.Close()
+			fmt.Fprintf(conn, "agi_uniqueid: %d\n\n", i)
+			select {
+			case id := <-handled:
+				assert.Equal(t, strconv.Itoa(i), id)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("no session on %s", addr)
+			}
+		}
+	})
+
+	t.Run("single family", func(t *testing.T) {
+		server, err := NewLoopbackServer(0, handler, WithNetwork("tcp6"))
+		require.NoError(t, err)
+		defer server.listener.Close()
+		require.Len(t, server.Addrs(), 1)
+		assert.True(t, server.Addr().(*net.TCPAddr).IP.Equal(net.IPv6loopback))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := NewLoopbackServer(70000, handler)
+		assert.ErrorIs(t, err, ErrInvalidAddress)
+		_, err = NewLoopbackServer(0, handler, WithNetwork("unix"))
+		assert.ErrorIs(t, err, ErrInvalidAddress)
+	})
+}
+
+func TestCommandDeadline(t *testing.T) {
+	session := 30 * time.Second
+	tests := []struct {
+		name    string
+		command string
+		want    time.Duration
+	}{
+		{"plain command", "STREAM FILE welcome \"\"", session},
+		{"five minute recording", "RECORD FILE msg wav \"#\" 300000 0 BEEP", 5*time.Minute + DeadlineGrace},
+		{"short recording", "RECORD FILE msg wav \"\" 5000 0", session},
+		{"unlimited recording", "RECORD FILE msg wav \"\" -1 0", 0},
+		{"wait for digit", "WAIT FOR DIGIT 60000", time.Minute + DeadlineGrace},
+		{"wait forever", "WAIT FOR DIGIT -1", 0},
+		{"get data", "GET DATA pin 10000 4", session + 40*time.Second},
+		{"get option", "GET OPTION menu \"123\" 20000", session + 20*time.Second},
+		{"exec wait", "EXEC Wait 120", 2*time.Minute + DeadlineGrace},
+		{"exec dial", "EXEC Dial \"PJSIP/100,60\"", 0},
+		{"malformed", "RECORD FILE msg wav", session},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CommandDeadline(tt.command, session))
+		})
+	}
+
+	assert.Zero(t, CommandDeadline("NOOP", 0))
+	assert.Equal(t, []string{"STREAM", "FILE", "welcome", ""}, SplitCommand("STREAM FILE welcome \"\""))
+}
+
+func TestCommandWithDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	session := acquireSession(context.Background(), server)
+	go io.Copy(io.Discard, client)
+
+	start := time.Now()
+	_, err := session.CommandWithDeadline("NOOP", 50*time.Millisecond)
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), session.timeout)
+	assert.False(t, session.hasDeadline)
+}
+
+func TestIOErrorClassification(t *testing.T) {
+	// tcpPair returns both ends of a loopback TCP connection
+	tcpPair := func(t *testing.T) (local, peer net.Conn) {
+		t.Helper()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := ln.Accept()
+			accepted <- conn
+		}()
+		local, err = net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		peer = <-accepted
+		require.NotNil(t, peer)
+		t.Cleanup(func() {
+			local.Close()
+			peer.Close()
+		})
+		return local, peer
+	}
+
+	t.Run("broken pipe", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		defer w.Close()
+		r.Close()
+		session, _ := newTestSession("")
+		session.writer = w
+
+		err = session.Noop()
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.ErrorIs(t, err, syscall.EPIPE)
+		assert.Equal(t, "hangup", ErrorCode(err))
+		assert.True(t, session.HungUp())
+	})
+
+	t.Run("connection reset", func(t *testing.T) {
+		local, peer := tcpPair(t)
+		go io.Copy(io.Discard, peer)
+		require.NoError(t, peer.(*net.TCPConn).SetLinger(0))
+		session := acquireSession(context.Background(), local)
+		peer.Close()
+
+		var err error
+		require.Eventually(t, func() bool {
+			err = session.Noop()
+			return err != nil
+		}, time.Second, time.Millisecond)
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.ErrorIs(t, err, syscall.ECONNRESET)
+	})
+
+	t.Run("use of closed connection", func(t *testing.T) {
+		local, _ := tcpPair(t)
+		session := acquireSession(context.Background(), local)
+		local.Close()
+
+		err := session.Noop()
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("closed pipe", func(t *testing.T) {
+		client, server := net.Pipe()
+		client.Close()
+		session := acquireSession(context.Background(), server)
+
+		err := session.Noop()
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	})
+
+	t.Run("closed locally", func(t *testing.T) {
+		local, _ := tcpPair(t)
+		session := acquireSession(context.Background(), local)
+		session.Close()
+		local.Close()
+
+		err := session.Noop()
+		assert.ErrorIs(t, err, ErrSessionClosed)
+		assert.NotErrorIs(t, err, ErrHangup)
+		assert.Equal(t, "session_closed", ErrorCode(err))
+		assert.False(t, session.HungUp())
+	})
+
+	t.Run("write deadline", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		session := acquireSession(context.Background(), server)
+		server.SetWriteDeadline(time.Now().Add(-time.Second))
+
+		err := session.Noop()
+		assert.ErrorIs(t, err, ErrTimeout)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("read deadline", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go io.Copy(io.Discard, client)
+		session := acquireSession(context.Background(), server)
+
+		_, err := session.CommandWithDeadline("NOOP", 20*time.Millisecond)
+		assert.ErrorIs(t, err, ErrTimeout)
+		assert.Equal(t, "timeout", ErrorCode(err))
+	})
+
+	t.Run("other errors", func(t *testing.T) {
+		failure := &os.PathError{Op: "write", Path: "agi", Err: syscall.EIO}
+		session, _ := newTestSession("")
+		session.writer = failingWriter{failure}
+
+		err := session.Noop()
+		var cmdErr *CommandError
+		require.ErrorAs(t, err, &cmdErr)
+		assert.Same(t, failure, errors.Unwrap(cmdErr.Err))
+		assert.ErrorIs(t, err, syscall.EIO)
+		assert.NotErrorIs(t, err, ErrHangup)
+		assert.False(t, session.HungUp())
+	})
+}
+
+// failingWriter fails every write with err
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+func TestRun(t *testing.T) {
+	const env = "agi_request: /usr/local/bin/menu\nagi_uniqueid: 1700000000.1\n\n"
+	// run runs h as a process script reading responses, returning the exit
+	// status, the commands sent and what was written to stderr
+	run := func(h Handler, responses string, hangups <-chan os.Signal, opts ...RunOption) (int, []string, string) {
+		cfg := runConfig{verboseLevel: DefaultRunVerboseLevel}
+		for _, opt := range opts {
+			opt(&cfg)
+		}
+		var stderr bytes.Buffer
+		cfg.stderr = &stderr
+		mock := newMockIO(env + responses)
+		code := runProcess(context.Background(), h, cfg, mock.reader, mock.writer, hangups)
+		var sent []string
+		if out := strings.TrimSuffix(mock.writer.String(), "\n"); out != "" {
+			sent = strings.Split(out, "\n")
+		}
+		return code, sent, stderr.String()
+	}
+
+	t.Run("success", func(t *testing.T) {
+		code, sent, stderr := run(HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			return s.Answer()
+		}), "200 result=0\n", nil)
+		assert.Zero(t, code)
+		assert.Equal(t, []string{"ANSWER"}, sent)
+		assert.Empty(t, stderr)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		code, sent, stderr := run(HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			s.Defer(DeferredFunc(func(s *AgiSession) error { return s.SetVariable("DONE", "1") }))
+			return errors.New(`lookup "acct" failed`)
+		}), "200 result=1\n200 result=1\n200 result=0 endpos=8000\n200 result=1\n", nil,
+			WithRunErrorPolicy(ErrorPolicy{Prompt: "technical-difficulties", Hangup: true}), WithRunVerboseLevel(3))
+		assert.Equal(t, 1, code)
+		assert.Equal(t, []string{
+			`VERBOSE "handler error: lookup \"acct\" failed" 3`,
+			`SET VARIABLE DONE "1"`,
+			`STREAM FILE technical-difficulties ""`,
+			"HANGUP",
+		}, sent)
+		assert.Contains(t, stderr, `/usr/local/bin/menu: handler error: lookup "acct" failed`)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		code, sent, stderr := run(HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			panic("nil map")
+		}), "200 result=1\n", nil, WithRunVerboseLevel(-1))
+		assert.Equal(t, 1, code)
+		assert.Empty(t, sent)
+		assert.Contains(t, stderr, ErrHandlerPanic.Error())
+	})
+
+	t.Run("hangup is not a failure", func(t *testing.T) {
+		code, sent, stderr := run(HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			_, err := s.GetData("enter-account", 5000, 4)
+			return err
+		}), "200 result=-1\n", nil, WithRunErrorPolicy(ErrorPolicy{Hangup: true}))
+		assert.Zero(t, code)
+		assert.Equal(t, []string{"GET DATA enter-account 5000 4"}, sent)
+		assert.Empty(t, stderr)
+	})
+
+	t.Run("sighup", func(t *testing.T) {
+		hangups := make(chan os.Signal, 1)
+		hangups <- syscall.SIGHUP
+		var cause error
+		code, sent, _ := run(HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			<-ctx.Done()
+			cause = context.Cause(ctx)
+			return ctx.Err()
+		}), "", hangups, WithRunErrorPolicy(ErrorPolicy{Hangup: true}))
+		assert.Zero(t, code)
+		assert.ErrorIs(t, cause, ErrHangup)
+		assert.Empty(t, sent)
+	})
+
+	t.Run("no environment", func(t *testing.T) {
+		var stderr bytes.Buffer
+		code := runProcess(context.Background(), HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			t.Error("handler called")
+			return nil
+		}), runConfig{stderr: &stderr}, strings.NewReader("agi_request: menu\n"), io.Discard, nil)
+		assert.Equal(t, 1, code)
+		assert.Contains(t, stderr.String(), "failed to read AGI environment")
+	})
+}
+
+func TestSessionContext(t *testing.T) {
+	t.Run("close", func(t *testing.T) {
+		closed := make(chan error, 1)
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			assert.Equal(t, ctx, s.Context())
+			require.NoError(t, s.Close())
+			<-ctx.Done()
+			closed <- s.Context().Err()
+			return nil
+		}))
+		dialTestServer(t, server, "agi_uniqueid: 1\n")
+
+		select {
+		case err := <-closed:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Close did not cancel the handler context")
+		}
+	})
+
+	t.Run("server cancelled", func(t *testing.T) {
+		started := make(chan struct{})
+		cancelled := make(chan error, 1)
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			close(started)
+			<-s.Context().Done()
+			cancelled <- ctx.Err()
+			return nil
+		}))
+		dialTestServer(t, server, "agi_uniqueid: 1\n")
+
+		<-started
+		server.cancelFunc()
+		select {
+		case err := <-cancelled:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(2 * time.Second):
+			t.Fatal("server context did not cancel the session")
+		}
+	})
+
+	t.Run("standalone", func(t *testing.T) {
+		session := &AgiSession{}
+		assert.NoError(t, session.Close())
+		assert.NoError(t, session.Context().Err())
+	})
+}
+
+func TestPlayback(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		opts  PlaybackOptions
+		want  string
+	}{
+		{"single file", []string{"welcome"}, PlaybackOptions{}, `EXEC Playback "welcome"`},
+		{"multiple files", []string{"welcome", "custom/menu", "goodbye"}, PlaybackOptions{}, `EXEC Playback "welcome&custom/menu&goodbye"`},
+		{"skip", []string{"welcome"}, PlaybackOptions{Skip: true}, `EXEC Playback "welcome,skip"`},
+		{"noanswer", []string{"early"}, PlaybackOptions{NoAnswer: true}, `EXEC Playback "early,noanswer"`},
+		{"say", []string{"hello world"}, PlaybackOptions{SayMode: true}, `EXEC Playback "hello world,say"`},
+		{"all options", []string{"a", "b"}, PlaybackOptions{Skip: true, NoAnswer: true, SayMode: true}, `EXEC Playback "a&b,skip,noanswer,say"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, mock := newTestSession("200 result=0\n200 result=1 (SUCCESS)\n")
+			require.NoError(t, session.Playback(tt.files, tt.opts))
+			assert.Equal(t, tt.want+"\nGET VARIABLE PLAYBACKSTATUS\n", mock.writer.String())
+		})
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n200 result=1 (FAILED)\n")
+		err := session.Playback([]string{"missing"}, PlaybackOptions{NoAnswer: true})
+		assert.ErrorIs(t, err, ErrPlaybackFailed)
+	})
+
+	t.Run("no files", func(t *testing.T) {
+		session, mock := newTestSession("")
+		assert.ErrorIs(t, session.Playback(nil, PlaybackOptions{}), ErrNoPrompts)
+		assert.Empty(t, mock.writer.String())
+	})
+}
+
+func TestErrorCodes(t *testing.T) {
+	// Codes are matched by alerting rules; changing one is a breaking change
+	want := map[error]string{
+		ErrInvalidResponse:        "invalid_response",
+		ErrInvalidEnvironment:     "invalid_environment",
+		ErrLineTooLong:            "line_too_long",
+		ErrHangup:                 "hangup",
+		ErrSessionClosed:          "session_closed",
+		ErrCommandFailed:          "command_failed",
+		ErrNoPrompts:              "no_prompts",
+		ErrNoCallState:            "no_call_state",
+		ErrInvalidPattern:         "invalid_pattern",
+		ErrPatternMismatch:        "pattern_mismatch",
+		ErrDialplanNotFound:       "dialplan_not_found",
+		ErrTimeout:                "timeout",
+		ErrPromptNotFound:         "prompt_not_found",
+		ErrNoOptions:              "no_options",
+		ErrChannelGone:            "channel_gone",
+		ErrNoStats:                "no_stats",
+		ErrUnsupportedChannelTech: "unsupported_channel_tech",
+		ErrCommandDenied:          "command_denied",
+		ErrRouteNotFound:          "route_not_found",
+		ErrRouteBusy:              "route_busy",
+		ErrUnknownTenant:          "unknown_tenant",
+		ErrNilHandler:             "nil_handler",
+		ErrInvalidLimit:           "invalid_limit",
+		ErrInvalidOption:          "invalid_option",
+		ErrConflictingOptions:     "conflicting_options",
+		ErrNoRoutes:               "no_routes",
+		ErrHandlerPanic:           "handler_panic",
+		ErrInvalidAddress:         "invalid_address",
+		ErrRecordFailed:           "record_failed",
+		ErrAppNotFound:            "app_not_found",
+		ErrAppFailed:              "app_failed",
+		ErrPlaybackFailed:         "playback_failed",
+		ErrRenameFailed:           "rename_failed",
+		ErrCommandLimitExceeded:   "command_limit_exceeded",
+		ErrInvalidFlowState:       "invalid_flow_state",
+		ErrMalformedCommand:       "malformed_command",
+		ErrAlreadyCompleted:       "already_completed",
+		ErrAlreadyAwaited:         "already_awaited",
+		ErrNoAudio:                "no_audio",
+		ErrNextHandler:            "next_handler",
+		ResumePrompt:              "resume_prompt",
+		RestartPrompt:             "restart_prompt",
+		AbortFlow:                 "abort_flow",
+	}
+	seen := make(map[string]bool)
+	for err, code := range want {
+		coder, ok := err.(Coder)
+		require.True(t, ok, "%v does not implement Coder", err)
+		assert.Equal(t, code, coder.Code(), "code of %v", err)
+		assert.False(t, seen[code], "code %s used twice", code)
+		seen[code] = true
+	}
+
+	t.Run("wrapped", func(t *testing.T) {
+		tests := []struct {
+			err  error
+			want string
+		}{
+			{nil, ""},
+			{fmt.Errorf("failed to read response: %w: %w", ErrTimeout, errors.New("i/o timeout")), "timeout"},
+			{&CommandError{Verb: "EXEC", Err: ErrCommandDenied}, "command_denied"},
+			{&CommandError{Verb: "EXEC", Err: errors.New("boom"), ErrCode: "hangup"}, "hangup"},
+			{&RecordError{PartialFile: "msg.part", Err: ErrHangup}, "hangup"},
+			{&RecordError{PartialFile: "msg.part", Err: errors.New("boom")}, "record_failed"},
+			{newReadError([]byte("20"), io.EOF), "disconnected"},
+			{newReadError(nil, errors.New("boom")), "read_failed"},
+			{fmt.Errorf("handler: %w", context.Canceled), "canceled"},
+			{context.DeadlineExceeded, "deadline_exceeded"},
+			{errors.New("boom"), CodeUnknown},
+		}
+		for _, tt := range tests {
+			assert.Equal(t, tt.want, ErrorCode(tt.err), "%v", tt.err)
+		}
+	})
+
+	t.Run("command error field", func(t *testing.T) {
+		session, _ := newTestSession("")
+		session.SetCommandPolicy(DenyCommands("EXEC"))
+		err := session.Execute("Dial", "PJSIP/100")
+		var cmdErr *CommandError
+		require.ErrorAs(t, err, &cmdErr)
+		assert.Equal(t, "command_denied", cmdErr.ErrCode)
+	})
+}
+
+func TestExecuteResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     error
+	}{
+		{"success", "200 result=0\n", nil},
+		{"application status", "200 result=3\n", nil},
+		{"not found", "200 result=-2\n", ErrAppNotFound},
+		// Asterisk 13 and later log the missing application but send the
+		// same line; tolerate trailing data should a build annotate it
+		{"not found annotated", "200 result=-2 (Application not found)\n", ErrAppNotFound},
+		{"failed", "200 result=-1\n", ErrAppFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, _ := newTestSession(tt.response)
+			err := session.Execute("Dial", "PJSIP/100,30")
+			if tt.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.want)
+			assert.ErrorContains(t, err, "Dial")
+		})
+	}
+
+	t.Run("hangup", func(t *testing.T) {
+		session, _ := newTestSession("511 Command Not Permitted on a dead channel or intercept routine\n")
+		assert.ErrorIs(t, session.Execute("Dial", "PJSIP/100"), ErrHangup)
+	})
+}
+
+func TestOnClose(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		session, _ := newTestSession("")
+		var order []int
+		for i := range 3 {
+			session.OnClose(func(err error) {
+				assert.NoError(t, err)
+				order = append(order, i)
+			})
+		}
+		require.NoError(t, session.Close())
+		require.NoError(t, session.Close())
+		assert.Equal(t, []int{2, 1, 0}, order)
+
+		late := false
+		session.OnClose(func(error) { late = true })
+		assert.True(t, late)
+	})
+
+	t.Run("handler panics", func(t *testing.T) {
+		type closed struct {
+			name string
+			err  error
+		}
+		results := make(chan closed, 2)
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			s.OnClose(func(err error) { results <- closed{"recording", err} })
+			s.OnClose(func(err error) { results <- closed{"lock", err} })
+			panic("nil map")
+		}), WithErrorHandler(func(*AgiSession, error) {}))
+		dialTestServer(t, server, "agi_uniqueid: 1\n")
+
+		for _, want := range []string{"lock", "recording"} {
+			select {
+			case got := <-results:
+				assert.Equal(t, want, got.name)
+				assert.ErrorIs(t, got.err, ErrHandlerPanic)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s cleanup did not run", want)
+			}
+		}
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		errs := make(chan error, 2)
+		server := startTestServer(t, HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+			s.OnClose(func(err error) { errs <- err })
+			return ErrRouteNotFound
+		}), WithErrorHandler(func(*AgiSession, error) {}))
+		dialTestServer(t, server, "agi_uniqueid: 1\n")
+
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, ErrRouteNotFound)
+		case <-time.After(2 * time.Second):
+			t.Fatal("cleanup did not run")
+		}
+		select {
+		case <-errs:
+			t.Fatal("cleanup ran twice")
+		case <-time.After(20 * time.Millisecond):
+		}
+	})
+}
+
+func TestCommandOrder(t *testing.T) {
+	const workers, rounds = 3, 50
+	session, mock := newTestSession(strings.Repeat("200 result=0\n", workers*rounds))
+
+	issue := make([]chan string, workers)
+	var wg sync.WaitGroup
+	for i := range issue {
+		issue[i] = make(chan string)
+		go func() {
+			for tag := range issue[i] {
+				_, err := session.Command("NOOP " + tag)
+				assert.NoError(t, err)
+				wg.Done()
+			}
+		}()
+	}
+	defer func() {
+		for _, ch := range issue {
+			close(ch)
+		}
+	}()
+
+	var want strings.Builder
+	for round := range rounds {
+		// Hold the session so every command of the round queues, in an
+		// order that differs from round to round
+		session.mutex.Lock()
+		for n := range workers {
+			worker := (round + n*(round%2+1)) % workers
+			tag := fmt.Sprintf("w%d-r%d", worker, round)
+			fmt.Fprintf(&want, "NOOP %s\n", tag)
+			wg.Add(1)
+			issue[worker] <- tag
+			require.Eventually(t, func() bool { return session.QueuedCommands() == n+1 }, time.Second, 100*time.Microsecond)
+		}
+		session.mutex.Unlock()
+		wg.Wait()
+		assert.Zero(t, session.QueuedCommands())
+	}
+
+	assert.Equal(t, want.String(), mock.writer.String())
+}
+
+func TestCommandCatalog(t *testing.T) {
+	specs := Commands()
+	require.Equal(t, agiVerbs, commandSpecVerbs())
+	for _, spec := range specs {
+		assert.Equal(t, spec.Class, VerbClasses[spec.Verb], spec.Verb)
+		assert.Equal(t, spec.Class == VerbMutating, spec.Mutating, spec.Verb)
+	}
+	specs[0].Params = append(specs[0].Params, ParamSpec{Name: "x"})
+	assert.Empty(t, Commands()[0].Params, "Commands must return a copy")
+
+	data, err := json.Marshal(Commands()[len(specs)-1])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"verb":"WAIT FOR DIGIT","params":[{"name":"timeout","type":"int"}],"class":"media","mutating":false,"blocking":true,"method":"WaitForDigit"}`, string(data))
+
+	// Arguments for wrappers that reject zero values before sending
+	args := map[string][]any{
+		"Execute":         {"Wait"},
+		"SetCallerID":     {"100"},
+		"SetContext":      {"default"},
+		"SetExtension":    {"100"},
+		"SetPriority":     {1},
+		"SpeechRecognize": {&MRCPRecog{}},
+		"SpeechSpeak":     {&MRCPSynth{Text: "hello"}},
+	}
+
+	t.Run("wrappers send their verb", func(t *testing.T) {
+		for _, spec := range Commands() {
+			if spec.Method == "" {
+				continue
+			}
+			session, mock := newTestSession("200 result=0\n200 result=0\n")
+			method := reflect.ValueOf(session).MethodByName(spec.Method)
+			require.True(t, method.IsValid(), "%s has no method %s", spec.Verb, spec.Method)
+
+			in := make([]reflect.Value, method.Type().NumIn())
+			if method.Type().IsVariadic() {
+				in = in[:len(in)-1]
+			}
+			for i := range in {
+				in[i] = reflect.Zero(method.Type().In(i))
+				if i < len(args[spec.Method]) {
+					in[i] = reflect.ValueOf(args[spec.Method][i])
+				}
+			}
+			method.Call(in)
+			first, _, _ := strings.Cut(mock.writer.String(), "\n")
+			assert.Equal(t, spec.Verb, commandVerb(first), spec.Method)
+		}
+	})
+
+	t.Run("every method is classified", func(t *testing.T) {
+		// helpers build on one or more commands; settings send none
+		helpers := []string{
+			"AnnounceQueuePosition", "AwaitExternal", "AwaitExternalWith", "ChannelStateOf", "CollectDigitsInteractive", "CollectSequence",
+			"Command", "CommandWithDeadline", "ConsentAndRecord", "Defer", "DetectTone", "DialplanExists", "DirectMedia",
+			"ForceCodec", "ForcedCodec", "CollectMaskedDigits", "GetDataMulti", "Goto", "Heartbeat", "MixMonitorStart",
+			"MixMonitorStop", "MonitorHangup", "MusicOnHoldClass", "Originate", "PlayPrompt", "Playback",
+			"QueueMemberCount", "QueueVariables", "QueueWaitingCount", "RTPStats", "RecordFileAtomic",
+			"RecordFileWithProgress", "LoadFlowState", "SaveFlowState", "SelectLanguage", "SendMessage", "SetCallerIDE164", "SetDirectMedia", "SetLanguage",
+			"SetPriorityLabel", "SetResult", "SoundExists", "StageResult", "StreamFileFrom", "Transfer", "TransferInfo",
+			"ValidExtension", "WaitForChannelState", "WaitForVariable", "WaitForVariableWith",
+			"WaitForSilenceLocal", "WarmPrompts", "WatchVariable", "WithMusicClass", "WithMusicOnHold",
+		}
+		settings := []string{
+			"ArgsSeq", "Audio", "BargeIn", "CallState", "ChannelTech", "Close", "Context", "Degradation", "Env", "EnvSeq",
+			"EnvTransformed", "Flag", "Flags", "GetEnv", "HungUp", "Info", "IsNetwork", "Language",
+			"LatencyStats", "LocalAddr", "OnClose", "QueuedCommands", "ReadCacheStats", "RecentExchanges", "RegisterHotkey", "RemoteAddr", "RequestURL",
+			"SetAudio", "SetBargeIn", "SetClock", "SetCommandPolicy", "SetCommandValidation", "SetDebug", "SetDegradationPolicy", "SetErrorPolicy", "SetFlowStateVariable", "SetExchangeRedactor", "SetGotoPrecheck",
+			"SetHeartbeatHook", "SetHistorySize", "SetMaxDataDigits", "SetMaxLineSize", "SetPromptMetrics",
+			"SetPromptResolver", "SetPromptWarmer", "SetReadCache", "SetSoundFormats", "SetSoundsDir", "SetStrictPrompts", "SetTimeout",
+			"SetTimezoneValidation", "SetTranscript", "SetVariableEscaping", "SetVariableSetter",
+			"Tenant", "WithoutHotkeys",
+		}
+		known := make(map[string]bool)
+		for _, spec := range Commands() {
+			if spec.Method != "" {
+				assert.False(t, known[spec.Method], "%s wraps two verbs", spec.Method)
+				known[spec.Method] = true
+			}
+		}
+		for _, name := range slices.Concat(helpers, settings) {
+			assert.False(t, known[name], "%s is listed twice", name)
+			known[name] = true
+		}
+
+		typ := reflect.TypeOf(&AgiSession{})
+		for i := range typ.NumMethod() {
+			name := typ.Method(i).Name
+			assert.True(t, known[name], "%s is neither in the command catalog nor listed as a helper or setting", name)
+			delete(known, name)
+		}
+		assert.Empty(t, known, "listed methods that do not exist")
+	})
+}
+
+// warmRecorder collects PromptWarmMetrics reports
+type warmRecorder struct {
+	mu     sync.Mutex
+	warmed map[string]error
+}
+
+func (r *warmRecorder) OnPromptComplete(string, int64, bool, string) {}
+
+func (r *warmRecorder) OnPromptWarmed(file string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.warmed[file] = err
+}
+
+func TestWarmPrompts(t *testing.T) {
+	t.Run("stat probes", func(t *testing.T) {
+		files := []string{"welcome", "menu", "goodbye"}
+		session, mock := newTestSession(strings.Repeat("200 result=1 (1)\n", len(files)))
+		metrics := &warmRecorder{warmed: make(map[string]error)}
+		session.SetPromptMetrics(metrics)
+		session.SetSoundFormats("wav")
+
+		require.NoError(t, session.WarmPrompts(context.Background(), files))
+		for _, file := range files {
+			assert.Contains(t, mock.writer.String(), fmt.Sprintf(`GET FULL VARIABLE "$[${STAT(e,/var/lib/asterisk/sounds/%s.wav)}]"`, file))
+			err, ok := metrics.warmed[file]
+			assert.True(t, ok, file)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, len(files), strings.Count(mock.writer.String(), "\n"))
+	})
+
+	t.Run("interactive command mid-warm", func(t *testing.T) {
+		files := []string{"p1", "p2", "p3", "p4", "p5", "p6"}
+		session, mock := newTestSession(strings.Repeat("200 result=0 endpos=100\n", len(files)+1))
+		session.SetPromptWarmer(PromptWarmerFunc(func(_ context.Context, s *AgiSession, file string) error {
+			_, err := s.Command("NOOP warm " + file)
+			return err
+		}))
+
+		session.mutex.Lock()
+		warmed := make(chan error, 1)
+		go func() { warmed <- session.WarmPrompts(context.Background(), files) }()
+		require.Eventually(t, func() bool { return session.QueuedCommands() == WarmParallelism }, time.Second, time.Millisecond)
+		played := make(chan error, 1)
+		go func() { played <- session.StreamFile("welcome", "") }()
+		require.Eventually(t, func() bool { return session.QueuedCommands() == WarmParallelism+1 }, time.Second, time.Millisecond)
+		session.mutex.Unlock()
+
+		require.NoError(t, <-played)
+		require.NoError(t, <-warmed)
+		lines := strings.Split(strings.TrimSpace(mock.writer.String()), "\n")
+		require.Len(t, lines, len(files)+1)
+		for i, line := range lines {
+			if i == WarmParallelism {
+				assert.Equal(t, `STREAM FILE welcome ""`, line)
+			} else {
+				assert.True(t, strings.HasPrefix(line, "NOOP warm "), line)
+			}
+		}
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		session, _ := newTestSession("")
+		session.SetPromptWarmer(PromptWarmerFunc(func(_ context.Context, _ *AgiSession, file string) error {
+			if file == "missing" {
+				return ErrPromptNotFound
+			}
+			return nil
+		}))
+		err := session.WarmPrompts(context.Background(), []string{"welcome", "missing"})
+		assert.ErrorIs(t, err, ErrPromptNotFound)
+		assert.ErrorContains(t, err, "missing")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.ErrorIs(t, session.WarmPrompts(ctx, []string{"welcome"}), context.Canceled)
+	})
+}
+
+func TestFlowState(t *testing.T) {
+	type flowState struct {
+		Step      string            `json:"step"`
+		Collected map[string]string `json:"collected"`
+		Notes     []string          `json:"notes"`
+	}
+	want := flowState{Step: "confirm-payment", Collected: map[string]string{"account": "00123", "amount": "42.50"}}
+	for i := range 100 {
+		want.Notes = append(want.Notes, fmt.Sprintf("caller chose \"option %d\"", i))
+	}
+
+	// save returns the variables SaveFlowState set, in order, after it read
+	// the saved state
+	save := func(t *testing.T, session *AgiSession, mock *mockIO, v any) (names, values []string) {
+		t.Helper()
+		require.NoError(t, session.SaveFlowState(v))
+		lines := strings.Split(strings.TrimSpace(mock.writer.String()), "\n")
+		assert.Equal(t, "GET VARIABLE "+session.flowStateVariable(), lines[0])
+		for _, line := range lines[1:] {
+			args := SplitCommand(line)
+			require.Len(t, args, 4)
+			names, values = append(names, args[2]), append(values, args[3])
+		}
+		return names, values
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		session, mock := newTestSession("200 result=0\n" + strings.Repeat("200 result=1\n", 10))
+		names, values := save(t, session, mock, want)
+		require.Greater(t, len(names), 2)
+		last := len(names) - 1
+		assert.Equal(t, DefaultFlowStateVariable, names[last])
+		assert.Equal(t, fmt.Sprintf("1:%d", last), values[last])
+		for i, value := range values[:last] {
+			assert.Equal(t, fmt.Sprintf("%s_1_%d", DefaultFlowStateVariable, i+1), names[i])
+			assert.LessOrEqual(t, len(value), FlowStateChunkSize)
+		}
+
+		// The new process reads the header first, then each chunk
+		var input strings.Builder
+		for _, value := range append(values[last:], values[:last]...) {
+			fmt.Fprintf(&input, "200 result=1 (%s)\n", value)
+		}
+		session, mock = newTestSession(input.String())
+		var got flowState
+		ok, err := session.LoadFlowState(&got)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, want, got)
+		assert.True(t, strings.HasPrefix(mock.writer.String(), "GET VARIABLE AGI_FLOW_STATE\nGET VARIABLE AGI_FLOW_STATE_1_1\n"))
+	})
+
+	t.Run("new generation", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (4:2)\n" + strings.Repeat("200 result=1\n", 4))
+		session.SetFlowStateVariable("IVR_STATE")
+		names, values := save(t, session, mock, flowState{Step: "menu"})
+		assert.Equal(t, []string{"IVR_STATE_5_1", "IVR_STATE", "IVR_STATE_4_1", "IVR_STATE_4_2"}, names)
+		assert.Equal(t, []string{"5:1", "", ""}, values[1:])
+	})
+
+	t.Run("failure part way keeps the previous state", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1 (1:2)\n200 result=1\n" +
+			"511 Command Not Permitted on a dead channel or intercept routine\n")
+		err := session.SaveFlowState(want)
+		assert.ErrorIs(t, err, ErrHangup)
+		for _, line := range strings.Split(strings.TrimSpace(mock.writer.String()), "\n")[1:] {
+			name := SplitCommand(line)[2]
+			assert.True(t, strings.HasPrefix(name, "AGI_FLOW_STATE_2_"), "%s written before the save completed", name)
+		}
+
+		// The next process still finds the previous state intact
+		previous, _ := json.Marshal(flowState{Step: "menu"})
+		encoded := base64.StdEncoding.EncodeToString(previous)
+		session, _ = newTestSession(fmt.Sprintf("200 result=1 (1:2)\n200 result=1 (%s)\n200 result=1 (%s)\n", encoded[:8], encoded[8:]))
+		var got flowState
+		ok, err := session.LoadFlowState(&got)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "menu", got.Step)
+	})
+
+	t.Run("no state", func(t *testing.T) {
+		session, _ := newTestSession("200 result=0\n")
+		var got flowState
+		ok, err := session.LoadFlowState(&got)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			input string
+		}{
+			{"bad header", "200 result=1 (two)\n"},
+			{"bad count", "200 result=1 (1:0)\n"},
+			{"missing chunk", "200 result=1 (1:2)\n200 result=1 (e30=)\n200 result=0\n"},
+			{"bad encoding", "200 result=1 (1:1)\n200 result=1 (not base64!)\n"},
+			{"bad json", "200 result=1 (1:1)\n200 result=1 (bm90IGpzb24=)\n"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				session, _ := newTestSession(tt.input)
+				var got flowState
+				ok, err := session.LoadFlowState(&got)
+				assert.ErrorIs(t, err, ErrInvalidFlowState)
+				assert.False(t, ok)
+			})
+		}
+	})
+}
+
+func TestValidateCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		valid   bool
+	}{
+		{"plain", "ANSWER", true},
+		{"quoted value", `SET VARIABLE GREETING "hello \"world\""`, true},
+		{"empty escape digits", `STREAM FILE welcome ""`, true},
+		{"escaped backslash", `SET VARIABLE PATH "C:\\ivr"`, true},
+		{"line break", "SET VARIABLE A \"1\nHANGUP\"", false},
+		{"carriage return", "NOOP\r", false},
+		{"unclosed quote", `SET VARIABLE A "1`, false},
+		{"dangling escape", `SET VARIABLE A 1\`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateCommand(tt.command)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrMalformedCommand)
+			}
+		})
+	}
+
+	t.Run("join round trip", func(t *testing.T) {
+		parts := []string{"SET", "VARIABLE", "A", "", `C:\ivr`, `say "hi"`, "two words", "tab\tseparated"}
+		assert.Equal(t, parts, SplitCommand(JoinCommand(parts)))
+	})
+
+	t.Run("reports and sends", func(t *testing.T) {
+		session, mock := newTestSession("200 result=1\n")
+		var reported []string
+		session.SetCommandValidation(func(_ *AgiSession, command string, err error) {
+			assert.ErrorIs(t, err, ErrMalformedCommand)
+			reported = append(reported, command)
+		})
+		_, err := session.Command(`EXEC Playback "welcome`)
+		require.NoError(t, err)
+		assert.Equal(t, []string{`EXEC Playback "welcome`}, reported)
+		assert.Equal(t, "EXEC Playback \"welcome\n", mock.writer.String())
+	})
+
+	t.Run("panics in tests", func(t *testing.T) {
+		session, _ := newTestSession("200 result=1\n")
+		assert.PanicsWithError(t, `malformed command: "EXEC Playback \"welcome" has an unclosed quote`, func() {
+			session.Command(`EXEC Playback "welcome`)
+		})
+	})
+}
+
+func TestDeferClose(t *testing.T) {
+	session, mock := newTestSession("200 result=1\n520 Invalid command syntax.\n200 result=1\n")
+	var order []string
+	session.Defer(DeferredFunc(func(s *AgiSession) error {
+		order = append(order, "first")
+		return s.SetVariable("A", "1")
+	}))
+	session.Defer(DeferredFunc(func(s *AgiSession) error {
+		order = append(order, "second")
+		return s.SetVariable("B", "2")
+	}))
+
+	err := session.Close()
+	assert.ErrorIs(t, err, ErrInvalidResponse)
+	assert.ErrorContains(t, err, "deferred command")
+	assert.NoError(t, session.Close())
+	assert.Equal(t, []string{"second", "first"}, order)
+
+	// Commands deferred after teardown run at once
+	session.Defer(SetVariable{Name: "C", Value: "3"})
+	assert.Equal(t, "SET VARIABLE B \"2\"\nSET VARIABLE A \"1\"\nSET VARIABLE C \"3\"\n", mock.writer.String())
+}
+
+func TestAudioHelpers(t *testing.T) {
+	// slin returns d of 8kHz audio at freq Hz, or silence when freq is zero
+	slin := func(d time.Duration, freq float64) []byte {
+		buf := make([]byte, 2*int(d.Seconds()*8000))
+		for i := 0; i < len(buf); i += 2 {
+			v := 0.4 * math.Sin(2*math.Pi*freq*float64(i/2)/8000)
+			binary.LittleEndian.PutUint16(buf[i:], uint16(int16(v*32767)))
+		}
+		return buf
+	}
+
+	t.Run("no audio", func(t *testing.T) {
+		session, _ := newTestSession("")
+		assert.Nil(t, session.Audio())
+		assert.ErrorIs(t, session.WaitForSilenceLocal(context.Background(), time.Second), ErrNoAudio)
+		assert.ErrorIs(t, session.DetectTone(context.Background(), 2100, time.Second), ErrNoAudio)
+	})
+
+	t.Run("silence", func(t *testing.T) {
+		session, _ := newTestSession("")
+		session.SetAudio(bytes.NewReader(append(slin(time.Second, 440), slin(time.Second, 0)...)))
+		require.NoError(t, session.WaitForSilenceLocal(context.Background(), 500*time.Millisecond))
+
+		session.SetAudio(bytes.NewReader(slin(time.Second, 440)))
+		assert.ErrorIs(t, session.WaitForSilenceLocal(context.Background(), 500*time.Millisecond), audio.ErrNotDetected)
+	})
+
+	t.Run("tone", func(t *testing.T) {
+		session, _ := newTestSession("")
+		session.SetAudio(bytes.NewReader(append(slin(500*time.Millisecond, 0), slin(time.Second, 2100)...)))
+		require.NoError(t, session.DetectTone(context.Background(), 2100, 500*time.Millisecond))
+
+		session.SetAudio(bytes.NewReader(slin(time.Second, 1400)))
+		assert.ErrorIs(t, session.DetectTone(context.Background(), 2100, 500*time.Millisecond), audio.ErrNotDetected)
+	})
+}
+
+// stepClock is a Clock whose Now is set by the test
+type stepClock struct {
+	RealClock
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	return c.now
+}
+
+func TestAwaitExternal(t *testing.T) {
+	// awaiting starts session waiting for key on r and returns its result
+	awaiting := func(r *ExternalRegistry, session *AgiSession, ctx context.Context, key string) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			payload, err := session.AwaitExternalWith(ctx, key, AwaitOptions{Poll: time.Hour})
+			if err == nil && payload != "paid" {
+				err = fmt.Errorf("payload %q", payload)
+			}
+			done <- err
+		}()
+		require.Eventually(t, func() bool { return r.Len() == 1 }, time.Second, time.Millisecond)
+		return done
+	}
+
+	t.Run("complete then await", func(t *testing.T) {
+		r := NewExternalRegistry(0)
+		session, mock := newTestSession("")
+		session.externals = r
+		require.NoError(t, r.Complete("pay-1", "paid"))
+		payload, err := session.AwaitExternal(context.Background(), "pay-1")
+		require.NoError(t, err)
+		assert.Equal(t, "paid", payload)
+		assert.Empty(t, mock.writer.String())
+		assert.Equal(t, 1, r.Len())
+
+		session.Close()
+		assert.Equal(t, 0, r.Len())
+	})
+
+	t.Run("await then complete", func(t *testing.T) {
+		r := NewExternalRegistry(0)
+		session, mock := newTestSession("")
+		session.externals = r
+		done := awaiting(r, session, context.Background(), "pay-1")
+		require.NoError(t, r.Complete("pay-1", "paid"))
+		require.NoError(t, <-done)
+		assert.Empty(t, mock.writer.String())
+	})
+
+	t.Run("duplicate complete", func(t *testing.T) {
+		r := NewExternalRegistry(0)
+		session, _ := newTestSession("")
+		session.externals = r
+		done := awaiting(r, session, context.Background(), "pay-1")
+		require.NoError(t, r.Complete("pay-1", "paid"))
+		require.NoError(t, <-done)
+
+		assert.ErrorIs(t, r.Complete("pay-1", "paid"), ErrAlreadyCompleted)
+		other, _ := newTestSession("")
+		other.externals = r
+		_, err := other.AwaitExternal(context.Background(), "pay-1")
+		assert.ErrorIs(t, err, ErrAlreadyCompleted)
+
+		session.Close()
+		assert.Equal(t, 0, r.Len())
+	})
+
+	t.Run("duplicate await", func(t *testing.T) {
+		r := NewExternalRegistry(0)
+		session, _ := newTestSession("")
+		session.externals = r
+		done := awaiting(r, session, context.Background(), "pay-1")
+
+		other, _ := newTestSession("")
+		other.externals = r
+		_, err := other.AwaitExternal(context.Background(), "pay-1")
+		assert.ErrorIs(t, err, ErrAlreadyAwaited)
+		other.Close()
+
+		require.NoError(t, r.Complete("pay-1", "paid"))
+		require.NoError(t, <-done)
+	})
+
+	t.Run("pending expires", func(t *testing.T) {
+		clock := &stepClock{now: time.Unix(1700000000, 0)}
+		r := NewExternalRegistry(time.Minute)
+		r.clk = clock
+		require.NoError(t, r.Complete("pay-1", "early"))
+		clock.now = clock.now.Add(59 * time.Second)
+		assert.Equal(t, 1, r.Len())
+		clock.now = clock.now.Add(time.Second)
+		assert.Equal(t, 0, r.Len())
+		assert.NoError(t, r.Complete("pay-1", "paid"))
+	})
+
+	t.Run("context expires", func(t *testing.T) {
+		r := NewExternalRegistry(0)
+		session, _ := newTestSession("")
+		session.externals = r
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := session.AwaitExternalWith(ctx, "pay-1", AwaitOptions{Poll: time.Hour})
+		assert.ErrorIs(t, err, ErrTimeout)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 0, r.Len())
+
+		// a late webhook is kept like an early one
+		require.NoError(t, r.Complete("pay-1", "paid"))
+		payload, err := session.AwaitExternal(context.Background(), "pay-1")
+		require.NoError(t, err)
+		assert.Equal(t, "paid", payload)
+	})
+
+	t.Run("session close releases keys", func(t *testing.T) {
+		r := NewExternalRegistry(0)
+		session, _ := newTestSession("")
+		session.externals = r
+		session.ctx, session.cancelFunc = context.WithCancel(context.Background())
+		done := awaiting(r, session, session.Context(), "pay-1")
+		session.Close()
+		assert.Error(t, <-done)
+		assert.Equal(t, 0, r.Len())
+	})
+
+	t.Run("hangup while polling", func(t *testing.T) {
+		r := NewExternalRegistry(0)
+		session, mock := newTestSession("200 result=0\nHANGUP\n200 result=0\n")
+		session.externals = r
+		_, err := session.AwaitExternalWith(context.Background(), "pay-1", AwaitOptions{Poll: time.Millisecond})
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.Equal(t, "NOOP\nNOOP\n", mock.writer.String())
+		assert.Equal(t, 0, r.Len())
+	})
+
+	t.Run("hangup cause", func(t *testing.T) {
+		r := NewExternalRegistry(0)
+		session, _ := newTestSession("")
+		session.externals = r
+		ctx, cancel := context.WithCancelCause(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			_, err := session.AwaitExternalWith(ctx, "pay-1", AwaitOptions{Poll: time.Hour})
+			done <- err
+		}()
+		require.Eventually(t, func() bool { return r.Len() == 1 }, time.Second, time.Millisecond)
+		cancel(ErrHangup)
+		err := <-done
+		assert.ErrorIs(t, err, ErrHangup)
+		assert.NotErrorIs(t, err, ErrTimeout)
+	})
+
+	t.Run("hold music", func(t *testing.T) {
+		r := NewExternalRegistry(0)
+		session, mock := newTestSession("200 result=0\n200 result=0\n")
+		session.externals = r
+		require.NoError(t, r.Complete("pay-1", "paid"))
+		payload, err := session.AwaitExternalWith(context.Background(), "pay-1", AwaitOptions{Hold: true, MusicClass: "hold"})
+		require.NoError(t, err)
+		assert.Equal(t, "paid", payload)
+		assert.Equal(t, "SET MUSIC ON hold\nSET MUSIC OFF\n", mock.writer.String())
+	})
+
+	t.Run("package registry", func(t *testing.T) {
+		session, _ := newTestSession("")
+		require.NoError(t, Complete("pay-package", "paid"))
+		payload, err := session.AwaitExternal(context.Background(), "pay-package")
+		require.NoError(t, err)
+		assert.Equal(t, "paid", payload)
+		session.Close()
+	})
+}
@@ -0,0 +1,179 @@
+// Package agitest provides a scripted fake Asterisk for testing AGI handlers
+// without a PBX.
+package agitest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// Fake plays the Asterisk side of an AGI session. It sends an environment,
+// then answers each command with the next scripted response and records the
+// commands it received in its Recorder. A command arriving after the script
+// is exhausted is recorded and answered by hanging up, closing the
+// connection.
+type Fake struct {
+	Recorder
+
+	env       map[string]string
+	responses []string
+	delay     func(cmd string) time.Duration
+	// respond, when set, answers every command in place of responses
+	respond   func(cmd string) string
+	variables map[string]string
+
+	mu   sync.Mutex
+	conn net.Conn
+	done chan struct{}
+}
+
+// Option configures a Fake
+type Option func(*Fake)
+
+// WithEnv adds an AGI environment variable sent to the session
+func WithEnv(key, value string) Option {
+	return func(f *Fake) {
+		f.env[key] = value
+	}
+}
+
+// WithVariable sets a channel variable a dry run returns for GET VARIABLE
+// and for GET FULL VARIABLE of "${name}"
+func WithVariable(name, value string) Option {
+	return func(f *Fake) {
+		if f.variables == nil {
+			f.variables = make(map[string]string)
+		}
+		f.variables[name] = value
+	}
+}
+
+// WithResponseDelay delays each response by the duration fn returns for the
+// command being answered, for testing slow Asterisk servers and timeouts
+func WithResponseDelay(fn func(cmd string) time.Duration) Option {
+	return func(f *Fake) {
+		f.delay = fn
+	}
+}
+
+// NewFake returns a fake that answers commands with responses in order, such
+// as "200 result=1 (value)"
+func NewFake(responses []string, opts ...Option) *Fake {
+	f := &Fake{
+		env:       map[string]string{"agi_network": "yes", "agi_uniqueid": "1700000000.1"},
+		responses: responses,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Session starts the fake and returns a session connected to it. The
+// session's connection is a net.Pipe, so command timeouts apply, and it
+// panics on commands that fail agi.ValidateCommand. Call Close when the
+// test is done.
+func (f *Fake) Session(ctx context.Context) (*agi.AgiSession, error) {
+	client, server := net.Pipe()
+
+	f.mu.Lock()
+	f.conn = server
+	f.done = make(chan struct{})
+	f.mu.Unlock()
+
+	go f.serve(server)
+
+	session, err := agi.NewSession(ctx, client, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	session.SetCommandValidation(agi.PanicOnMalformedCommand)
+	return session, nil
+}
+
+// Serve plays the fake over conn, for example a connection dialed to a
+// FastAGIServer, and returns when the script is exhausted or conn fails
+func (f *Fake) Serve(conn net.Conn) {
+	f.mu.Lock()
+	f.conn = conn
+	f.done = make(chan struct{})
+	f.mu.Unlock()
+
+	f.serve(conn)
+}
+
+// serve writes the environment and answers commands until the script runs out
+func (f *Fake) serve(conn net.Conn) {
+	defer close(f.done)
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(f.envBlock())); err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	for i := 0; ; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+
+		f.add(cmd)
+
+		var response string
+		switch {
+		case f.respond != nil:
+			response = f.respond(cmd)
+		case i == len(f.responses):
+			return
+		default:
+			response = f.responses[i]
+		}
+		if f.delay != nil {
+			time.Sleep(f.delay(cmd))
+		}
+		if _, err := fmt.Fprintf(conn, "%s\n", response); err != nil {
+			return
+		}
+	}
+}
+
+// envBlock formats the environment in sorted key order
+func (f *Fake) envBlock() string {
+	keys := make([]string, 0, len(f.env))
+	for k := range f.env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s: %s\n", k, f.env[k])
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Close hangs up the fake and waits for it to stop
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	conn, done := f.conn, f.done
+	f.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	err := conn.Close()
+	<-done
+	return err
+}
@@ -0,0 +1,561 @@
+package agitest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+func TestFake(t *testing.T) {
+	fake := NewFake([]string{"200 result=0", "200 result=1 (1234)"}, WithEnv("agi_callerid", "100"))
+	defer fake.Close()
+
+	session, err := fake.Session(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "100", session.GetEnv("agi_callerid"))
+	assert.Equal(t, "yes", session.GetEnv("agi_network"))
+
+	require.NoError(t, session.Answer())
+	account, err := session.GetVariable("ACCOUNT")
+	require.NoError(t, err)
+	assert.Equal(t, "1234", account)
+
+	// The script is exhausted, so the fake hangs up
+	assert.Error(t, session.Hangup())
+	assert.Equal(t, []string{"ANSWER", "GET VARIABLE ACCOUNT", "HANGUP"}, fake.Commands())
+}
+
+func TestLargeVariableRoundTrip(t *testing.T) {
+	type item struct {
+		ID    int    `json:"id"`
+		Note  string `json:"note"`
+		Path  string `json:"path"`
+		Lines string `json:"lines"`
+	}
+	var items []item
+	for i := 0; i < 150; i++ {
+		items = append(items, item{i, fmt.Sprintf("caller said \"option %d\"", i), `C:\ivr\prompts`, "first\n\tsecond"})
+	}
+	blob, err := json.MarshalIndent(items, "", "\t")
+	require.NoError(t, err)
+	require.Greater(t, len(blob), 16*1024)
+
+	// Set the value and capture the command Asterisk would receive
+	setter := NewFake([]string{"200 result=1"})
+	defer setter.Close()
+	session, err := setter.Session(context.Background())
+	require.NoError(t, err)
+	session.SetVariableEscaping(true)
+	require.NoError(t, session.SetVariable("PAYLOAD", string(blob)))
+
+	cmd := setter.Commands()[0]
+	assert.NotContains(t, cmd, "\n")
+	quoted, ok := strings.CutPrefix(cmd, "SET VARIABLE PAYLOAD ")
+	require.True(t, ok)
+	stored := agi.UnescapeString(strings.TrimSuffix(strings.TrimPrefix(quoted, `"`), `"`))
+
+	// Asterisk returns the stored value verbatim in parentheses
+	response := "200 result=1 (" + stored + ")"
+
+	getter := NewFake([]string{response, response})
+	defer getter.Close()
+	session, err = getter.Session(context.Background())
+	require.NoError(t, err)
+	session.SetVariableEscaping(true)
+
+	session.SetMaxLineSize(8 * 1024)
+	_, err = session.GetVariable("PAYLOAD")
+	require.ErrorIs(t, err, agi.ErrLineTooLong)
+
+	getter = NewFake([]string{response})
+	defer getter.Close()
+	session, err = getter.Session(context.Background())
+	require.NoError(t, err)
+	session.SetVariableEscaping(true)
+	session.SetMaxLineSize(32 * 1024)
+
+	value, err := session.GetVariable("PAYLOAD")
+	require.NoError(t, err)
+	assert.Equal(t, string(blob), value)
+	assert.True(t, json.Valid([]byte(value)))
+}
+
+func TestReplayTranscript(t *testing.T) {
+	handler := func(session *agi.AgiSession) error {
+		if err := session.Answer(); err != nil {
+			return err
+		}
+		account, err := session.GetVariable("ACCOUNT")
+		if err != nil {
+			return err
+		}
+		return session.Verbose("account "+account, 1)
+	}
+
+	for _, format := range []agi.TranscriptFormat{agi.TranscriptText, agi.TranscriptJSON} {
+		fake := NewFake([]string{"200 result=0", "200 result=1 (1234)", "200 result=1"}, WithEnv("agi_uniqueid", "1700000000.9"))
+		session, err := fake.Session(context.Background())
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		session.SetTranscript(&out, format)
+		session.SetExchangeRedactor(func(e agi.Exchange) agi.Exchange { return e })
+		require.NoError(t, handler(session))
+		fake.Close()
+
+		records, err := ParseTranscript(&out)
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		assert.Equal(t, "1700000000.9", records[0].UniqueID)
+		assert.Equal(t, "GET VARIABLE", records[1].Verb)
+		assert.Equal(t, "ACCOUNT", records[1].Args)
+		assert.Equal(t, "(1234)", records[1].Data)
+
+		replay := Replay(records)
+		session, err = replay.Session(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "1700000000.9", session.GetEnv("agi_uniqueid"))
+		require.NoError(t, handler(session))
+		replay.Close()
+		assert.Equal(t, fake.Commands(), replay.Commands())
+	}
+}
+
+func TestParseTranscriptErrors(t *testing.T) {
+	_, err := ParseTranscript(strings.NewReader("2026-01-01T00:00:00.000000Z - 1ms < 200 result=0\n"))
+	assert.Error(t, err)
+	_, err = ParseTranscript(strings.NewReader("{not json\n"))
+	assert.Error(t, err)
+	_, err = ParseTranscript(strings.NewReader("garbage\n"))
+	assert.Error(t, err)
+}
+
+// screenCall hangs up on blacklisted callers and otherwise dials the
+// department chosen from the menu
+func screenCall(s *agi.AgiSession) error {
+	if err := s.Answer(); err != nil {
+		return err
+	}
+	blacklisted, err := s.GetVariable("BLACKLISTED")
+	if err != nil {
+		return err
+	}
+	if blacklisted == "1" {
+		if err := s.StreamFile("goodbye", ""); err != nil {
+			return err
+		}
+		return s.Hangup()
+	}
+
+	choice, err := s.GetOption("main-menu", "12", 0)
+	if err != nil {
+		return err
+	}
+	account, _, err := s.GetDataMulti([]string{"enter-account"}, 0, 6)
+	if err != nil {
+		return err
+	}
+	if err := s.SetVariable("ACCOUNT", account); err != nil {
+		return err
+	}
+	return s.Execute("Dial", "PJSIP/dept"+choice, "30")
+}
+
+func TestDryRun(t *testing.T) {
+	t.Run("blacklist never dials", func(t *testing.T) {
+		dry := NewDryRun(nil, WithVariable("BLACKLISTED", "1"))
+		session, err := dry.Session(context.Background())
+		require.NoError(t, err)
+		defer dry.Close()
+
+		require.NoError(t, screenCall(session))
+		assert.True(t, dry.AssertNotAttempted(t, "EXEC Dial", "SET VARIABLE"))
+		assert.True(t, dry.AssertAttemptedInOrder(t, "ANSWER", "STREAM FILE", "HANGUP"))
+	})
+
+	t.Run("menu and account", func(t *testing.T) {
+		dry := NewDryRun([]string{"2", "004217"})
+		session, err := dry.Session(context.Background())
+		require.NoError(t, err)
+		defer dry.Close()
+
+		require.NoError(t, screenCall(session))
+		dial := dry.Attempted("exec dial")
+		require.Len(t, dial, 1)
+		assert.Equal(t, `"PJSIP/dept2,30"`, dial[0].Args)
+		assert.Equal(t, agi.VerbMutating, dial[0].Class)
+
+		var mutations []string
+		for _, cmd := range dry.Mutations() {
+			mutations = append(mutations, cmd.Name())
+		}
+		assert.Equal(t, []string{"ANSWER", "SET VARIABLE", "EXEC DIAL"}, mutations)
+		assert.Equal(t, "ACCOUNT \"004217\"", dry.Attempted("SET VARIABLE")[0].Args)
+		assert.Equal(t, agi.VerbReadOnly, dry.Attempts()[1].Class)
+	})
+
+	t.Run("function reads", func(t *testing.T) {
+		dry := NewDryRun(nil, WithVariable("CALLERID(num)", "5551234"))
+		session, err := dry.Session(context.Background())
+		require.NoError(t, err)
+		defer dry.Close()
+
+		number, err := session.GetVariable("CALLERID(num)")
+		require.NoError(t, err)
+		assert.Equal(t, "5551234", number)
+		_, err = session.GetFullVariable("${SHELL(id)}")
+		require.NoError(t, err)
+		mutations := dry.Mutations()
+		require.Len(t, mutations, 1)
+		assert.Equal(t, "GET FULL VARIABLE", mutations[0].Verb)
+	})
+
+	t.Run("failed assertions", func(t *testing.T) {
+		dry := NewDryRun(nil)
+		session, err := dry.Session(context.Background())
+		require.NoError(t, err)
+		defer dry.Close()
+		require.NoError(t, screenCall(session))
+
+		rec := &recordingT{}
+		assert.False(t, dry.AssertNotAttempted(rec, "EXEC Dial"))
+		assert.False(t, dry.AssertAttemptedInOrder(rec, "EXEC Dial", "ANSWER"))
+		assert.Len(t, rec.errors, 2)
+	})
+
+	t.Run("set variable is read back", func(t *testing.T) {
+		dry := NewDryRun(nil)
+		session, err := dry.Session(context.Background())
+		require.NoError(t, err)
+		defer dry.Close()
+
+		require.NoError(t, session.SetVariable("ROUTE", `sales "east"`))
+		value, err := session.GetFullVariable("${ROUTE}")
+		require.NoError(t, err)
+		assert.Equal(t, `sales "east"`, value)
+	})
+}
+
+// recordingT collects assertion failures instead of failing the test
+type recordingT struct {
+	errors []string
+}
+
+func (r *recordingT) Helper() {}
+
+func (r *recordingT) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// pinCheck is a handler written against agi.Session rather than
+// *agi.AgiSession
+func pinCheck(ctx context.Context, s agi.Session) error {
+	if err := s.Answer(); err != nil {
+		return err
+	}
+	pin, err := s.GetData("enter-pin", 5000, 4)
+	if err != nil {
+		return err
+	}
+	want, err := s.GetVariable("PIN")
+	if err != nil {
+		return err
+	}
+	result := "FAIL"
+	if pin == want {
+		result = "OK"
+	}
+	return s.SetVariable("PIN_RESULT", result)
+}
+
+func TestMockSession(t *testing.T) {
+	t.Run("records calls", func(t *testing.T) {
+		mock := NewMockSession("1234")
+		mock.Variables["PIN"] = "1234"
+
+		require.NoError(t, pinCheck(context.Background(), mock))
+		assert.Equal(t, "OK", mock.Variables["PIN_RESULT"])
+		assert.Equal(t, []string{
+			"ANSWER",
+			"GET DATA enter-pin 5000 4",
+			"GET VARIABLE PIN",
+			`SET VARIABLE PIN_RESULT "OK"`,
+		}, mock.Commands())
+	})
+
+	t.Run("hangup", func(t *testing.T) {
+		mock := NewMockSession()
+		require.NoError(t, mock.Hangup())
+		assert.ErrorIs(t, pinCheck(context.Background(), mock), agi.ErrHangup)
+	})
+
+	t.Run("same handler on a real session", func(t *testing.T) {
+		fake := NewFake([]string{"200 result=0", "200 result=1234", "200 result=1 (9999)", "200 result=1"})
+		defer fake.Close()
+		session, err := fake.Session(context.Background())
+		require.NoError(t, err)
+
+		require.NoError(t, agi.Adapt(agi.SessionHandlerFunc(pinCheck)).Handle(context.Background(), session))
+		assert.Equal(t, []string{
+			"ANSWER",
+			"GET DATA enter-pin 5000 4",
+			"GET VARIABLE PIN",
+			`SET VARIABLE PIN_RESULT "FAIL"`,
+		}, fake.Commands())
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	dry := NewDryRun([]string{"", "1"})
+	session, err := dry.Session(context.Background())
+	require.NoError(t, err)
+	defer dry.Close()
+
+	require.NoError(t, session.StreamFile("welcome", ""))
+	require.NoError(t, session.Playback([]string{"main-menu", "press-1"}, agi.PlaybackOptions{NoAnswer: true}))
+	_, err = session.GetData("enter-account", 5000, 4)
+	require.NoError(t, err)
+	require.NoError(t, session.SetVariable("ACCOUNT", "1234"))
+	require.NoError(t, session.Hangup())
+
+	t.Run("passing", func(t *testing.T) {
+		assert.True(t, dry.ExpectPlayed(t, "welcome"))
+		assert.True(t, dry.ExpectPlayed(t, "press-1"))
+		assert.True(t, dry.ExpectPlayedInOrder(t, "welcome", "main-menu", "enter-account"))
+		assert.True(t, dry.ExpectVariableSet(t, "ACCOUNT", "1234"))
+		assert.True(t, dry.ExpectHangup(t))
+		assert.True(t, dry.ExpectNoCommand(t, "EXEC Dial"))
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		rec := &recordingT{}
+		// Prompt names are matched whole, not as substrings
+		assert.False(t, dry.ExpectPlayed(rec, "main"))
+		assert.False(t, dry.ExpectPlayedInOrder(rec, "main-menu", "welcome"))
+		assert.False(t, dry.ExpectVariableSet(rec, "ACCOUNT", "9999"))
+		assert.False(t, dry.ExpectVariableSet(rec, "PIN", "1234"))
+		assert.False(t, dry.ExpectNoCommand(rec, "SET VARIABLE"))
+		require.Len(t, rec.errors, 5)
+
+		assert.Contains(t, rec.errors[1], "welcome was not played after [main-menu]")
+		assert.Contains(t, rec.errors[2], `ACCOUNT was set to "1234", expected "9999"`)
+		assert.Contains(t, rec.errors[3], "PIN was not set")
+		assert.Contains(t, rec.errors[4], "SET VARIABLE was sent as command 5")
+		for _, msg := range rec.errors {
+			assert.Contains(t, msg, `   1. STREAM FILE welcome ""`)
+			assert.Contains(t, msg, "   6. HANGUP")
+		}
+	})
+
+	t.Run("mock session", func(t *testing.T) {
+		mock := NewMockSession("1234")
+		mock.Variables["PIN"] = "1234"
+		require.NoError(t, pinCheck(context.Background(), mock))
+
+		assert.True(t, mock.ExpectPlayed(t, "enter-pin"))
+		assert.True(t, mock.ExpectVariableSet(t, "PIN_RESULT", "OK"))
+		rec := &recordingT{}
+		assert.False(t, mock.ExpectHangup(rec))
+		require.Len(t, rec.errors, 1)
+		assert.Contains(t, rec.errors[0], "the channel was not hung up")
+	})
+}
+
+func TestClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+
+	timer := clock.NewTimer(5 * time.Second)
+	ticker := clock.NewTicker(2 * time.Second)
+	assert.Equal(t, 2, clock.Pending())
+
+	clock.Advance(4 * time.Second)
+	assert.Equal(t, start.Add(4*time.Second), clock.Now())
+	// The ticker fired at 2s and 4s, but its channel holds one tick
+	assert.Equal(t, start.Add(2*time.Second), <-ticker.C())
+	assert.Empty(t, ticker.C())
+	assert.Empty(t, timer.C())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(5*time.Second), <-timer.C())
+	assert.False(t, timer.Stop())
+	assert.Equal(t, 1, clock.Pending())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(6*time.Second), <-ticker.C())
+	ticker.Stop()
+	assert.Zero(t, clock.Pending())
+
+	immediate := clock.NewTimer(0)
+	assert.Equal(t, clock.Now(), <-immediate.C())
+
+	go func() {
+		time.Sleep(time.Millisecond)
+		clock.NewTimer(time.Second)
+	}()
+	clock.BlockUntil(1)
+	assert.Equal(t, 1, clock.Pending())
+}
+
+// bankMenu is a looping menu: the main menu replays on no input or another
+// key, 1 opens a submenu that replays after each choice until 9 returns to
+// the main menu, and 2 asks for an account
+func bankMenu(ctx context.Context, s *agi.AgiSession) error {
+	if err := s.Answer(); err != nil {
+		return err
+	}
+main:
+	for {
+		choice, err := s.GetOption("main-menu", "129", 3*time.Second)
+		if err != nil {
+			return err
+		}
+		switch choice {
+		case "1":
+			for {
+				sub, err := s.GetOption("balance-menu", "129", 3*time.Second)
+				if err != nil {
+					return err
+				}
+				switch sub {
+				case "1":
+					err = s.StreamFile("balance-savings", "")
+				case "2":
+					err = s.Execute("Playback", "balance-checking&thank-you")
+				case "9":
+					continue main
+				}
+				if err != nil {
+					return err
+				}
+			}
+		case "2":
+			account, err := s.GetData("enter-account", 3000, 4)
+			if err != nil {
+				return err
+			}
+			prompt := "invalid-account"
+			if account == "0042" {
+				prompt = "vip-welcome"
+			}
+			if err := s.StreamFile(prompt, ""); err != nil {
+				return err
+			}
+			return s.Hangup()
+		case "9":
+			if err := s.StreamFile("goodbye", ""); err != nil {
+				return err
+			}
+			return s.Hangup()
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	files := func(r *AuditReport) []string {
+		var names []string
+		for _, f := range r.Files {
+			names = append(names, f.File)
+		}
+		return names
+	}
+	paths := func(r *AuditReport) map[string][]string {
+		paths := make(map[string][]string)
+		for _, f := range r.Files {
+			paths[f.File] = f.Path
+		}
+		return paths
+	}
+
+	t.Run("looping menu", func(t *testing.T) {
+		report, err := Audit(agi.HandlerFunc(bankMenu), AuditOptions{DataInputs: []string{"0042", "7"}})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"balance-checking", "balance-menu", "balance-savings", "enter-account",
+			"goodbye", "invalid-account", "main-menu", "thank-you", "vip-welcome"}, files(report))
+		assert.False(t, report.Truncated)
+		assert.Less(t, report.Runs, 20, "explored choices must not be explored again")
+
+		got := paths(report)
+		assert.Equal(t, []string{}, got["main-menu"])
+		assert.Equal(t, []string{"1"}, got["balance-menu"])
+		assert.Equal(t, []string{"1", "1"}, got["balance-savings"])
+		assert.Equal(t, []string{"1", "2"}, got["thank-you"])
+		assert.Equal(t, []string{"2", "0042"}, got["vip-welcome"])
+		assert.Equal(t, []string{"9"}, got["goodbye"])
+	})
+
+	t.Run("depth limit", func(t *testing.T) {
+		report, err := Audit(agi.HandlerFunc(bankMenu), AuditOptions{MaxDepth: 1, DataInputs: []string{}})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"balance-menu", "enter-account", "goodbye", "invalid-account", "main-menu"}, files(report))
+		assert.False(t, report.Truncated)
+	})
+
+	t.Run("run limit", func(t *testing.T) {
+		report, err := Audit(agi.HandlerFunc(bankMenu), AuditOptions{MaxRuns: 2})
+		require.NoError(t, err)
+		assert.True(t, report.Truncated)
+		assert.Equal(t, 2, report.Runs)
+	})
+
+	t.Run("replaying without input ends", func(t *testing.T) {
+		plays := 0
+		forever := agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			for {
+				plays++
+				if _, err := s.GetOption("still-there", "", 0); err != nil {
+					return err
+				}
+			}
+		})
+		report, err := Audit(forever, AuditOptions{MaxRepeats: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"still-there"}, files(report))
+		assert.Equal(t, 1, report.Runs)
+		assert.Equal(t, 3, plays)
+	})
+
+	t.Run("routes and missing files", func(t *testing.T) {
+		routes := agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			return s.StreamFile(s.GetEnv("agi_network_script")+"-welcome", "")
+		})
+		report, err := Audit(routes, AuditOptions{
+			Scripts: []string{"sales", "support"},
+			Exists:  func(file string) (bool, error) { return file != "support-welcome", nil },
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []AuditFile{
+			{File: "sales-welcome", Script: "sales", Path: []string{}},
+			{File: "support-welcome", Script: "support", Path: []string{}},
+		}, report.Files)
+		assert.Equal(t, []string{"support-welcome"}, report.Missing)
+
+		var buf bytes.Buffer
+		require.NoError(t, report.WriteJSON(&buf))
+		var decoded AuditReport
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+		assert.Equal(t, *report, decoded)
+		assert.Contains(t, buf.String(), `"missing": [`)
+	})
+
+	t.Run("handler panic", func(t *testing.T) {
+		_, err := Audit(agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			choice, err := s.GetOption("menu", "1", 0)
+			if choice == "1" {
+				panic("no such branch")
+			}
+			return err
+		}), AuditOptions{})
+		assert.ErrorContains(t, err, `input ["1"]`)
+		assert.ErrorContains(t, err, "no such branch")
+	})
+}
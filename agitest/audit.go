@@ -0,0 +1,300 @@
+package agitest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// DefaultAuditDepth is how many keys a path explored by Audit may press
+const DefaultAuditDepth = 6
+
+// DefaultAuditRepeats is how many times Audit lets a run repeat a media
+// command without new input before it hangs up the run as a loop
+const DefaultAuditRepeats = 3
+
+// DefaultAuditRuns is how many times Audit runs the handler at most
+const DefaultAuditRuns = 1000
+
+// auditRunCommands is how many commands one run may send before Audit
+// hangs it up, for handlers looping without media commands
+const auditRunCommands = 10000
+
+// allKeys are the keys WAIT FOR DIGIT accepts
+const allKeys = "0123456789*#"
+
+// hangupResponse ends a run: every later command fails with agi.ErrHangup
+const hangupResponse = "511 Command Not Permitted on a dead channel or intercept routine"
+
+// AuditOptions configures Audit
+type AuditOptions struct {
+	// MaxDepth is how many keys a path may press, DefaultAuditDepth when
+	// zero
+	MaxDepth int
+	// MaxRepeats is how many times a run may repeat the same media command
+	// once its keys are used up, DefaultAuditRepeats when zero. The run is
+	// then hung up, so a menu replaying itself on timeout ends.
+	MaxRepeats int
+	// MaxRuns caps the number of runs, DefaultAuditRuns when zero; the
+	// report is Truncated when paths were left unexplored
+	MaxRuns int
+	// DataInputs are the inputs tried for GET DATA besides none, by default
+	// each single key but #
+	DataInputs []string
+	// Scripts are the agi_network_script values to explore, such as the
+	// routes of an agi.Mux; when empty the handler is explored once with
+	// the environment Options give
+	Scripts []string
+	// Exists, when set, is asked about every file found, such as with
+	// agi.AgiSession.SoundExists on a live session, and the files it
+	// reports missing are listed in AuditReport.Missing
+	Exists func(file string) (bool, error)
+	// Options configure the DryRun of each run, such as WithVariable
+	Options []Option
+}
+
+// AuditReport is the outcome of Audit
+type AuditReport struct {
+	// Files are the sound files played on the explored paths, sorted
+	Files []AuditFile `json:"files"`
+	// Missing are the files Exists reported missing
+	Missing []string `json:"missing,omitempty"`
+	// Runs is how many times the handler ran
+	Runs int `json:"runs"`
+	// Truncated reports that MaxRuns stopped the exploration early
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// AuditFile is a sound file and the first path found to play it
+type AuditFile struct {
+	File string `json:"file"`
+	// Script is the agi_network_script the file was found under
+	Script string `json:"script,omitempty"`
+	// Path is the input of each media command before the file was played,
+	// as in NewDryRun: an empty entry is no input
+	Path []string `json:"path"`
+}
+
+// WriteJSON writes the report as indented JSON, for a script to check the
+// files on the Asterisk host
+func (r *AuditReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Audit explores the handler's menus in dry runs and reports every sound
+// file played by STREAM FILE, GET OPTION, GET DATA and the other media
+// commands, and by EXEC Playback, Background, ControlPlayback and Read.
+// Each run answers media commands from a DTMF plan as NewDryRun does; the
+// plans tried press, at each media command, every key the command accepts:
+// its escape digits, any key for WAIT FOR DIGIT, and DataInputs for GET
+// DATA.
+//
+// Paths are explored shortest first up to MaxDepth keys. A key pressed at
+// a media command already explored with that key, such as a "back to the
+// main menu" option, is not explored again, so menus looping into each
+// other end; this assumes the handler offers the same choices each time it
+// sends the same command. Handler errors are ignored: they are how runs
+// end when the dry run hangs up.
+func Audit(h agi.Handler, opts AuditOptions) (*AuditReport, error) {
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = DefaultAuditDepth
+	}
+	if opts.MaxRepeats <= 0 {
+		opts.MaxRepeats = DefaultAuditRepeats
+	}
+	if opts.MaxRuns <= 0 {
+		opts.MaxRuns = DefaultAuditRuns
+	}
+	if opts.DataInputs == nil {
+		for _, key := range strings.TrimSuffix(allKeys, "#") {
+			opts.DataInputs = append(opts.DataInputs, string(key))
+		}
+	}
+	scripts := opts.Scripts
+	if len(scripts) == 0 {
+		scripts = []string{""}
+	}
+
+	a := &auditor{handler: h, opts: opts, found: make(map[string]AuditFile)}
+	for _, script := range scripts {
+		if err := a.explore(script); err != nil {
+			return nil, err
+		}
+	}
+	return a.report()
+}
+
+// auditor is the state of one Audit
+type auditor struct {
+	handler agi.Handler
+	opts    AuditOptions
+
+	runs      int
+	truncated bool
+	found     map[string]AuditFile
+}
+
+// auditPlay is a sound file a run played
+type auditPlay struct {
+	file string
+	// after is how many media commands came before it
+	after int
+}
+
+// explore runs the handler with every plan reachable under script
+func (a *auditor) explore(script string) error {
+	explored := make(map[string]bool)
+	queue := [][]string{nil}
+	for len(queue) > 0 {
+		if a.runs == a.opts.MaxRuns {
+			a.truncated = true
+			return nil
+		}
+		plan := queue[0]
+		queue = queue[1:]
+
+		media, played, err := a.run(script, plan)
+		if err != nil {
+			return err
+		}
+		for _, p := range played {
+			if _, ok := a.found[p.file]; !ok {
+				a.found[p.file] = AuditFile{File: p.file, Script: script, Path: planPrefix(plan, p.after)}
+			}
+		}
+
+		// Press each key at each media command the plan did not reach
+		for i := len(plan); i < len(media) && i < a.opts.MaxDepth; i++ {
+			for _, key := range a.keys(media[i]) {
+				choice := media[i] + "\x00" + key
+				if explored[choice] {
+					continue
+				}
+				explored[choice] = true
+				queue = append(queue, append(planPrefix(plan, i), key))
+			}
+		}
+	}
+	return nil
+}
+
+// run runs the handler once with plan and returns the media commands it
+// sent, up to where it was hung up, and the files it played
+func (a *auditor) run(script string, plan []string) (media []string, played []auditPlay, err error) {
+	a.runs++
+	opts := a.opts.Options
+	if script != "" {
+		opts = append(slices.Clip(opts), WithEnv("agi_network_script", script))
+	}
+	dry := NewDryRun(plan, opts...)
+
+	// The run is hung up once a media command without input repeats too
+	// often, or once it sent too many commands
+	commands, hungUp := 0, false
+	repeats := make(map[string]int)
+	answer := dry.respond
+	dry.respond = func(line string) string {
+		commands++
+		cmd := agi.ParseCommand(line)
+		if cmd.Class == agi.VerbMedia && len(media) >= len(plan) {
+			repeats[line]++
+			hungUp = hungUp || repeats[line] > a.opts.MaxRepeats
+		}
+		if hungUp || commands > auditRunCommands {
+			hungUp = true
+			return hangupResponse
+		}
+		for _, file := range playedFiles(cmd) {
+			played = append(played, auditPlay{file: file, after: len(media)})
+		}
+		if cmd.Class == agi.VerbMedia {
+			media = append(media, line)
+		}
+		return answer(line)
+	}
+
+	session, err := dry.Session(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	panicked := a.handle(session)
+	session.Close()
+	// The fake has stopped answering once Close returns
+	dry.Close()
+	if panicked != nil {
+		return nil, nil, fmt.Errorf("agitest: handler panicked with input %q: %v", plan, panicked)
+	}
+	return media, played, nil
+}
+
+// handle runs the handler on session and returns what it panicked with
+func (a *auditor) handle(session *agi.AgiSession) (panicked any) {
+	defer func() {
+		panicked = recover()
+	}()
+	a.handler.Handle(session.Context(), session)
+	return nil
+}
+
+// keys returns the inputs to try at the media command line
+func (a *auditor) keys(line string) []string {
+	cmd := agi.ParseCommand(line)
+	var keys string
+	switch cmd.Verb {
+	case "GET DATA":
+		return a.opts.DataInputs
+	case "WAIT FOR DIGIT":
+		keys = allKeys
+	default:
+		args := agi.SplitCommand(cmd.Args)
+		for i, spec := range commandParams[cmd.Verb] {
+			if spec.Name == "escape_digits" && i < len(args) {
+				keys = args[i]
+			}
+		}
+	}
+
+	var inputs []string
+	for _, key := range keys {
+		if strings.ContainsRune(allKeys, key) && !slices.Contains(inputs, string(key)) {
+			inputs = append(inputs, string(key))
+		}
+	}
+	return inputs
+}
+
+// report lists the files found and checks them with Exists
+func (a *auditor) report() (*AuditReport, error) {
+	r := &AuditReport{Files: make([]AuditFile, 0, len(a.found)), Runs: a.runs, Truncated: a.truncated}
+	for _, f := range a.found {
+		r.Files = append(r.Files, f)
+	}
+	slices.SortFunc(r.Files, func(x, y AuditFile) int { return strings.Compare(x.File, y.File) })
+
+	if a.opts.Exists != nil {
+		for _, f := range r.Files {
+			ok, err := a.opts.Exists(f.File)
+			if err != nil {
+				return nil, fmt.Errorf("agitest: check %s: %w", f.File, err)
+			}
+			if !ok {
+				r.Missing = append(r.Missing, f.File)
+			}
+		}
+	}
+	return r, nil
+}
+
+// planPrefix returns the first n inputs of plan, padded with no input
+func planPrefix(plan []string, n int) []string {
+	prefix := make([]string, n)
+	copy(prefix, plan)
+	return prefix
+}
@@ -0,0 +1,154 @@
+package agitest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// Clock is an agi.Clock that only moves when Advance is called, for
+// testing heartbeats, polling and timeouts without sleeping. Like the time
+// package's, its timer and ticker channels hold one pending tick and drop
+// ticks a slow receiver misses.
+type Clock struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	timers  []*fakeTimer
+}
+
+var _ agi.Clock = (*Clock)(nil)
+
+// fakeTimer is a timer or, with a period, a ticker of a Clock
+type fakeTimer struct {
+	clock  *Clock
+	when   time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewClock returns a clock reading start
+func NewClock(start time.Time) *Clock {
+	c := &Clock{now: start}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the clock's time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer firing once the clock has advanced by d
+func (c *Clock) NewTimer(d time.Duration) agi.Timer {
+	return c.add(d, 0)
+}
+
+// NewTicker returns a ticker firing every time the clock advances by d
+func (c *Clock) NewTicker(d time.Duration) agi.Ticker {
+	if d <= 0 {
+		panic("agitest: non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.add(d, d)}
+}
+
+// add registers a timer firing after d and then every period, if set
+func (c *Clock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	c.changed.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer and ticker due
+// on the way in order
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.now = t.when
+		select {
+		case t.c <- t.when:
+		default:
+		}
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+		} else {
+			c.timers = c.timers[1:]
+		}
+	}
+	c.now = end
+	c.changed.Broadcast()
+}
+
+// BlockUntil waits until n timers and tickers are pending, so a test can
+// advance the clock once the code under test has started waiting on it
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.changed.Wait()
+	}
+}
+
+// Pending returns how many timers and tickers are waiting to fire
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// remove stops t, reporting whether it was pending
+func (c *Clock) remove(t *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// C returns the channel ticks are delivered on
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops the timer, reporting whether it was pending
+func (t *fakeTimer) Stop() bool {
+	return t.clock.remove(t)
+}
+
+// fakeTicker adapts a periodic fakeTimer to agi.Ticker
+type fakeTicker struct {
+	t *fakeTimer
+}
+
+// C returns the channel ticks are delivered on
+func (t fakeTicker) C() <-chan time.Time {
+	return t.t.c
+}
+
+// Stop stops the ticker
+func (t fakeTicker) Stop() {
+	t.t.Stop()
+}
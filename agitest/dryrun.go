@@ -0,0 +1,178 @@
+package agitest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// DryRunEndPos is the playback offset dry runs report for prompts, so they
+// look played rather than missing
+const DryRunEndPos = 8000
+
+// DryRun is a Fake for checking which commands a handler attempts without a
+// scripted response per command. Commands are classified with
+// agi.VerbClasses: mutating ones are recorded and answered with success,
+// read-only ones are answered from the variables set with WithVariable, and
+// media ones take the caller's input from a DTMF plan.
+type DryRun struct {
+	*Fake
+
+	mu   sync.Mutex
+	plan []string
+}
+
+// NewDryRun returns a dry run answering media commands from plan in order.
+// Each entry is the input for one media command: the key pressed during a
+// prompt, WAIT FOR DIGIT or RECORD FILE, or all the digits entered for GET
+// DATA. An empty entry, or running out of entries, is no input.
+func NewDryRun(plan []string, opts ...Option) *DryRun {
+	d := &DryRun{Fake: NewFake(nil, opts...), plan: plan}
+	d.respond = d.answer
+	if d.variables == nil {
+		d.variables = make(map[string]string)
+	}
+	return d
+}
+
+// answer returns the synthetic response to cmd
+func (d *DryRun) answer(line string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cmd := agi.ParseCommand(line)
+	switch cmd.Class {
+	case agi.VerbMedia:
+		return d.media(cmd)
+	case agi.VerbReadOnly:
+		return d.read(cmd)
+	}
+
+	switch cmd.Verb {
+	case "ANSWER", "EXEC":
+		return "200 result=0"
+	case "SET VARIABLE":
+		// Later reads see the value, so flows that set and read back work
+		name, value, _ := strings.Cut(cmd.Args, " ")
+		d.variables[name] = agi.UnescapeString(strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`))
+	}
+	return "200 result=1"
+}
+
+// media answers a media command with the next planned input
+func (d *DryRun) media(cmd agi.PolicyCommand) string {
+	var input string
+	if len(d.plan) > 0 {
+		input, d.plan = d.plan[0], d.plan[1:]
+	}
+
+	if cmd.Verb == "GET DATA" {
+		if input == "" {
+			return "200 result= (timeout)"
+		}
+		return "200 result=" + input
+	}
+
+	result := 0
+	if input != "" {
+		result = int(input[0])
+	}
+	switch cmd.Verb {
+	case "STREAM FILE", "CONTROL STREAM FILE", "GET OPTION", "RECORD FILE":
+		return fmt.Sprintf("200 result=%d endpos=%d", result, DryRunEndPos)
+	}
+	return fmt.Sprintf("200 result=%d", result)
+}
+
+// read answers a read-only command from the dry run's variables
+func (d *DryRun) read(cmd agi.PolicyCommand) string {
+	switch cmd.Verb {
+	case "CHANNEL STATUS":
+		return "200 result=6"
+	case "GET VARIABLE", "GET FULL VARIABLE":
+		name := strings.Trim(cmd.Args, `"`)
+		if cmd.Verb == "GET FULL VARIABLE" {
+			name = strings.TrimSuffix(strings.TrimPrefix(name, "${"), "}")
+		}
+		if value, ok := d.variables[name]; ok {
+			return fmt.Sprintf("200 result=1 (%s)", value)
+		}
+		return "200 result=0"
+	case "DATABASE GET":
+		return "200 result=0"
+	}
+	return "200 result=1"
+}
+
+// Attempts returns the commands received so far, parsed and classified
+func (d *DryRun) Attempts() []agi.PolicyCommand {
+	commands := d.Commands()
+	attempts := make([]agi.PolicyCommand, len(commands))
+	for i, cmd := range commands {
+		attempts[i] = agi.ParseCommand(cmd)
+	}
+	return attempts
+}
+
+// Mutations returns the attempted commands that would have changed the call
+func (d *DryRun) Mutations() []agi.PolicyCommand {
+	var mutations []agi.PolicyCommand
+	for _, cmd := range d.Attempts() {
+		if cmd.Class == agi.VerbMutating {
+			mutations = append(mutations, cmd)
+		}
+	}
+	return mutations
+}
+
+// Attempted returns the attempts matching name, such as "SET VARIABLE" or
+// "EXEC Dial", matched as in agi.DenyCommands
+func (d *DryRun) Attempted(name string) []agi.PolicyCommand {
+	var matched []agi.PolicyCommand
+	for _, cmd := range d.Attempts() {
+		if cmd.Matches(name) {
+			matched = append(matched, cmd)
+		}
+	}
+	return matched
+}
+
+// TestingT is the part of testing.T the dry run assertions use
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// AssertNotAttempted fails t for each named command that was attempted and
+// reports whether none were
+func (d *DryRun) AssertNotAttempted(t TestingT, names ...string) bool {
+	t.Helper()
+	ok := true
+	for _, name := range names {
+		for _, cmd := range d.Attempted(name) {
+			t.Errorf("dry run: %s was attempted: %s", name, cmd.Command)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// AssertAttemptedInOrder fails t unless the named commands were attempted
+// in this order, other commands being allowed between them, and reports
+// whether they were
+func (d *DryRun) AssertAttemptedInOrder(t TestingT, names ...string) bool {
+	t.Helper()
+	next := 0
+	for _, cmd := range d.Attempts() {
+		if next < len(names) && cmd.Matches(names[next]) {
+			next++
+		}
+	}
+	if next < len(names) {
+		t.Errorf("dry run: %s was not attempted after %v; attempted %v", names[next], names[:next], d.Commands())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package agitest
+
+import (
+	"fmt"
+	"sync"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// MockSession is an in-memory agi.Session for unit testing handlers written
+// against that interface, without any AGI protocol. It records each call as
+// the AGI command it stands for, keeps channel variables in a map and
+// returns scripted input for GetData. The commands are recorded in its
+// Recorder.
+type MockSession struct {
+	Recorder
+
+	// Env is returned by GetEnv
+	Env map[string]string
+	// Variables holds channel variables read by GetVariable and written by
+	// SetVariable
+	Variables map[string]string
+	// Input is returned by successive GetData calls; running out is no input
+	Input []string
+	// Err, when set, is returned by every method except GetEnv
+	Err error
+
+	mu     sync.Mutex
+	hungUp bool
+}
+
+var _ agi.Session = (*MockSession)(nil)
+
+// NewMockSession returns a mock with an empty environment and no variables
+// that answers GetData with input in order
+func NewMockSession(input ...string) *MockSession {
+	return &MockSession{
+		Env:       make(map[string]string),
+		Variables: make(map[string]string),
+		Input:     input,
+	}
+}
+
+// record notes a call and returns the error it should fail with
+func (m *MockSession) record(format string, args ...any) error {
+	m.add(fmt.Sprintf(format, args...))
+	if m.Err != nil {
+		return m.Err
+	}
+	if m.hungUp {
+		return agi.ErrHangup
+	}
+	return nil
+}
+
+// Answer implements agi.Session
+func (m *MockSession) Answer() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.record("ANSWER")
+}
+
+// Hangup implements agi.Session. Later calls fail with agi.ErrHangup.
+func (m *MockSession) Hangup() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.record("HANGUP")
+	m.hungUp = true
+	return err
+}
+
+// StreamFile implements agi.Session
+func (m *MockSession) StreamFile(filename string, escapeDigits string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.record("STREAM FILE %s %q", filename, escapeDigits)
+}
+
+// GetData implements agi.Session
+func (m *MockSession) GetData(filename string, timeout, maxDigits int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.record("GET DATA %s %d %d", filename, timeout, maxDigits); err != nil {
+		return "", err
+	}
+	if len(m.Input) == 0 {
+		return "", nil
+	}
+	digits := m.Input[0]
+	m.Input = m.Input[1:]
+	return digits, nil
+}
+
+// GetVariable implements agi.Session
+func (m *MockSession) GetVariable(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.record("GET VARIABLE %s", name); err != nil {
+		return "", err
+	}
+	return m.Variables[name], nil
+}
+
+// SetVariable implements agi.Session
+func (m *MockSession) SetVariable(name, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.record("SET VARIABLE %s %q", name, value); err != nil {
+		return err
+	}
+	m.Variables[name] = value
+	return nil
+}
+
+// Verbose implements agi.Session
+func (m *MockSession) Verbose(message string, level int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.record("VERBOSE %q %d", message, level)
+}
+
+// GetEnv implements agi.Session
+func (m *MockSession) GetEnv(key string) string {
+	return m.Env[key]
+}
@@ -0,0 +1,187 @@
+package agitest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// Recorder is the log of commands a Fake or MockSession received, with
+// assertions for handler tests. The assertions parse commands with
+// agi.ParseCommand and agi.SplitCommand, so "welcome" matches a prompt
+// played by STREAM FILE, GET DATA or EXEC Playback alike but not a prompt
+// named "welcome-back". Failures list every command received.
+type Recorder struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+// add appends cmd to the log
+func (r *Recorder) add(cmd string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, cmd)
+}
+
+// Commands returns the commands received so far
+func (r *Recorder) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+// ExpectPlayed fails t unless file was played and reports whether it was
+func (r *Recorder) ExpectPlayed(t TestingT, file string) bool {
+	t.Helper()
+	return r.ExpectPlayedInOrder(t, file)
+}
+
+// ExpectPlayedInOrder fails t unless files were played in this order,
+// other prompts being allowed between them, and reports whether they were
+func (r *Recorder) ExpectPlayedInOrder(t TestingT, files ...string) bool {
+	t.Helper()
+	commands := r.Commands()
+	next := 0
+	for _, line := range commands {
+		for _, file := range playedFiles(agi.ParseCommand(line)) {
+			if next < len(files) && file == files[next] {
+				next++
+			}
+		}
+	}
+	if next < len(files) {
+		if next == 0 {
+			t.Errorf("agitest: %s was not played\n%s", files[next], timeline(commands))
+		} else {
+			t.Errorf("agitest: %s was not played after %v\n%s", files[next], files[:next], timeline(commands))
+		}
+		return false
+	}
+	return true
+}
+
+// ExpectVariableSet fails t unless the channel variable name was set to
+// value and reports whether it was
+func (r *Recorder) ExpectVariableSet(t TestingT, name, value string) bool {
+	t.Helper()
+	commands := r.Commands()
+	var values []string
+	for _, line := range commands {
+		if got, ok := variableSet(agi.ParseCommand(line), name); ok {
+			if got == value {
+				return true
+			}
+			values = append(values, fmt.Sprintf("%q", got))
+		}
+	}
+	if len(values) == 0 {
+		t.Errorf("agitest: %s was not set, expected %q\n%s", name, value, timeline(commands))
+	} else {
+		t.Errorf("agitest: %s was set to %s, expected %q\n%s", name, strings.Join(values, " then "), value, timeline(commands))
+	}
+	return false
+}
+
+// ExpectHangup fails t unless the session hung up its channel and reports
+// whether it did
+func (r *Recorder) ExpectHangup(t TestingT) bool {
+	t.Helper()
+	commands := r.Commands()
+	for _, line := range commands {
+		cmd := agi.ParseCommand(line)
+		if (cmd.Verb == "HANGUP" && cmd.Args == "") || cmd.App == "HANGUP" {
+			return true
+		}
+	}
+	t.Errorf("agitest: the channel was not hung up\n%s", timeline(commands))
+	return false
+}
+
+// ExpectNoCommand fails t if a command matching name, such as
+// "SET VARIABLE" or "EXEC Dial", was received, matched as in
+// agi.DenyCommands, and reports whether none was
+func (r *Recorder) ExpectNoCommand(t TestingT, name string) bool {
+	t.Helper()
+	commands := r.Commands()
+	for i, line := range commands {
+		if agi.ParseCommand(line).Matches(name) {
+			t.Errorf("agitest: %s was sent as command %d\n%s", name, i+1, timeline(commands))
+			return false
+		}
+	}
+	return true
+}
+
+// commandParams are the parameters of each command verb in the catalog
+var commandParams = func() map[string][]agi.ParamSpec {
+	params := make(map[string][]agi.ParamSpec)
+	for _, spec := range agi.Commands() {
+		params[spec.Verb] = spec.Params
+	}
+	return params
+}()
+
+// playbackApps are the dialplan applications that play prompts, and the
+// position of the prompts among their arguments
+var playbackApps = map[string]int{"PLAYBACK": 0, "BACKGROUND": 0, "CONTROLPLAYBACK": 0, "READ": 1}
+
+// playedFiles returns the prompts cmd plays: the file parameters of media
+// commands in the agi.Commands catalog, but the file RECORD FILE writes,
+// and the prompts of EXEC Playback and the like
+func playedFiles(cmd agi.PolicyCommand) []string {
+	args := agi.SplitCommand(cmd.Args)
+	if len(args) == 0 {
+		return nil
+	}
+	if cmd.Verb == "EXEC" {
+		pos, ok := playbackApps[cmd.App]
+		if !ok {
+			return nil
+		}
+		if appArgs := strings.Split(args[0], ","); pos < len(appArgs) && appArgs[pos] != "" {
+			return strings.Split(appArgs[pos], "&")
+		}
+		return nil
+	}
+	if cmd.Class != agi.VerbMedia || cmd.Verb == "RECORD FILE" {
+		return nil
+	}
+
+	var files []string
+	for i, spec := range commandParams[cmd.Verb] {
+		if spec.Type == agi.ParamFile && i < len(args) {
+			files = append(files, args[i])
+		}
+	}
+	return files
+}
+
+// variableSet returns the value cmd sets the variable name to, if it sets
+// it at all
+func variableSet(cmd agi.PolicyCommand, name string) (string, bool) {
+	args := agi.SplitCommand(cmd.Args)
+	switch {
+	case cmd.Verb == "SET VARIABLE" && len(args) == 2 && args[0] == name:
+		return args[1], true
+	case cmd.App == "SET" && len(args) == 1:
+		if got, value, ok := strings.Cut(args[0], "="); ok && got == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// timeline formats commands as a numbered list for failure messages
+func timeline(commands []string) string {
+	if len(commands) == 0 {
+		return "no commands were received"
+	}
+	var b strings.Builder
+	b.WriteString("commands received:")
+	for i, cmd := range commands {
+		fmt.Fprintf(&b, "\n%4d. %s", i+1, cmd)
+	}
+	return b.String()
+}
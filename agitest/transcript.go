@@ -0,0 +1,110 @@
+package agitest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// ParseTranscript reads a transcript written in either agi.TranscriptText
+// or agi.TranscriptJSON format, detecting the format line by line
+func ParseTranscript(r io.Reader) ([]agi.TranscriptRecord, error) {
+	var records []agi.TranscriptRecord
+	var pending *agi.Exchange
+	var pendingID string
+
+	flush := func() {
+		if pending != nil {
+			records = append(records, agi.NewTranscriptRecord(pendingID, *pending))
+			pending = nil
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, agi.DefaultMaxLineSize*2)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+		case strings.HasPrefix(line, "{"):
+			flush()
+			var record agi.TranscriptRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			records = append(records, record)
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 5)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: malformed transcript line", n)
+		}
+		ts, err := time.Parse(agi.TranscriptTimeFormat, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		elapsed, err := time.ParseDuration(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		uniqueID := fields[1]
+		if uniqueID == "-" {
+			uniqueID = ""
+		}
+		var rest string
+		if len(fields) == 5 {
+			rest = fields[4]
+		}
+
+		switch fields[3] {
+		case ">":
+			flush()
+			pending = &agi.Exchange{Time: ts, Command: rest, Elapsed: elapsed}
+			pendingID = uniqueID
+		case "<", "!":
+			if pending == nil {
+				return nil, fmt.Errorf("line %d: response without a command", n)
+			}
+			if fields[3] == "<" {
+				pending.Response = rest
+			} else {
+				pending.Err = errors.New(rest)
+			}
+			flush()
+		default:
+			return nil, fmt.Errorf("line %d: unknown marker %q", n, fields[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return records, nil
+}
+
+// Replay creates a Fake answering with the responses recorded in a
+// transcript, so a handler can be run again against a call it handled
+// before. The transcript must have been written without redacting
+// responses. Replay stops at the first exchange that failed.
+func Replay(records []agi.TranscriptRecord, opts ...Option) *Fake {
+	var responses []string
+	for _, record := range records {
+		e := record.Exchange()
+		if e.Err != nil || e.Response == "" {
+			break
+		}
+		responses = append(responses, e.Response)
+	}
+	if len(records) > 0 && records[0].UniqueID != "" {
+		opts = append([]Option{WithEnv("agi_uniqueid", records[0].UniqueID)}, opts...)
+	}
+	return NewFake(responses, opts...)
+}
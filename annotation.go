@@ -0,0 +1,72 @@
+package agi
+
+import "strings"
+
+// Annotation is the word Asterisk places in parentheses after the result
+// of some commands to say how they ended, such as "(timeout)" in
+// "200 result=0 (timeout) endpos=16000"
+type Annotation string
+
+// Annotations sent by res_agi
+const (
+	// AnnotationNone means the response carried no known annotation
+	AnnotationNone Annotation = ""
+	// AnnotationTimeout is sent by GET DATA, RECORD FILE and SPEECH
+	// RECOGNIZE when no input arrived in time
+	AnnotationTimeout Annotation = "timeout"
+	// AnnotationDTMF is sent by RECORD FILE when a digit ended the recording
+	AnnotationDTMF Annotation = "dtmf"
+	// AnnotationHangup is sent by RECORD FILE when the channel hung up
+	AnnotationHangup Annotation = "hangup"
+	// AnnotationRandomError is sent by RECORD FILE when reading a frame failed
+	AnnotationRandomError Annotation = "randomerror"
+	// AnnotationWriteFile is sent by RECORD FILE when the file could not be
+	// written
+	AnnotationWriteFile Annotation = "writefile"
+	// AnnotationWaitFor is sent by RECORD FILE when waiting for audio failed
+	AnnotationWaitFor Annotation = "waitfor"
+	// AnnotationSpeech is sent by SPEECH RECOGNIZE with recognition results
+	AnnotationSpeech Annotation = "speech"
+	// AnnotationDigit is sent by SPEECH RECOGNIZE when a digit interrupted it
+	AnnotationDigit Annotation = "digit"
+)
+
+// timeoutVerbs are the commands that annotate a timeout, the only ones
+// whose responses set AgiResponse.Timeout
+var timeoutVerbs = map[string]bool{
+	"GET DATA":         true,
+	"GET OPTION":       true,
+	"WAIT FOR DIGIT":   true,
+	"RECORD FILE":      true,
+	"SPEECH RECOGNIZE": true,
+}
+
+// annotations is the set ParseAnnotation recognizes
+var annotations = map[Annotation]bool{
+	AnnotationTimeout:     true,
+	AnnotationDTMF:        true,
+	AnnotationHangup:      true,
+	AnnotationRandomError: true,
+	AnnotationWriteFile:   true,
+	AnnotationWaitFor:     true,
+	AnnotationSpeech:      true,
+	AnnotationDigit:       true,
+}
+
+// ParseAnnotation returns the annotation that starts data, the text after
+// the result in a response, or AnnotationNone when it does not start with
+// a known annotation. Commands such as GET VARIABLE return values in the
+// same parentheses, so a variable holding "timeout" reads as an annotation;
+// wrappers only consult it for commands that send annotations.
+func ParseAnnotation(data string) Annotation {
+	first, _, _ := strings.Cut(strings.TrimSpace(data), " ")
+	word, ok := strings.CutPrefix(first, "(")
+	if !ok {
+		return AnnotationNone
+	}
+	word, ok = strings.CutSuffix(word, ")")
+	if !ok || !annotations[Annotation(word)] {
+		return AnnotationNone
+	}
+	return Annotation(word)
+}
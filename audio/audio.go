@@ -0,0 +1,239 @@
+// Package audio detects silence and tones in raw PCM streams, such as the
+// caller's audio an EAGI script reads from file descriptor 3.
+package audio
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// ErrNotDetected is returned when a stream ends before the detector found
+// what it was looking for
+var ErrNotDetected = errors.New("audio: not detected before the stream ended")
+
+// FrameDuration is how much audio the detectors analyze at a time. Silence
+// and tones are found to within one frame.
+const FrameDuration = 20 * time.Millisecond
+
+// DefaultSilenceThreshold is the RMS level, as a fraction of full scale,
+// below which SilenceDetector treats audio as silence. It is about -40dBFS,
+// above line noise and below quiet speech.
+const DefaultSilenceThreshold = 0.01
+
+// DefaultToneThreshold is the fraction of a frame's energy ToneDetector
+// requires at its frequency. A clean tone scores close to 1 and speech or
+// noise far less.
+const DefaultToneThreshold = 0.5
+
+// minToneLevel is the RMS level below which a frame is too quiet to hold a
+// tone, so silence with a faint hum does not match
+const minToneLevel = 0.005
+
+// Format describes raw PCM audio. The zero value is SLIN.
+type Format struct {
+	// SampleRate is the number of samples per second
+	SampleRate int
+	// SampleWidth is the size of a sample in bytes: 1 for unsigned 8-bit
+	// samples or 2 for signed little-endian 16-bit samples
+	SampleWidth int
+}
+
+// SLIN is the 8kHz signed 16-bit mono audio Asterisk sends EAGI scripts
+var SLIN = Format{SampleRate: 8000, SampleWidth: 2}
+
+// withDefaults returns f with zero fields taken from SLIN
+func (f Format) withDefaults() (Format, error) {
+	if f.SampleRate == 0 {
+		f.SampleRate = SLIN.SampleRate
+	}
+	if f.SampleWidth == 0 {
+		f.SampleWidth = SLIN.SampleWidth
+	}
+	if f.SampleRate < 0 || (f.SampleWidth != 1 && f.SampleWidth != 2) {
+		return f, fmt.Errorf("audio: unsupported format %d Hz, %d bytes per sample", f.SampleRate, f.SampleWidth)
+	}
+	return f, nil
+}
+
+// frameSamples returns how many samples a frame holds
+func (f Format) frameSamples() int {
+	return max(1, f.SampleRate*int(FrameDuration)/int(time.Second))
+}
+
+// frameReader reads a stream a frame at a time as samples scaled to [-1, 1]
+type frameReader struct {
+	r       io.Reader
+	format  Format
+	buf     []byte
+	samples []float64
+	frames  int
+}
+
+// newFrameReader returns a frameReader for r in format
+func newFrameReader(r io.Reader, format Format) (*frameReader, error) {
+	format, err := format.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	n := format.frameSamples()
+	return &frameReader{
+		r:       r,
+		format:  format,
+		buf:     make([]byte, n*format.SampleWidth),
+		samples: make([]float64, n),
+	}, nil
+}
+
+// next reads the next frame, returning ErrNotDetected at the end of the
+// stream and ctx's error once it is done
+func (fr *frameReader) next(ctx context.Context) ([]float64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(fr.r, fr.buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotDetected
+		}
+		return nil, err
+	}
+	for i := range fr.samples {
+		if fr.format.SampleWidth == 1 {
+			fr.samples[i] = (float64(fr.buf[i]) - 128) / 128
+		} else {
+			fr.samples[i] = float64(int16(binary.LittleEndian.Uint16(fr.buf[2*i:]))) / 32768
+		}
+	}
+	fr.frames++
+	return fr.samples, nil
+}
+
+// elapsed returns how much audio the frames read so far hold
+func (fr *frameReader) elapsed() time.Duration {
+	return time.Duration(fr.frames) * FrameDuration
+}
+
+// energy returns the sum of the squared samples
+func energy(samples []float64) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += s * s
+	}
+	return sum
+}
+
+// rms returns the root mean square level of samples
+func rms(samples []float64) float64 {
+	return math.Sqrt(energy(samples) / float64(len(samples)))
+}
+
+// SilenceDetector finds a stretch of continuous silence, such as a caller
+// who stopped talking
+type SilenceDetector struct {
+	// Format is the stream's format, SLIN when zero
+	Format Format
+	// Threshold is the RMS level, as a fraction of full scale, below which
+	// audio is silence. Defaults to DefaultSilenceThreshold.
+	Threshold float64
+	// Duration is how long the silence must last
+	Duration time.Duration
+}
+
+// Wait reads r until Duration of continuous silence, returning how far
+// into the stream the silence ended. It returns ErrNotDetected when r ends
+// first. ctx is checked between frames, so it cannot interrupt a read that
+// blocks.
+func (d SilenceDetector) Wait(ctx context.Context, r io.Reader) (time.Duration, error) {
+	fr, err := newFrameReader(r, d.Format)
+	if err != nil {
+		return 0, err
+	}
+	threshold := d.Threshold
+	if threshold <= 0 {
+		threshold = DefaultSilenceThreshold
+	}
+
+	var silent time.Duration
+	for {
+		samples, err := fr.next(ctx)
+		if err != nil {
+			return fr.elapsed(), err
+		}
+		if rms(samples) >= threshold {
+			silent = 0
+			continue
+		}
+		silent += FrameDuration
+		if silent >= d.Duration {
+			return fr.elapsed(), nil
+		}
+	}
+}
+
+// ToneDetector finds a steady tone at one frequency, such as the 2100Hz
+// answer tone of a fax machine or an answering machine's beep, with the
+// Goertzel algorithm
+type ToneDetector struct {
+	// Format is the stream's format, SLIN when zero
+	Format Format
+	// Frequency is the tone's frequency in Hz
+	Frequency float64
+	// MinDuration is how long the tone must last
+	MinDuration time.Duration
+	// Threshold is the fraction of a frame's energy that must be at
+	// Frequency. Defaults to DefaultToneThreshold.
+	Threshold float64
+}
+
+// Detect reads r until the tone has lasted MinDuration, returning how far
+// into the stream it started. It returns ErrNotDetected when r ends first.
+// ctx is checked between frames, so it cannot interrupt a read that blocks.
+func (d ToneDetector) Detect(ctx context.Context, r io.Reader) (time.Duration, error) {
+	fr, err := newFrameReader(r, d.Format)
+	if err != nil {
+		return 0, err
+	}
+	if d.Frequency <= 0 || d.Frequency >= float64(fr.format.SampleRate)/2 {
+		return 0, fmt.Errorf("audio: tone frequency %g Hz is outside the %d Hz stream's range", d.Frequency, fr.format.SampleRate)
+	}
+	threshold := d.Threshold
+	if threshold <= 0 {
+		threshold = DefaultToneThreshold
+	}
+
+	coeff := 2 * math.Cos(2*math.Pi*d.Frequency/float64(fr.format.SampleRate))
+	var toneFor time.Duration
+	for {
+		samples, err := fr.next(ctx)
+		if err != nil {
+			return fr.elapsed(), err
+		}
+		if toneScore(samples, coeff) < threshold || rms(samples) < minToneLevel {
+			toneFor = 0
+			continue
+		}
+		toneFor += FrameDuration
+		if toneFor >= d.MinDuration {
+			return fr.elapsed() - toneFor, nil
+		}
+	}
+}
+
+// toneScore returns the fraction of the energy of samples at the frequency
+// coeff was computed for: about 1 for a pure tone at that frequency
+func toneScore(samples []float64, coeff float64) float64 {
+	var s1, s2 float64
+	for _, x := range samples {
+		s1, s2 = x+coeff*s1-s2, s1
+	}
+	power := s1*s1 + s2*s2 - coeff*s1*s2
+	total := energy(samples)
+	if total == 0 {
+		return 0
+	}
+	return power / (total * float64(len(samples)) / 2)
+}
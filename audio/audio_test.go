@@ -0,0 +1,151 @@
+package audio
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// samples returns d of 8kHz audio whose nth sample is fn(n), as SLIN
+func samples(d time.Duration, fn func(n int) float64) []byte {
+	n := int(d.Seconds() * 8000)
+	buf := make([]byte, 2*n)
+	for i := range n {
+		binary.LittleEndian.PutUint16(buf[2*i:], uint16(int16(fn(i)*32767)))
+	}
+	return buf
+}
+
+// sine returns d of a tone at freq Hz and amplitude amp
+func sine(d time.Duration, freq, amp float64) []byte {
+	return samples(d, func(n int) float64 { return amp * math.Sin(2*math.Pi*freq*float64(n)/8000) })
+}
+
+// silence returns d of digital silence
+func silence(d time.Duration) []byte {
+	return samples(d, func(int) float64 { return 0 })
+}
+
+// noise returns d of white noise at amplitude amp, the same on every call
+func noise(d time.Duration, amp float64) []byte {
+	rng := rand.New(rand.NewSource(1))
+	return samples(d, func(int) float64 { return amp * (2*rng.Float64() - 1) })
+}
+
+// stream joins fixtures into one reader
+func stream(parts ...[]byte) *bytes.Reader {
+	return bytes.NewReader(bytes.Join(parts, nil))
+}
+
+func TestSilenceDetector(t *testing.T) {
+	ms := time.Millisecond
+	detector := SilenceDetector{Duration: 400 * ms}
+
+	t.Run("after speech", func(t *testing.T) {
+		at, err := detector.Wait(context.Background(), stream(noise(500*ms, 0.3), silence(time.Second)))
+		require.NoError(t, err)
+		assert.Equal(t, 900*ms, at)
+	})
+
+	t.Run("quiet noise is silence", func(t *testing.T) {
+		at, err := detector.Wait(context.Background(), stream(sine(200*ms, 440, 0.5), noise(time.Second, 0.005)))
+		require.NoError(t, err)
+		assert.Equal(t, 600*ms, at)
+	})
+
+	t.Run("pause too short", func(t *testing.T) {
+		_, err := detector.Wait(context.Background(), stream(noise(300*ms, 0.3), silence(300*ms), noise(300*ms, 0.3)))
+		assert.ErrorIs(t, err, ErrNotDetected)
+	})
+
+	t.Run("threshold", func(t *testing.T) {
+		loud := SilenceDetector{Duration: 400 * ms, Threshold: 0.5}
+		at, err := loud.Wait(context.Background(), stream(noise(time.Second, 0.3)))
+		require.NoError(t, err)
+		assert.Equal(t, 400*ms, at)
+	})
+
+	t.Run("8-bit samples", func(t *testing.T) {
+		pcm := make([]byte, 8000)
+		for i := range pcm {
+			pcm[i] = 128
+			if i < 2400 {
+				pcm[i] = byte(128 + 100*math.Sin(float64(i)))
+			}
+		}
+		at, err := SilenceDetector{Format: Format{SampleRate: 8000, SampleWidth: 1}, Duration: 400 * ms}.
+			Wait(context.Background(), bytes.NewReader(pcm))
+		require.NoError(t, err)
+		assert.Equal(t, 700*ms, at)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := detector.Wait(ctx, stream(silence(time.Second)))
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("unsupported format", func(t *testing.T) {
+		_, err := SilenceDetector{Format: Format{SampleWidth: 3}}.Wait(context.Background(), stream(silence(time.Second)))
+		assert.ErrorContains(t, err, "unsupported format")
+	})
+}
+
+func TestToneDetector(t *testing.T) {
+	ms := time.Millisecond
+	fax := ToneDetector{Frequency: 2100, MinDuration: 400 * ms}
+
+	t.Run("fax answer tone", func(t *testing.T) {
+		at, err := fax.Detect(context.Background(), stream(noise(300*ms, 0.3), sine(600*ms, 2100, 0.4), silence(200*ms)))
+		require.NoError(t, err)
+		assert.Equal(t, 300*ms, at)
+	})
+
+	t.Run("tone under noise", func(t *testing.T) {
+		tone, hiss := sine(time.Second, 2100, 0.5), noise(time.Second, 0.05)
+		mixed := make([]byte, len(tone))
+		for i := 0; i < len(tone); i += 2 {
+			sum := int16(binary.LittleEndian.Uint16(tone[i:])) + int16(binary.LittleEndian.Uint16(hiss[i:]))
+			binary.LittleEndian.PutUint16(mixed[i:], uint16(sum))
+		}
+		at, err := fax.Detect(context.Background(), bytes.NewReader(mixed))
+		require.NoError(t, err)
+		assert.Zero(t, at)
+	})
+
+	t.Run("answering machine beep", func(t *testing.T) {
+		beep := ToneDetector{Frequency: 1000, MinDuration: 200 * ms}
+		at, err := beep.Detect(context.Background(), stream(sine(500*ms, 440, 0.3), silence(100*ms), sine(300*ms, 1000, 0.6)))
+		require.NoError(t, err)
+		assert.Equal(t, 600*ms, at)
+	})
+
+	tests := []struct {
+		name  string
+		audio []byte
+	}{
+		{"other frequency", sine(time.Second, 1000, 0.4)},
+		{"noise", noise(time.Second, 0.4)},
+		{"silence", silence(time.Second)},
+		{"too short", append(sine(300*ms, 2100, 0.4), silence(300*ms)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := fax.Detect(context.Background(), bytes.NewReader(tt.audio))
+			assert.ErrorIs(t, err, ErrNotDetected)
+		})
+	}
+
+	t.Run("frequency out of range", func(t *testing.T) {
+		_, err := ToneDetector{Frequency: 4000}.Detect(context.Background(), stream(silence(time.Second)))
+		assert.ErrorContains(t, err, "outside")
+	})
+}
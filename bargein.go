@@ -0,0 +1,43 @@
+package agi
+
+// BargeInPolicy is the set of keys that interrupt prompts played with
+// DefaultEscapeDigits
+type BargeInPolicy string
+
+const (
+	// BargeInDisabled makes prompts uninterruptible. It is the default.
+	BargeInDisabled BargeInPolicy = ""
+	// BargeInAllDigits lets any key interrupt prompts
+	BargeInAllDigits BargeInPolicy = "0123456789*#"
+)
+
+// DefaultEscapeDigits passed as the escape digits of StreamFile, SayNumber,
+// SayDigits or SayDateTime uses the session's barge-in policy instead. Any
+// other value, including "", is sent as given.
+const DefaultEscapeDigits = "default"
+
+// Digits returns the escape digits the policy sends
+func (p BargeInPolicy) Digits() string {
+	return string(p)
+}
+
+// SetBargeIn sets which keys interrupt prompts played with
+// DefaultEscapeDigits from now on, such as BargeInDisabled,
+// BargeInAllDigits or a custom set like BargeInPolicy("#")
+func (s *AgiSession) SetBargeIn(policy BargeInPolicy) {
+	s.bargeIn = policy
+}
+
+// BargeIn returns the session's barge-in policy, for helpers that play
+// prompts of their own
+func (s *AgiSession) BargeIn() BargeInPolicy {
+	return s.bargeIn
+}
+
+// escapeDigits resolves DefaultEscapeDigits to the barge-in policy
+func (s *AgiSession) escapeDigits(digits string) string {
+	if digits == DefaultEscapeDigits {
+		return s.bargeIn.Digits()
+	}
+	return digits
+}
@@ -0,0 +1,233 @@
+package agi
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// DefaultCallStateTTL is how long the default in-memory store keeps a call's
+// state after it was last written
+const DefaultCallStateTTL = time.Hour
+
+// CallStateStore holds state shared by every AGI invocation for the same
+// call. Each call is a key holding named string fields, the shape of a Redis
+// hash: implementations backed by an external store can map Get, Set, Delete
+// and All onto HGET, HSET, HDEL and HGETALL, refreshing the key's expiry on
+// every Set.
+type CallStateStore interface {
+	Get(key, field string) (string, bool, error)
+	Set(key, field, value string) error
+	Delete(key, field string) error
+	All(key string) (map[string]string, error)
+}
+
+// MemoryCallStateStore is an in-process CallStateStore. A call's state
+// expires once it has not been written for the store's TTL; expired calls
+// are removed lazily as the store is used.
+type MemoryCallStateStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	calls     map[string]*memoryCall
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memoryCall struct {
+	fields  map[string]string
+	expires time.Time
+}
+
+// NewMemoryCallStateStore creates an in-memory store whose entries expire
+// after ttl, or DefaultCallStateTTL when ttl is not positive
+func NewMemoryCallStateStore(ttl time.Duration) *MemoryCallStateStore {
+	if ttl <= 0 {
+		ttl = DefaultCallStateTTL
+	}
+	return &MemoryCallStateStore{
+		ttl:   ttl,
+		calls: make(map[string]*memoryCall),
+		now:   time.Now,
+	}
+}
+
+// Get returns a field of the call's state
+func (m *MemoryCallStateStore) Get(key, field string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	call := m.live(key)
+	if call == nil {
+		return "", false, nil
+	}
+	value, ok := call.fields[field]
+	return value, ok, nil
+}
+
+// Set stores a field of the call's state and extends its expiry
+func (m *MemoryCallStateStore) Set(key, field, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+	call := m.live(key)
+	if call == nil {
+		call = &memoryCall{fields: make(map[string]string)}
+		m.calls[key] = call
+	}
+	call.fields[field] = value
+	call.expires = now.Add(m.ttl)
+	return nil
+}
+
+// Delete removes a field of the call's state
+func (m *MemoryCallStateStore) Delete(key, field string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if call := m.live(key); call != nil {
+		delete(call.fields, field)
+	}
+	return nil
+}
+
+// All returns a copy of every field of the call's state
+func (m *MemoryCallStateStore) All(key string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	call := m.live(key)
+	if call == nil {
+		return map[string]string{}, nil
+	}
+	return maps.Clone(call.fields), nil
+}
+
+// Len returns the number of calls with unexpired state
+func (m *MemoryCallStateStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep(m.now())
+	return len(m.calls)
+}
+
+// live returns the call's state, removing it first if it has expired
+func (m *MemoryCallStateStore) live(key string) *memoryCall {
+	call, ok := m.calls[key]
+	if !ok {
+		return nil
+	}
+	if !m.now().Before(call.expires) {
+		delete(m.calls, key)
+		return nil
+	}
+	return call
+}
+
+// sweep removes expired calls, at most once per TTL so writes stay cheap
+func (m *MemoryCallStateStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.ttl && !m.lastSweep.IsZero() {
+		return
+	}
+	m.lastSweep = now
+	for key, call := range m.calls {
+		if !now.Before(call.expires) {
+			delete(m.calls, key)
+		}
+	}
+}
+
+// CallState is a session's view of the state shared across every AGI
+// invocation for its call. It is safe for concurrent use. Its methods
+// return ErrNoCallState on the nil CallState returned when the server was
+// not configured with WithCallState.
+type CallState struct {
+	store CallStateStore
+	key   string
+}
+
+// Key returns the key the call's state is stored under
+func (c *CallState) Key() string {
+	if c == nil {
+		return ""
+	}
+	return c.key
+}
+
+// Get returns a value stored for the call
+func (c *CallState) Get(name string) (string, bool, error) {
+	if c == nil {
+		return "", false, ErrNoCallState
+	}
+	return c.store.Get(c.key, name)
+}
+
+// Set stores a value for the call
+func (c *CallState) Set(name, value string) error {
+	if c == nil {
+		return ErrNoCallState
+	}
+	return c.store.Set(c.key, name, value)
+}
+
+// Delete removes a value stored for the call
+func (c *CallState) Delete(name string) error {
+	if c == nil {
+		return ErrNoCallState
+	}
+	return c.store.Delete(c.key, name)
+}
+
+// All returns every value stored for the call
+func (c *CallState) All() (map[string]string, error) {
+	if c == nil {
+		return nil, ErrNoCallState
+	}
+	return c.store.All(c.key)
+}
+
+// WithCallState shares state between sessions for the same call through
+// store, exposed to handlers by AgiSession.CallState. A nil store uses a
+// MemoryCallStateStore with DefaultCallStateTTL. Calls are keyed by
+// agi_uniqueid unless changed with WithCallStateKey.
+func WithCallState(store CallStateStore) ServerOption {
+	return func(s *FastAGIServer) {
+		if store == nil {
+			store = NewMemoryCallStateStore(DefaultCallStateTTL)
+		}
+		s.callStore = store
+	}
+}
+
+// WithCallStateKey sets the function that picks the key a session's call
+// state is stored under, for example the channel's linkedid so every leg of
+// a bridged call shares state. It runs once, the first time a handler calls
+// CallState.
+func WithCallStateKey(fn func(s *AgiSession) string) ServerOption {
+	return func(s *FastAGIServer) {
+		s.callKey = fn
+	}
+}
+
+// uniqueIDKey is the default call state key
+func uniqueIDKey(s *AgiSession) string {
+	return s.GetEnv("agi_uniqueid")
+}
+
+// CallState returns the state shared by every invocation for this call, or
+// nil when the server was not configured with WithCallState
+func (s *AgiSession) CallState() *CallState {
+	if s.callStore == nil {
+		return nil
+	}
+	s.callStateOnce.Do(func() {
+		keyFn := s.callKey
+		if keyFn == nil {
+			keyFn = uniqueIDKey
+		}
+		s.callState = &CallState{store: s.callStore, key: keyFn(s)}
+	})
+	return s.callState
+}
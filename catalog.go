@@ -0,0 +1,190 @@
+package agi
+
+import "slices"
+
+// ParamType is the kind of value an AGI command parameter takes
+type ParamType string
+
+const (
+	ParamString ParamType = "string"
+	ParamInt    ParamType = "int"
+	// ParamDigits is a set of DTMF digits, such as escape digits
+	ParamDigits ParamType = "digits"
+	// ParamFile is a sound or recording file name without extension
+	ParamFile ParamType = "file"
+)
+
+// ParamSpec describes one parameter of an AGI command
+type ParamSpec struct {
+	Name     string    `json:"name"`
+	Type     ParamType `json:"type"`
+	Optional bool      `json:"optional,omitempty"`
+}
+
+// CommandSpec describes an AGI command verb
+type CommandSpec struct {
+	Verb   string      `json:"verb"`
+	Params []ParamSpec `json:"params"`
+	// Class is the verb's entry in VerbClasses
+	Class VerbClass `json:"class"`
+	// Mutating reports whether the command changes the channel, the
+	// dialplan position or the Asterisk database
+	Mutating bool `json:"mutating"`
+	// Blocking reports whether the command waits for caller input, such as
+	// DTMF, speech or a recording
+	Blocking bool `json:"blocking"`
+	// Method is the AgiSession method that wraps the command, or empty
+	// when it is only available through Command
+	Method string `json:"method,omitempty"`
+}
+
+// Parameter shorthands for commandSpecs
+var (
+	escapeDigitsParam = ParamSpec{Name: "escape_digits", Type: ParamDigits}
+	timeoutParam      = ParamSpec{Name: "timeout", Type: ParamInt}
+)
+
+// param returns a required ParamSpec for commandSpecs
+func param(name string, typ ParamType) ParamSpec {
+	return ParamSpec{Name: name, Type: typ}
+}
+
+// optional returns an optional ParamSpec for commandSpecs
+func optional(name string, typ ParamType) ParamSpec {
+	return ParamSpec{Name: name, Type: typ, Optional: true}
+}
+
+// commandSpecs is the catalog of AGI commands. Verb parsing, VerbClasses
+// and Commands all derive from it. Verbs are sorted, longest first within
+// each prefix, so that commandVerb matches "GET FULL VARIABLE" before "GET".
+var commandSpecs = []CommandSpec{
+	{Verb: "ANSWER", Class: VerbMutating, Method: "Answer"},
+	{Verb: "ASYNCAGI BREAK", Class: VerbMutating},
+	{Verb: "CHANNEL STATUS", Class: VerbReadOnly, Method: "ChannelStatus",
+		Params: []ParamSpec{optional("channelname", ParamString)}},
+	{Verb: "CONTROL STREAM FILE", Class: VerbMedia, Method: "ControlStreamFile",
+		Params: []ParamSpec{param("filename", ParamFile), escapeDigitsParam, optional("skipms", ParamInt),
+			optional("ffchar", ParamDigits), optional("rewchr", ParamDigits), optional("pausechr", ParamDigits),
+			optional("offsetms", ParamInt)}},
+	{Verb: "DATABASE DELTREE", Class: VerbMutating,
+		Params: []ParamSpec{param("family", ParamString), optional("keytree", ParamString)}},
+	{Verb: "DATABASE DEL", Class: VerbMutating, Method: "DatabaseDel",
+		Params: []ParamSpec{param("family", ParamString), param("key", ParamString)}},
+	{Verb: "DATABASE GET", Class: VerbReadOnly, Method: "DatabaseGet",
+		Params: []ParamSpec{param("family", ParamString), param("key", ParamString)}},
+	{Verb: "DATABASE PUT", Class: VerbMutating, Method: "DatabasePut",
+		Params: []ParamSpec{param("family", ParamString), param("key", ParamString), param("value", ParamString)}},
+	{Verb: "EXEC", Class: VerbMutating, Method: "Execute",
+		Params: []ParamSpec{param("application", ParamString), optional("options", ParamString)}},
+	{Verb: "GET DATA", Class: VerbMedia, Blocking: true, Method: "GetData",
+		Params: []ParamSpec{param("file", ParamFile), optional("timeout", ParamInt), optional("maxdigits", ParamInt)}},
+	{Verb: "GET FULL VARIABLE", Class: VerbReadOnly, Method: "GetFullVariable",
+		Params: []ParamSpec{param("expression", ParamString), optional("channelname", ParamString)}},
+	{Verb: "GET OPTION", Class: VerbMedia, Blocking: true, Method: "GetOption",
+		Params: []ParamSpec{param("filename", ParamFile), escapeDigitsParam, optional("timeout", ParamInt)}},
+	{Verb: "GET VARIABLE", Class: VerbReadOnly, Method: "GetVariable",
+		Params: []ParamSpec{param("variablename", ParamString)}},
+	{Verb: "GOSUB", Class: VerbMutating,
+		Params: []ParamSpec{param("context", ParamString), param("extension", ParamString),
+			param("priority", ParamString), optional("optional-argument", ParamString)}},
+	{Verb: "HANGUP", Class: VerbMutating, Method: "Hangup",
+		Params: []ParamSpec{optional("channelname", ParamString)}},
+	{Verb: "NOOP", Class: VerbReadOnly, Method: "Noop"},
+	{Verb: "RECEIVE CHAR", Class: VerbMedia, Blocking: true, Method: "ReceiveChar",
+		Params: []ParamSpec{timeoutParam}},
+	{Verb: "RECEIVE TEXT", Class: VerbMedia, Blocking: true, Method: "ReceiveText",
+		Params: []ParamSpec{timeoutParam}},
+	{Verb: "RECORD FILE", Class: VerbMedia, Blocking: true, Method: "RecordFile",
+		Params: []ParamSpec{param("filename", ParamFile), param("format", ParamString), escapeDigitsParam,
+			timeoutParam, optional("offset_samples", ParamInt), optional("BEEP", ParamString),
+			optional("s=silence", ParamInt)}},
+	{Verb: "SAY ALPHA", Class: VerbMedia, Method: "SayAlpha",
+		Params: []ParamSpec{param("number", ParamString), escapeDigitsParam}},
+	{Verb: "SAY DATETIME", Class: VerbMedia, Method: "SayDateTime",
+		Params: []ParamSpec{param("time", ParamInt), escapeDigitsParam, optional("format", ParamString),
+			optional("timezone", ParamString)}},
+	{Verb: "SAY DATE", Class: VerbMedia, Method: "SayDate",
+		Params: []ParamSpec{param("date", ParamInt), escapeDigitsParam}},
+	{Verb: "SAY DIGITS", Class: VerbMedia, Method: "SayDigits",
+		Params: []ParamSpec{param("number", ParamDigits), escapeDigitsParam}},
+	{Verb: "SAY NUMBER", Class: VerbMedia, Method: "SayNumber",
+		Params: []ParamSpec{param("number", ParamInt), escapeDigitsParam, optional("gender", ParamString)}},
+	{Verb: "SAY PHONETIC", Class: VerbMedia,
+		Params: []ParamSpec{param("string", ParamString), escapeDigitsParam}},
+	{Verb: "SAY TIME", Class: VerbMedia, Method: "SayTime",
+		Params: []ParamSpec{param("time", ParamInt), escapeDigitsParam}},
+	{Verb: "SEND IMAGE", Class: VerbMutating, Method: "SendImage",
+		Params: []ParamSpec{param("image", ParamString)}},
+	{Verb: "SEND TEXT", Class: VerbMutating, Method: "SendText",
+		Params: []ParamSpec{param("text", ParamString)}},
+	{Verb: "SET AUTOHANGUP", Class: VerbMutating,
+		Params: []ParamSpec{param("time", ParamInt)}},
+	{Verb: "SET CALLERID", Class: VerbMutating, Method: "SetCallerID",
+		Params: []ParamSpec{param("number", ParamString)}},
+	{Verb: "SET CONTEXT", Class: VerbMutating, Method: "SetContext",
+		Params: []ParamSpec{param("context", ParamString)}},
+	{Verb: "SET EXTENSION", Class: VerbMutating, Method: "SetExtension",
+		Params: []ParamSpec{param("extension", ParamString)}},
+	{Verb: "SET MUSIC", Class: VerbMutating, Method: "SetMusic",
+		Params: []ParamSpec{param("on", ParamString), optional("class", ParamString)}},
+	{Verb: "SET PRIORITY", Class: VerbMutating, Method: "SetPriority",
+		Params: []ParamSpec{param("priority", ParamString)}},
+	{Verb: "SET VARIABLE", Class: VerbMutating, Method: "SetVariable",
+		Params: []ParamSpec{param("variablename", ParamString), param("value", ParamString)}},
+	{Verb: "SPEECH ACTIVATE GRAMMAR", Class: VerbMutating, Method: "SpeechActivateGrammar",
+		Params: []ParamSpec{param("grammar_name", ParamString)}},
+	{Verb: "SPEECH CREATE", Class: VerbMutating, Method: "SpeechCreate",
+		Params: []ParamSpec{optional("engine", ParamString)}},
+	{Verb: "SPEECH DEACTIVATE GRAMMAR", Class: VerbMutating, Method: "SpeechDeactivateGrammar",
+		Params: []ParamSpec{param("grammar_name", ParamString)}},
+	{Verb: "SPEECH DESTROY", Class: VerbMutating, Method: "SpeechDestroy"},
+	{Verb: "SPEECH LOAD GRAMMAR", Class: VerbMutating, Method: "SpeechLoadGrammar",
+		Params: []ParamSpec{param("grammar_name", ParamString), param("path_to_grammar", ParamString)}},
+	{Verb: "SPEECH RECOGNIZE", Class: VerbMedia, Blocking: true, Method: "SpeechRecognize",
+		Params: []ParamSpec{param("prompt", ParamFile), timeoutParam, optional("offset", ParamInt)}},
+	{Verb: "SPEECH SET", Class: VerbMutating, Method: "SpeechSet",
+		Params: []ParamSpec{param("name", ParamString), param("value", ParamString)}},
+	{Verb: "SPEECH SYNTHESIZE", Class: VerbMedia, Method: "SpeechSpeak",
+		Params: []ParamSpec{param("text", ParamString)}},
+	{Verb: "SPEECH UNLOAD GRAMMAR", Class: VerbMutating, Method: "SpeechUnloadGrammar",
+		Params: []ParamSpec{param("grammar_name", ParamString)}},
+	{Verb: "STREAM FILE", Class: VerbMedia, Method: "StreamFile",
+		Params: []ParamSpec{param("filename", ParamFile), escapeDigitsParam, optional("sample_offset", ParamInt)}},
+	{Verb: "TDD MODE", Class: VerbMutating,
+		Params: []ParamSpec{param("boolean", ParamString)}},
+	{Verb: "VERBOSE", Class: VerbReadOnly, Method: "Verbose",
+		Params: []ParamSpec{param("message", ParamString), param("level", ParamInt)}},
+	{Verb: "WAIT FOR DIGIT", Class: VerbMedia, Blocking: true, Method: "WaitForDigit",
+		Params: []ParamSpec{timeoutParam}},
+}
+
+// Commands returns the catalog of AGI commands the package knows, in verb
+// order, for tooling such as documentation generators and linters. The
+// result is a copy; Class reflects VerbClasses as shipped, not later
+// changes to it.
+func Commands() []CommandSpec {
+	specs := slices.Clone(commandSpecs)
+	for i := range specs {
+		specs[i].Params = slices.Clone(specs[i].Params)
+		specs[i].Mutating = specs[i].Class == VerbMutating
+	}
+	return specs
+}
+
+// commandSpecVerbs returns the verbs of commandSpecs in catalog order
+func commandSpecVerbs() []string {
+	verbs := make([]string, len(commandSpecs))
+	for i, spec := range commandSpecs {
+		verbs[i] = spec.Verb
+	}
+	return verbs
+}
+
+// commandSpecClasses returns the class of each verb of commandSpecs
+func commandSpecClasses() map[string]VerbClass {
+	classes := make(map[string]VerbClass, len(commandSpecs))
+	for _, spec := range commandSpecs {
+		classes[spec.Verb] = spec.Class
+	}
+	return classes
+}
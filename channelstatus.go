@@ -0,0 +1,120 @@
+package agi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ChannelState is a channel state reported by CHANNEL STATUS
+type ChannelState int
+
+// Channel states, as numbered by Asterisk
+const (
+	ChannelDown     ChannelState = 0 // down and available
+	ChannelReserved ChannelState = 1 // down, but reserved
+	ChannelOffHook  ChannelState = 2 // off hook
+	ChannelDialing  ChannelState = 3 // digits have been dialed
+	ChannelRing     ChannelState = 4 // line is ringing
+	ChannelRinging  ChannelState = 5 // remote end is ringing
+	ChannelUp       ChannelState = 6 // line is up
+	ChannelBusy     ChannelState = 7 // line is busy
+)
+
+// DefaultChannelPoll is how often WaitForChannelState polls when no
+// interval is given
+const DefaultChannelPoll = 250 * time.Millisecond
+
+// String returns the state as Asterisk's core show channels names it
+func (c ChannelState) String() string {
+	switch c {
+	case ChannelDown:
+		return "Down"
+	case ChannelReserved:
+		return "Rsrvd"
+	case ChannelOffHook:
+		return "OffHook"
+	case ChannelDialing:
+		return "Dialing"
+	case ChannelRing:
+		return "Ring"
+	case ChannelRinging:
+		return "Ringing"
+	case ChannelUp:
+		return "Up"
+	case ChannelBusy:
+		return "Busy"
+	}
+	return fmt.Sprintf("Unknown(%d)", int(c))
+}
+
+// ChannelStateOf returns the state of the named channel, or of the
+// session's own channel when channel is empty. It returns ErrChannelGone
+// when the channel does not exist, which Asterisk reports with result=-1,
+// and also when the session's own channel is queried after it hung up,
+// which Asterisk rejects with 511.
+func (s *AgiSession) ChannelStateOf(channel string) (ChannelState, error) {
+	cmd := "CHANNEL STATUS"
+	if channel != "" {
+		cmd += " " + channel
+	}
+	resp, err := s.execute(cmd)
+	if err != nil {
+		if errors.Is(err, ErrHangup) && (channel == "" || channel == s.env["agi_channel"]) {
+			return 0, fmt.Errorf("%w: %w", ErrChannelGone, err)
+		}
+		return 0, err
+	}
+	if resp.Result < 0 {
+		if channel == "" {
+			channel = s.env["agi_channel"]
+		}
+		return 0, fmt.Errorf("%w: %s", ErrChannelGone, channel)
+	}
+	return ChannelState(resp.Result), nil
+}
+
+// WaitForChannelState polls CHANNEL STATUS for channel, or the session's
+// own channel when it is empty, every poll interval until it is in one of
+// the want states, and returns that state. Use it to wait for a channel the
+// handler just originated to answer or fail:
+//
+//	state, err := s.WaitForChannelState(ctx, "PJSIP/200-00000002",
+//		[]agi.ChannelState{agi.ChannelUp, agi.ChannelBusy}, 0)
+//
+// It returns ErrTimeout when ctx is done first and ErrChannelGone once the
+// channel no longer exists. Other failed queries, such as a hangup of the
+// session's channel while watching another, are returned as they are.
+func (s *AgiSession) WaitForChannelState(ctx context.Context, channel string, want []ChannelState, poll time.Duration) (ChannelState, error) {
+	if poll <= 0 {
+		poll = DefaultChannelPoll
+	}
+	name := channel
+	if name == "" {
+		name = s.env["agi_channel"]
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, fmt.Errorf("%w: waiting for %s: %w", ErrTimeout, name, err)
+		}
+
+		state, err := s.ChannelStateOf(channel)
+		if err != nil {
+			return 0, err
+		}
+		if slices.Contains(want, state) {
+			return state, nil
+		}
+
+		timer := s.clock().NewTimer(poll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return state, fmt.Errorf("%w: waiting for %s in state %s: %w", ErrTimeout, name, state, ctx.Err())
+		case <-timer.C():
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package agi
+
+// OnClose registers fn to run when the session closes, for cleanup such as
+// deleting temporary recordings or releasing locks that must happen however
+// the call ends. Callbacks run exactly once, most recently registered
+// first, when the FastAGI server finishes the session or Close is called.
+// They receive the session's terminal error: the handler's error, one
+// wrapping ErrHandlerPanic when it panicked, or nil. A callback registered
+// after the session closed runs immediately.
+func (s *AgiSession) OnClose(fn func(err error)) {
+	s.closeMu.Lock()
+	if !s.closed {
+		s.cleanups = append(s.cleanups, fn)
+		s.closeMu.Unlock()
+		return
+	}
+	s.closeMu.Unlock()
+	fn(nil)
+}
+
+// isClosed reports whether the session has finished
+func (s *AgiSession) isClosed() bool {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	return s.closed
+}
+
+// finish runs the OnClose callbacks in reverse order with err, once
+func (s *AgiSession) finish(err error) {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return
+	}
+	s.closed = true
+	cleanups := s.cleanups
+	s.cleanups = nil
+	s.closeMu.Unlock()
+
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i](err)
+	}
+}
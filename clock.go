@@ -0,0 +1,91 @@
+package agi
+
+import "time"
+
+// Clock is the source of time for timeouts, polling, heartbeats and
+// durations reported by sessions and servers. Tests can replace the real
+// clock with a fake one, such as agitest.Clock, to run time-dependent code
+// without sleeping. Network deadlines always use the real clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a Clock's equivalent of time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is a Clock's equivalent of time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is the Clock of the time package
+type RealClock struct{}
+
+// Now returns time.Now()
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer returns a time.Timer
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// NewTicker returns a time.Ticker
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// SetClock sets the session's clock. A nil c restores RealClock. Before
+// the first command it also restarts the session's start time on the new
+// clock, so SessionInfo durations are measured on one clock.
+func (s *AgiSession) SetClock(c Clock) {
+	s.clk = c
+	if s.sent == 0 {
+		s.start = s.clock().Now()
+	}
+}
+
+// WithClock sets the clock of the server and every session
+func WithClock(c Clock) ServerOption {
+	return func(s *FastAGIServer) {
+		s.clk = c
+	}
+}
+
+// clock returns the session's clock
+func (s *AgiSession) clock() Clock {
+	if s.clk == nil {
+		return RealClock{}
+	}
+	return s.clk
+}
+
+// clock returns the server's clock
+func (s *FastAGIServer) clock() Clock {
+	if s.clk == nil {
+		return RealClock{}
+	}
+	return s.clk
+}
+
+// since returns the time elapsed on c since t
+func since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
@@ -0,0 +1,444 @@
+package agi_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agitest"
+)
+
+// clockedSession returns a session connected to fake and driven by a fake
+// clock
+func clockedSession(t *testing.T, fake *agitest.Fake) (*agi.AgiSession, *agitest.Clock) {
+	t.Helper()
+	session, err := fake.Session(context.Background())
+	require.NoError(t, err)
+	t.Cleanup(func() { fake.Close() })
+	clock := agitest.NewClock(time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC))
+	session.SetClock(clock)
+	return session, clock
+}
+
+// blockingFake returns a fake that holds its answer to commands starting
+// with prefix until release is closed
+func blockingFake(responses []string, prefix string) (*agitest.Fake, chan struct{}) {
+	release := make(chan struct{})
+	fake := agitest.NewFake(responses, agitest.WithResponseDelay(func(cmd string) time.Duration {
+		if len(cmd) >= len(prefix) && cmd[:len(prefix)] == prefix {
+			<-release
+		}
+		return 0
+	}))
+	return fake, release
+}
+
+// timedFake returns a session connected to a fake that answers each command
+// after advancing the session's fake clock by the next gap
+func timedFake(t *testing.T, responses []string, gaps ...time.Duration) (*agi.AgiSession, *agitest.Fake) {
+	t.Helper()
+	clock := agitest.NewClock(time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC))
+	fake := agitest.NewFake(responses, agitest.WithResponseDelay(func(string) time.Duration {
+		clock.Advance(gaps[0])
+		gaps = gaps[1:]
+		return 0
+	}))
+	session, err := fake.Session(context.Background())
+	require.NoError(t, err)
+	t.Cleanup(func() { fake.Close() })
+	session.SetClock(clock)
+	return session, fake
+}
+
+type setterFunc func(channel, name, value string) error
+
+func (f setterFunc) SetChannelVariable(channel, name, value string) error {
+	return f(channel, name, value)
+}
+
+func TestSessionStartClock(t *testing.T) {
+	fake := agitest.NewFake([]string{"200 result=0"})
+	session, clock := clockedSession(t, fake)
+	start := clock.Now()
+	assert.Equal(t, start, session.Info().Start)
+
+	require.NoError(t, session.Noop())
+	clock.Advance(time.Minute)
+	session.SetClock(clock)
+	assert.Equal(t, start, session.Info().Start, "start is kept once commands were sent")
+}
+
+func TestHeartbeat(t *testing.T) {
+	const interval = 30 * time.Second
+	collect := func(session *agi.AgiSession) chan agi.Beat {
+		beats := make(chan agi.Beat, 16)
+		session.SetHeartbeatHook(func(_ *agi.AgiSession, b agi.Beat) { beats <- b })
+		return beats
+	}
+
+	t.Run("noop when idle", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=0", "200 result=0"})
+		session, clock := clockedSession(t, fake)
+		beats := collect(session)
+
+		stop := session.Heartbeat(context.Background(), interval)
+		defer stop()
+		clock.BlockUntil(1)
+		for range 2 {
+			clock.Advance(interval)
+			b := receive(t, beats, "beat")
+			assert.Equal(t, agi.HeartbeatNoop, b.Mode)
+			require.NoError(t, b.Err)
+			assert.Equal(t, clock.Now(), b.Time)
+		}
+		assert.Equal(t, []string{"NOOP", "NOOP"}, fake.Commands())
+	})
+
+	t.Run("blocked command is not interleaved", func(t *testing.T) {
+		fake, release := blockingFake([]string{"200 result=0"}, "EXEC Dial")
+		session, clock := clockedSession(t, fake)
+		beats := collect(session)
+
+		done := make(chan error, 1)
+		go func() { done <- session.Execute("Dial", "PJSIP/200,60") }()
+		require.Eventually(t, func() bool { return len(fake.Commands()) == 1 }, time.Second, time.Millisecond)
+
+		stop := session.Heartbeat(context.Background(), interval)
+		clock.BlockUntil(1)
+		for range 3 {
+			clock.Advance(interval)
+			assert.Equal(t, agi.HeartbeatSkipped, receive(t, beats, "beat").Mode)
+		}
+		stop()
+
+		close(release)
+		require.NoError(t, receive(t, done, "Dial"))
+		assert.Equal(t, []string{`EXEC Dial "PJSIP/200,60"`}, fake.Commands())
+	})
+
+	t.Run("variable setter works during a blocked command", func(t *testing.T) {
+		fake, release := blockingFake([]string{"200 result=0"}, "EXEC Dial")
+		defer close(release)
+		session, clock := clockedSession(t, fake)
+		beats := collect(session)
+		set := make(chan string, 1)
+		session.SetVariableSetter(setterFunc(func(channel, name, value string) error {
+			set <- name + "=" + value
+			return nil
+		}))
+
+		go session.Execute("Dial", "PJSIP/200,60")
+		require.Eventually(t, func() bool { return len(fake.Commands()) == 1 }, time.Second, time.Millisecond)
+
+		stop := session.Heartbeat(context.Background(), interval)
+		defer stop()
+		clock.BlockUntil(1)
+		clock.Advance(interval)
+		b := receive(t, beats, "beat")
+		assert.Equal(t, agi.HeartbeatSetVariable, b.Mode)
+		require.NoError(t, b.Err)
+		assert.Equal(t, agi.HeartbeatVariable+"=1704099630", receive(t, set, "variable"))
+	})
+
+	t.Run("stops on hangup", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"HANGUP\n200 result=0"})
+		session, clock := clockedSession(t, fake)
+		beats := collect(session)
+		require.NoError(t, session.Noop())
+		require.True(t, session.HungUp())
+
+		stop := session.Heartbeat(context.Background(), interval)
+		defer stop()
+		clock.BlockUntil(1)
+		clock.Advance(interval)
+		require.Eventually(t, func() bool { return clock.Pending() == 0 }, time.Second, time.Millisecond)
+		assert.Empty(t, beats)
+		assert.Equal(t, []string{"NOOP"}, fake.Commands())
+	})
+}
+
+// advanceExactly checks that the only pending timer fires after d and not
+// before
+func advanceExactly(t *testing.T, clock *agitest.Clock, d time.Duration) {
+	t.Helper()
+	clock.BlockUntil(1)
+	clock.Advance(d - time.Millisecond)
+	require.Equal(t, 1, clock.Pending(), "timer fired before %v", d)
+	clock.Advance(time.Millisecond)
+}
+
+func TestPollingBackoff(t *testing.T) {
+	t.Run("watch variable", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=0", "200 result=0", "200 result=0", "200 result=0", "200 result=1 (x)"})
+		session, clock := clockedSession(t, fake)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := session.WatchVariable(context.Background(), "JOB", nil, agi.WatchOptions{Interval: 2 * time.Second, MaxInterval: 4 * time.Second})
+			done <- err
+		}()
+		for _, d := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second} {
+			advanceExactly(t, clock, d)
+		}
+		require.NoError(t, receive(t, done, "WatchVariable"))
+		assert.Len(t, fake.Commands(), 5)
+	})
+
+	t.Run("wait for variable", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=0", "200 result=0", "200 result=0"})
+		session, clock := clockedSession(t, fake)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := session.WaitForVariableWith(context.Background(), "ROUTE", agi.WaitVariableOptions{
+				Poll:        2 * time.Second,
+				Backoff:     2,
+				MaxPoll:     3 * time.Second,
+				MaxAttempts: 3,
+			})
+			done <- err
+		}()
+		advanceExactly(t, clock, 2*time.Second)
+		advanceExactly(t, clock, 3*time.Second)
+		assert.ErrorIs(t, receive(t, done, "WaitForVariableWith"), agi.ErrTimeout)
+		assert.Len(t, fake.Commands(), 3)
+	})
+}
+
+func TestDigitTimings(t *testing.T) {
+	ms := time.Millisecond
+
+	t.Run("collect digits", func(t *testing.T) {
+		session, _ := timedFake(t,
+			[]string{"200 result=49", "200 result=50", "200 result=42", "200 result=51", "200 result=35"},
+			900*ms, 100*ms, 100*ms, 100*ms, 100*ms)
+		result, err := session.CollectDigitsInteractive(context.Background(), agi.CollectOptions{Timings: true})
+		require.NoError(t, err)
+		assert.Equal(t, "13", result.Digits)
+		assert.Equal(t, []time.Duration{900 * ms, 1000 * ms, 1100 * ms, 1200 * ms, 1300 * ms}, result.Timings)
+		assert.True(t, agi.SuspiciouslyUniform(result.Timings))
+	})
+
+	t.Run("not requested", func(t *testing.T) {
+		session, _ := timedFake(t, []string{"200 result=49", "200 result=35"}, 100*ms, 100*ms)
+		result, err := session.CollectDigitsInteractive(context.Background(), agi.CollectOptions{})
+		require.NoError(t, err)
+		assert.Nil(t, result.Timings)
+	})
+
+	t.Run("timeout is not a digit", func(t *testing.T) {
+		session, _ := timedFake(t, []string{"200 result=49", "200 result=0"}, 300*ms, 5*time.Second)
+		result, err := session.CollectDigitsInteractive(context.Background(), agi.CollectOptions{Timings: true})
+		require.NoError(t, err)
+		assert.Equal(t, agi.CollectTimeout, result.End)
+		assert.Equal(t, []time.Duration{300 * ms}, result.Timings)
+	})
+
+	t.Run("sequence", func(t *testing.T) {
+		session, _ := timedFake(t, []string{"200 result=42", "200 result=57", "200 result=56"}, 400*ms, 250*ms, 180*ms)
+		result, err := session.CollectSequence(context.Background(), agi.SequenceOptions{
+			Match:   agi.FeatureCodes("*98"),
+			Timings: true,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "*98", result.Digits)
+		assert.Equal(t, []time.Duration{400 * ms, 650 * ms, 830 * ms}, result.Timings)
+	})
+
+	t.Run("uniform", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			timings []time.Duration
+			want    bool
+		}{
+			{"exactly even", []time.Duration{2 * time.Second, 2100 * ms, 2200 * ms, 2300 * ms}, true},
+			{"within spread", []time.Duration{0, 100 * ms, 210 * ms, 315 * ms}, true},
+			{"human", []time.Duration{1200 * ms, 1450 * ms, 1610 * ms, 2030 * ms}, false},
+			{"too few digits", []time.Duration{0, 100 * ms, 200 * ms}, false},
+			{"none", nil, false},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				assert.Equal(t, tt.want, agi.SuspiciouslyUniform(tt.timings))
+			})
+		}
+	})
+}
+
+func TestDegradation(t *testing.T) {
+	ms := time.Millisecond
+	policy := agi.DegradeWhenSlow(200 * ms)
+
+	t.Run("latency stats", func(t *testing.T) {
+		session, _ := timedFake(t,
+			[]string{"200 result=1 (a)", "200 result=1 (b)", "200 result=1", "200 result=0 endpos=800"},
+			5*ms, 505*ms, 20*ms, 3*time.Second)
+		for _, name := range []string{"A", "B"} {
+			_, err := session.GetVariable(name)
+			require.NoError(t, err)
+		}
+		require.NoError(t, session.SetVariable("C", "1"))
+		require.NoError(t, session.StreamFile("welcome", ""))
+
+		stats := session.LatencyStats()
+		assert.Equal(t, agi.LatencyStat{Count: 2, Estimate: 105 * ms, Last: 505 * ms, Max: 505 * ms}, stats[agi.VerbReadOnly])
+		assert.Equal(t, agi.LatencyStat{Count: 1, Estimate: 20 * ms, Last: 20 * ms, Max: 20 * ms}, stats[agi.VerbMutating])
+		assert.Equal(t, 3*time.Second, stats[agi.VerbMedia].Estimate)
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		fast := agi.LatencyStats{agi.VerbReadOnly: {Count: 3, Estimate: 8 * ms}, agi.VerbMedia: {Count: 1, Estimate: 4 * time.Second}}
+		slow := agi.LatencyStats{agi.VerbMutating: {Count: 3, Estimate: 450 * ms}}
+		assert.Equal(t, agi.Degradation{}, policy(nil, fast))
+		assert.Equal(t, agi.Degradation{}, policy(nil, nil))
+		d := policy(nil, slow)
+		assert.True(t, d.SkipOptionalPrompts)
+		assert.Equal(t, agi.DegradedRetries, d.Retries(3))
+		assert.Equal(t, 0, d.Retries(0))
+		assert.Equal(t, 3, agi.Degradation{}.Retries(3))
+	})
+
+	t.Run("get data multi skips optional prompts", func(t *testing.T) {
+		for _, tt := range []struct {
+			name      string
+			delay     time.Duration
+			responses []string
+			want      []string
+		}{
+			{"fast", 5 * ms, []string{"200 result=1 (42)", "200 result=0 endpos=100", "200 result=1234"},
+				[]string{"GET VARIABLE ACCOUNT", `STREAM FILE intro "0123456789*#"`, "GET DATA menu 3000 4"}},
+			{"slow", 500 * ms, []string{"200 result=1 (42)", "200 result=1234"},
+				[]string{"GET VARIABLE ACCOUNT", "GET DATA menu 3000 4"}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				session, fake := timedFake(t, tt.responses, tt.delay, time.Second, 2*time.Second)
+				session.SetDegradationPolicy(policy)
+				_, err := session.GetVariable("ACCOUNT")
+				require.NoError(t, err)
+
+				digits, _, err := session.GetDataMulti([]string{"intro", "menu"}, 3*time.Second, 4)
+				require.NoError(t, err)
+				assert.Equal(t, "1234", digits)
+				assert.Equal(t, tt.want, fake.Commands())
+			})
+		}
+	})
+
+	t.Run("select language limits retries", func(t *testing.T) {
+		opts := agi.LanguageSelectOptions{
+			Options: []agi.LanguageOption{{Digit: "1", Language: "en", Prompt: "press-1-english"}},
+			Retries: 2,
+		}
+		for _, tt := range []struct {
+			name     string
+			delay    time.Duration
+			attempts int
+		}{
+			{"fast", 5 * ms, 3},
+			{"slow", 500 * ms, 2},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				responses := []string{"200 result=1 (42)"}
+				gaps := []time.Duration{tt.delay}
+				for range tt.attempts {
+					responses = append(responses, "200 result=1", "200 result=0 endpos=100", "200 result=0")
+					gaps = append(gaps, 0, time.Second, 5*time.Second)
+				}
+				responses = append(responses, "200 result=1")
+				gaps = append(gaps, 0)
+				session, fake := timedFake(t, responses, gaps...)
+				session.SetDegradationPolicy(policy)
+				_, err := session.GetVariable("ACCOUNT")
+				require.NoError(t, err)
+
+				lang, err := session.SelectLanguage(context.Background(), opts)
+				require.NoError(t, err)
+				assert.Equal(t, "en", lang)
+				assert.Len(t, fake.Commands(), len(responses))
+			})
+		}
+	})
+}
+
+func TestReadCache(t *testing.T) {
+	t.Run("hits", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=1 (5551234)", "200 result=1 (en)", "200 result=1 (en)"})
+		session, _ := clockedSession(t, fake)
+		session.SetReadCache(0, "CALLERID(num)")
+
+		for range 2 {
+			num, err := session.GetVariable("CALLERID(num)")
+			require.NoError(t, err)
+			assert.Equal(t, "5551234", num)
+		}
+		num, err := session.GetFullVariable("${CALLERID(num)}")
+		require.NoError(t, err)
+		assert.Equal(t, "5551234", num)
+		for range 2 {
+			_, err := session.GetVariable("CHANNEL(language)")
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, agi.ReadCacheStats{Hits: 2, Misses: 1}, session.ReadCacheStats())
+		assert.Equal(t, []string{"GET VARIABLE CALLERID(num)", "GET VARIABLE CHANNEL(language)", "GET VARIABLE CHANNEL(language)"}, fake.Commands())
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=1 (5551234)", "200 result=1 (5551234)"})
+		session, _ := clockedSession(t, fake)
+		for range 2 {
+			_, err := session.GetVariable("CALLERID(num)")
+			require.NoError(t, err)
+		}
+		assert.Len(t, fake.Commands(), 2)
+		assert.Zero(t, session.ReadCacheStats())
+	})
+
+	t.Run("invalidated by own writes", func(t *testing.T) {
+		fake := agitest.NewFake([]string{
+			"200 result=1 (en)", "200 result=1", "200 result=1 (es)",
+			"200 result=1 (5551234)", "200 result=1", "200 result=1 (5550000)",
+		})
+		session, _ := clockedSession(t, fake)
+		session.SetReadCache(0, "CHANNEL(language)", "CALLERID(num)")
+
+		lang, err := session.GetVariable("CHANNEL(language)")
+		require.NoError(t, err)
+		assert.Equal(t, "en", lang)
+		require.NoError(t, session.SetLanguage("es"))
+		lang, err = session.GetVariable("CHANNEL(language)")
+		require.NoError(t, err)
+		assert.Equal(t, "es", lang)
+
+		_, err = session.GetVariable("CALLERID(num)")
+		require.NoError(t, err)
+		_, err = session.Command(`SET CALLERID "5550000"`)
+		require.NoError(t, err)
+		num, err := session.GetVariable("CALLERID(num)")
+		require.NoError(t, err)
+		assert.Equal(t, "5550000", num)
+		assert.Equal(t, agi.ReadCacheStats{Misses: 4}, session.ReadCacheStats())
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=1 (on)", "200 result=1 (off)"})
+		session, clock := clockedSession(t, fake)
+		session.SetReadCache(30*time.Second, "FEATURE_X")
+
+		read := func() string {
+			value, err := session.GetVariable("FEATURE_X")
+			require.NoError(t, err)
+			return value
+		}
+		assert.Equal(t, "on", read())
+		clock.Advance(29 * time.Second)
+		assert.Equal(t, "on", read())
+		clock.Advance(time.Second)
+		assert.Equal(t, "off", read())
+		assert.Equal(t, agi.ReadCacheStats{Hits: 1, Misses: 2}, session.ReadCacheStats())
+	})
+}
@@ -0,0 +1,148 @@
+package agi
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// CollectEnd describes why digit collection finished
+type CollectEnd int
+
+const (
+	// CollectSubmitted means the caller pressed the submit digit
+	CollectSubmitted CollectEnd = iota
+	// CollectMaxDigits means the buffer reached the maximum length
+	CollectMaxDigits
+	// CollectTimeout means no digit arrived within the per-digit timeout
+	CollectTimeout
+)
+
+// String returns a readable name for the collection end
+func (e CollectEnd) String() string {
+	switch e {
+	case CollectSubmitted:
+		return "submitted"
+	case CollectMaxDigits:
+		return "max digits"
+	case CollectTimeout:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// CollectOptions configures CollectDigitsInteractive
+type CollectOptions struct {
+	// MaxDigits ends collection once the buffer holds this many digits.
+	// Zero means no limit.
+	MaxDigits int
+	// Timeout is how long to wait for each digit. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Backspace removes the last collected digit. Defaults to "*".
+	Backspace string
+	// Submit ends collection. Defaults to "#".
+	Submit string
+	// BackspaceSound is played after a backspace when set
+	BackspaceSound string
+	// Pattern, when set, must match the collected digits or
+	// ErrPatternMismatch is returned with the result. A bounded pattern also
+	// supplies MaxDigits when that is zero.
+	Pattern *Pattern
+	// Hotkeys sets when registered hotkeys fire instead of being collected.
+	// The default, HotkeysOff, collects them like any other digit, as
+	// account numbers and PINs need.
+	Hotkeys HotkeyScope
+	// Timings records when each digit arrived in CollectResult.Timings,
+	// for SuspiciouslyUniform
+	Timings bool
+}
+
+// CollectResult is the outcome of CollectDigitsInteractive
+type CollectResult struct {
+	Digits string
+	End    CollectEnd
+	// Timings holds, when CollectOptions.Timings is set, the time each
+	// digit arrived after collection began, including backspace, submit
+	// and hotkey digits
+	Timings []time.Duration
+}
+
+// CollectDigitsInteractive collects digits one at a time with WaitForDigit,
+// letting the caller erase the last digit with the backspace digit and finish
+// with the submit digit, which GET DATA cannot express. Neither the backspace
+// nor the submit digit is included in the result.
+func (s *AgiSession) CollectDigitsInteractive(ctx context.Context, opts CollectOptions) (CollectResult, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.Backspace == "" {
+		opts.Backspace = "*"
+	}
+	if opts.Submit == "" {
+		opts.Submit = "#"
+	}
+	if opts.Pattern != nil && opts.MaxDigits == 0 && opts.Pattern.maxLen != unbounded {
+		opts.MaxDigits = opts.Pattern.maxLen
+	}
+
+	timer := s.digitTimer(opts.Timings)
+	result, err := s.collectDigits(ctx, opts, timer)
+	result.Timings = timer.result()
+	if err == nil && opts.Pattern != nil && !opts.Pattern.Match(result.Digits) {
+		err = ErrPatternMismatch
+	}
+	return result, err
+}
+
+// collectDigits runs the collection loop for CollectDigitsInteractive
+func (s *AgiSession) collectDigits(ctx context.Context, opts CollectOptions, timer *digitTimer) (CollectResult, error) {
+	var buf strings.Builder
+	for {
+		if err := ctx.Err(); err != nil {
+			return CollectResult{Digits: buf.String()}, err
+		}
+
+		digit, err := s.WaitForDigit(int(opts.Timeout.Milliseconds()))
+		if err != nil {
+			return CollectResult{Digits: buf.String()}, err
+		}
+		if digit != "" {
+			timer.mark()
+		}
+
+		switch digit {
+		case "":
+			return CollectResult{Digits: buf.String(), End: CollectTimeout}, nil
+		case opts.Submit:
+			return CollectResult{Digits: buf.String(), End: CollectSubmitted}, nil
+		case opts.Backspace:
+			if digits := buf.String(); digits != "" {
+				buf.Reset()
+				buf.WriteString(digits[:len(digits)-1])
+			}
+			if opts.BackspaceSound != "" {
+				if err := s.StreamFile(opts.BackspaceSound, ""); err != nil {
+					return CollectResult{Digits: buf.String()}, err
+				}
+			}
+			continue
+		}
+
+		if s.collectHotkey(digit, opts, buf.Len()) {
+			restart, err := s.runHotkey(ctx, digit)
+			if err != nil {
+				return CollectResult{Digits: buf.String()}, err
+			}
+			if restart {
+				buf.Reset()
+			}
+			continue
+		}
+
+		buf.WriteString(digit)
+		if opts.MaxDigits > 0 && buf.Len() >= opts.MaxDigits {
+			return CollectResult{Digits: buf.String(), End: CollectMaxDigits}, nil
+		}
+	}
+}
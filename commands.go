@@ -1,8 +1,11 @@
 package agi
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 )
 
 // ChannelStatus gets the status of the current channel
@@ -14,66 +17,165 @@ func (s *AgiSession) ChannelStatus() (int, error) {
 	return resp.Result, nil
 }
 
-// Execute executes a dialplan application
+// Command sends a raw AGI command, such as one without a wrapper in this
+// package, and returns the parsed response. Command policies apply as for
+// every other command; see AgiResponse.Annotation for how it ended.
+func (s *AgiSession) Command(command string) (*AgiResponse, error) {
+	return s.execute(command)
+}
+
+// Execute executes a dialplan application. It returns an error wrapping
+// ErrAppNotFound when Asterisk has no such application loaded, which EXEC
+// reports with result=-2, and one wrapping ErrAppFailed when the
+// application itself returned failure with result=-1, as Dial does when the
+// caller hangs up. Other results, which some applications use for their own
+// status, are success.
 func (s *AgiSession) Execute(application string, options ...string) error {
 	cmd := fmt.Sprintf("EXEC %s", application)
 	if len(options) > 0 {
 		cmd += fmt.Sprintf(" \"%s\"", strings.Join(options, ","))
 	}
-	_, err := s.execute(cmd)
-	return err
-}
-
-// GetOption streams a file and gets a digit
-func (s *AgiSession) GetOption(filename string, escapeDigits string, timeout int) (string, error) {
-	cmd := fmt.Sprintf("GET OPTION %s \"%s\" %d", filename, escapeDigits, timeout)
 	resp, err := s.execute(cmd)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if resp.Result == -1 {
-		return "", nil // Timeout
+	return execResult(application, resp)
+}
+
+// execResult interprets the result of EXEC application. res_agi has sent
+// -2 for unknown applications and the application's own return value
+// otherwise since Asterisk 1.4, so no version check is needed.
+func execResult(application string, resp *AgiResponse) error {
+	switch {
+	case resp.Result == -2:
+		return fmt.Errorf("%w: %s", ErrAppNotFound, application)
+	case resp.Result < 0:
+		return fmt.Errorf("%w: %s returned %d", ErrAppFailed, application, resp.Result)
 	}
-	return string(resp.Result), nil
+	return nil
 }
 
-// SayNumber says a number
-func (s *AgiSession) SayNumber(number int, escapeDigits string) (string, error) {
-	cmd := fmt.Sprintf("SAY NUMBER %d \"%s\"", number, escapeDigits)
-	resp, err := s.execute(cmd)
+// GetOption streams a file and gets a digit. The timeout is how long to wait
+// for a digit after playback ends; zero waits no longer than the file itself.
+// ErrPromptNotFound is returned when Asterisk could not play the file. A
+// result of -1 is ErrHangup once the session has seen the hangup and wraps
+// ErrPlaybackFailed otherwise.
+// Registered hotkeys that are not among escapeDigits are honoured both while
+// the file plays and while waiting; see RegisterHotkey.
+func (s *AgiSession) GetOption(filename string, escapeDigits string, timeout time.Duration) (string, error) {
+	if timeout < 0 {
+		return "", fmt.Errorf("invalid timeout %v: must not be negative", timeout)
+	}
+	if s.activeHotkeys(escapeDigits) != "" {
+		return s.getOptionWithHotkeys(filename, escapeDigits, timeout)
+	}
+	resp, err := s.promptCommand(filename, true, func(file string) string {
+		return fmt.Sprintf("GET OPTION %s \"%s\" %d", file, escapeDigits, timeout.Milliseconds())
+	})
 	if err != nil {
 		return "", err
 	}
-	if resp.Result == -1 {
-		return "", nil // Timeout or hangup
+	switch {
+	case resp.Result == -1 && s.HungUp():
+		return "", ErrHangup
+	case resp.Result == -1:
+		return "", fmt.Errorf("%w: %s", ErrPlaybackFailed, filename)
+	case resp.Result == 0 && resp.HasEndPos && resp.EndPos == 0:
+		return "", ErrPromptNotFound
 	}
-	return string(resp.Result), nil
+	if resp.Result == 0 {
+		return "", nil
+	}
+	return string(rune(resp.Result)), nil
+}
+
+// SayNumber says a number and returns the digit that interrupted it, with
+// errors as for SayDigits
+func (s *AgiSession) SayNumber(number int, escapeDigits string) (string, error) {
+	return s.say(fmt.Sprintf("SAY NUMBER %d \"%s\"", number, s.escapeDigits(escapeDigits)))
 }
 
-// SayDigits says digits
+// SayDigits says digits one by one and returns the digit that interrupted
+// it, or an empty string when it completed. Asterisk reports a hangup and a
+// failure, such as a missing sound, alike with result -1; every SAY command
+// returns ErrHangup for it once the session has seen the hangup and
+// ErrCommandFailed otherwise.
 func (s *AgiSession) SayDigits(digits string, escapeDigits string) (string, error) {
-	cmd := fmt.Sprintf("SAY DIGITS %s \"%s\"", digits, escapeDigits)
-	resp, err := s.execute(cmd)
-	if err != nil {
-		return "", err
+	return s.say(fmt.Sprintf("SAY DIGITS %s \"%s\"", digits, s.escapeDigits(escapeDigits)))
+}
+
+// SayAlpha spells text character by character, such as a confirmation
+// code, and returns the digit that interrupted it, with errors as for
+// SayDigits
+func (s *AgiSession) SayAlpha(text string, escapeDigits string) (string, error) {
+	return s.say(fmt.Sprintf("SAY ALPHA \"%s\" \"%s\"", EscapeString(text), s.escapeDigits(escapeDigits)))
+}
+
+// DefaultDateTimeFormat is the format SayDateTime uses when none is given,
+// matching Asterisk's own default: weekday, month, day, year, "at", then the
+// 12-hour time with AM/PM
+const DefaultDateTimeFormat = "ABdY 'digits/at' IMp"
+
+// SayDateTime says a date/time. An empty format uses DefaultDateTimeFormat
+// and an empty timezone uses the PBX's zone. The timezone is checked with
+// time.LoadLocation unless validation is disabled with SetTimezoneValidation,
+// because Asterisk silently falls back to the system zone for unknown names.
+// Errors are as for SayDigits.
+func (s *AgiSession) SayDateTime(timestamp int64, escapeDigits string, format string, timezone string) (string, error) {
+	if format == "" {
+		format = DefaultDateTimeFormat
 	}
-	if resp.Result == -1 {
-		return "", nil
+	if timezone != "" && !s.skipTZValidation {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return "", fmt.Errorf("invalid timezone %q: %w", timezone, err)
+		}
+	}
+
+	cmd := fmt.Sprintf("SAY DATETIME %d \"%s\" \"%s\"", timestamp, s.escapeDigits(escapeDigits), EscapeString(format))
+	if timezone != "" {
+		cmd += " " + timezone
 	}
-	return string(resp.Result), nil
+	return s.say(cmd)
 }
 
-// SayDateTime says a date/time
-func (s *AgiSession) SayDateTime(timestamp int64, escapeDigits string, format string, timezone string) (string, error) {
-	cmd := fmt.Sprintf("SAY DATETIME %d \"%s\" %s %s", timestamp, escapeDigits, format, timezone)
+// SayDate says the date of t, such as an appointment, in the channel's
+// language, and returns the digit that interrupted it. Only the day is
+// said; Asterisk takes it in the PBX's zone, so convert t there when it
+// differs. Errors are as for SayDigits.
+func (s *AgiSession) SayDate(t time.Time, escapeDigits string) (string, error) {
+	return s.say(fmt.Sprintf("SAY DATE %d \"%s\"", t.Unix(), s.escapeDigits(escapeDigits)))
+}
+
+// SayTime says the time of day of t as SayDate says its date, with the same
+// zone and errors
+func (s *AgiSession) SayTime(t time.Time, escapeDigits string) (string, error) {
+	return s.say(fmt.Sprintf("SAY TIME %d \"%s\"", t.Unix(), s.escapeDigits(escapeDigits)))
+}
+
+// say sends a SAY command and returns the digit that interrupted it, or an
+// empty string when it completed. Result -1 is ErrHangup once the session
+// has seen the hangup and ErrCommandFailed otherwise.
+func (s *AgiSession) say(cmd string) (string, error) {
 	resp, err := s.execute(cmd)
 	if err != nil {
 		return "", err
 	}
-	if resp.Result == -1 {
+	switch {
+	case resp.Result == -1 && s.HungUp():
+		return "", ErrHangup
+	case resp.Result == -1:
+		return "", ErrCommandFailed
+	}
+	if resp.Result == 0 {
 		return "", nil
 	}
-	return string(resp.Result), nil
+	return string(rune(resp.Result)), nil
+}
+
+// SetTimezoneValidation controls whether SayDateTime checks timezone names
+// against the local zoneinfo database. Disable it for zones only the PBX knows.
+func (s *AgiSession) SetTimezoneValidation(enabled bool) {
+	s.skipTZValidation = !enabled
 }
 
 // DatabaseGet gets a value from the Asterisk database
@@ -121,7 +223,7 @@ func (s *AgiSession) RecordFile(filename, format, escapeDigits string, timeout,
 	if resp.Result == -1 {
 		return "", nil
 	}
-	return string(resp.Result), nil
+	return string(rune(resp.Result)), nil
 }
 
 // SendText sends text to channels that support it
@@ -138,26 +240,126 @@ func (s *AgiSession) SendImage(image string) error {
 	return err
 }
 
-// SetMusic enables/disables music on hold
+// MusicClassDefault is the music on hold class Asterisk ships configured
+const MusicClassDefault = "default"
+
+// SetMusic enables/disables music on hold. An empty class is omitted so
+// Asterisk uses the channel's class; classes containing spaces are quoted.
 func (s *AgiSession) SetMusic(on bool, class string) error {
-	onStr := "OFF"
+	cmd := "SET MUSIC OFF"
 	if on {
-		onStr = "ON"
+		cmd = "SET MUSIC ON"
+	}
+	switch {
+	case class == "":
+	case strings.ContainsAny(class, " \t"):
+		cmd += fmt.Sprintf(" \"%s\"", EscapeString(class))
+	default:
+		cmd += " " + class
 	}
-	cmd := fmt.Sprintf("SET MUSIC %s %s", onStr, class)
 	_, err := s.execute(cmd)
 	return err
 }
 
-// SetCallerID sets the caller ID
+// MusicOnHoldClass returns the channel's music on hold class from
+// CHANNEL(musicclass), which is empty when none has been set
+func (s *AgiSession) MusicOnHoldClass() (string, error) {
+	return s.GetVariable("CHANNEL(musicclass)")
+}
+
+// WithMusicOnHold plays music on hold in class, or the channel's class when
+// empty, while fn runs and stops it afterwards, including when fn fails
+// because ctx ended. Music is left alone once the channel has hung up.
+func (s *AgiSession) WithMusicOnHold(class string, fn func() error) error {
+	if err := s.SetMusic(true, class); err != nil {
+		return err
+	}
+
+	err := fn()
+	if s.HungUp() || errors.Is(err, ErrHangup) {
+		return err
+	}
+	if stopErr := s.SetMusic(false, ""); stopErr != nil && err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// WithMusicClass sets the channel's music on hold class for the duration of
+// fn and restores the previous class afterwards, even when fn fails. It does
+// not start or stop music itself.
+func (s *AgiSession) WithMusicClass(class string, fn func() error) error {
+	previous, err := s.MusicOnHoldClass()
+	if err != nil {
+		return err
+	}
+	if err := s.SetVariable("CHANNEL(musicclass)", class); err != nil {
+		return err
+	}
+
+	err = fn()
+	if restoreErr := s.SetVariable("CHANNEL(musicclass)", previous); restoreErr != nil && err == nil {
+		err = restoreErr
+	}
+	return err
+}
+
+// SetCallerID sets the caller ID. The value is either a bare number or the
+// "Name" <number> form produced by FormatCallerID; other values containing
+// whitespace are rejected.
 func (s *AgiSession) SetCallerID(number string) error {
+	if err := validateCallerID(number); err != nil {
+		return err
+	}
 	cmd := fmt.Sprintf("SET CALLERID %s", number)
+	if strings.Contains(number, " ") {
+		cmd = fmt.Sprintf("SET CALLERID \"%s\"", EscapeString(number))
+	}
 	_, err := s.execute(cmd)
 	return err
 }
 
+// SetCallerIDE164 validates number as E.164 and sets it as the caller ID.
+// With lenient set, punctuation such as spaces, dashes and parentheses is
+// stripped first; see NormalizeE164.
+func (s *AgiSession) SetCallerIDE164(number string, lenient bool) error {
+	normalized, err := NormalizeE164(number, lenient)
+	if err != nil {
+		return err
+	}
+	return s.SetCallerID(normalized)
+}
+
+// validateCallerID checks a caller ID passed to SetCallerID
+func validateCallerID(callerID string) error {
+	if callerID == "" {
+		return fmt.Errorf("invalid caller ID: must not be empty")
+	}
+	if strings.ContainsAny(callerID, "\r\n\t") {
+		return fmt.Errorf("invalid caller ID %q: control characters are not allowed", callerID)
+	}
+	if !strings.Contains(callerID, " ") {
+		return nil
+	}
+
+	// Only "Name" <number> may contain spaces, and only inside the name
+	invalid := fmt.Errorf("invalid caller ID %q: values with spaces must use the \"Name\" <number> form", callerID)
+	name, number, ok := strings.Cut(callerID, "\" <")
+	if !ok || !strings.HasPrefix(name, "\"") || strings.Contains(name[1:], "\"") {
+		return invalid
+	}
+	number, ok = strings.CutSuffix(number, ">")
+	if !ok || strings.ContainsAny(number, " <>\"") {
+		return invalid
+	}
+	return nil
+}
+
 // SetContext sets the context for the channel
 func (s *AgiSession) SetContext(context string) error {
+	if err := validateDialplanName("context", context, contextChars); err != nil {
+		return err
+	}
 	cmd := fmt.Sprintf("SET CONTEXT %s", context)
 	_, err := s.execute(cmd)
 	return err
@@ -165,6 +367,9 @@ func (s *AgiSession) SetContext(context string) error {
 
 // SetExtension sets the extension for the channel
 func (s *AgiSession) SetExtension(extension string) error {
+	if err := validateDialplanName("extension", extension, extensionChars); err != nil {
+		return err
+	}
 	cmd := fmt.Sprintf("SET EXTENSION %s", extension)
 	_, err := s.execute(cmd)
 	return err
@@ -172,11 +377,49 @@ func (s *AgiSession) SetExtension(extension string) error {
 
 // SetPriority sets the priority for the channel
 func (s *AgiSession) SetPriority(priority int) error {
+	if priority <= 0 {
+		return fmt.Errorf("invalid priority %d: must be greater than zero", priority)
+	}
 	cmd := fmt.Sprintf("SET PRIORITY %d", priority)
 	_, err := s.execute(cmd)
 	return err
 }
 
+// SetPriorityLabel sets the priority for the channel using a named priority label
+func (s *AgiSession) SetPriorityLabel(label string) error {
+	if err := validateDialplanName("priority label", label, labelChars); err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("SET PRIORITY %s", label)
+	_, err := s.execute(cmd)
+	return err
+}
+
+// Characters permitted in dialplan names beyond ASCII letters and digits
+const (
+	contextChars   = "-_."
+	extensionChars = "-_.[]*#+!"
+	labelChars     = "-_"
+)
+
+// validateDialplanName checks that value is non-empty and only contains
+// characters Asterisk accepts for the given dialplan element, so the value
+// can never break out of its command argument
+func validateDialplanName(kind, value, extra string) error {
+	if value == "" {
+		return fmt.Errorf("invalid %s: must not be empty", kind)
+	}
+	for _, c := range value {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune(extra, c):
+		default:
+			return fmt.Errorf("invalid %s %q: character %q is not allowed", kind, value, c)
+		}
+	}
+	return nil
+}
+
 // Noop does nothing (but can be used for debugging)
 func (s *AgiSession) Noop() error {
 	_, err := s.execute("NOOP")
@@ -193,7 +436,7 @@ func (s *AgiSession) ReceiveChar(timeout int) (string, error) {
 	if resp.Result == -1 {
 		return "", nil
 	}
-	return string(resp.Result), nil
+	return string(rune(resp.Result)), nil
 }
 
 // ReceiveText receives text from channels that support it
@@ -229,3 +472,89 @@ func GetResultCode(result int) AGIResultCode {
 		return Error
 	}
 }
+
+// agiVerbs lists the AGI command verbs in catalog order; see commandSpecs
+var agiVerbs = commandSpecVerbs()
+
+// agiVerbWords holds the words of each verb of agiVerbs
+var agiVerbWords = func() [][]string {
+	words := make([][]string, len(agiVerbs))
+	for i, verb := range agiVerbs {
+		words[i] = strings.Fields(verb)
+	}
+	return words
+}()
+
+// maxVerbWords is the number of words of the longest verb
+var maxVerbWords = func() int {
+	n := 0
+	for _, words := range agiVerbWords {
+		n = max(n, len(words))
+	}
+	return n
+}()
+
+// commandVerb returns the verb of an AGI command without its arguments.
+// The command is split into words as Asterisk splits it, so leading
+// whitespace, tabs, repeated spaces and quotes do not hide the verb.
+func commandVerb(command string) string {
+	words, _ := commandFields(command, maxVerbWords)
+	for i, verb := range agiVerbs {
+		verbWords := agiVerbWords[i]
+		if len(verbWords) <= len(words) && slices.EqualFunc(verbWords, words[:len(verbWords)], strings.EqualFold) {
+			return verb
+		}
+	}
+	if len(words) > 0 {
+		return words[0]
+	}
+	return ""
+}
+
+// commandFields returns the first n words of command, split as Asterisk's
+// parse_args splits them: on runs of spaces and tabs, with double quotes
+// grouping words and a backslash escaping the next character. rest is the
+// command after those words, as sent.
+func commandFields(command string, n int) (words []string, rest string) {
+	i := 0
+	for len(words) < n {
+		for i < len(command) && isCommandSpace(command[i]) {
+			i++
+		}
+		if i == len(command) {
+			break
+		}
+		var word string
+		word, i = commandWord(command, i)
+		words = append(words, word)
+	}
+	return words, strings.TrimSpace(command[i:])
+}
+
+// commandWord returns the word of command starting at start and the index
+// just past it
+func commandWord(command string, start int) (string, int) {
+	var word strings.Builder
+	inQuotes := false
+	i := start
+	for ; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == '\\' && i+1 < len(command):
+			i++
+			word.WriteByte(command[i])
+		case c == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && isCommandSpace(c):
+			return word.String(), i
+		default:
+			word.WriteByte(c)
+		}
+	}
+	return word.String(), i
+}
+
+// isCommandSpace reports whether Asterisk separates command words with c
+func isCommandSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
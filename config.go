@@ -0,0 +1,95 @@
+package agi
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Validate checks the server's options for mistakes that would otherwise
+// only surface once calls arrive, such as a nil handler, negative limits or
+// options that have no effect without another. Every problem found is
+// reported, joined with errors.Join, each wrapping one of ErrNilHandler,
+// ErrInvalidLimit, ErrInvalidOption, ErrConflictingOptions or ErrNoRoutes.
+// Serve calls it before accepting connections.
+func (s *FastAGIServer) Validate() error {
+	var errs []error
+	problem := func(sentinel error, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{sentinel}, args...)...))
+	}
+
+	switch h := s.handler.(type) {
+	case nil:
+		problem(ErrNilHandler, "server has no handler")
+	case HandlerFunc:
+		if h == nil {
+			problem(ErrNilHandler, "server has a nil HandlerFunc")
+		}
+	case muxHandler:
+		errs = append(errs, h.mux.validate()...)
+	}
+
+	if s.workers < 0 {
+		problem(ErrInvalidLimit, "WithWorkerPool(%d) must not be negative", s.workers)
+	}
+	if s.workers == 0 && s.queueLength > 0 {
+		problem(ErrConflictingOptions, "WithQueueLength needs WithWorkerPool")
+	}
+	if s.workers == 0 && s.onQueueFull != nil {
+		problem(ErrConflictingOptions, "WithQueueFullHandler needs WithWorkerPool")
+	}
+	if s.limits.max < 0 {
+		problem(ErrInvalidLimit, "WithMaxCommandsPerSession(%d) must not be negative", s.limits.max)
+	}
+	if s.limits.rate < 0 {
+		problem(ErrInvalidLimit, "WithMaxCommandRate(%g) must not be negative", s.limits.rate)
+	}
+	if s.limits.terminate && s.limits.max == 0 && s.limits.rate == 0 {
+		problem(ErrConflictingOptions, "WithTerminateOnCommandLimit needs WithMaxCommandsPerSession or WithMaxCommandRate")
+	}
+	if s.maxLineSize < 0 {
+		problem(ErrInvalidLimit, "WithMaxLineSize(%d) must not be negative", s.maxLineSize)
+	}
+	if s.envReadTimeout < 0 {
+		problem(ErrInvalidLimit, "WithEnvReadTimeout(%v) must not be negative", s.envReadTimeout)
+	}
+	if s.maxDataDigits < 0 {
+		problem(ErrInvalidLimit, "WithMaxDataDigits(%d) must not be negative", s.maxDataDigits)
+	}
+
+	if s.faults != nil && s.faults.FirstResponseDelay < 0 {
+		problem(ErrInvalidOption, "WithFaultInjection delay %v must not be negative", s.faults.FirstResponseDelay)
+	}
+	if s.resultPrefix != "" && !isVariableName(s.resultPrefix) {
+		problem(ErrInvalidOption, "WithResultPrefix(%q) is not a valid variable name", s.resultPrefix)
+	}
+	if s.transcriptFormat != TranscriptText && s.transcriptFormat != TranscriptJSON {
+		problem(ErrInvalidOption, "unknown transcript format %d", s.transcriptFormat)
+	}
+	if s.transcriptFormat != TranscriptText && s.transcriptWriter == nil {
+		problem(ErrConflictingOptions, "WithTranscriptFormat needs WithTranscript")
+	}
+	if s.errorPolicy.Hangup && s.errorPolicy.ContinueAt != nil {
+		problem(ErrConflictingOptions, "WithErrorPolicy cannot both hang up and continue in the dialplan")
+	}
+	if s.callKey != nil && s.callStore == nil {
+		problem(ErrConflictingOptions, "WithCallStateKey needs WithCallState")
+	}
+	if s.tenantResolver == nil && len(s.tenants) > 0 {
+		problem(ErrConflictingOptions, "WithTenant needs WithTenantResolver")
+	}
+	if s.tenantResolver == nil && s.unknownTenant != nil {
+		problem(ErrConflictingOptions, "WithUnknownTenantHandler needs WithTenantResolver")
+	}
+	if s.tenantResolver != nil && len(s.tenants) == 0 && s.unknownTenant == nil {
+		problem(ErrNoRoutes, "WithTenantResolver has no tenants registered with WithTenant")
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.tenants)) {
+		if c := s.tenants[name].config; c.MaxCommands < 0 || c.CommandRate < 0 {
+			problem(ErrInvalidLimit, "tenant %q command limits must not be negative", name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,184 @@
+package agi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ConsentMode is the recording consent rule for a caller's jurisdiction
+type ConsentMode int
+
+const (
+	// ConsentExplicit requires the caller to press a key before recording,
+	// as in two-party consent jurisdictions
+	ConsentExplicit ConsentMode = iota
+	// ConsentImplicit plays a notice and records, as in one-party consent
+	// jurisdictions
+	ConsentImplicit
+)
+
+// String returns a readable name for the consent mode
+func (m ConsentMode) String() string {
+	switch m {
+	case ConsentExplicit:
+		return "explicit"
+	case ConsentImplicit:
+		return "implicit"
+	default:
+		return "unknown"
+	}
+}
+
+// ConsentResult is the outcome of ConsentAndRecord
+type ConsentResult int
+
+const (
+	// ConsentRecorded means the caller pressed the accept key and
+	// recording started
+	ConsentRecorded ConsentResult = iota + 1
+	// ConsentDeclinedNotRecorded means the caller declined or did not
+	// answer the consent prompt, so nothing is recorded
+	ConsentDeclinedNotRecorded
+	// ConsentImplicitRecorded means the notice was played and recording
+	// started without a keypress
+	ConsentImplicitRecorded
+)
+
+// String returns the value ConsentAndRecord stores in the consent variable
+func (r ConsentResult) String() string {
+	switch r {
+	case ConsentRecorded:
+		return "accepted"
+	case ConsentDeclinedNotRecorded:
+		return "declined"
+	case ConsentImplicitRecorded:
+		return "implicit"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultConsentVariable is the channel variable ConsentAndRecord sets
+const DefaultConsentVariable = "RECORDING_CONSENT"
+
+// ConsentOptions configures ConsentAndRecord
+type ConsentOptions struct {
+	// Resolver picks the consent mode from the caller's number. When nil
+	// every caller is asked for explicit consent.
+	Resolver func(callerNumber string) ConsentMode
+	// Prompts is the prompt played for each mode: the question for
+	// ConsentExplicit and the notice for ConsentImplicit
+	Prompts map[ConsentMode]string
+	// AcceptDigit is the key that gives consent. Defaults to "1".
+	AcceptDigit string
+	// Timeout is how long to wait for a key after the prompt. Defaults to
+	// 5 seconds; no key counts as declining.
+	Timeout time.Duration
+	// DeclinedPrompt is played when the caller declines, if set
+	DeclinedPrompt string
+	// Variable is set to the result's String. Defaults to
+	// DefaultConsentVariable.
+	Variable string
+	// Recording is passed to MixMonitorStart once consent is given
+	Recording MixMonitorOptions
+}
+
+// PrefixConsentResolver returns a resolver choosing the mode of the longest
+// prefix of the caller number found in prefixes, or fallback when none
+// matches. A leading "+" on the number is ignored.
+func PrefixConsentResolver(prefixes map[string]ConsentMode, fallback ConsentMode) func(callerNumber string) ConsentMode {
+	return func(callerNumber string) ConsentMode {
+		number := strings.TrimPrefix(callerNumber, "+")
+		mode, best := fallback, -1
+		for prefix, m := range prefixes {
+			if len(prefix) > best && strings.HasPrefix(number, prefix) {
+				mode, best = m, len(prefix)
+			}
+		}
+		return mode
+	}
+}
+
+// ConsentAndRecord asks for recording consent according to the caller's
+// jurisdiction and starts MixMonitor only once consent is established. In
+// explicit mode any key interrupts the prompt and only AcceptDigit gives
+// consent. The outcome is stored in a channel variable before recording
+// starts. ErrHangup is returned if the caller hangs up during the prompt.
+func (s *AgiSession) ConsentAndRecord(ctx context.Context, opts ConsentOptions) (ConsentResult, error) {
+	if opts.AcceptDigit == "" {
+		opts.AcceptDigit = "1"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.Variable == "" {
+		opts.Variable = DefaultConsentVariable
+	}
+	if opts.Recording.Filename == "" {
+		return 0, fmt.Errorf("consent: recording filename must not be empty")
+	}
+
+	mode := ConsentExplicit
+	if opts.Resolver != nil {
+		mode = opts.Resolver(s.GetEnv("agi_callerid"))
+	}
+	prompt := opts.Prompts[mode]
+	if prompt == "" {
+		return 0, fmt.Errorf("consent: no prompt for %s mode", mode)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	result, err := s.askConsent(mode, prompt, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.SetVariable(opts.Variable, result.String()); err != nil {
+		return 0, err
+	}
+	if result == ConsentDeclinedNotRecorded {
+		if opts.DeclinedPrompt != "" {
+			if err := s.StreamFile(opts.DeclinedPrompt, ""); err != nil {
+				return result, err
+			}
+		}
+		return result, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := s.MixMonitorStart(opts.Recording); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// askConsent plays the prompt for mode and decides the outcome
+func (s *AgiSession) askConsent(mode ConsentMode, prompt string, opts ConsentOptions) (ConsentResult, error) {
+	if mode == ConsentImplicit {
+		if err := s.StreamFile(prompt, ""); err != nil {
+			return 0, err
+		}
+		return ConsentImplicitRecorded, nil
+	}
+
+	digit, err := s.streamFile(prompt, getDataEscapeDigits)
+	if err != nil {
+		return 0, err
+	}
+	if digit == "" {
+		digit, err = s.WaitForDigit(int(opts.Timeout.Milliseconds()))
+		if err != nil {
+			return 0, err
+		}
+	}
+	if digit == opts.AcceptDigit {
+		return ConsentRecorded, nil
+	}
+	return ConsentDeclinedNotRecorded, nil
+}
@@ -0,0 +1,129 @@
+package agi
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeadlineGrace is added to the time a command's own arguments allow it to
+// run, for the response to arrive
+const DeadlineGrace = 10 * time.Second
+
+// DeadlineFunc returns how long to wait for the response to a command from
+// its arguments and the session timeout. Zero means no deadline.
+type DeadlineFunc func(args []string, sessionTimeout time.Duration) time.Duration
+
+// CommandDeadlines lists the commands whose response may legitimately take
+// longer than the session timeout, keyed by verb or, for EXEC, by "EXEC"
+// and the application in upper case, as in "EXEC DIAL". Args are the
+// command's arguments after the verb; for EXEC they are the application's
+// comma-separated arguments. Commands missing from it, including playback
+// of files of unknown length, wait for the session timeout; raw commands
+// can set their own with CommandWithDeadline. Add to it before sessions
+// start, not while they run.
+//
+//	RECORD FILE     its timeout plus DeadlineGrace, none for -1
+//	WAIT FOR DIGIT  its timeout plus DeadlineGrace, none for -1
+//	GET DATA        session timeout plus the digit timeout per digit
+//	GET OPTION      session timeout plus its timeout
+//	SPEECH RECOGNIZE session timeout plus its timeout
+//	EXEC WAIT       its seconds plus DeadlineGrace
+//	EXEC DIAL       none: the call lasts as long as the parties talk
+//	EXEC QUEUE      none
+//
+// No deadline is ever shorter than the session timeout.
+var CommandDeadlines = map[string]DeadlineFunc{
+	"RECORD FILE":      argDeadline(3, time.Millisecond),
+	"WAIT FOR DIGIT":   argDeadline(0, time.Millisecond),
+	"GET DATA":         getDataDeadline,
+	"GET OPTION":       extraDeadline(2),
+	"SPEECH RECOGNIZE": extraDeadline(1),
+	"EXEC WAIT":        argDeadline(0, time.Second),
+	"EXEC DIAL":        noDeadline,
+	"EXEC QUEUE":       noDeadline,
+}
+
+// argDeadline returns a DeadlineFunc for commands that run for the duration
+// in unit at args[i] plus DeadlineGrace, and without limit when it is
+// negative
+func argDeadline(i int, unit time.Duration) DeadlineFunc {
+	return func(args []string, sessionTimeout time.Duration) time.Duration {
+		n, ok := intArg(args, i)
+		switch {
+		case !ok:
+			return sessionTimeout
+		case n < 0:
+			return 0
+		}
+		return max(sessionTimeout, time.Duration(n)*unit+DeadlineGrace)
+	}
+}
+
+// extraDeadline returns a DeadlineFunc for commands that play a prompt and
+// then wait for the timeout in milliseconds at args[i]
+func extraDeadline(i int) DeadlineFunc {
+	return func(args []string, sessionTimeout time.Duration) time.Duration {
+		n, ok := intArg(args, i)
+		if !ok || n <= 0 {
+			return sessionTimeout
+		}
+		return sessionTimeout + time.Duration(n)*time.Millisecond
+	}
+}
+
+// getDataDeadline allows GET DATA its prompt and the digit timeout for each
+// digit it may collect
+func getDataDeadline(args []string, sessionTimeout time.Duration) time.Duration {
+	timeout, ok := intArg(args, 1)
+	if !ok || timeout <= 0 {
+		return sessionTimeout
+	}
+	digits, ok := intArg(args, 2)
+	if !ok || digits < 1 {
+		digits = 1
+	}
+	return sessionTimeout + time.Duration(timeout*digits)*time.Millisecond
+}
+
+// noDeadline is the DeadlineFunc of commands that may run indefinitely
+func noDeadline([]string, time.Duration) time.Duration {
+	return 0
+}
+
+// intArg parses args[i] as an integer
+func intArg(args []string, i int) (int, bool) {
+	if i >= len(args) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(args[i])
+	return n, err == nil
+}
+
+// CommandDeadline returns how long a session with sessionTimeout waits for
+// the response to command, following CommandDeadlines. Zero means no
+// deadline.
+func CommandDeadline(command string, sessionTimeout time.Duration) time.Duration {
+	if sessionTimeout <= 0 {
+		return 0
+	}
+	cmd := ParseCommand(command)
+	fn, ok := CommandDeadlines[cmd.Name()]
+	if !ok {
+		return sessionTimeout
+	}
+	args := SplitCommand(cmd.Args)
+	if cmd.App != "" && len(args) > 0 {
+		args = strings.Split(args[0], ",")
+	}
+	if d := fn(args, sessionTimeout); d > 0 {
+		return max(d, sessionTimeout)
+	}
+	return 0
+}
+
+// CommandWithDeadline is Command waiting up to d for the response instead
+// of the deadline CommandDeadline gives it. Zero waits without limit.
+func (s *AgiSession) CommandWithDeadline(command string, d time.Duration) (*AgiResponse, error) {
+	return s.executeWithin(command, d, true)
+}
@@ -0,0 +1,146 @@
+package agi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// DeferredCommand is bookkeeping Defer runs once the handler is done, such
+// as setting CDR(userfield) or firing a UserEvent
+type DeferredCommand interface {
+	// RunDeferred sends the command
+	RunDeferred(s *AgiSession) error
+	// Media reports whether the command needs a live channel, like
+	// playing a prompt does; media commands are skipped once the channel
+	// hung up
+	Media() bool
+}
+
+// DeferredFunc adapts a function sending commands that work on a hung up
+// channel, such as SET VARIABLE, to DeferredCommand
+type DeferredFunc func(s *AgiSession) error
+
+// RunDeferred calls f(s)
+func (f DeferredFunc) RunDeferred(s *AgiSession) error { return f(s) }
+
+// Media implements DeferredCommand
+func (f DeferredFunc) Media() bool { return false }
+
+// DeferredMedia adapts a function that needs a live channel, such as one
+// playing a goodbye prompt, to DeferredCommand
+type DeferredMedia func(s *AgiSession) error
+
+// RunDeferred calls f(s)
+func (f DeferredMedia) RunDeferred(s *AgiSession) error { return f(s) }
+
+// Media implements DeferredCommand
+func (f DeferredMedia) Media() bool { return true }
+
+// SetVariable is a DeferredCommand setting a channel variable, such as
+// CDR(userfield)
+type SetVariable struct {
+	Name  string
+	Value string
+}
+
+// RunDeferred sets the variable
+func (v SetVariable) RunDeferred(s *AgiSession) error {
+	return s.SetVariable(v.Name, v.Value)
+}
+
+// Media implements DeferredCommand
+func (v SetVariable) Media() bool { return false }
+
+// String returns a description for error reports
+func (v SetVariable) String() string {
+	return "SET VARIABLE " + v.Name
+}
+
+// UserEvent is a DeferredCommand raising a UserEvent for AMI listeners.
+// Fields are sent sorted by key; their values must not contain commas.
+type UserEvent struct {
+	Name   string
+	Fields map[string]string
+}
+
+// RunDeferred runs the UserEvent application
+func (e UserEvent) RunDeferred(s *AgiSession) error {
+	keys := make([]string, 0, len(e.Fields))
+	for key := range e.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []string{e.Name}
+	for _, key := range keys {
+		args = append(args, key+": "+e.Fields[key])
+	}
+	return s.Execute("UserEvent", args...)
+}
+
+// Media implements DeferredCommand
+func (e UserEvent) Media() bool { return false }
+
+// String returns a description for error reports
+func (e UserEvent) String() string {
+	return "UserEvent " + e.Name
+}
+
+// Defer queues commands to run best-effort when the handler is done,
+// however it ends: by returning, panicking or the caller hanging up. The
+// FastAGI server runs them after the handler and its staged results and
+// before closing the connection; for process AGI Close runs them. Each
+// Defer call's commands run in order, later calls first, exactly once.
+// Media commands are skipped once the channel hung up. Failures are
+// reported to the server's error handler or returned by Close and never
+// replace the handler's error. Commands deferred after the others ran are
+// run at once, ignoring failures.
+func (s *AgiSession) Defer(cmds ...DeferredCommand) {
+	s.closeMu.Lock()
+	if !s.deferredRan {
+		s.deferred = append(s.deferred, cmds)
+		s.closeMu.Unlock()
+		return
+	}
+	s.closeMu.Unlock()
+	_ = s.runDeferredCommands(cmds)
+}
+
+// runDeferred runs the commands queued with Defer, once, and returns
+// their failures joined
+func (s *AgiSession) runDeferred() error {
+	s.closeMu.Lock()
+	if s.deferredRan {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.deferredRan = true
+	deferred := s.deferred
+	s.deferred = nil
+	s.closeMu.Unlock()
+
+	var errs []error
+	for i := len(deferred) - 1; i >= 0; i-- {
+		errs = append(errs, s.runDeferredCommands(deferred[i]))
+	}
+	return errors.Join(errs...)
+}
+
+// runDeferredCommands runs cmds in order, skipping media commands on a
+// hung up channel
+func (s *AgiSession) runDeferredCommands(cmds []DeferredCommand) error {
+	var errs []error
+	for _, cmd := range cmds {
+		if cmd.Media() && s.HungUp() {
+			continue
+		}
+		if err := cmd.RunDeferred(s); err != nil {
+			name := "command"
+			if str, ok := cmd.(fmt.Stringer); ok {
+				name = str.String()
+			}
+			errs = append(errs, fmt.Errorf("deferred %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
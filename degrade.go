@@ -0,0 +1,137 @@
+package agi
+
+import (
+	"sync"
+	"time"
+)
+
+// latencySmoothing is the weight of each new round trip in
+// LatencyStat.Estimate
+const latencySmoothing = 0.2
+
+// LatencyStat summarizes the round trips of one class of commands
+type LatencyStat struct {
+	// Count is how many commands of the class were answered
+	Count int
+	// Estimate is a moving average weighted towards recent round trips,
+	// so it follows a PBX that becomes overloaded mid-call
+	Estimate time.Duration
+	Last     time.Duration
+	Max      time.Duration
+}
+
+// LatencyStats holds a LatencyStat for each class of command that has
+// been answered. Round trips of media commands include playback and
+// waiting for the caller, so only the other classes measure the PBX.
+type LatencyStats map[VerbClass]LatencyStat
+
+// latencies tracks LatencyStats. Heartbeats and hotkey actions send
+// commands while the handler reads them, so it has its own lock.
+type latencies struct {
+	mu    sync.Mutex
+	stats LatencyStats
+}
+
+// observe records a round trip of a command of class
+func (l *latencies) observe(class VerbClass, elapsed time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stats == nil {
+		l.stats = make(LatencyStats)
+	}
+	stat := l.stats[class]
+	if stat.Count == 0 {
+		stat.Estimate = elapsed
+	} else {
+		stat.Estimate += time.Duration(latencySmoothing * float64(elapsed-stat.Estimate))
+	}
+	stat.Count++
+	stat.Last = elapsed
+	stat.Max = max(stat.Max, elapsed)
+	l.stats[class] = stat
+}
+
+// snapshot returns a copy of the stats
+func (l *latencies) snapshot() LatencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make(LatencyStats, len(l.stats))
+	for class, stat := range l.stats {
+		stats[class] = stat
+	}
+	return stats
+}
+
+// LatencyStats returns the round trip statistics of the session's commands
+// so far, by class
+func (s *AgiSession) LatencyStats() LatencyStats {
+	return s.latency.snapshot()
+}
+
+// Degradation is how much to shorten flows while the PBX is slow. The zero
+// value shortens nothing.
+type Degradation struct {
+	// SkipOptionalPrompts plays only the prompt that collects input, such
+	// as the last file of GetDataMulti
+	SkipOptionalPrompts bool
+	// LimitRetries caps retries at MaxRetries, such as those of
+	// SelectLanguage
+	LimitRetries bool
+	MaxRetries   int
+}
+
+// Retries returns n capped as d requires
+func (d Degradation) Retries(n int) int {
+	if d.LimitRetries {
+		return min(n, d.MaxRetries)
+	}
+	return n
+}
+
+// DegradationPolicy decides from a session's latency how much its flows
+// should be shortened. It is consulted each time a helper reaches a point
+// where it could shorten one.
+type DegradationPolicy func(s *AgiSession, stats LatencyStats) Degradation
+
+// DegradedRetries is how many retries DegradeWhenSlow leaves a flow, so a
+// caller who mistypes once still gets a second chance
+const DegradedRetries = 1
+
+// DegradeWhenSlow returns a policy skipping optional prompts and capping
+// retries at DegradedRetries while the latency estimate of read-only or
+// mutating commands is at least threshold. Round trips that take a few
+// milliseconds on a healthy PBX take hundreds under overload, so a
+// threshold around 200ms only catches the latter.
+func DegradeWhenSlow(threshold time.Duration) DegradationPolicy {
+	return func(_ *AgiSession, stats LatencyStats) Degradation {
+		for _, class := range []VerbClass{VerbReadOnly, VerbMutating} {
+			if stat, ok := stats[class]; ok && stat.Estimate >= threshold {
+				return Degradation{SkipOptionalPrompts: true, LimitRetries: true, MaxRetries: DegradedRetries}
+			}
+		}
+		return Degradation{}
+	}
+}
+
+// SetDegradationPolicy sets the policy the session's helpers consult before
+// optional prompts and retries. A nil policy, the default, never shortens
+// flows.
+func (s *AgiSession) SetDegradationPolicy(policy DegradationPolicy) {
+	s.degradationPolicy = policy
+}
+
+// WithDegradationPolicy sets the degradation policy of every session
+func WithDegradationPolicy(policy DegradationPolicy) ServerOption {
+	return func(s *FastAGIServer) {
+		s.degradationPolicy = policy
+	}
+}
+
+// Degradation returns what the session's DegradationPolicy currently asks
+// for, so handlers can shorten their own flows the way the helpers do
+func (s *AgiSession) Degradation() Degradation {
+	if s.degradationPolicy == nil {
+		return Degradation{}
+	}
+	return s.degradationPolicy(s, s.LatencyStats())
+}
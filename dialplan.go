@@ -0,0 +1,82 @@
+package agi
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// DialplanExists reports whether priority exists for extension in context,
+// using the DIALPLAN_EXISTS function. Extension may be a pattern such as
+// "_X." or contain "#", and is matched as the dialplan would match it.
+func (s *AgiSession) DialplanExists(context, extension string, priority int) (bool, error) {
+	if priority <= 0 {
+		return false, fmt.Errorf("invalid priority %d: must be greater than zero", priority)
+	}
+	return s.dialplanExists(context, extension, strconv.Itoa(priority))
+}
+
+// ValidExtension reports whether extension exists in context at any priority
+func (s *AgiSession) ValidExtension(context, extension string) (bool, error) {
+	return s.dialplanExists(context, extension, "")
+}
+
+// dialplanExists evaluates DIALPLAN_EXISTS, omitting the priority when empty.
+// Names are validated first so they cannot break out of the function call.
+func (s *AgiSession) dialplanExists(context, extension, priority string) (bool, error) {
+	if err := validateDialplanName("context", context, contextChars); err != nil {
+		return false, err
+	}
+	if err := validateDialplanName("extension", extension, extensionChars); err != nil {
+		return false, err
+	}
+
+	args := context + "," + extension
+	if priority != "" {
+		args += "," + priority
+	}
+	value, err := s.GetFullVariable("${DIALPLAN_EXISTS(" + args + ")}")
+	if err != nil {
+		return false, err
+	}
+	return value == "1", nil
+}
+
+// SetGotoPrecheck controls whether Goto first checks that its target exists
+// with DialplanExists, returning ErrDialplanNotFound instead of sending the
+// caller to a missing extension
+func (s *AgiSession) SetGotoPrecheck(enabled bool) {
+	s.gotoPrecheck = enabled
+}
+
+// Goto sets the context, extension and priority the channel continues at
+// once the AGI script exits. All three are validated before any command is
+// sent so an invalid target never leaves the channel half redirected.
+func (s *AgiSession) Goto(context, extension string, priority int) error {
+	if err := validateDialplanName("context", context, contextChars); err != nil {
+		return err
+	}
+	if err := validateDialplanName("extension", extension, extensionChars); err != nil {
+		return err
+	}
+	if priority <= 0 {
+		return fmt.Errorf("invalid priority %d: must be greater than zero", priority)
+	}
+
+	if s.gotoPrecheck {
+		exists, err := s.DialplanExists(context, extension, priority)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s,%s,%d", ErrDialplanNotFound, context, extension, priority)
+		}
+	}
+
+	if err := s.SetContext(context); err != nil {
+		return err
+	}
+	if err := s.SetExtension(extension); err != nil {
+		return err
+	}
+	return s.SetPriority(priority)
+}
@@ -0,0 +1,60 @@
+package agi
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Shubham-Thakur06/go-asterisk-agi/audio"
+)
+
+// eagiAudioFD is the file descriptor Asterisk passes EAGI scripts the
+// caller's audio on
+const eagiAudioFD = 3
+
+// Audio returns the caller's audio, in audio.SLIN format, or nil when the
+// session has none. Process sessions started with EAGI() read it from file
+// descriptor 3; other sessions need SetAudio.
+func (s *AgiSession) Audio() io.Reader {
+	return s.audio
+}
+
+// SetAudio sets the stream of the caller's audio that WaitForSilenceLocal
+// and DetectTone analyze, in audio.SLIN format
+func (s *AgiSession) SetAudio(r io.Reader) {
+	s.audio = r
+}
+
+// openEAGIAudio sets the session's audio to file descriptor 3 when
+// Asterisk started the script with EAGI()
+func (s *AgiSession) openEAGIAudio() {
+	if s.env["agi_enhanced"] == "1.0" {
+		s.audio = os.NewFile(eagiAudioFD, "eagi-audio")
+	}
+}
+
+// WaitForSilenceLocal waits until the caller has been silent for d,
+// analyzing the session's audio locally instead of running an Asterisk
+// application, so other commands can be sent meanwhile. It returns
+// ErrNoAudio without an audio stream and audio.ErrNotDetected when the
+// stream ends first.
+func (s *AgiSession) WaitForSilenceLocal(ctx context.Context, d time.Duration) error {
+	if s.audio == nil {
+		return ErrNoAudio
+	}
+	_, err := audio.SilenceDetector{Duration: d}.Wait(ctx, s.audio)
+	return err
+}
+
+// DetectTone waits until the session's audio carries a tone at freq Hz for
+// minDuration, such as 2100Hz from a fax machine. It returns ErrNoAudio
+// without an audio stream and audio.ErrNotDetected when the stream ends
+// first.
+func (s *AgiSession) DetectTone(ctx context.Context, freq float64, minDuration time.Duration) error {
+	if s.audio == nil {
+		return ErrNoAudio
+	}
+	_, err := audio.ToneDetector{Frequency: freq, MinDuration: minDuration}.Detect(ctx, s.audio)
+	return err
+}
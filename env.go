@@ -0,0 +1,108 @@
+package agi
+
+import (
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// Env holds the numeric fields of the AGI environment with their types.
+// Parsing is lenient: a field that is missing or malformed is zero, and Raw
+// holds every variable exactly as received, so callers can still inspect
+// what was sent.
+//
+// Asterisk versions differ in what they send. agi_version and agi_threadid
+// are missing from old releases. Since Asterisk 1.8, agi_callingpres is the
+// combined presentation of the caller's name and number; before, it was the
+// number's presentation alone. The calling-party attributes come from the
+// channel's signalling: ISDN and SS7 channels such as DAHDI carry real
+// values, while SIP and PJSIP channels usually send 0.
+type Env struct {
+	// Priority is agi_priority. Asterisk sends the numeric priority;
+	// when something else, such as an environment transformer, passes a
+	// priority label instead, Priority is 0 and PriorityLabel holds it.
+	Priority      int
+	PriorityLabel string
+	// Enhanced reports agi_enhanced "1.0": the script was started with
+	// EAGI() and has the caller's audio on file descriptor 3
+	Enhanced bool
+	// ThreadID is agi_threadid, the Asterisk thread running the AGI
+	ThreadID uint64
+	// CallingPres is agi_callingpres, the caller's presentation and
+	// screening indicator
+	CallingPres CallingPres
+	// CallingANI2 is agi_callingani2, the ANI II information digits
+	CallingANI2 int
+	// CallingTON is agi_callington, the type and numbering plan of the
+	// caller's number
+	CallingTON int
+	// CallingTNS is agi_callingtns, the transit network selection code
+	CallingTNS int
+	// Raw holds every environment variable as received
+	Raw map[string]string
+}
+
+// CallingPres is a calling presentation value, as used by
+// CALLERID(pres): bits 5 and 6 hold the presentation and bits 0 and 1 the
+// screening indicator
+type CallingPres int
+
+// Presentation indicators of CallingPres
+const (
+	PresAllowed     CallingPres = 0x00
+	PresRestricted  CallingPres = 0x20
+	PresUnavailable CallingPres = 0x40
+)
+
+// Screening indicators of CallingPres
+const (
+	ScreenUserNotScreened CallingPres = 0x00
+	ScreenUserPassed      CallingPres = 0x01
+	ScreenUserFailed      CallingPres = 0x02
+	ScreenNetwork         CallingPres = 0x03
+)
+
+// Presentation returns the presentation indicator of p, such as
+// PresRestricted
+func (p CallingPres) Presentation() CallingPres {
+	return p & 0x60
+}
+
+// Screening returns the screening indicator of p, such as ScreenNetwork
+func (p CallingPres) Screening() CallingPres {
+	return p & 0x03
+}
+
+// Allowed reports whether the caller's number may be presented
+func (p CallingPres) Allowed() bool {
+	return p.Presentation() == PresAllowed
+}
+
+// ParseEnv parses the numeric fields of an AGI environment
+func ParseEnv(env map[string]string) Env {
+	e := Env{
+		Enhanced:    strings.HasPrefix(strings.TrimSpace(env["agi_enhanced"]), "1"),
+		CallingPres: CallingPres(parseIntField(env, "agi_callingpres")),
+		CallingANI2: parseIntField(env, "agi_callingani2"),
+		CallingTON:  parseIntField(env, "agi_callington"),
+		CallingTNS:  parseIntField(env, "agi_callingtns"),
+		Raw:         maps.Clone(env),
+	}
+	if e.Raw == nil {
+		e.Raw = make(map[string]string)
+	}
+	if priority := strings.TrimSpace(env["agi_priority"]); priority != "" {
+		n, err := strconv.Atoi(priority)
+		if err != nil {
+			e.PriorityLabel = priority
+		}
+		e.Priority = n
+	}
+	e.ThreadID, _ = strconv.ParseUint(strings.TrimSpace(env["agi_threadid"]), 10, 64)
+	return e
+}
+
+// Env returns the numeric fields of the session's environment; see ParseEnv
+func (s *AgiSession) Env() Env {
+	return ParseEnv(s.env)
+}
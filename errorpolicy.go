@@ -0,0 +1,91 @@
+package agi
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DialplanLocation is a place in the dialplan a channel can continue at
+type DialplanLocation struct {
+	Context   string
+	Extension string
+	Priority  int
+}
+
+// ErrorPolicy is what the FastAGI server does with the channel when a
+// handler fails, so callers get the same experience whatever the dialplan
+// does after AGI returns. The zero value does nothing and leaves the
+// channel to the dialplan.
+type ErrorPolicy struct {
+	// Prompt is played first, such as "technical-difficulties"
+	Prompt string
+	// Hangup hangs up the channel after the prompt
+	Hangup bool
+	// ContinueAt sends the channel to a dialplan location, such as an
+	// operator queue, once the AGI returns. It cannot be combined with
+	// Hangup.
+	ContinueAt *DialplanLocation
+}
+
+// WithErrorPolicy sets what the server does with the channel when a handler
+// returns an error. It runs after the handler's staged results and
+// deferred commands, best-effort: errors are passed to the error handler,
+// and nothing is sent once the channel hung up or the session was
+// cancelled. Errors that are part of normal control flow, ErrNextHandler,
+// AbortFlow and ErrHangup, do not trigger it.
+func WithErrorPolicy(p ErrorPolicy) ServerOption {
+	return func(s *FastAGIServer) {
+		s.errorPolicy = p
+	}
+}
+
+// WithRouteErrorPolicy overrides the server's WithErrorPolicy for the
+// route's sessions
+func WithRouteErrorPolicy(p ErrorPolicy) RouteOption {
+	return func(r *route) {
+		r.errorPolicy = &p
+	}
+}
+
+// SetErrorPolicy replaces the error policy applied if the session's handler
+// fails
+func (s *AgiSession) SetErrorPolicy(p ErrorPolicy) {
+	s.errorPolicy = p
+}
+
+// applyErrorPolicy applies the session's error policy after its handler
+// failed with err, recording it for Info when it did anything
+func (s *AgiSession) applyErrorPolicy(err error) error {
+	p := s.errorPolicy
+	if p == (ErrorPolicy{}) || isControlError(err) || s.HungUp() || s.Context().Err() != nil {
+		return nil
+	}
+	s.appliedErrorPolicy = &p
+
+	if p.Prompt != "" {
+		if err := s.StreamFile(p.Prompt, ""); err != nil {
+			if errors.Is(err, ErrHangup) {
+				return nil
+			}
+			return fmt.Errorf("error policy prompt: %w", err)
+		}
+	}
+	switch {
+	case p.Hangup:
+		if err := s.Hangup(); err != nil {
+			return fmt.Errorf("error policy hangup: %w", err)
+		}
+	case p.ContinueAt != nil:
+		at := p.ContinueAt
+		if err := s.Goto(at.Context, at.Extension, at.Priority); err != nil {
+			return fmt.Errorf("error policy goto: %w", err)
+		}
+	}
+	return nil
+}
+
+// isControlError reports whether a handler error is part of normal control
+// flow rather than a failure
+func isControlError(err error) bool {
+	return errors.Is(err, ErrNextHandler) || errors.Is(err, AbortFlow) || errors.Is(err, ErrHangup)
+}
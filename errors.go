@@ -0,0 +1,316 @@
+package agi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Coder is implemented by the errors of this package. Code returns a short
+// snake_case name for the class of failure, such as "hangup" or "timeout",
+// that stays the same when messages are reworded, for alerting rules and
+// dashboards that count failures by class.
+type Coder interface {
+	Code() string
+}
+
+// CodeUnknown is the code ErrorCode gives errors it does not recognize
+const CodeUnknown = "unknown"
+
+// codedError is a sentinel error with a stable code
+type codedError struct {
+	code string
+	msg  string
+}
+
+// newError returns a sentinel error with the given code and message
+func newError(code, msg string) error {
+	return &codedError{code: code, msg: msg}
+}
+
+// Error implements the error interface
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// Code implements Coder
+func (e *codedError) Code() string {
+	return e.code
+}
+
+// ErrorCode returns the code of the first Coder in err's chain. Cancelled
+// and expired contexts are "canceled" and "deadline_exceeded", a connection
+// closed by Asterisk is "disconnected", and other errors are CodeUnknown.
+// A nil err has the empty code.
+func ErrorCode(err error) string {
+	var coder Coder
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &coder):
+		return coder.Code()
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return "disconnected"
+	}
+	return CodeUnknown
+}
+
+// ErrInvalidResponse is returned when Asterisk sends a response that is not a
+// well-formed "200 result=" line
+var ErrInvalidResponse = newError("invalid_response", "invalid response")
+
+// ErrInvalidEnvironment is returned when an AGI environment line is not in
+// "key: value" form
+var ErrInvalidEnvironment = newError("invalid_environment", "invalid environment line")
+
+// ErrLineTooLong is returned when Asterisk sends a line longer than the
+// session's maximum line size
+var ErrLineTooLong = newError("line_too_long", "line exceeds maximum size")
+
+// ErrHangup is returned when Asterisk reports that the channel hung up
+var ErrHangup = newError("hangup", "channel hung up")
+
+// ErrSessionClosed is returned for a command sent after the session was
+// closed locally, by Close or by the FastAGI server once the handler
+// returned
+var ErrSessionClosed = newError("session_closed", "session closed")
+
+// ErrCommandFailed is returned when Asterisk reports that a command failed
+// with result=-1
+var ErrCommandFailed = newError("command_failed", "command failed")
+
+// ErrNoPrompts is returned when a prompt sequence has no files to play
+var ErrNoPrompts = newError("no_prompts", "no prompt files given")
+
+// ErrNoCallState is returned by CallState methods when the server was not
+// configured with WithCallState
+var ErrNoCallState = newError("no_call_state", "call state not configured")
+
+// ErrInvalidPattern is returned when a digit pattern cannot be compiled
+var ErrInvalidPattern = newError("invalid_pattern", "invalid digit pattern")
+
+// ErrPatternMismatch is returned when collected digits do not match the
+// required pattern
+var ErrPatternMismatch = newError("pattern_mismatch", "digits do not match pattern")
+
+// ErrDialplanNotFound is returned by Goto when its target does not exist
+var ErrDialplanNotFound = newError("dialplan_not_found", "dialplan target not found")
+
+// ErrTimeout is returned when Asterisk does not respond within the session timeout
+var ErrTimeout = newError("timeout", "timed out waiting for response")
+
+// ErrPromptNotFound is returned when Asterisk reports that a sound file could
+// not be played, which it signals with result=0 and endpos=0
+var ErrPromptNotFound = newError("prompt_not_found", "prompt not found")
+
+// ErrNoOptions is returned by menu helpers called without any options
+var ErrNoOptions = newError("no_options", "no options given")
+
+// ErrChannelGone is returned when CHANNEL STATUS reports that the channel
+// being watched no longer exists
+var ErrChannelGone = newError("channel_gone", "channel no longer exists")
+
+// ErrNoStats is returned when a channel has no RTP statistics, either because
+// it does not use RTP or because none are available yet
+var ErrNoStats = newError("no_stats", "no RTP statistics available")
+
+// ErrUnsupportedChannelTech is returned by media helpers for channel
+// technologies they do not know how to control
+var ErrUnsupportedChannelTech = newError("unsupported_channel_tech", "unsupported channel technology")
+
+// ErrCommandDenied is returned when a command policy blocks a command
+var ErrCommandDenied = newError("command_denied", "command denied by policy")
+
+// ErrRouteNotFound is returned by a Mux for a FastAGI URL path with no
+// registered route
+var ErrRouteNotFound = newError("route_not_found", "no route for request")
+
+// ErrRouteBusy is returned by a Mux when a route is at its concurrency limit
+// and has no busy prompt or fallback handler
+var ErrRouteBusy = newError("route_busy", "route at concurrency limit")
+
+// ErrUnknownTenant is returned for a session whose tenant, named by the
+// WithTenantResolver function, was not registered with WithTenant
+var ErrUnknownTenant = newError("unknown_tenant", "unknown tenant")
+
+// ErrNilHandler is reported by FastAGIServer.Validate for a server or Mux
+// route without a handler
+var ErrNilHandler = newError("nil_handler", "nil handler")
+
+// ErrInvalidLimit is reported by FastAGIServer.Validate for a negative size
+// or a limit that can never be met, and by GetData for a maxDigits above
+// the session's cap
+var ErrInvalidLimit = newError("invalid_limit", "invalid limit")
+
+// ErrInvalidOption is reported by FastAGIServer.Validate for an option value
+// the server cannot use
+var ErrInvalidOption = newError("invalid_option", "invalid option")
+
+// ErrConflictingOptions is reported by FastAGIServer.Validate for an option
+// that has no effect without another
+var ErrConflictingOptions = newError("conflicting_options", "conflicting options")
+
+// ErrNoRoutes is reported by FastAGIServer.Validate for a Mux that would
+// turn away every call
+var ErrNoRoutes = newError("no_routes", "no routes registered")
+
+// ErrHandlerPanic is returned for a FastAGI session whose handler panicked;
+// the server recovers and carries on serving other sessions
+var ErrHandlerPanic = newError("handler_panic", "handler panicked")
+
+// ErrInvalidAddress is returned when a server listen address or network is
+// malformed
+var ErrInvalidAddress = newError("invalid_address", "invalid listen address")
+
+// ErrRecordFailed is returned when Asterisk reports that a recording failed
+var ErrRecordFailed = newError("record_failed", "recording failed")
+
+// ErrAppNotFound is returned by Execute when Asterisk has no dialplan
+// application of the given name loaded
+var ErrAppNotFound = newError("app_not_found", "application not found")
+
+// ErrAppFailed is returned by Execute when the dialplan application
+// returned failure, which usually means the channel hung up while it ran
+var ErrAppFailed = newError("app_failed", "application failed")
+
+// ErrPlaybackFailed is returned by Playback when PLAYBACKSTATUS reports that
+// a file could not be played
+var ErrPlaybackFailed = newError("playback_failed", "playback failed")
+
+// ErrRenameFailed is returned when a completed recording could not be moved
+// to its final name
+var ErrRenameFailed = newError("rename_failed", "rename of recording failed")
+
+// ErrCommandLimitExceeded is returned for commands a session may not send
+// because of WithMaxCommandsPerSession or WithMaxCommandRate
+var ErrCommandLimitExceeded = newError("command_limit_exceeded", "command limit exceeded")
+
+// ErrInvalidFlowState is returned by LoadFlowState when the saved state is
+// incomplete or cannot be decoded
+var ErrInvalidFlowState = newError("invalid_flow_state", "invalid flow state")
+
+// ErrMalformedCommand is reported by ValidateCommand for commands Asterisk
+// would split into different arguments than intended
+var ErrMalformedCommand = newError("malformed_command", "malformed command")
+
+// ErrAlreadyCompleted is returned by Complete for a key completed before,
+// and by AwaitExternal for a key a session already received
+var ErrAlreadyCompleted = newError("already_completed", "already completed")
+
+// ErrAlreadyAwaited is returned by AwaitExternal for a key another session
+// is waiting for
+var ErrAlreadyAwaited = newError("already_awaited", "already awaited")
+
+// ErrNoAudio is returned by audio helpers for sessions without the
+// caller's audio; see SetAudio
+var ErrNoAudio = newError("no_audio", "no audio stream")
+
+// maxErrorPrefix is how much of a failed line is kept in a ReadError
+const maxErrorPrefix = 128
+
+// ReadError describes a line read that failed or was cut short. It records
+// how many bytes arrived and the start of what was received, which helps
+// identify peers or middleboxes sending unexpected data. Prefix can hold
+// collected digits or variable values, so Error leaves it out.
+type ReadError struct {
+	Received int
+	Prefix   string
+	Err      error
+}
+
+// newReadError builds a ReadError from the bytes received before err
+func newReadError(received []byte, err error) *ReadError {
+	prefix := received
+	if len(prefix) > maxErrorPrefix {
+		prefix = prefix[:maxErrorPrefix]
+	}
+	return &ReadError{
+		Received: len(received),
+		Prefix:   string(prefix),
+		Err:      err,
+	}
+}
+
+// Error implements the error interface
+func (e *ReadError) Error() string {
+	if e.Received == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v after %d bytes", e.Err, e.Received)
+}
+
+// Unwrap returns the underlying error
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// Code implements Coder with the code of the underlying error, or
+// "read_failed"
+func (e *ReadError) Code() string {
+	if code := ErrorCode(e.Err); code != CodeUnknown {
+		return code
+	}
+	return "read_failed"
+}
+
+// CommandError reports a failed AGI command. It names the command verb but
+// never its arguments, which may contain collected digits or other caller
+// data, and unwraps to the underlying cause. Recent holds the session's last
+// exchanges, already redacted; they are printed by the %+v verb.
+type CommandError struct {
+	Verb     string
+	UniqueID string
+	Elapsed  time.Duration
+	Err      error
+	// ErrCode is ErrorCode(Err)
+	ErrCode string
+	Recent  []Exchange
+}
+
+// Error implements the error interface
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s (uniqueid %s, after %v): %v", e.Verb, e.UniqueID, e.Elapsed.Round(time.Millisecond), e.Err)
+}
+
+// Format implements fmt.Formatter. The %+v verb appends one line per recent
+// exchange after the error message.
+func (e *CommandError) Format(f fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && f.Flag('+'):
+		io.WriteString(f, e.Error())
+		for _, x := range e.Recent {
+			fmt.Fprintf(f, "\n\t%s %s -> ", x.Time.Format("15:04:05.000"), x.Command)
+			if x.Err != nil {
+				fmt.Fprintf(f, "error: %v", x.Err)
+			} else {
+				io.WriteString(f, x.Response)
+			}
+			fmt.Fprintf(f, " (%v)", x.Elapsed.Round(time.Millisecond))
+		}
+	case verb == 'q':
+		fmt.Fprintf(f, "%q", e.Error())
+	default:
+		io.WriteString(f, e.Error())
+	}
+}
+
+// Unwrap returns the underlying error
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Code implements Coder with ErrCode, or the code of the underlying error
+// when ErrCode is empty
+func (e *CommandError) Code() string {
+	if e.ErrCode != "" {
+		return e.ErrCode
+	}
+	return ErrorCode(e.Err)
+}
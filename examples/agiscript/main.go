@@ -0,0 +1,40 @@
+// Command agiscript is an example process AGI script, run by Asterisk for
+// each call:
+//
+//	exten => 1000,1,AGI(/usr/local/bin/agiscript)
+//	 same => n,Verbose(1,Caller chose ${AGIRESULT_CHOICE})
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// run answers the call, offers a one-digit menu and writes the choice to
+// AGIRESULT_CHOICE for the dialplan
+func run(ctx context.Context, s *agi.AgiSession) error {
+	if err := s.Answer(); err != nil {
+		return err
+	}
+
+	choice, err := s.GetOption("main-menu", "123", 5*time.Second)
+	switch {
+	case errors.Is(err, agi.ErrPromptNotFound):
+		log.Printf("call %s: main-menu prompt is missing", s.GetEnv("agi_uniqueid"))
+		choice = ""
+	case err != nil:
+		return err
+	}
+	if choice == "" {
+		choice = "none"
+	}
+	return s.SetResult(map[string]string{"CHOICE": choice})
+}
+
+func main() {
+	agi.RunFunc(run)
+}
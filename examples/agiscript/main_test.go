@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agitest"
+)
+
+func TestRunSmoke(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{"choice", "200 result=50 endpos=12000", `SET VARIABLE AGIRESULT_CHOICE "2"`},
+		{"no input", "200 result=0 endpos=24000", `SET VARIABLE AGIRESULT_CHOICE "none"`},
+		{"missing prompt", "200 result=0 endpos=0", `SET VARIABLE AGIRESULT_CHOICE "none"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := agitest.NewFake([]string{"200 result=0", tt.response, "200 result=1"})
+			session, err := fake.Session(context.Background())
+			require.NoError(t, err)
+			defer fake.Close()
+
+			require.NoError(t, run(context.Background(), session))
+			assert.Equal(t, []string{"ANSWER", `GET OPTION main-menu "123" 5000`, tt.want}, fake.Commands())
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Command fastagi is an example FastAGI server. It asks the caller for an
+// account number and hands the result back to the dialplan in
+// AGIRESULT_STATUS and AGIRESULT_ACCOUNT:
+//
+//	exten => 1001,1,AGI(agi://localhost:4573/account)
+//	 same => n,GotoIf($["${AGIRESULT_STATUS}" = "OK"]?found)
+//	 same => n,Playback(goodbye)
+//	 same => n,Hangup()
+//	 same => n(found),Goto(accounts,${AGIRESULT_ACCOUNT},1)
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// accountDigits is the length of an account number
+const accountDigits = 4
+
+// handleAccount collects an account number and stages the outcome for the
+// dialplan. A caller hanging up is an ordinary end to the call, not an
+// error.
+func handleAccount(ctx context.Context, s *agi.AgiSession) error {
+	err := collectAccount(ctx, s)
+	if errors.Is(err, agi.ErrHangup) {
+		return nil
+	}
+	return err
+}
+
+// collectAccount plays the prompts and stages STATUS and ACCOUNT. Callers
+// who know the flow can start typing during the welcome prompt.
+func collectAccount(ctx context.Context, s *agi.AgiSession) error {
+	prompts := []string{"welcome", "enter-account"}
+	for attempt := 0; attempt < 3; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		account, _, err := s.GetDataMulti(prompts, 5*time.Second, accountDigits)
+		if err != nil {
+			return err
+		}
+		if len(account) == accountDigits {
+			s.StageResult("STATUS", "OK")
+			s.StageResult("ACCOUNT", account)
+			return nil
+		}
+		prompts = []string{"invalid", "enter-account"}
+	}
+
+	s.StageResult("STATUS", "NOINPUT")
+	return nil
+}
+
+// newServer creates the example server listening on addr
+func newServer(addr string, logger *log.Logger) (*agi.FastAGIServer, error) {
+	return agi.NewFastAGIServer(addr, agi.HandlerFunc(handleAccount),
+		agi.WithAutoAnswer(true),
+		agi.WithResultPrefix(agi.DefaultResultPrefix),
+		agi.WithErrorHandler(func(s *agi.AgiSession, err error) {
+			if s != nil {
+				logger.Printf("call %s: %v", s.GetEnv("agi_uniqueid"), err)
+				return
+			}
+			logger.Print(err)
+		}),
+	)
+}
+
+func main() {
+	addr := flag.String("listen", ":4573", "address to listen on")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	server, err := newServer(*addr, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Print(err)
+		}
+	}()
+
+	logger.Printf("FastAGI server listening on %s", server.Addr())
+	if err := server.Serve(); err != nil {
+		logger.Fatal(err)
+	}
+}
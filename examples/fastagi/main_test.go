@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agitest"
+)
+
+func TestServerSmoke(t *testing.T) {
+	server, err := newServer("127.0.0.1:0", log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	t.Cleanup(func() {
+		assert.NoError(t, server.Stop())
+		assert.NoError(t, <-served)
+	})
+
+	fake := agitest.NewFake([]string{
+		"200 result=6",             // CHANNEL STATUS: up
+		"200 result=0 endpos=8000", // welcome
+		"200 result=12 (timeout)",  // enter-account: too short
+		"200 result=0 endpos=4000", // invalid
+		"200 result=4321",          // enter-account
+		"200 result=1",             // SET VARIABLE AGIRESULT_ACCOUNT
+		"200 result=1",             // SET VARIABLE AGIRESULT_STATUS
+	}, agitest.WithEnv("agi_extension", "1001"))
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fake.Serve(conn)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not finish")
+	}
+	assert.Equal(t, []string{
+		"CHANNEL STATUS",
+		`STREAM FILE welcome "0123456789*#"`,
+		"GET DATA enter-account 5000 4",
+		`STREAM FILE invalid "0123456789*#"`,
+		"GET DATA enter-account 5000 4",
+		`SET VARIABLE AGIRESULT_ACCOUNT "4321"`,
+		`SET VARIABLE AGIRESULT_STATUS "OK"`,
+	}, fake.Commands())
+}
+
+func TestServerSmokeHangup(t *testing.T) {
+	var logged []string
+	server, err := newServer("127.0.0.1:0", log.New(writerFunc(func(p []byte) (int, error) {
+		logged = append(logged, string(p))
+		return len(p), nil
+	}), "", 0))
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+
+	fake := agitest.NewFake([]string{
+		"200 result=6",
+		"HANGUP\n200 result=-1 endpos=200", // welcome: caller hangs up
+	})
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	fake.Serve(conn)
+
+	require.NoError(t, server.Shutdown(context.Background()))
+	require.NoError(t, <-served)
+	assert.Equal(t, []string{"CHANNEL STATUS", `STREAM FILE welcome "0123456789*#"`}, fake.Commands())
+	assert.Empty(t, logged, "a hangup is not an error")
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,16 @@
+module github.com/Shubham-Thakur06/go-asterisk-agi/examples
+
+go 1.23.2
+
+require (
+	github.com/Shubham-Thakur06/go-asterisk-agi v0.0.0
+	github.com/stretchr/testify v1.10.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/Shubham-Thakur06/go-asterisk-agi => ../
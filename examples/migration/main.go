@@ -0,0 +1,66 @@
+// Command migration is the agiscript example part way through a move to
+// the agi2 API. The menu runs on agi2, with a context bounding each command
+// and typed results, while the result handling still uses the
+// *agi.AgiSession underneath. Both send the same commands, so a call can
+// be migrated one step at a time:
+//
+//	exten => 1000,1,AGI(/usr/local/bin/migration)
+//	 same => n,Verbose(1,Caller chose ${AGIRESULT_CHOICE})
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agi2"
+)
+
+// commandTimeout bounds each command, on top of the prompt itself
+const commandTimeout = 30 * time.Second
+
+// run answers the call, offers a one-digit menu and writes the choice to
+// AGIRESULT_CHOICE for the dialplan
+func run(ctx context.Context, s *agi2.Session) error {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	// Migrated: Answer() became Answer(ctx)
+	if err := s.Answer(ctx); err != nil {
+		return err
+	}
+
+	// Migrated: GetOption returns the digit and where playback stopped,
+	// and a hangup is agi.ErrHangup rather than no choice
+	choice := "none"
+	played, err := s.GetOption(ctx, "main-menu", "123", 5*time.Second)
+	switch {
+	case errors.Is(err, agi.ErrPromptNotFound):
+		log.Printf("call %s: main-menu prompt is missing", s.V1().GetEnv("agi_uniqueid"))
+	case err != nil:
+		return err
+	case played.Digit != "":
+		choice = played.Digit
+	}
+
+	// Not migrated yet: SetResult has no agi2 equivalent
+	return s.V1().SetResult(map[string]string{"CHOICE": choice})
+}
+
+func main() {
+	// Asterisk owns stdout, so log to stderr, which it shows on the console
+	log.SetOutput(os.Stderr)
+
+	session, err := agi.NewAgiSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+
+	if err := run(context.Background(), agi2.New(session)); err != nil && !errors.Is(err, agi.ErrHangup) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,278 @@
+package agi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultPendingTTL is how long an ExternalRegistry keeps a payload
+// completed before anyone awaited its key
+const DefaultPendingTTL = 5 * time.Minute
+
+// DefaultAwaitPoll is how often AwaitExternal checks that the channel is
+// still up while it waits
+const DefaultAwaitPoll = time.Second
+
+// ExternalRegistry pairs AwaitExternal calls with the Complete calls that
+// deliver their payloads, such as from a webhook handler running in the
+// same process as the FastAGI server. Keys are chosen by the caller and
+// must be unique across the sessions sharing a registry, such as a payment
+// reference or the call's uniqueid.
+//
+// A payload completed before its key is awaited is kept for the registry's
+// pending TTL and handed to the first AwaitExternal of the key. Each key
+// is completed once: the keys a session awaited are remembered until the
+// session closes, so a webhook delivered twice gets ErrAlreadyCompleted
+// rather than being mistaken for a new payment.
+type ExternalRegistry struct {
+	pendingTTL time.Duration
+	clk        Clock
+
+	mu      sync.Mutex
+	entries map[string]*externalEntry
+	owned   map[*AgiSession][]string
+}
+
+// externalEntry is the state of one key
+type externalEntry struct {
+	payload   string
+	completed bool
+	// ready is closed by Complete when a session is waiting
+	ready chan struct{}
+	owner *AgiSession
+	// expires is when a completed key no session owns is forgotten
+	expires time.Time
+}
+
+// defaultRegistry is the registry of Complete and of sessions whose server
+// has no WithExternalRegistry
+var defaultRegistry = NewExternalRegistry(DefaultPendingTTL)
+
+// NewExternalRegistry returns a registry keeping payloads completed ahead
+// of AwaitExternal for pendingTTL, DefaultPendingTTL when zero or less
+func NewExternalRegistry(pendingTTL time.Duration) *ExternalRegistry {
+	if pendingTTL <= 0 {
+		pendingTTL = DefaultPendingTTL
+	}
+	return &ExternalRegistry{
+		pendingTTL: pendingTTL,
+		entries:    make(map[string]*externalEntry),
+		owned:      make(map[*AgiSession][]string),
+	}
+}
+
+// WithExternalRegistry makes AwaitExternal on the server's sessions wait on
+// r instead of the package registry Complete delivers to
+func WithExternalRegistry(r *ExternalRegistry) ServerOption {
+	return func(s *FastAGIServer) {
+		s.externals = r
+	}
+}
+
+// Complete delivers payload to the AwaitExternal call waiting for key on
+// the package registry; see ExternalRegistry.Complete
+func Complete(key, payload string) error {
+	return defaultRegistry.Complete(key, payload)
+}
+
+// Complete delivers payload to the AwaitExternal call waiting for key, or
+// keeps it for the first one to come. It returns ErrAlreadyCompleted when
+// key was completed before.
+func (r *ExternalRegistry) Complete(key, payload string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+
+	e := r.entries[key]
+	switch {
+	case e == nil:
+		r.entries[key] = &externalEntry{payload: payload, completed: true, expires: r.clock().Now().Add(r.pendingTTL)}
+	case e.completed:
+		return fmt.Errorf("%w: %s", ErrAlreadyCompleted, key)
+	default:
+		e.payload, e.completed = payload, true
+		close(e.ready)
+	}
+	return nil
+}
+
+// Len returns how many keys the registry holds, awaited, completed or
+// remembered
+func (r *ExternalRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+	return len(r.entries)
+}
+
+// await registers s as waiting for key. It returns the payload when key
+// was completed already, or the entry whose ready channel Complete closes.
+func (r *ExternalRegistry) await(s *AgiSession, key string) (payload string, waiting *externalEntry, err error) {
+	r.mu.Lock()
+	r.expire()
+	e := r.entries[key]
+	switch {
+	case e != nil && e.owner != nil && e.completed:
+		err = fmt.Errorf("%w: %s", ErrAlreadyCompleted, key)
+	case e != nil && e.owner != nil:
+		err = fmt.Errorf("%w: %s", ErrAlreadyAwaited, key)
+	case e != nil:
+		payload = e.payload
+	default:
+		e = &externalEntry{ready: make(chan struct{})}
+		r.entries[key] = e
+		waiting = e
+	}
+	first := false
+	if err == nil {
+		e.owner = s
+		_, held := r.owned[s]
+		r.owned[s] = append(r.owned[s], key)
+		first = !held
+	}
+	r.mu.Unlock()
+
+	// Outside r.mu: OnClose runs release at once on a closed session
+	if first {
+		s.OnClose(func(error) { r.release(s) })
+	}
+	return payload, waiting, err
+}
+
+// cancel forgets the entry e of key when its session stopped waiting
+// before it was completed, and returns the payload when it was completed
+// meanwhile
+func (r *ExternalRegistry) cancel(key string, e *externalEntry) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e.completed {
+		return e.payload, true
+	}
+	if r.entries[key] == e {
+		delete(r.entries, key)
+	}
+	return "", false
+}
+
+// payload returns the payload delivered to e
+func (r *ExternalRegistry) payload(e *externalEntry) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return e.payload
+}
+
+// release forgets every key s held
+func (r *ExternalRegistry) release(s *AgiSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range r.owned[s] {
+		if e := r.entries[key]; e != nil && e.owner == s {
+			delete(r.entries, key)
+		}
+	}
+	delete(r.owned, s)
+}
+
+// expire forgets completed keys no session took in time. The caller must
+// hold r.mu.
+func (r *ExternalRegistry) expire() {
+	now := r.clock().Now()
+	for key, e := range r.entries {
+		if e.owner == nil && !now.Before(e.expires) {
+			delete(r.entries, key)
+		}
+	}
+}
+
+// clock returns the registry's clock, RealClock unless a test set one
+func (r *ExternalRegistry) clock() Clock {
+	if r.clk == nil {
+		return RealClock{}
+	}
+	return r.clk
+}
+
+// AwaitOptions configures AwaitExternalWith
+type AwaitOptions struct {
+	// Hold plays music on hold while waiting, of MusicClass or the
+	// channel's class when empty
+	Hold       bool
+	MusicClass string
+	// Poll is how often the channel is checked with NOOP, which makes
+	// Asterisk report a hangup. Defaults to DefaultAwaitPoll.
+	Poll time.Duration
+}
+
+// AwaitExternal waits until Complete delivers the payload for key, such as
+// a payment provider's webhook confirming a payment, and returns it. It
+// returns ErrTimeout when ctx is done first and ErrHangup when the channel
+// hangs up, after which a late Complete for key is kept like one arriving
+// early. ErrAlreadyAwaited is returned when another session is waiting for
+// key and ErrAlreadyCompleted when a session already received it.
+func (s *AgiSession) AwaitExternal(ctx context.Context, key string) (string, error) {
+	return s.AwaitExternalWith(ctx, key, AwaitOptions{})
+}
+
+// AwaitExternalWith is AwaitExternal with hold music and a custom hangup
+// check interval; see AwaitOptions
+func (s *AgiSession) AwaitExternalWith(ctx context.Context, key string, opts AwaitOptions) (string, error) {
+	if opts.Poll <= 0 {
+		opts.Poll = DefaultAwaitPoll
+	}
+	if !opts.Hold {
+		return s.awaitExternal(ctx, key, opts.Poll)
+	}
+	var payload string
+	err := s.WithMusicOnHold(opts.MusicClass, func() error {
+		var err error
+		payload, err = s.awaitExternal(ctx, key, opts.Poll)
+		return err
+	})
+	return payload, err
+}
+
+// awaitExternal waits for key, checking the channel every poll
+func (s *AgiSession) awaitExternal(ctx context.Context, key string, poll time.Duration) (string, error) {
+	r := s.externals
+	if r == nil {
+		r = defaultRegistry
+	}
+	payload, e, err := r.await(s, key)
+	if err != nil || e == nil {
+		return payload, err
+	}
+
+	// stop gives up waiting with err unless key was completed meanwhile
+	stop := func(err error) (string, error) {
+		if payload, ok := r.cancel(key, e); ok {
+			return payload, nil
+		}
+		return "", err
+	}
+	for {
+		timer := s.clock().NewTimer(poll)
+		select {
+		case <-e.ready:
+			timer.Stop()
+			return r.payload(e), nil
+		case <-ctx.Done():
+			timer.Stop()
+			if s.HungUp() || errors.Is(context.Cause(ctx), ErrHangup) {
+				return stop(ErrHangup)
+			}
+			return stop(fmt.Errorf("%w: awaiting %s: %w", ErrTimeout, key, ctx.Err()))
+		case <-timer.C():
+		}
+		err := s.Noop()
+		switch {
+		case s.HungUp():
+			return stop(ErrHangup)
+		case err != nil:
+			return stop(err)
+		}
+	}
+}
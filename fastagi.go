@@ -3,20 +3,300 @@ package agi
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // FastAGIServer represents a FastAGI server
 type FastAGIServer struct {
 	listener   net.Listener
+	network    string
 	handler    Handler
 	wg         sync.WaitGroup
 	mu         sync.Mutex
 	ctx        context.Context
 	cancelFunc context.CancelFunc
+
+	workers     int
+	queueLength int
+	onQueueFull func(conn net.Conn)
+	queue       chan queuedConn
+
+	maxLineSize       int
+	maxDataDigits     int
+	envTransformer    func(env map[string]string) map[string]string
+	envReadTimeout    time.Duration
+	autoAnswer        bool
+	faults            *FaultInjection
+	limits            commandLimits
+	errorHandler      func(session *AgiSession, err error)
+	historySize       int
+	callStore         CallStateStore
+	callKey           func(s *AgiSession) string
+	promptMetrics     PromptMetrics
+	strictPrompts     bool
+	promptResolver    PromptResolver
+	promptWarmer      PromptWarmer
+	clk               Clock
+	degradationPolicy DegradationPolicy
+	flowStateVar      string
+	commandValidation func(s *AgiSession, command string, err error)
+	readCacheTTL      time.Duration
+	readCacheNames    []string
+	errorPolicy       ErrorPolicy
+	varEscaping       bool
+
+	transcriptWriter io.Writer
+	transcriptFormat TranscriptFormat
+	transcript       *transcript
+	featureFlags     func(env map[string]string) map[string]bool
+	hangupMonitor    HangupMonitor
+	commandPolicy    CommandPolicy
+	deniedHandler    func(s *AgiSession, cmd PolicyCommand)
+	resultPrefix     string
+	varSetter        VariableSetter
+	onHeartbeat      func(s *AgiSession, b Beat)
+	sessionCompleted func(SessionInfo)
+	tenantResolver   func(s *AgiSession) (string, error)
+	tenants          map[string]*tenant
+	unknownTenant    Handler
+	externals        *ExternalRegistry
+
+	serving      atomic.Bool
+	shuttingDown atomic.Bool
+
+	lameDuck        atomic.Bool
+	lameDuckHandler Handler
+
+	stats serverCounters
+}
+
+// ServerOption configures optional FastAGIServer behavior
+type ServerOption func(*FastAGIServer)
+
+// WithWorkerPool serves accepted connections with a fixed number of workers
+// instead of one goroutine per connection. Connections wait in a bounded queue
+// until a worker is free; see WithQueueLength and WithQueueFullHandler.
+func WithWorkerPool(workers int) ServerOption {
+	return func(s *FastAGIServer) {
+		s.workers = workers
+	}
+}
+
+// WithQueueLength sets how many accepted connections may wait for a worker.
+// It defaults to the number of workers and has no effect without WithWorkerPool.
+func WithQueueLength(n int) ServerOption {
+	return func(s *FastAGIServer) {
+		s.queueLength = n
+	}
+}
+
+// WithQueueFullHandler sets the function called with a connection that is
+// rejected because the worker queue is full. The connection is closed after
+// the function returns. By default rejected connections are closed silently.
+func WithQueueFullHandler(fn func(conn net.Conn)) ServerOption {
+	return func(s *FastAGIServer) {
+		s.onQueueFull = fn
+	}
+}
+
+// WithMaxLineSize sets the maximum size of a line received from Asterisk on
+// each session, including environment lines. It defaults to DefaultMaxLineSize.
+func WithMaxLineSize(size int) ServerOption {
+	return func(s *FastAGIServer) {
+		s.maxLineSize = size
+	}
+}
+
+// WithMaxDataDigits sets the largest maxDigits GetData and GetDataMulti
+// accept on each session; see SetMaxDataDigits. It defaults to
+// DefaultMaxDataDigits.
+func WithMaxDataDigits(n int) ServerOption {
+	return func(s *FastAGIServer) {
+		s.maxDataDigits = n
+	}
+}
+
+// DefaultEnvReadTimeout is how long a connection has to send its AGI
+// environment by default
+const DefaultEnvReadTimeout = 30 * time.Second
+
+// WithEnvReadTimeout sets how long each connection has to send its AGI
+// environment. It defaults to DefaultEnvReadTimeout. Shutdown's deadline
+// also ends an environment read, so a shorter drain does not wait for it.
+func WithEnvReadTimeout(d time.Duration) ServerOption {
+	return func(s *FastAGIServer) {
+		s.envReadTimeout = d
+	}
+}
+
+// WithEnvTransformer sets a function that can inspect and rewrite each
+// session's AGI environment before the handler runs, for example to add
+// canary markers or normalize caller ID formats. The function receives a copy
+// of the environment and returns the map the session should use.
+func WithEnvTransformer(fn func(env map[string]string) map[string]string) ServerOption {
+	return func(s *FastAGIServer) {
+		s.envTransformer = fn
+	}
+}
+
+// WithAutoAnswer answers each channel after the environment is read and
+// before the handler runs. Channels that are already up and calls running
+// the h extension are not answered. If answering fails the handler is not
+// called and the error goes to the error handler. WithRouteAutoAnswer and
+// the AutoAnswerParam URL parameter override it.
+func WithAutoAnswer(enabled bool) ServerOption {
+	return func(s *FastAGIServer) {
+		s.autoAnswer = enabled
+	}
+}
+
+// WithRouteAutoAnswer overrides the server's WithAutoAnswer for the route's
+// sessions
+func WithRouteAutoAnswer(enabled bool) RouteOption {
+	return func(r *route) {
+		r.autoAnswer = &enabled
+	}
+}
+
+// AutoAnswerParam is the FastAGI URL parameter that turns auto answer on or
+// off for one call, overriding the route and server settings:
+// agi://host/ivr?autoanswer=no. It takes yes, no, true, false, 1 or 0.
+const AutoAnswerParam = "autoanswer"
+
+// wantsAutoAnswer reports whether session is answered before handler runs:
+// the AutoAnswerParam URL parameter wins over the route's
+// WithRouteAutoAnswer, which wins over WithAutoAnswer
+func (s *FastAGIServer) wantsAutoAnswer(session *AgiSession, handler Handler) bool {
+	switch strings.ToLower(requestQuery(session.env).Get(AutoAnswerParam)) {
+	case "yes", "true", "1":
+		return true
+	case "no", "false", "0":
+		return false
+	}
+	if mh, ok := handler.(muxHandler); ok {
+		if enabled, ok := mh.mux.autoAnswer(session.env); ok {
+			return enabled
+		}
+	}
+	return s.autoAnswer
+}
+
+// WithVariableEscaping enables SetVariableEscaping on every session
+func WithVariableEscaping(enabled bool) ServerOption {
+	return func(s *FastAGIServer) {
+		s.varEscaping = enabled
+	}
+}
+
+// WithHistorySize sets how many recent exchanges each session keeps for
+// RecentExchanges. Zero or a negative size disables the history.
+func WithHistorySize(size int) ServerOption {
+	return func(s *FastAGIServer) {
+		if size <= 0 {
+			size = -1
+		}
+		s.historySize = size
+	}
+}
+
+// WithErrorHandler sets the function that receives session errors, such as
+// environment read failures and errors returned by the handler. Accept errors
+// Serve recovers from are passed with a nil session. By default errors are
+// printed to standard output.
+func WithErrorHandler(fn func(session *AgiSession, err error)) ServerOption {
+	return func(s *FastAGIServer) {
+		s.errorHandler = fn
+	}
+}
+
+// queuedConn is a connection waiting for a pool worker
+type queuedConn struct {
+	conn     net.Conn
+	handler  Handler
+	queuedAt time.Time
+}
+
+// ServerStats is a point-in-time snapshot of server counters
+type ServerStats struct {
+	Accepted           int64
+	Probes             int64
+	AutoAnswerFailures int64
+	Rejected           int64
+	QueueDepth         int
+	QueueCapacity      int
+	MaxQueueWait       time.Duration
+	TotalQueueWait     time.Duration
+	Dequeued           int64
+	// AcceptBackoffs counts temporary accept errors, such as running out of
+	// file descriptors, that Serve waited out
+	AcceptBackoffs int64
+	// CommandsDenied counts commands blocked by WithCommandPolicy or a
+	// session's own policy
+	CommandsDenied int64
+	// LameDuck counts connections accepted in lame-duck mode, closed or
+	// passed to the lame-duck handler
+	LameDuck int64
+	// UnknownTenants counts sessions whose tenant was not registered with
+	// WithTenant
+	UnknownTenants int64
+	// Tenants holds per-tenant counters, keyed by tenant name, when the
+	// server has a WithTenantResolver
+	Tenants map[string]TenantStats
+	// Routes holds per-route counters, keyed by route name, when the
+	// server's handler is a Mux
+	Routes map[string]RouteStats
+}
+
+// serverCounters holds the live counters behind ServerStats
+type serverCounters struct {
+	accepted       atomic.Int64
+	probes         atomic.Int64
+	answerFailures atomic.Int64
+	rejected       atomic.Int64
+	dequeued       atomic.Int64
+	totalWait      atomic.Int64
+	maxWait        atomic.Int64
+	acceptBackoffs atomic.Int64
+	commandsDenied atomic.Int64
+	lameDuck       atomic.Int64
+	unknownTenants atomic.Int64
+}
+
+// Stats returns a snapshot of the server counters
+func (s *FastAGIServer) Stats() ServerStats {
+	stats := ServerStats{
+		Accepted:           s.stats.accepted.Load(),
+		Probes:             s.stats.probes.Load(),
+		AutoAnswerFailures: s.stats.answerFailures.Load(),
+		Rejected:           s.stats.rejected.Load(),
+		Dequeued:           s.stats.dequeued.Load(),
+		TotalQueueWait:     time.Duration(s.stats.totalWait.Load()),
+		MaxQueueWait:       time.Duration(s.stats.maxWait.Load()),
+		AcceptBackoffs:     s.stats.acceptBackoffs.Load(),
+		CommandsDenied:     s.stats.commandsDenied.Load(),
+		LameDuck:           s.stats.lameDuck.Load(),
+		UnknownTenants:     s.stats.unknownTenants.Load(),
+	}
+	if s.queue != nil {
+		stats.QueueDepth = len(s.queue)
+		stats.QueueCapacity = cap(s.queue)
+	}
+	if s.tenantResolver != nil {
+		stats.Tenants = s.tenantStats()
+	}
+	if mux, ok := s.handler.(muxHandler); ok {
+		stats.Routes = mux.mux.stats()
+	}
+	return stats
 }
 
 // Handler is the interface that must be implemented to handle FastAGI requests
@@ -32,81 +312,507 @@ func (f HandlerFunc) Handle(ctx context.Context, s *AgiSession) error {
 	return f(ctx, s)
 }
 
-// NewFastAGIServer creates a new FastAGI server
-func NewFastAGIServer(address string, handler Handler) (*FastAGIServer, error) {
-	listener, err := net.Listen("tcp", address)
+// NewFastAGIServer creates a new FastAGI server listening on address, such
+// as ":4573", "127.0.0.1:4573" or "[::1]:4573". Malformed addresses fail
+// with ErrInvalidAddress before anything is bound.
+func NewFastAGIServer(address string, handler Handler, opts ...ServerOption) (*FastAGIServer, error) {
+	s := newServer(handler, opts)
+	listener, err := listen(s.network, address)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create listener: %v", err)
+		s.cancelFunc()
+		return nil, err
 	}
+	s.listener = listener
+	return s, nil
+}
 
+// newServer creates a server without a listener, with opts applied
+func newServer(handler Handler, opts []ServerOption) *FastAGIServer {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &FastAGIServer{
-		listener:   listener,
+	s := &FastAGIServer{
 		handler:    handler,
+		network:    "tcp",
 		ctx:        ctx,
 		cancelFunc: cancel,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.workers > 0 {
+		if s.queueLength <= 0 {
+			s.queueLength = s.workers
+		}
+		s.queue = make(chan queuedConn, s.queueLength)
+	}
+	if s.transcriptWriter != nil {
+		s.transcript = &transcript{w: s.transcriptWriter, format: s.transcriptFormat}
+	}
+
+	return s
 }
 
-// Serve starts serving FastAGI requests
+// Delays Serve waits after a temporary accept error, doubling from the
+// minimum up to the maximum while errors continue, as net/http does
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// isTemporaryAcceptError reports whether an accept error is likely to clear
+// by itself, such as the process or system running out of file descriptors
+func isTemporaryAcceptError(err error) bool {
+	switch {
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE),
+		errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.ENOMEM),
+		errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.ECONNRESET):
+		return true
+	}
+	var temp interface{ Temporary() bool }
+	return errors.As(err, &temp) && temp.Temporary()
+}
+
+// Serve starts serving FastAGI requests. It returns at once, without
+// accepting connections, when Validate reports a problem.
 func (s *FastAGIServer) Serve() error {
-	defer s.cancelFunc()
+	// Shutdown cancels sessions itself once they drained or its deadline
+	// passed
+	defer func() {
+		if !s.shuttingDown.Load() {
+			s.cancelFunc()
+		}
+	}()
+
+	if err := s.Validate(); err != nil {
+		return fmt.Errorf("invalid server configuration: %w", err)
+	}
 
+	s.serving.Store(true)
+	defer s.serving.Store(false)
+
+	if s.queue != nil {
+		defer close(s.queue)
+		for i := 0; i < s.workers; i++ {
+			s.wg.Add(1)
+			go s.worker()
+		}
+	}
+
+	var backoff time.Duration
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if s.shuttingDown.Load() {
+				return nil
+			}
 			select {
 			case <-s.ctx.Done():
 				return nil
 			default:
+			}
+			if !isTemporaryAcceptError(err) {
 				return fmt.Errorf("failed to accept connection: %v", err)
 			}
+
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			s.stats.acceptBackoffs.Add(1)
+			s.reportError(nil, fmt.Errorf("accept error: %w; retrying in %v", err, backoff))
+			timer := s.clock().NewTimer(backoff)
+			select {
+			case <-s.ctx.Done():
+				timer.Stop()
+				return nil
+			case <-timer.C():
+			}
+			continue
+		}
+		backoff = 0
+
+		s.stats.accepted.Add(1)
+
+		handler := s.acceptHandler()
+		if handler == nil {
+			conn.Close()
+			continue
+		}
+		if s.queue != nil {
+			s.enqueue(conn, handler)
+			continue
 		}
 
 		s.wg.Add(1)
-		go s.handleConnection(conn)
+		go func() {
+			defer s.wg.Done()
+			s.handleConnection(conn, handler)
+		}()
+	}
+}
+
+// enqueue hands conn to the worker pool, rejecting it when the queue is full
+func (s *FastAGIServer) enqueue(conn net.Conn, handler Handler) {
+	select {
+	case s.queue <- queuedConn{conn: conn, handler: handler, queuedAt: s.clock().Now()}:
+	default:
+		s.stats.rejected.Add(1)
+		if s.onQueueFull != nil {
+			s.onQueueFull(conn)
+		}
+		conn.Close()
 	}
 }
 
-// Stop stops the FastAGI server
+// worker serves queued connections until the queue is closed
+func (s *FastAGIServer) worker() {
+	defer s.wg.Done()
+
+	for qc := range s.queue {
+		wait := since(s.clock(), qc.queuedAt)
+		s.stats.dequeued.Add(1)
+		s.stats.totalWait.Add(int64(wait))
+		for {
+			max := s.stats.maxWait.Load()
+			if int64(wait) <= max || s.stats.maxWait.CompareAndSwap(max, int64(wait)) {
+				break
+			}
+		}
+
+		if s.ctx.Err() != nil {
+			qc.conn.Close()
+			continue
+		}
+		s.handleConnection(qc.conn, qc.handler)
+	}
+}
+
+// Stop stops the FastAGI server, cancelling in-flight sessions
 func (s *FastAGIServer) Stop() error {
+	s.shuttingDown.Store(true)
 	s.cancelFunc()
 	err := s.listener.Close()
 	s.wg.Wait()
 	return err
 }
 
-func (s *FastAGIServer) handleConnection(conn net.Conn) {
-	defer s.wg.Done()
+// Shutdown stops accepting new connections and waits for in-flight sessions
+// to finish. If ctx is done first, the remaining sessions are cancelled and
+// ctx's error is returned. Connections still sending their environment are
+// cancelled too, so a deadline shorter than WithEnvReadTimeout is honoured.
+func (s *FastAGIServer) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	err := s.listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancelFunc()
+		return err
+	case <-ctx.Done():
+		s.cancelFunc()
+		return ctx.Err()
+	}
+}
+
+// Addr returns the address the server is listening on
+func (s *FastAGIServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Healthy reports whether the server is accepting connections
+func (s *FastAGIServer) Healthy() bool {
+	return s.serving.Load()
+}
+
+// Ready reports whether the server should receive new calls: it is accepting
+// connections, is not in lame-duck mode and neither Stop nor Shutdown has
+// begun
+func (s *FastAGIServer) Ready() bool {
+	return s.serving.Load() && !s.shuttingDown.Load() && !s.lameDuck.Load()
+}
+
+// handleConnection serves the session on conn with handler
+func (s *FastAGIServer) handleConnection(conn net.Conn, handler Handler) {
 	defer conn.Close()
 
-	// Set connection timeout
-	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	// The environment must arrive promptly; afterwards each command
+	// sets its own read deadline
+	envTimeout := s.envReadTimeout
+	if envTimeout <= 0 {
+		envTimeout = DefaultEnvReadTimeout
+	}
+	conn.SetDeadline(time.Now().Add(envTimeout))
 
-	session := &AgiSession{
-		reader:    bufio.NewReader(conn),
-		writer:    conn,
-		env:       make(map[string]string),
-		variables: make(map[string]string),
-		debugMode: false,
-		timeout:   30 * time.Second,
+	session := acquireSession(s.ctx, conn)
+	defer releaseSession(session)
+
+	// failure is reported to the session completed callback, which runs
+	// before the session is released
+	var failure error
+	probe := false
+	if s.sessionCompleted != nil {
+		defer func() {
+			if probe {
+				return
+			}
+			info := session.Info()
+			info.End = session.clock().Now()
+			info.Err = failure
+			info.ErrCode = ErrorCode(failure)
+			if failure != nil {
+				info.RecentExchanges = session.RecentExchanges()
+			}
+			s.sessionCompleted(info)
+		}()
+	}
+	// OnClose callbacks run before the session completed callback, with
+	// the same error
+	defer func() { session.finish(failure) }()
+	session.maxLineSize = s.maxLineSize
+	session.maxDataDigits = s.maxDataDigits
+	session.faults = s.faults
+	session.limits = s.limits
+	session.historySize = s.historySize
+	session.callStore = s.callStore
+	session.callKey = s.callKey
+	session.promptMetrics = s.promptMetrics
+	session.strictPrompts = s.strictPrompts
+	session.promptResolver = s.promptResolver
+	session.promptWarmer = s.promptWarmer
+	session.clk = s.clk
+	session.degradationPolicy = s.degradationPolicy
+	session.flowStateVar = s.flowStateVar
+	session.commandValidation = s.commandValidation
+	session.readCache = newReadCache(s.readCacheTTL, s.readCacheNames)
+	session.errorPolicy = s.errorPolicy
+	session.start = session.clock().Now()
+	session.variableEscaping = s.varEscaping
+	session.transcript = s.transcript
+	session.serverPolicy = s.commandPolicy
+	session.onCommandDenied = s.commandDenied
+	session.resultPrefix = s.resultPrefix
+	session.varSetter = s.varSetter
+	if setter, ok := s.hangupMonitor.(VariableSetter); ok && s.varSetter == nil {
+		session.varSetter = setter
 	}
+	session.onHeartbeat = s.onHeartbeat
+	session.externals = s.externals
 
-	// Read environment
-	if err := session.readEnvironment(); err != nil {
-		fmt.Printf("Failed to read environment: %v\n", err)
+	// Read environment. Cancelling the session, as Shutdown does once its
+	// deadline passes, ends a read still waiting for a slow peer.
+	stopEnvAbort := context.AfterFunc(session.ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	err := session.readEnvironment()
+	stopEnvAbort()
+	if err != nil {
+		if isProbe(session, err) {
+			s.stats.probes.Add(1)
+			probe = true
+			return
+		}
+		if ctxErr := session.ctx.Err(); ctxErr != nil {
+			err = errors.Join(ctxErr, err)
+		}
+		failure = fmt.Errorf("failed to read environment: %w", err)
+		s.reportError(session, fmt.Errorf("%s: %w", conn.RemoteAddr(), failure))
 		return
 	}
 
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(s.ctx, session.timeout)
+	conn.SetDeadline(time.Time{})
+
+	if s.envTransformer != nil {
+		session.transformEnv(s.envTransformer)
+	}
+	if s.featureFlags != nil {
+		session.evaluateFlags(s.featureFlags)
+	}
+	if s.tenantResolver != nil {
+		t, err := s.resolveTenant(session)
+		switch {
+		case t != nil:
+			defer func() {
+				if failure != nil {
+					t.failures.Add(1)
+				}
+			}()
+			if err := session.applyTenant(t.config); err != nil {
+				failure = fmt.Errorf("configure tenant %q: %w", session.tenant, err)
+				s.reportError(session, fmt.Errorf("%s: %w", conn.RemoteAddr(), failure))
+				return
+			}
+		case s.unknownTenant != nil && errors.Is(err, ErrUnknownTenant):
+			handler = s.unknownTenant
+		default:
+			failure = err
+			s.reportError(session, fmt.Errorf("%s: %w", conn.RemoteAddr(), failure))
+			return
+		}
+	}
+
+	if s.wantsAutoAnswer(session, handler) {
+		if err := autoAnswer(session); err != nil {
+			s.stats.answerFailures.Add(1)
+			failure = fmt.Errorf("auto answer failed: %w", err)
+			s.reportError(session, fmt.Errorf("%s: %w", conn.RemoteAddr(), failure))
+			return
+		}
+	}
+
+	// The handler runs with the session's context, so Close and the
+	// server's context both cancel it. It has no deadline: session.timeout
+	// bounds each command's response, not the call.
+	ctx := session.ctx
+	if session.tenant != "" {
+		ctx = context.WithValue(ctx, tenantKey{}, session.tenant)
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	session.ctx = ctx
+
+	// Interrupt a command blocked on Asterisk once the session is cancelled,
+	// such as when Shutdown's deadline passes; it fails with ctx.Err()
+	stopAbort := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stopAbort()
+	if s.hangupMonitor != nil {
+		var stop context.CancelFunc
+		ctx, stop = session.MonitorHangup(ctx, s.hangupMonitor)
+		defer stop()
+	}
 
 	// Handle the request
-	if err := s.handler.Handle(ctx, session); err != nil {
-		fmt.Printf("Handler error: %v\n", err)
+	if err := runHandler(ctx, handler, session); err != nil {
+		failure = err
+		s.reportError(session, fmt.Errorf("%s: handler error: %w", conn.RemoteAddr(), err))
+	}
+	if s.resultPrefix != "" {
+		if err := session.flushResult(); err != nil {
+			failure = errors.Join(failure, fmt.Errorf("writing result failed: %w", err))
+			s.reportError(session, fmt.Errorf("%s: writing result failed: %w", conn.RemoteAddr(), err))
+		}
+	}
+	if err := session.runDeferred(); err != nil {
+		s.reportError(session, fmt.Errorf("%s: %w", conn.RemoteAddr(), err))
+	}
+	if failure != nil {
+		if err := session.applyErrorPolicy(failure); err != nil {
+			s.reportError(session, fmt.Errorf("%s: %w", conn.RemoteAddr(), err))
+		}
+	}
+}
+
+// runHandler runs handler, turning a panic into an error
+// wrapping ErrHandlerPanic so one faulty call does not stop the server
+func runHandler(ctx context.Context, handler Handler, session *AgiSession) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v\n%s", ErrHandlerPanic, r, debug.Stack())
+		}
+	}()
+	return handler.Handle(ctx, session)
+}
+
+// sessionPool recycles FastAGI sessions, including their read buffer and
+// maps, between connections
+var sessionPool = sync.Pool{
+	New: func() any {
+		return &AgiSession{
+			reader:    bufio.NewReader(nil),
+			env:       make(map[string]string),
+			variables: make(map[string]string),
+		}
+	},
+}
+
+// acquireSession returns a clean session reading from and writing to conn,
+// with a context derived from ctx that releaseSession cancels
+func acquireSession(ctx context.Context, conn net.Conn) *AgiSession {
+	session := sessionPool.Get().(*AgiSession)
+	session.ctx, session.cancelFunc = context.WithCancel(ctx)
+	counted := countingConn{Conn: conn, session: session}
+	session.reader.Reset(counted)
+	session.writer = counted
+	session.conn = conn
+	session.start = time.Now()
+	session.timeout = 30 * time.Second
+	session.remoteAddr = conn.RemoteAddr()
+	session.localAddr = conn.LocalAddr()
+	return session
+}
+
+// releaseSession clears every field of session except its reusable buffer
+// and maps, which are emptied, and returns it to the pool. Handlers must not
+// use a session after they return. A session that started a goroutine of
+// its own is closed but not recycled, since that goroutine may still be
+// reading it.
+func releaseSession(session *AgiSession) {
+	session.Close()
+	if session.escaped.Load() {
+		return
+	}
+	reader, env, envOrder, variables := session.reader, session.env, session.envOrder, session.variables
+	reader.Reset(nil)
+	clear(env)
+	clear(envOrder)
+	clear(variables)
+
+	*session = AgiSession{
+		reader:    reader,
+		env:       env,
+		envOrder:  envOrder[:0],
+		variables: variables,
+	}
+	sessionPool.Put(session)
+}
+
+// reportError passes err to the configured error handler
+func (s *FastAGIServer) reportError(session *AgiSession, err error) {
+	if s.errorHandler != nil {
+		s.errorHandler(session, err)
+		return
+	}
+	fmt.Printf("%v\n", err)
+}
+
+// commandDenied counts a blocked command and passes it to the denied handler
+func (s *FastAGIServer) commandDenied(session *AgiSession, cmd PolicyCommand) {
+	s.stats.commandsDenied.Add(1)
+	if s.deniedHandler != nil {
+		s.deniedHandler(session, cmd)
+	}
+}
+
+// autoAnswer answers the channel unless it is already up or running the h extension
+func autoAnswer(session *AgiSession) error {
+	if session.GetEnv("agi_extension") == "h" {
+		return nil
+	}
+
+	status, err := session.ChannelStatus()
+	if err != nil {
+		return err
+	}
+	if ChannelState(status) == ChannelUp {
+		return nil
+	}
+
+	return session.Answer()
+}
+
+// isProbe reports whether an environment read failed because the peer closed
+// the connection without sending anything, as TCP health checks do
+func isProbe(session *AgiSession, err error) bool {
+	if len(session.env) > 0 {
+		return false
 	}
+	var readErr *ReadError
+	return errors.As(err, &readErr) && readErr.Received == 0 && errors.Is(err, io.EOF)
 }
 
 // Example usage:
@@ -0,0 +1,628 @@
+package agi_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agitest"
+)
+
+// serveTestServer starts server and returns the channel Serve's result is
+// sent on
+func serveTestServer(server *agi.FastAGIServer) <-chan error {
+	served := make(chan error, 1)
+	go func() { served <- server.Serve() }()
+	return served
+}
+
+// dialFake connects fake to server, returning once the fake has finished
+// its script or the connection closed
+func dialFake(t *testing.T, server *agi.FastAGIServer, fake *agitest.Fake) <-chan struct{} {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fake.Serve(conn)
+	}()
+	return done
+}
+
+// serveSession serves one session of handler to fake and returns its
+// SessionInfo once it completed
+func serveSession(t *testing.T, handler agi.Handler, fake *agitest.Fake, opts ...agi.ServerOption) agi.SessionInfo {
+	t.Helper()
+	completed := make(chan agi.SessionInfo, 1)
+	opts = append(opts,
+		agi.WithSessionCompleted(func(info agi.SessionInfo) { completed <- info }),
+		agi.WithErrorHandler(func(*agi.AgiSession, error) {}))
+	server, err := agi.NewFastAGIServer("127.0.0.1:0", handler, opts...)
+	require.NoError(t, err)
+	served := serveTestServer(server)
+
+	dialFake(t, server, fake)
+	info := receive(t, completed, "session")
+	require.NoError(t, server.Stop())
+	assert.NoError(t, receive(t, served, "Serve"))
+	return info
+}
+
+// receive returns the next value of ch, failing the test after a while
+func receive[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	panic("unreachable")
+}
+
+func TestFastAGIServer(t *testing.T) {
+	type outcome struct {
+		account  string
+		channel  string
+		deadline bool
+		err      error
+	}
+	outcomes := make(chan outcome, 1)
+	handler := agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+		var o outcome
+		defer func() { outcomes <- o }()
+		o.channel = s.GetEnv("agi_channel")
+		_, o.deadline = ctx.Deadline()
+		// The command timeout bounds each response, not the call
+		s.SetTimeout(20 * time.Millisecond)
+		time.Sleep(40 * time.Millisecond)
+		if o.err = s.Answer(); o.err != nil {
+			return o.err
+		}
+		if o.account, o.err = s.GetVariable("ACCOUNT"); o.err != nil {
+			return o.err
+		}
+		o.err = s.StreamFile("welcome", "#")
+		return o.err
+	})
+	server, err := agi.NewFastAGIServer("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	served := serveTestServer(server)
+
+	fake := agitest.NewFake(
+		[]string{"200 result=0", "200 result=1 (1234)", "200 result=0 endpos=8000"},
+		agitest.WithEnv("agi_channel", "PJSIP/100-00000001"),
+		agitest.WithEnv("agi_request", "agi://127.0.0.1/ivr"),
+	)
+	finished := dialFake(t, server, fake)
+
+	o := receive(t, outcomes, "handler")
+	require.NoError(t, o.err)
+	assert.Equal(t, "1234", o.account)
+	assert.Equal(t, "PJSIP/100-00000001", o.channel)
+	assert.False(t, o.deadline, "the handler's context must not expire with the command timeout")
+	receive(t, finished, "fake")
+	assert.Equal(t, []string{"ANSWER", "GET VARIABLE ACCOUNT", `STREAM FILE welcome "#"`}, fake.Commands())
+
+	require.NoError(t, server.Stop())
+	assert.NoError(t, receive(t, served, "Serve"))
+}
+
+func TestFastAGIServerShutdown(t *testing.T) {
+	t.Run("shutdown waits for sessions", func(t *testing.T) {
+		started := make(chan struct{})
+		results := make(chan error, 1)
+		server, err := agi.NewFastAGIServer("127.0.0.1:0", agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			close(started)
+			_, err := s.GetVariable("ACCOUNT")
+			results <- err
+			return err
+		}))
+		require.NoError(t, err)
+		served := serveTestServer(server)
+
+		fake := agitest.NewFake([]string{"200 result=1 (1234)"},
+			agitest.WithResponseDelay(func(string) time.Duration { return 100 * time.Millisecond }))
+		dialFake(t, server, fake)
+		receive(t, started, "handler")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		require.NoError(t, server.Shutdown(ctx))
+		select {
+		case err := <-results:
+			assert.NoError(t, err)
+		default:
+			t.Fatal("Shutdown returned before the session finished")
+		}
+		assert.NoError(t, receive(t, served, "Serve"))
+	})
+
+	t.Run("stop cancels sessions", func(t *testing.T) {
+		started := make(chan struct{})
+		results := make(chan error, 1)
+		server, err := agi.NewFastAGIServer("127.0.0.1:0", agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			close(started)
+			_, err := s.GetVariable("ACCOUNT")
+			results <- err
+			return err
+		}), agi.WithErrorHandler(func(*agi.AgiSession, error) {}))
+		require.NoError(t, err)
+		served := serveTestServer(server)
+
+		fake := agitest.NewFake([]string{"200 result=1 (1234)"},
+			agitest.WithResponseDelay(func(string) time.Duration { return 5 * time.Second }))
+		dialFake(t, server, fake)
+		receive(t, started, "handler")
+
+		require.NoError(t, server.Stop())
+		select {
+		case err := <-results:
+			assert.ErrorIs(t, err, context.Canceled)
+		default:
+			t.Fatal("Stop returned before the session finished")
+		}
+		assert.NoError(t, receive(t, served, "Serve"))
+	})
+}
+
+func TestTenants(t *testing.T) {
+	acme := agi.WithTenant("acme", agi.TenantConfig{
+		SoundPrefix: "acme",
+		Language:    "es",
+		Flags:       map[string]bool{"beta": true},
+		MaxCommands: 3,
+	})
+
+	t.Run("from query parameter", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=1", "200 result=0 endpos=1200", "200 result=0"},
+			agitest.WithEnv("agi_network_script", "ivr?tenant=acme"))
+		var tenant, fromContext string
+		var beta bool
+		var limitErr error
+		info := serveSession(t, agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			tenant, fromContext, beta = s.Tenant(), agi.TenantFromContext(ctx), s.Flag("beta")
+			if err := s.StreamFile("welcome", ""); err != nil {
+				return err
+			}
+			if err := s.Answer(); err != nil {
+				return err
+			}
+			limitErr = s.Noop()
+			return nil
+		}), fake, agi.WithTenantResolver(agi.TenantFromQuery("tenant")), acme)
+
+		require.NoError(t, info.Err)
+		assert.Equal(t, "acme", info.Tenant)
+		assert.Equal(t, "acme", tenant)
+		assert.Equal(t, "acme", fromContext)
+		assert.True(t, beta)
+		assert.ErrorIs(t, limitErr, agi.ErrCommandLimitExceeded)
+		assert.Equal(t, []string{`SET VARIABLE CHANNEL(language) "es"`, `STREAM FILE acme/welcome ""`, "ANSWER"}, fake.Commands())
+	})
+
+	t.Run("from channel variable", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=1 (globex)", "200 result=0"})
+		info := serveSession(t, agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			return s.Answer()
+		}), fake, agi.WithTenantResolver(agi.TenantFromVariable("TENANT")), acme, agi.WithTenant("globex", agi.TenantConfig{}))
+
+		require.NoError(t, info.Err)
+		assert.Equal(t, "globex", info.Tenant)
+		assert.Equal(t, []string{"GET VARIABLE TENANT", "ANSWER"}, fake.Commands())
+	})
+
+	t.Run("unknown tenant", func(t *testing.T) {
+		handled := false
+		handler := agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			handled = true
+			return nil
+		})
+		fake := agitest.NewFake(nil, agitest.WithEnv("agi_network_script", "ivr?tenant=initech"))
+		info := serveSession(t, handler, fake, agi.WithTenantResolver(agi.TenantFromQuery("tenant")), acme)
+
+		assert.ErrorIs(t, info.Err, agi.ErrUnknownTenant)
+		assert.Equal(t, "unknown_tenant", info.ErrCode)
+		assert.Equal(t, "initech", info.Tenant)
+		assert.False(t, handled)
+		assert.Empty(t, fake.Commands())
+
+		fake = agitest.NewFake([]string{"200 result=0", "200 result=0", "200 result=0"})
+		info = serveSession(t, handler, fake, agi.WithTenantResolver(agi.TenantFromQuery("tenant")), acme,
+			agi.WithUnknownTenantHandler(agi.ContinueDialplanAt(agi.DialplanLocation{Context: "rejected", Extension: "s", Priority: 1})))
+
+		require.NoError(t, info.Err)
+		assert.Empty(t, info.Tenant)
+		assert.False(t, handled)
+		assert.Equal(t, []string{"SET CONTEXT rejected", "SET EXTENSION s", "SET PRIORITY 1"}, fake.Commands())
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		server, err := agi.NewFastAGIServer("127.0.0.1:0", agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			if strings.Contains(s.Info().Script, "fail") {
+				return errors.New("boom")
+			}
+			return nil
+		}), agi.WithTenantResolver(agi.TenantFromQuery("tenant")), agi.WithTenant("acme", agi.TenantConfig{}),
+			agi.WithErrorHandler(func(*agi.AgiSession, error) {}))
+		require.NoError(t, err)
+		served := serveTestServer(server)
+
+		for _, script := range []string{"ivr?tenant=acme", "ivr?tenant=acme&fail=1", "ivr?tenant=initech", "ivr"} {
+			receive(t, dialFake(t, server, agitest.NewFake(nil, agitest.WithEnv("agi_network_script", script))), script)
+		}
+		require.NoError(t, server.Stop())
+		assert.NoError(t, receive(t, served, "Serve"))
+
+		stats := server.Stats()
+		assert.Equal(t, map[string]agi.TenantStats{"acme": {Sessions: 2, Failures: 1}}, stats.Tenants)
+		assert.Equal(t, int64(2), stats.UnknownTenants)
+	})
+}
+
+func TestLameDuck(t *testing.T) {
+	t.Run("existing sessions continue", func(t *testing.T) {
+		started, release := make(chan struct{}, 2), make(chan struct{})
+		server, err := agi.NewFastAGIServer("127.0.0.1:0", agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			started <- struct{}{}
+			<-release
+			return s.Answer()
+		}))
+		require.NoError(t, err)
+		served := serveTestServer(server)
+		require.Eventually(t, server.Ready, time.Second, time.Millisecond)
+
+		inFlight := agitest.NewFake([]string{"200 result=0"})
+		inFlightDone := dialFake(t, server, inFlight)
+		receive(t, started, "handler")
+
+		server.SetLameDuck(true)
+		assert.True(t, server.LameDuck())
+		assert.False(t, server.Ready())
+		assert.True(t, server.Healthy())
+
+		turnedAway := agitest.NewFake([]string{"200 result=0"})
+		receive(t, dialFake(t, server, turnedAway), "turned away connection")
+		assert.Empty(t, turnedAway.Commands())
+
+		close(release)
+		receive(t, inFlightDone, "in-flight session")
+		assert.Equal(t, []string{"ANSWER"}, inFlight.Commands())
+
+		server.SetLameDuck(false)
+		assert.True(t, server.Ready())
+		again := agitest.NewFake([]string{"200 result=0"})
+		receive(t, dialFake(t, server, again), "session")
+		assert.Equal(t, []string{"ANSWER"}, again.Commands())
+
+		assert.Equal(t, int64(1), server.Stats().LameDuck)
+		require.NoError(t, server.Stop())
+		assert.NoError(t, receive(t, served, "Serve"))
+	})
+
+	t.Run("lame duck handler", func(t *testing.T) {
+		server, err := agi.NewFastAGIServer("127.0.0.1:0", agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			return s.Answer()
+		}), agi.WithLameDuckHandler(agi.ContinueDialplanAt(agi.DialplanLocation{Context: "standby", Extension: "s", Priority: 1})))
+		require.NoError(t, err)
+		server.SetLameDuck(true)
+		served := serveTestServer(server)
+
+		fake := agitest.NewFake([]string{"200 result=0", "200 result=0", "200 result=0"})
+		receive(t, dialFake(t, server, fake), "session")
+		assert.Equal(t, []string{"SET CONTEXT standby", "SET EXTENSION s", "SET PRIORITY 1"}, fake.Commands())
+
+		require.NoError(t, server.Stop())
+		assert.NoError(t, receive(t, served, "Serve"))
+	})
+
+	t.Run("toggled while connections arrive", func(t *testing.T) {
+		const calls = 40
+		for _, opts := range [][]agi.ServerOption{nil, {agi.WithWorkerPool(4), agi.WithQueueLength(calls)}} {
+			var normal, lame atomic.Int64
+			server, err := agi.NewFastAGIServer("127.0.0.1:0", agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+				normal.Add(1)
+				return s.Answer()
+			}), append(opts, agi.WithLameDuckHandler(agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+				lame.Add(1)
+				return s.Hangup()
+			})))...)
+			require.NoError(t, err)
+			served := serveTestServer(server)
+
+			stop := make(chan struct{})
+			toggled := make(chan struct{})
+			go func() {
+				defer close(toggled)
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+						server.SetLameDuck(i%2 == 0)
+						time.Sleep(100 * time.Microsecond)
+					}
+				}
+			}()
+
+			var dones []<-chan struct{}
+			for range calls {
+				dones = append(dones, dialFake(t, server, agitest.NewFake([]string{"200 result=0"})))
+			}
+			for _, done := range dones {
+				receive(t, done, "session")
+			}
+			close(stop)
+			<-toggled
+			require.NoError(t, server.Stop())
+			assert.NoError(t, receive(t, served, "Serve"))
+
+			stats := server.Stats()
+			assert.Equal(t, int64(calls), stats.Accepted)
+			assert.Equal(t, int64(calls), normal.Load()+lame.Load())
+			assert.Equal(t, lame.Load(), stats.LameDuck)
+		}
+	})
+}
+
+func TestCommandLimits(t *testing.T) {
+	noops := func(n int) []string {
+		responses := make([]string, n)
+		for i := range responses {
+			responses[i] = "200 result=0"
+		}
+		return responses
+	}
+	serve := func(t *testing.T, handler agi.HandlerFunc, opts ...agi.ServerOption) (*agitest.Fake, agi.SessionInfo) {
+		t.Helper()
+		fake := agitest.NewFake(noops(10))
+		return fake, serveSession(t, handler, fake, opts...)
+	}
+
+	t.Run("commands per session", func(t *testing.T) {
+		sent := -1
+		fake, info := serve(t, func(ctx context.Context, s *agi.AgiSession) error {
+			for i := 0; ; i++ {
+				if err := s.Noop(); err != nil {
+					sent = i
+					return err
+				}
+			}
+		}, agi.WithMaxCommandsPerSession(3))
+
+		assert.Equal(t, 3, sent)
+		assert.Len(t, fake.Commands(), 3)
+		assert.ErrorIs(t, info.Err, agi.ErrCommandLimitExceeded)
+		assert.Equal(t, "command_limit_exceeded", info.ErrCode)
+		assert.Equal(t, 3, info.Commands)
+		assert.Equal(t, 1, info.CommandsRejected)
+	})
+
+	t.Run("command rate", func(t *testing.T) {
+		clock := agitest.NewClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+		limited := make(chan struct{})
+		advanced := make(chan struct{})
+		go func() {
+			<-limited
+			clock.Advance(500 * time.Millisecond)
+			close(advanced)
+		}()
+
+		var errs []error
+		fake, info := serve(t, func(ctx context.Context, s *agi.AgiSession) error {
+			for range 3 {
+				errs = append(errs, s.Noop())
+			}
+			close(limited)
+			<-advanced
+			for range 2 {
+				errs = append(errs, s.Noop())
+			}
+			return nil
+		}, agi.WithMaxCommandRate(2), agi.WithClock(clock))
+
+		require.Len(t, errs, 5)
+		for i, limited := range []bool{false, false, true, false, true} {
+			if limited {
+				assert.ErrorIs(t, errs[i], agi.ErrCommandLimitExceeded, "command %d", i)
+			} else {
+				assert.NoError(t, errs[i], "command %d", i)
+			}
+		}
+		assert.Len(t, fake.Commands(), 3)
+		assert.Equal(t, 2, info.CommandsRejected)
+	})
+
+	t.Run("terminate", func(t *testing.T) {
+		var afterLimit error
+		fake, info := serve(t, func(ctx context.Context, s *agi.AgiSession) error {
+			if err := s.Noop(); err != nil {
+				return err
+			}
+			err := s.Noop()
+			afterLimit = ctx.Err()
+			return err
+		}, agi.WithMaxCommandsPerSession(1), agi.WithTerminateOnCommandLimit(true))
+
+		assert.ErrorIs(t, afterLimit, context.Canceled)
+		assert.ErrorIs(t, info.Err, agi.ErrCommandLimitExceeded)
+		assert.Len(t, fake.Commands(), 1)
+	})
+}
+
+func TestDeferredCommands(t *testing.T) {
+	// run serves one session of handler against fake and returns the error
+	// the session completed with and the errors reported to the server
+	run := func(t *testing.T, handler agi.HandlerFunc, fake *agitest.Fake) (error, []error) {
+		t.Helper()
+		completed := make(chan error, 1)
+		var reported []error
+		server, err := agi.NewFastAGIServer("127.0.0.1:0", handler,
+			agi.WithSessionCompleted(func(info agi.SessionInfo) { completed <- info.Err }),
+			agi.WithErrorHandler(func(_ *agi.AgiSession, err error) { reported = append(reported, err) }))
+		require.NoError(t, err)
+		served := serveTestServer(server)
+
+		dialFake(t, server, fake)
+		failure := receive(t, completed, "session")
+		require.NoError(t, server.Stop())
+		assert.NoError(t, receive(t, served, "Serve"))
+		return failure, reported
+	}
+	bookkeeping := func(s *agi.AgiSession) {
+		s.Defer(agi.SetVariable{Name: "CDR(userfield)", Value: "ivr done"},
+			agi.UserEvent{Name: "IVRDone", Fields: map[string]string{"Result": "ok", "Account": "42"}})
+		s.Defer(agi.DeferredMedia(func(s *agi.AgiSession) error { return s.StreamFile("goodbye", "") }))
+	}
+	bookkeepingCommands := []string{
+		`STREAM FILE goodbye ""`,
+		`SET VARIABLE CDR(userfield) "ivr done"`,
+		`EXEC UserEvent "IVRDone,Account: 42,Result: ok"`,
+	}
+
+	t.Run("normal", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=0", "200 result=0 endpos=100", "200 result=1", "200 result=0"})
+		failure, reported := run(t, func(ctx context.Context, s *agi.AgiSession) error {
+			bookkeeping(s)
+			return s.Answer()
+		}, fake)
+		require.NoError(t, failure)
+		assert.Empty(t, reported)
+		assert.Equal(t, append([]string{"ANSWER"}, bookkeepingCommands...), fake.Commands())
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=0 endpos=100", "200 result=1", "200 result=0"})
+		failure, _ := run(t, func(ctx context.Context, s *agi.AgiSession) error {
+			bookkeeping(s)
+			panic("boom")
+		}, fake)
+		assert.ErrorIs(t, failure, agi.ErrHandlerPanic)
+		assert.Equal(t, bookkeepingCommands, fake.Commands())
+	})
+
+	t.Run("hangup skips media", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"511 Command Not Permitted on a dead channel or intercept routine", "200 result=1", "200 result=0"})
+		failure, _ := run(t, func(ctx context.Context, s *agi.AgiSession) error {
+			bookkeeping(s)
+			return s.StreamFile("menu", "12")
+		}, fake)
+		assert.ErrorIs(t, failure, agi.ErrHangup)
+		assert.Equal(t, append([]string{`STREAM FILE menu "12"`}, bookkeepingCommands[1:]...), fake.Commands())
+	})
+
+	t.Run("failures are reported", func(t *testing.T) {
+		fake := agitest.NewFake([]string{"200 result=0", "200 result=-2"})
+		failure, reported := run(t, func(ctx context.Context, s *agi.AgiSession) error {
+			s.Defer(agi.SetVariable{Name: "DONE", Value: "1"}, agi.UserEvent{Name: "IVRDone"})
+			return errors.New("handler failed")
+		}, fake)
+		assert.EqualError(t, failure, "handler failed")
+		require.Len(t, reported, 2)
+		assert.ErrorContains(t, reported[0], "handler failed")
+		assert.ErrorIs(t, reported[1], agi.ErrAppNotFound)
+		assert.ErrorContains(t, reported[1], "deferred UserEvent IVRDone")
+	})
+}
+
+func TestErrorPolicy(t *testing.T) {
+	failing := agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+		return errors.New("database unavailable")
+	})
+	sorry := agi.ErrorPolicy{Prompt: "technical-difficulties", Hangup: true}
+	operator := agi.ErrorPolicy{ContinueAt: &agi.DialplanLocation{Context: "support", Extension: "operator", Priority: 1}}
+
+	tests := []struct {
+		name      string
+		handler   agi.Handler
+		policy    agi.ErrorPolicy
+		responses []string
+		want      []string
+		applied   bool
+	}{
+		{"prompt and hangup", failing, sorry, []string{"200 result=0 endpos=100", "200 result=1"},
+			[]string{`STREAM FILE technical-difficulties ""`, "HANGUP"}, true},
+		{"continue in dialplan", failing, operator, []string{"200 result=0", "200 result=0", "200 result=0"},
+			[]string{"SET CONTEXT support", "SET EXTENSION operator", "SET PRIORITY 1"}, true},
+		{"no policy", failing, agi.ErrorPolicy{}, nil, nil, false},
+		{"success", agi.HandlerFunc(func(context.Context, *agi.AgiSession) error { return nil }), sorry, nil, nil, false},
+		{"control error", agi.HandlerFunc(func(context.Context, *agi.AgiSession) error { return agi.ErrNextHandler }), sorry, nil, nil, false},
+		{"dead channel", agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+			if err := s.Answer(); err != nil {
+				return fmt.Errorf("greeting failed: %v", err)
+			}
+			return nil
+		}), sorry, []string{"511 Command Not Permitted on a dead channel or intercept routine"}, []string{"ANSWER"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := agitest.NewFake(tt.responses)
+			info := serveSession(t, tt.handler, fake, agi.WithErrorPolicy(tt.policy))
+			assert.Equal(t, tt.want, fake.Commands())
+			if tt.applied {
+				require.NotNil(t, info.ErrorPolicy)
+				assert.Equal(t, tt.policy, *info.ErrorPolicy)
+			} else {
+				assert.Nil(t, info.ErrorPolicy)
+			}
+		})
+	}
+
+	t.Run("route override", func(t *testing.T) {
+		mux := agi.NewMux()
+		mux.Handle("billing", failing, agi.WithRouteErrorPolicy(operator))
+		mux.Handle("menu", failing)
+		for route, want := range map[string][]string{
+			"billing": {"SET CONTEXT support", "SET EXTENSION operator", "SET PRIORITY 1"},
+			"menu":    {`STREAM FILE technical-difficulties ""`, "HANGUP"},
+		} {
+			fake := agitest.NewFake([]string{"200 result=0", "200 result=0", "200 result=0"},
+				agitest.WithEnv("agi_network_script", route))
+			info := serveSession(t, mux.Handler(), fake, agi.WithErrorPolicy(sorry))
+			assert.Equal(t, want, fake.Commands(), route)
+			assert.NotNil(t, info.ErrorPolicy, route)
+		}
+	})
+}
+
+func TestGetDataDigits(t *testing.T) {
+	fake := agitest.NewFake([]string{"200 result=0012349", "200 result=0049927398716000000001 (timeout)", "200 result=42#", "200 result=1"})
+	var pin, card, code string
+	var capErr error
+	info := serveSession(t, agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+		var err error
+		if pin, err = s.GetData("enter-pin", 5000, 7); err != nil {
+			return err
+		}
+		if card, err = s.GetData("enter-card", 5000, 22); err != nil {
+			return err
+		}
+		// A negative limit is no limit, as before the cap existed
+		if code, err = s.GetData("enter-code", 5000, -1); err != nil {
+			return err
+		}
+		if _, capErr = s.GetData("enter-card", 5000, 256); capErr == nil {
+			return nil
+		}
+		return s.SetVariable("CARD", card)
+	}), fake, agi.WithMaxDataDigits(255))
+
+	require.NoError(t, info.Err)
+	assert.Equal(t, "0012349", pin)
+	assert.Equal(t, "0049927398716000000001", card)
+	assert.Equal(t, "42#", code)
+	assert.ErrorIs(t, capErr, agi.ErrInvalidLimit)
+	assert.Equal(t, []string{"GET DATA enter-pin 5000 7", "GET DATA enter-card 5000 22", "GET DATA enter-code 5000", `SET VARIABLE CARD "0049927398716000000001"`}, fake.Commands())
+}
@@ -0,0 +1,37 @@
+package agi
+
+import "time"
+
+// FaultInjection configures artificial faults on each session's first
+// command for chaos testing how handlers cope with a slow or unresponsive
+// Asterisk. It must be enabled explicitly with WithFaultInjection and should
+// never be used in production.
+type FaultInjection struct {
+	// FirstResponseDelay is waited before reading the first response. The
+	// session timeout keeps running, so a delay longer than the timeout
+	// produces ErrTimeout.
+	FirstResponseDelay time.Duration
+	// DropFirstResponse discards the first response, leaving the command
+	// waiting for one that never comes
+	DropFirstResponse bool
+}
+
+// WithFaultInjection enables artificial faults on every session; see FaultInjection
+func WithFaultInjection(faults FaultInjection) ServerOption {
+	return func(s *FastAGIServer) {
+		s.faults = &faults
+	}
+}
+
+// injectFaults applies the configured faults before the first response is read
+func (s *AgiSession) injectFaults() error {
+	if s.faults.FirstResponseDelay > 0 {
+		time.Sleep(s.faults.FirstResponseDelay)
+	}
+	if s.faults.DropFirstResponse {
+		if _, err := s.readLine(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
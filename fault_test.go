@@ -0,0 +1,81 @@
+package agi_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agitest"
+)
+
+func TestResponseDelay(t *testing.T) {
+	fake := agitest.NewFake([]string{"200 result=0", "200 result=1 (1234)"},
+		agitest.WithResponseDelay(func(cmd string) time.Duration {
+			if cmd == "GET VARIABLE ACCOUNT" {
+				return 200 * time.Millisecond
+			}
+			return 0
+		}))
+	defer fake.Close()
+
+	session, err := fake.Session(context.Background())
+	require.NoError(t, err)
+	session.SetTimeout(50 * time.Millisecond)
+
+	require.NoError(t, session.Answer())
+
+	_, err = session.GetVariable("ACCOUNT")
+	assert.True(t, errors.Is(err, agi.ErrTimeout), "got %v", err)
+	assert.False(t, errors.Is(err, agi.ErrInvalidResponse))
+
+	var cmdErr *agi.CommandError
+	require.True(t, errors.As(err, &cmdErr))
+	assert.Equal(t, "GET VARIABLE", cmdErr.Verb)
+}
+
+func TestServerFaultInjection(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults agi.FaultInjection
+	}{
+		{"delayed first response", agi.FaultInjection{FirstResponseDelay: 150 * time.Millisecond}},
+		{"dropped first response", agi.FaultInjection{DropFirstResponse: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			handler := agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) error {
+				s.SetTimeout(50 * time.Millisecond)
+				return s.Answer()
+			})
+			server, err := agi.NewFastAGIServer("127.0.0.1:0", handler,
+				agi.WithFaultInjection(tt.faults),
+				agi.WithErrorHandler(func(s *agi.AgiSession, err error) { errs <- err }),
+			)
+			require.NoError(t, err)
+			go server.Serve()
+			defer server.Stop()
+
+			conn, err := net.Dial("tcp", server.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			fake := agitest.NewFake([]string{"200 result=0"})
+			go fake.Serve(conn)
+
+			select {
+			case err := <-errs:
+				assert.True(t, errors.Is(err, agi.ErrTimeout), "got %v", err)
+			case <-time.After(2 * time.Second):
+				t.Fatal("handler error not reported")
+			}
+		})
+	}
+}
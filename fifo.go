@@ -0,0 +1,68 @@
+package agi
+
+import "sync"
+
+// commandLock serializes a session's commands first come, first served.
+// A sync.Mutex lets a goroutine that arrives later overtake goroutines
+// already waiting, which interleaves commands from a handler, a hotkey
+// action and a heartbeat in an arbitrary order; commandLock hands the
+// session to waiters in the order they asked for it. The zero value is
+// unlocked.
+type commandLock struct {
+	mu   sync.Mutex
+	held bool
+	// waiters are closed in order to pass the lock on
+	waiters []chan struct{}
+}
+
+// Lock waits for every earlier caller to unlock and then locks
+func (l *commandLock) Lock() {
+	l.mu.Lock()
+	if !l.held {
+		l.held = true
+		l.mu.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.mu.Unlock()
+	<-ready
+}
+
+// TryLock locks only when nobody holds or waits for the lock
+func (l *commandLock) TryLock() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held {
+		return false
+	}
+	l.held = true
+	return true
+}
+
+// Unlock passes the lock to the longest waiting caller, if any
+func (l *commandLock) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) == 0 {
+		l.held = false
+		return
+	}
+	next := l.waiters[0]
+	l.waiters = l.waiters[1:]
+	close(next)
+}
+
+// waiting returns how many callers are waiting for the lock
+func (l *commandLock) waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiters)
+}
+
+// QueuedCommands returns how many commands are waiting for the one in
+// progress, and those queued before them, to finish. Commands are sent in
+// the order they were issued, whichever goroutine issued them.
+func (s *AgiSession) QueuedCommands() int {
+	return s.mutex.waiting()
+}
@@ -0,0 +1,75 @@
+package agi
+
+import (
+	"maps"
+	"net/url"
+	"strings"
+)
+
+// WithFeatureFlags evaluates fn once per session, after the environment is
+// read and transformed, and exposes the flags it returns through
+// AgiSession.Flag. This lets rollouts keyed on the caller, such as a
+// percentage of agi_callerid values, be decided in one place. A nil fn uses
+// FlagsFromURL. fn receives a copy of the environment.
+func WithFeatureFlags(fn func(env map[string]string) map[string]bool) ServerOption {
+	return func(s *FastAGIServer) {
+		if fn == nil {
+			fn = FlagsFromURL
+		}
+		s.featureFlags = fn
+	}
+}
+
+// FlagsFromURL enables the flags listed in the flags query parameter of the
+// FastAGI URL, so agi://host/ivr?flags=new_menu,beta_tts enables new_menu
+// and beta_tts. The parameter may be repeated.
+func FlagsFromURL(env map[string]string) map[string]bool {
+	values := requestQuery(env)
+	if len(values) == 0 {
+		return nil
+	}
+
+	flags := make(map[string]bool)
+	for _, list := range values["flags"] {
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				flags[name] = true
+			}
+		}
+	}
+	return flags
+}
+
+// requestQuery returns the query parameters of the FastAGI URL, nil when
+// it has none or they cannot be parsed
+func requestQuery(env map[string]string) url.Values {
+	script := env["agi_network_script"]
+	if script == "" {
+		script = env["agi_request"]
+	}
+	_, query, ok := strings.Cut(script, "?")
+	if !ok {
+		return nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil
+	}
+	return values
+}
+
+// Flag reports whether the named feature flag is enabled for this session.
+// Flags are false unless the server was configured with WithFeatureFlags.
+func (s *AgiSession) Flag(name string) bool {
+	return s.flags[name]
+}
+
+// Flags returns a copy of every feature flag evaluated for this session
+func (s *AgiSession) Flags() map[string]bool {
+	return maps.Clone(s.flags)
+}
+
+// evaluateFlags runs the feature flag function against the session environment
+func (s *AgiSession) evaluateFlags(fn func(env map[string]string) map[string]bool) {
+	s.flags = fn(maps.Clone(s.env))
+}
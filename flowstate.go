@@ -0,0 +1,146 @@
+package agi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultFlowStateVariable is the channel variable SaveFlowState writes to
+// unless SetFlowStateVariable chose another
+const DefaultFlowStateVariable = "AGI_FLOW_STATE"
+
+// FlowStateChunkSize is the most encoded state SaveFlowState stores in one
+// channel variable. GET VARIABLE reads values into a 1024 byte buffer on
+// many Asterisk versions and silently truncates longer ones.
+const FlowStateChunkSize = 1000
+
+// SetFlowStateVariable sets the channel variable SaveFlowState and
+// LoadFlowState use. An empty name restores DefaultFlowStateVariable.
+func (s *AgiSession) SetFlowStateVariable(name string) {
+	s.flowStateVar = name
+}
+
+// WithFlowStateVariable sets the flow state variable of every session
+func WithFlowStateVariable(name string) ServerOption {
+	return func(s *FastAGIServer) {
+		s.flowStateVar = name
+	}
+}
+
+// flowStateVariable returns the variable holding the flow state
+func (s *AgiSession) flowStateVariable() string {
+	if s.flowStateVar == "" {
+		return DefaultFlowStateVariable
+	}
+	return s.flowStateVar
+}
+
+// SaveFlowState stores v, encoded as JSON, on the channel so another AGI
+// invocation for the same call can continue where this one stopped, such
+// as a new process taking over during a rolling deploy after the handler
+// returned to a dialplan priority that runs AGI again. The encoded state is
+// split into chunks of FlowStateChunkSize in the variables NAME_G_1,
+// NAME_G_2 and so on, where G is a generation one above the saved state's,
+// and NAME is then set to "G:chunks". Since the chunks of the previous
+// state are never overwritten, a save failing part way leaves it readable;
+// once NAME is set, the previous chunks are cleared as far as possible.
+func (s *AgiSession) SaveFlowState(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding flow state: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	name := s.flowStateVariable()
+	saved, err := s.GetVariable(name)
+	if err != nil {
+		return err
+	}
+	// A saved state that cannot be parsed is replaced rather than resumed
+	prevGen, prevChunks, _ := parseFlowStateHeader(saved)
+
+	gen := prevGen + 1
+	chunks := 0
+	for len(encoded) > 0 {
+		n := min(len(encoded), FlowStateChunkSize)
+		chunks++
+		if err := s.SetVariable(flowStateChunk(name, gen, chunks), encoded[:n]); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	if err := s.SetVariable(name, fmt.Sprintf("%d:%d", gen, chunks)); err != nil {
+		return err
+	}
+
+	// The new state is saved; chunks left behind only cost channel memory
+	for i := 1; i <= prevChunks; i++ {
+		if s.SetVariable(flowStateChunk(name, prevGen, i), "") != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// LoadFlowState decodes the state SaveFlowState stored on the channel into
+// v and reports whether there was any. A state that cannot be decoded
+// returns an error wrapping ErrInvalidFlowState.
+func (s *AgiSession) LoadFlowState(v any) (bool, error) {
+	name := s.flowStateVariable()
+	header, err := s.GetVariable(name)
+	if err != nil || header == "" {
+		return false, err
+	}
+	gen, chunks, ok := parseFlowStateHeader(header)
+	if !ok {
+		return false, fmt.Errorf("%w: %s holds %q", ErrInvalidFlowState, name, header)
+	}
+
+	var encoded strings.Builder
+	for i := 1; i <= chunks; i++ {
+		chunk, err := s.GetVariable(flowStateChunk(name, gen, i))
+		if err != nil {
+			return false, err
+		}
+		if chunk == "" {
+			return false, fmt.Errorf("%w: %s is empty", ErrInvalidFlowState, flowStateChunk(name, gen, i))
+		}
+		encoded.WriteString(chunk)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrInvalidFlowState, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("%w: %w", ErrInvalidFlowState, err)
+	}
+	return true, nil
+}
+
+// parseFlowStateHeader splits the "generation:chunks" value SaveFlowState
+// sets in the flow state variable
+func parseFlowStateHeader(header string) (gen, chunks int, ok bool) {
+	g, c, found := strings.Cut(header, ":")
+	if !found {
+		return 0, 0, false
+	}
+	gen, err := strconv.Atoi(g)
+	if err != nil || gen < 1 {
+		return 0, 0, false
+	}
+	chunks, err = strconv.Atoi(c)
+	if err != nil || chunks < 1 {
+		return 0, 0, false
+	}
+	return gen, chunks, true
+}
+
+// flowStateChunk returns the variable holding chunk i of generation gen of
+// the state in name
+func flowStateChunk(name string, gen, i int) string {
+	return fmt.Sprintf("%s_%d_%d", name, gen, i)
+}
@@ -2,8 +2,6 @@ module github.com/Shubham-Thakur06/go-asterisk-agi
 
 go 1.23.2
 
-require github.com/pkg/errors v0.9.1
-
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
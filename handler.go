@@ -0,0 +1,36 @@
+package agi
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNextHandler is returned by a handler in a Sequence to pass the call to
+// the next handler in the chain
+var ErrNextHandler = newError("next_handler", "pass to next handler")
+
+// Sequence returns a handler that runs handlers in order until one claims the
+// call. A handler delegates by returning ErrNextHandler; any other return
+// value, including nil, ends the chain and is returned as is. When every
+// handler delegates, the sequence itself returns ErrNextHandler, so sequences
+// can be nested and the outer chain continues.
+//
+// Because a sequence is an ordinary Handler, wrapping it applies to the whole
+// chain, while wrapping an individual handler before passing it to Sequence
+// applies only to that step.
+func Sequence(handlers ...Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+		for _, h := range handlers {
+			if err := h.Handle(ctx, s); !errors.Is(err, ErrNextHandler) {
+				return err
+			}
+		}
+		return ErrNextHandler
+	})
+}
+
+// SequenceWithFallback is like Sequence but runs fallback when every handler
+// delegates, for example to play an error prompt and hang up
+func SequenceWithFallback(fallback Handler, handlers ...Handler) Handler {
+	return Sequence(append(handlers[:len(handlers):len(handlers)], fallback)...)
+}
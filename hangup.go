@@ -0,0 +1,102 @@
+package agi
+
+import (
+	"context"
+	"sync"
+)
+
+// HangupMonitor reports channel hangups from outside the AGI stream, which
+// cannot deliver them while a blocking command such as EXEC Dial runs. An
+// AMI client typically implements it by watching Hangup events.
+type HangupMonitor interface {
+	// WatchHangup calls fn once when the channel with uniqueID hangs up.
+	// fn may be called from any goroutine and must not block. After stop
+	// returns, fn is not called.
+	WatchHangup(uniqueID string, fn func()) (stop func())
+}
+
+// HangupEvents is a HangupMonitor fed by the application's own AMI event
+// loop, which calls Hangup with the Uniqueid of each Hangup event
+type HangupEvents struct {
+	mu       sync.Mutex
+	nextID   uint64
+	watchers map[string]map[uint64]func()
+}
+
+// NewHangupEvents creates an empty HangupEvents
+func NewHangupEvents() *HangupEvents {
+	return &HangupEvents{watchers: make(map[string]map[uint64]func())}
+}
+
+// WatchHangup implements HangupMonitor
+func (h *HangupEvents) WatchHangup(uniqueID string, fn func()) func() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	id := h.nextID
+	if h.watchers[uniqueID] == nil {
+		h.watchers[uniqueID] = make(map[uint64]func())
+	}
+	h.watchers[uniqueID][id] = fn
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.watchers[uniqueID], id)
+		if len(h.watchers[uniqueID]) == 0 {
+			delete(h.watchers, uniqueID)
+		}
+	}
+}
+
+// Hangup notifies every watcher of uniqueID and removes them
+func (h *HangupEvents) Hangup(uniqueID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, fn := range h.watchers[uniqueID] {
+		fn()
+	}
+	delete(h.watchers, uniqueID)
+}
+
+// Watching returns how many watches are registered, for tests and metrics
+func (h *HangupEvents) Watching() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	for _, w := range h.watchers {
+		n += len(w)
+	}
+	return n
+}
+
+// MonitorHangup returns a copy of ctx that is cancelled with cause ErrHangup
+// as soon as m reports that the session's channel hung up, which also marks
+// the session HungUp. The command in progress at that moment is not
+// interrupted; ctx-aware helpers return at their next check. Call stop once
+// the session ends to release the watch.
+func (s *AgiSession) MonitorHangup(ctx context.Context, m HangupMonitor) (context.Context, context.CancelFunc) {
+	s.escaped.Store(true)
+	ctx, cancel := context.WithCancelCause(ctx)
+	unwatch := m.WatchHangup(s.env["agi_uniqueid"], func() {
+		s.hungUp.Store(true)
+		cancel(ErrHangup)
+	})
+	return ctx, func() {
+		unwatch()
+		cancel(context.Canceled)
+	}
+}
+
+// WithHangupMonitor cancels each handler's context with cause ErrHangup as
+// soon as m reports that its channel hung up, so handlers blocked in
+// ctx-aware helpers return promptly instead of waiting for the PBX. Use
+// context.Cause to tell a hangup from other cancellations.
+func WithHangupMonitor(m HangupMonitor) ServerOption {
+	return func(s *FastAGIServer) {
+		s.hangupMonitor = m
+	}
+}
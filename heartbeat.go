@@ -0,0 +1,154 @@
+package agi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HeartbeatVariable is the channel variable a VariableSetter heartbeat sets
+// to the Unix time of each beat
+const HeartbeatVariable = "AGI_HEARTBEAT"
+
+// HeartbeatMode is how a heartbeat marked the session alive
+type HeartbeatMode int
+
+const (
+	// HeartbeatNoop sent NOOP over the idle AGI connection
+	HeartbeatNoop HeartbeatMode = iota
+	// HeartbeatSkipped sent nothing because a command such as EXEC Dial
+	// was waiting for its response, and another command written then
+	// would be answered out of order
+	HeartbeatSkipped
+	// HeartbeatSetVariable set HeartbeatVariable through the session's
+	// VariableSetter, outside the AGI stream
+	HeartbeatSetVariable
+)
+
+// String returns the mode name
+func (m HeartbeatMode) String() string {
+	switch m {
+	case HeartbeatNoop:
+		return "noop"
+	case HeartbeatSkipped:
+		return "skipped"
+	case HeartbeatSetVariable:
+		return "setvar"
+	}
+	return "unknown"
+}
+
+// Beat reports one heartbeat
+type Beat struct {
+	Time time.Time
+	Mode HeartbeatMode
+	// Err is the error of the NOOP command or the variable set
+	Err error
+}
+
+// VariableSetter sets channel variables from outside the AGI stream, so it
+// works while a blocking command runs. An AMI client typically implements
+// it with the Setvar action.
+type VariableSetter interface {
+	SetChannelVariable(channel, name, value string) error
+}
+
+// SetVariableSetter makes Heartbeat set HeartbeatVariable through v instead
+// of sending NOOP. A nil v restores NOOP heartbeats.
+func (s *AgiSession) SetVariableSetter(v VariableSetter) {
+	s.varSetter = v
+}
+
+// WithVariableSetter sets the VariableSetter of every session. Without it,
+// sessions use the server's HangupMonitor when it also implements
+// VariableSetter.
+func WithVariableSetter(v VariableSetter) ServerOption {
+	return func(s *FastAGIServer) {
+		s.varSetter = v
+	}
+}
+
+// SetHeartbeatHook sets a function called after each heartbeat, for example
+// to log a warning when beats are skipped. A nil fn disables it.
+func (s *AgiSession) SetHeartbeatHook(fn func(s *AgiSession, b Beat)) {
+	s.onHeartbeat = fn
+}
+
+// WithHeartbeatHook sets the heartbeat hook of every session
+func WithHeartbeatHook(fn func(s *AgiSession, b Beat)) ServerOption {
+	return func(s *FastAGIServer) {
+		s.onHeartbeat = fn
+	}
+}
+
+// Heartbeat marks the session alive every interval until ctx is done, the
+// channel hangs up or stop is called, for handlers that outlast idle
+// timeouts on the PBX or on proxies in between. Each beat uses the safest
+// mechanism available: with a VariableSetter it sets HeartbeatVariable on
+// the channel, which works even during EXEC Dial; otherwise it sends NOOP
+// when the session is idle and skips the beat while a command is waiting
+// for its response. Skipped beats are reported to the heartbeat hook and,
+// in debug mode, printed as warnings. stop waits for a beat in progress.
+//
+//	stop := s.Heartbeat(ctx, 30*time.Second)
+//	defer stop()
+//	err := s.Execute("Dial", "PJSIP/100,120")
+func (s *AgiSession) Heartbeat(ctx context.Context, interval time.Duration) (stop func()) {
+	s.escaped.Store(true)
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := s.clock().NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C():
+				if s.HungUp() {
+					return
+				}
+				b := s.beat(now)
+				if s.onHeartbeat != nil {
+					s.onHeartbeat(s, b)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// beat performs a single heartbeat
+func (s *AgiSession) beat(now time.Time) Beat {
+	if s.varSetter != nil {
+		err := s.varSetter.SetChannelVariable(s.env["agi_channel"], HeartbeatVariable, strconv.FormatInt(now.Unix(), 10))
+		return Beat{Time: now, Mode: HeartbeatSetVariable, Err: err}
+	}
+
+	if err := s.checkPolicy("NOOP"); err != nil {
+		return Beat{Time: now, Mode: HeartbeatNoop, Err: &CommandError{
+			Verb:     "NOOP",
+			UniqueID: s.env["agi_uniqueid"],
+			Err:      err,
+			ErrCode:  ErrorCode(err),
+		}}
+	}
+	// A held mutex means a command is between writing and its response
+	if !s.mutex.TryLock() {
+		if s.debugMode {
+			fmt.Fprintf(os.Stderr, "AGI Heartbeat skipped: command in progress\n")
+		}
+		return Beat{Time: now, Mode: HeartbeatSkipped}
+	}
+	defer s.mutex.Unlock()
+	_, err := s.send("NOOP")
+	return Beat{Time: now, Mode: HeartbeatNoop, Err: err}
+}
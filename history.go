@@ -0,0 +1,184 @@
+package agi
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHistorySize is how many recent exchanges a session keeps for
+// RecentExchanges unless changed with SetHistorySize
+const DefaultHistorySize = 32
+
+// redactedValue replaces caller data in redacted exchanges
+const redactedValue = "***"
+
+// Exchange is one command sent to Asterisk and the response it received
+type Exchange struct {
+	Time     time.Time
+	Command  string
+	Response string
+	Elapsed  time.Duration
+	Err      error
+	// Sensitive marks exchanges whose responses carry secrets, such as the
+	// digits read by CollectMaskedDigits. Their responses are masked after
+	// the exchange redactor runs.
+	Sensitive bool
+}
+
+// history is a fixed-size ring of the most recent exchanges. Its storage is
+// allocated on first use so sessions that never send a command pay nothing.
+type history struct {
+	mu      sync.Mutex
+	entries []Exchange
+	next    int
+	full    bool
+}
+
+// add records e, overwriting the oldest entry once size entries are held
+func (h *history) add(e Exchange, size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.entries) != size {
+		h.entries = make([]Exchange, size)
+		h.next, h.full = 0, false
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % size
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// snapshot returns the held entries, oldest first
+func (h *history) snapshot() []Exchange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.full {
+		return append([]Exchange(nil), h.entries[:h.next]...)
+	}
+	out := make([]Exchange, 0, len(h.entries))
+	out = append(out, h.entries[h.next:]...)
+	return append(out, h.entries[:h.next]...)
+}
+
+// redactedArgs lists the commands whose trailing arguments carry caller data,
+// such as PINs or card numbers read back to the caller, with how many leading
+// arguments are safe to keep
+var redactedArgs = map[string]int{
+	"SET VARIABLE": 1,
+	"DATABASE PUT": 2,
+	"SEND TEXT":    0,
+	"SAY DIGITS":   0,
+	"SAY NUMBER":   0,
+	"SAY ALPHA":    0,
+	"SAY PHONETIC": 0,
+}
+
+// redactedResults lists the commands whose responses carry caller input or
+// stored values
+var redactedResults = map[string]bool{
+	"GET DATA":            true,
+	"GET OPTION":          true,
+	"WAIT FOR DIGIT":      true,
+	"STREAM FILE":         true,
+	"CONTROL STREAM FILE": true,
+	"SAY DIGITS":          true,
+	"SAY NUMBER":          true,
+	"SAY ALPHA":           true,
+	"SAY PHONETIC":        true,
+	"RECEIVE CHAR":        true,
+	"RECEIVE TEXT":        true,
+	"GET VARIABLE":        true,
+	"GET FULL VARIABLE":   true,
+	"DATABASE GET":        true,
+}
+
+// RedactExchange is the default redactor applied to RecentExchanges. It
+// masks variable and database values being written, numbers and text said
+// to the caller, and the results of commands that return collected digits
+// or stored values. Hangup results
+// (result=-1) are kept since they explain most failures.
+func RedactExchange(e Exchange) Exchange {
+	verb := commandVerb(e.Command)
+
+	if keep, ok := redactedArgs[verb]; ok {
+		fields := strings.Fields(e.Command)
+		keep += len(strings.Fields(verb))
+		if len(fields) > keep {
+			e.Command = strings.Join(fields[:keep], " ") + " " + redactedValue
+		}
+	}
+
+	if redactedResults[verb] {
+		e.Response = redactResponse(e.Response)
+	}
+	return e
+}
+
+// redactResponse masks the result of a response, keeping hangup results
+// (result=-1) since they explain most failures
+func redactResponse(response string) string {
+	if response == "" || strings.HasPrefix(response, "200 result=-1") {
+		return response
+	}
+	return "200 result=" + redactedValue
+}
+
+// SetHistorySize sets how many recent exchanges the session keeps. Zero or
+// a negative size disables the history.
+func (s *AgiSession) SetHistorySize(size int) {
+	if size <= 0 {
+		size = -1
+	}
+	s.historySize = size
+}
+
+// SetExchangeRedactor replaces the function applied to exchanges returned by
+// RecentExchanges and written to transcripts. A nil fn restores
+// RedactExchange.
+func (s *AgiSession) SetExchangeRedactor(fn func(Exchange) Exchange) {
+	s.redactor = fn
+}
+
+// RecentExchanges returns the session's most recent exchanges, oldest first,
+// after redaction. It is safe to call while a command is in progress.
+func (s *AgiSession) RecentExchanges() []Exchange {
+	if s.historySize < 0 {
+		return nil
+	}
+	exchanges := s.history.snapshot()
+	for i := range exchanges {
+		exchanges[i] = s.redact(exchanges[i])
+	}
+	return exchanges
+}
+
+// redact applies the session's exchange redactor, then masks the response
+// of a sensitive exchange
+func (s *AgiSession) redact(e Exchange) Exchange {
+	sensitive := e.Sensitive
+	if s.redactor == nil {
+		e = RedactExchange(e)
+	} else {
+		e = s.redactor(e)
+	}
+	if sensitive {
+		e.Response = redactResponse(e.Response)
+	}
+	return e
+}
+
+// recordExchange adds an exchange to the session history unless it is disabled
+func (s *AgiSession) recordExchange(e Exchange) {
+	size := s.historySize
+	switch {
+	case size < 0:
+		return
+	case size == 0:
+		size = DefaultHistorySize
+	}
+	s.history.add(e, size)
+}
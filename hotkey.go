@@ -0,0 +1,185 @@
+package agi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// HotkeyAction runs when the caller presses a registered hotkey. Its return
+// value decides what happens to the interrupted prompt: nil or ResumePrompt
+// continues it where it stopped, RestartPrompt plays it again from the
+// start, and AbortFlow or any other error ends the helper with that error.
+// Hotkeys do not fire while an action runs.
+type HotkeyAction func(ctx context.Context, s *AgiSession) error
+
+// Control errors returned by a HotkeyAction
+var (
+	// ResumePrompt continues the prompt from where the hotkey stopped it
+	ResumePrompt = newError("resume_prompt", "resume prompt")
+	// RestartPrompt plays the prompt again from the start, and clears the
+	// digits collected so far by CollectDigitsInteractive
+	RestartPrompt = newError("restart_prompt", "restart prompt")
+	// AbortFlow ends the helper, which returns an error wrapping AbortFlow,
+	// for actions that have taken over the call, such as a transfer
+	AbortFlow = newError("abort_flow", "flow aborted by hotkey")
+)
+
+// HotkeyScope sets when hotkeys fire during CollectDigitsInteractive
+type HotkeyScope int
+
+const (
+	// HotkeysOff collects hotkeys as ordinary digits. It is the default.
+	HotkeysOff HotkeyScope = iota
+	// HotkeysFirstDigit fires a hotkey pressed before any other digit and
+	// collects it afterwards, for "enter the extension, or 0 for the
+	// operator"
+	HotkeysFirstDigit
+	// HotkeysAlways fires hotkeys whenever they are pressed, so they are
+	// never collected
+	HotkeysAlways
+)
+
+// hotkeyDigits are the keys that can be registered as hotkeys
+const hotkeyDigits = "0123456789*#"
+
+// RegisterHotkey makes digit run action whenever the caller presses it
+// during PlayPrompt, GetOption, or CollectDigitsInteractive when its Hotkeys
+// option allows, such as 0 for the operator or 9 to repeat. Digits a helper
+// was asked to accept keep their own meaning there. A nil action removes the
+// hotkey.
+func (s *AgiSession) RegisterHotkey(digit string, action HotkeyAction) error {
+	if len(digit) != 1 || !strings.Contains(hotkeyDigits, digit) {
+		return fmt.Errorf("invalid hotkey %q: must be one of %s", digit, hotkeyDigits)
+	}
+	if action == nil {
+		delete(s.hotkeys, digit)
+		return nil
+	}
+	if s.hotkeys == nil {
+		s.hotkeys = make(map[string]HotkeyAction)
+	}
+	s.hotkeys[digit] = action
+	return nil
+}
+
+// WithoutHotkeys runs fn with every hotkey disabled, for steps that must
+// treat all keys as input
+func (s *AgiSession) WithoutHotkeys(fn func() error) error {
+	prev := s.hotkeysOff
+	s.hotkeysOff = true
+	defer func() { s.hotkeysOff = prev }()
+	return fn()
+}
+
+// activeHotkeys returns the enabled hotkeys, leaving out digits the caller
+// already accepts
+func (s *AgiSession) activeHotkeys(accepted string) string {
+	if s.hotkeysOff || len(s.hotkeys) == 0 {
+		return ""
+	}
+	digits := make([]string, 0, len(s.hotkeys))
+	for digit := range s.hotkeys {
+		if !strings.Contains(accepted, digit) {
+			digits = append(digits, digit)
+		}
+	}
+	slices.Sort(digits)
+	return strings.Join(digits, "")
+}
+
+// runHotkey runs the action for digit and reports whether the prompt should
+// restart. Errors other than ResumePrompt and RestartPrompt are returned.
+func (s *AgiSession) runHotkey(ctx context.Context, digit string) (bool, error) {
+	prev := s.hotkeysOff
+	s.hotkeysOff = true
+	err := s.hotkeys[digit](ctx, s)
+	s.hotkeysOff = prev
+
+	switch {
+	case err == nil, errors.Is(err, ResumePrompt):
+		return false, nil
+	case errors.Is(err, RestartPrompt):
+		return true, nil
+	}
+	return false, fmt.Errorf("hotkey %s: %w", digit, err)
+}
+
+// collectHotkey reports whether digit fires a hotkey during collection
+func (s *AgiSession) collectHotkey(digit string, opts CollectOptions, collected int) bool {
+	switch {
+	case opts.Hotkeys == HotkeysOff:
+		return false
+	case opts.Hotkeys == HotkeysFirstDigit && collected > 0:
+		return false
+	}
+	return strings.Contains(s.activeHotkeys(opts.Submit+opts.Backspace), digit)
+}
+
+// PlayPrompt plays a sound file like StreamFile and returns the escape digit
+// that interrupted it, or "" when it played to the end. A registered hotkey
+// pressed meanwhile runs its action; the prompt then resumes or restarts as
+// the action decides.
+func (s *AgiSession) PlayPrompt(ctx context.Context, filename string, escapeDigits string) (string, error) {
+	escapeDigits = s.escapeDigits(escapeDigits)
+	offset := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		hotkeys := s.activeHotkeys(escapeDigits)
+		digit, endpos, err := s.StreamFileFrom(filename, escapeDigits+hotkeys, offset)
+		if err != nil || digit == "" || !strings.Contains(hotkeys, digit) {
+			return digit, err
+		}
+
+		restart, err := s.runHotkey(ctx, digit)
+		if err != nil {
+			return "", err
+		}
+		offset = endpos
+		if restart {
+			offset = 0
+		}
+	}
+}
+
+// getOptionWithHotkeys is GetOption built from STREAM FILE and WAIT FOR
+// DIGIT, which unlike GET OPTION let hotkeys pressed at any point be told
+// apart from menu choices
+func (s *AgiSession) getOptionWithHotkeys(filename string, escapeDigits string, timeout time.Duration) (string, error) {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for {
+		digit, err := s.PlayPrompt(ctx, filename, escapeDigits)
+		if err != nil || digit != "" {
+			return digit, err
+		}
+
+		restart := false
+		deadline := s.clock().Now().Add(timeout)
+		for !restart {
+			remaining := deadline.Sub(s.clock().Now())
+			if remaining <= 0 {
+				return "", nil
+			}
+			digit, err := s.WaitForDigit(int(remaining.Milliseconds()))
+			if err != nil || digit == "" || strings.Contains(escapeDigits, digit) {
+				return digit, err
+			}
+			if !strings.Contains(s.activeHotkeys(escapeDigits), digit) {
+				continue
+			}
+			if restart, err = s.runHotkey(ctx, digit); err != nil {
+				return "", err
+			}
+			deadline = s.clock().Now().Add(timeout)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package agi
+
+import "context"
+
+// SetLameDuck puts the server in or out of lame-duck mode, for maintenance
+// on one node of a pair. In lame-duck mode Ready reports false, so health
+// checks steer traffic away, and connections accepted from then on are
+// closed at once, which Asterisk reports as AGISTATUS=FAILURE, or passed to
+// the WithLameDuckHandler handler. Sessions already accepted are untouched.
+// Whether a connection is served normally is decided once, when it is
+// accepted.
+func (s *FastAGIServer) SetLameDuck(enabled bool) {
+	s.lameDuck.Store(enabled)
+}
+
+// LameDuck reports whether the server is in lame-duck mode
+func (s *FastAGIServer) LameDuck() bool {
+	return s.lameDuck.Load()
+}
+
+// WithLameDuckHandler sets the handler for connections accepted in
+// lame-duck mode, in place of closing them, such as ContinueDialplanAt a
+// priority that retries the call on the standby server
+func WithLameDuckHandler(h Handler) ServerOption {
+	return func(s *FastAGIServer) {
+		s.lameDuckHandler = h
+	}
+}
+
+// ContinueDialplanAt returns a handler that sends the channel to at once
+// the AGI returns, for WithLameDuckHandler
+func ContinueDialplanAt(at DialplanLocation) Handler {
+	return HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+		return s.Goto(at.Context, at.Extension, at.Priority)
+	})
+}
+
+// acceptHandler returns the handler for a connection accepted now, or nil
+// when lame-duck mode turns it away
+func (s *FastAGIServer) acceptHandler() Handler {
+	if !s.lameDuck.Load() {
+		return s.handler
+	}
+	s.stats.lameDuck.Add(1)
+	return s.lameDuckHandler
+}
@@ -0,0 +1,116 @@
+package agi
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// LanguageOption is one choice offered by SelectLanguage
+type LanguageOption struct {
+	// Digit selects this option
+	Digit string
+	// Language is the Asterisk language code, such as "en" or "es"
+	Language string
+	// Prompt is played with the channel language set to Language
+	Prompt string
+}
+
+// LanguageSelectOptions configures SelectLanguage
+type LanguageSelectOptions struct {
+	// Options are offered in order
+	Options []LanguageOption
+	// Retries is how many times the prompts are repeated after no or an
+	// invalid selection, fewer while the session's DegradationPolicy
+	// limits retries
+	Retries int
+	// Timeout is how long to wait for a digit after the prompts.
+	// Defaults to 5 seconds.
+	Timeout time.Duration
+	// Default is used when the caller makes no valid selection.
+	// Defaults to the first option's language.
+	Default string
+}
+
+// SelectLanguage plays a prompt for each language option in its own language,
+// collects the caller's choice and sets CHANNEL(language) accordingly, so the
+// rest of the call uses the chosen sound tree. The chosen code is returned
+// and remembered by the session; see Language.
+func (s *AgiSession) SelectLanguage(ctx context.Context, opts LanguageSelectOptions) (string, error) {
+	if len(opts.Options) == 0 {
+		return "", ErrNoOptions
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.Default == "" {
+		opts.Default = opts.Options[0].Language
+	}
+
+	var escape strings.Builder
+	for _, opt := range opts.Options {
+		escape.WriteString(opt.Digit)
+	}
+
+	lookup := func(digit string) (string, bool) {
+		for _, opt := range opts.Options {
+			if opt.Digit == digit {
+				return opt.Language, true
+			}
+		}
+		return "", false
+	}
+
+	for attempt := 0; attempt <= s.Degradation().Retries(opts.Retries); attempt++ {
+		digit, err := s.playLanguagePrompts(ctx, opts.Options, escape.String())
+		if err != nil {
+			return "", err
+		}
+		if digit == "" {
+			digit, err = s.WaitForDigit(int(opts.Timeout.Milliseconds()))
+			if err != nil {
+				return "", err
+			}
+		}
+		if lang, ok := lookup(digit); ok {
+			return lang, s.SetLanguage(lang)
+		}
+	}
+
+	return opts.Default, s.SetLanguage(opts.Default)
+}
+
+// playLanguagePrompts plays each option's prompt in its language, stopping
+// at the first digit pressed
+func (s *AgiSession) playLanguagePrompts(ctx context.Context, options []LanguageOption, escape string) (string, error) {
+	for _, opt := range options {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if err := s.SetVariable("CHANNEL(language)", opt.Language); err != nil {
+			return "", err
+		}
+		digit, err := s.streamFile(opt.Prompt, escape)
+		if err != nil || digit != "" {
+			return digit, err
+		}
+	}
+	return "", nil
+}
+
+// SetLanguage sets CHANNEL(language), which selects the sound tree used by
+// later prompts, and remembers it on the session
+func (s *AgiSession) SetLanguage(language string) error {
+	if err := s.SetVariable("CHANNEL(language)", language); err != nil {
+		return err
+	}
+	s.language = language
+	clear(s.soundCache)
+	return nil
+}
+
+// Language returns the language last set with SetLanguage or
+// SelectLanguage, or an empty string if neither has been called
+func (s *AgiSession) Language() string {
+	return s.language
+}
@@ -0,0 +1,87 @@
+package agi
+
+import (
+	"fmt"
+	"time"
+)
+
+// commandLimits guards a session against runaway handlers, such as a
+// retry loop that never ends. The zero value sets no limits.
+type commandLimits struct {
+	max       int
+	rate      float64
+	terminate bool
+
+	// tokens is the rate limiter's bucket, refilled at rate per second up
+	// to burst since refilled
+	tokens   float64
+	refilled time.Time
+	rejected int
+}
+
+// WithMaxCommandsPerSession fails every command after the first n of a
+// session with ErrCommandLimitExceeded. Zero, the default, sets no limit.
+func WithMaxCommandsPerSession(n int) ServerOption {
+	return func(s *FastAGIServer) {
+		s.limits.max = n
+	}
+}
+
+// WithMaxCommandRate fails commands sent faster than perSecond on average
+// with ErrCommandLimitExceeded. Bursts of up to perSecond commands, and at
+// least one, are allowed. Zero, the default, sets no limit.
+func WithMaxCommandRate(perSecond float64) ServerOption {
+	return func(s *FastAGIServer) {
+		s.limits.rate = perSecond
+	}
+}
+
+// WithTerminateOnCommandLimit cancels a session once it exceeds
+// WithMaxCommandsPerSession or WithMaxCommandRate, so a handler ignoring
+// the error cannot keep running; a command in progress fails too
+func WithTerminateOnCommandLimit(enabled bool) ServerOption {
+	return func(s *FastAGIServer) {
+		s.limits.terminate = enabled
+	}
+}
+
+// burst is how many commands the rate limiter allows at once
+func (l *commandLimits) burst() float64 {
+	return max(l.rate, 1)
+}
+
+// allow reports whether the command after sent others may be sent at now,
+// counting the commands it refuses
+func (l *commandLimits) allow(sent int, now time.Time) error {
+	if l.max > 0 && sent >= l.max {
+		l.rejected++
+		return fmt.Errorf("%w: %d commands per session", ErrCommandLimitExceeded, l.max)
+	}
+	if l.rate <= 0 {
+		return nil
+	}
+
+	if l.refilled.IsZero() {
+		l.tokens = l.burst()
+	} else {
+		l.tokens = min(l.burst(), l.tokens+now.Sub(l.refilled).Seconds()*l.rate)
+	}
+	l.refilled = now
+	if l.tokens < 1 {
+		l.rejected++
+		return fmt.Errorf("%w: %g commands per second", ErrCommandLimitExceeded, l.rate)
+	}
+	l.tokens--
+	return nil
+}
+
+// checkLimits applies the session's command limits to the next command,
+// cancelling the session when they are exceeded and it should terminate.
+// The caller must hold the session mutex.
+func (s *AgiSession) checkLimits() error {
+	err := s.limits.allow(s.sent, s.clock().Now())
+	if err != nil && s.limits.terminate && s.cancelFunc != nil {
+		s.cancelFunc()
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package agi
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// WithNetwork sets the network the server listens on: "tcp", the default,
+// accepts IPv4 and IPv6, while "tcp4" and "tcp6" force one family. An IP
+// literal address of the other family fails with ErrInvalidAddress.
+func WithNetwork(network string) ServerOption {
+	return func(s *FastAGIServer) {
+		s.network = network
+	}
+}
+
+// validateAddress checks a listen address for network, returning an error
+// wrapping ErrInvalidAddress that says what is wrong with it
+func validateAddress(network, address string) error {
+	if err := validateNetwork(network); err != nil {
+		return err
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return fmt.Errorf("%w: %q: IPv6 addresses need brackets, as in [::1]:4573", ErrInvalidAddress, address)
+		}
+		return fmt.Errorf("%w: %q: %v", ErrInvalidAddress, address, err)
+	}
+
+	if n, err := strconv.Atoi(port); err == nil {
+		if n < 0 || n > 65535 {
+			return fmt.Errorf("%w: %q: port %d out of range", ErrInvalidAddress, address, n)
+		}
+	} else if _, err := net.LookupPort(network, port); err != nil {
+		return fmt.Errorf("%w: %q: unknown port %q", ErrInvalidAddress, address, port)
+	}
+
+	// Hostnames are left to Listen to resolve; IP literals must match
+	// the network family
+	addr, _, _ := strings.Cut(host, "%")
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+	case network == "tcp4" && ip.To4() == nil:
+		return fmt.Errorf("%w: %q: IPv6 address on network tcp4", ErrInvalidAddress, address)
+	case network == "tcp6" && ip.To4() != nil:
+		return fmt.Errorf("%w: %q: IPv4 address on network tcp6", ErrInvalidAddress, address)
+	}
+	return nil
+}
+
+// validateNetwork checks that network is one WithNetwork accepts
+func validateNetwork(network string) error {
+	if !slices.Contains([]string{"tcp", "tcp4", "tcp6"}, network) {
+		return fmt.Errorf("%w: unsupported network %q, want tcp, tcp4 or tcp6", ErrInvalidAddress, network)
+	}
+	return nil
+}
+
+// listen validates address and listens on it
+func listen(network, address string) (net.Listener, error) {
+	if err := validateAddress(network, address); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(network, address)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("failed to create listener: %w (is another FastAGI server already listening on %s?)", err, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create listener: %w", err)
+	}
+	return listener, nil
+}
+
+// NewLoopbackServer creates a FastAGI server listening on port on both
+// 127.0.0.1 and ::1, for the common case of running on the Asterisk host
+// without exposing the server to the network. A zero port picks a free one,
+// the same on both addresses. Hosts without IPv6 get the IPv4 listener
+// only. WithNetwork("tcp4") or WithNetwork("tcp6") binds one of them.
+func NewLoopbackServer(port int, handler Handler, opts ...ServerOption) (*FastAGIServer, error) {
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("%w: port %d out of range", ErrInvalidAddress, port)
+	}
+	s := newServer(handler, opts)
+	if err := validateNetwork(s.network); err != nil {
+		s.cancelFunc()
+		return nil, err
+	}
+	listener, err := listenLoopback(s.network, port)
+	if err != nil {
+		s.cancelFunc()
+		return nil, err
+	}
+	s.listener = listener
+	return s, nil
+}
+
+// listenLoopback listens on the loopback addresses network allows
+func listenLoopback(network string, port int) (net.Listener, error) {
+	var first net.Listener
+	if network != "tcp6" {
+		var err error
+		if first, err = listen("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+			return nil, err
+		}
+		if network == "tcp4" {
+			return first, nil
+		}
+		port = first.Addr().(*net.TCPAddr).Port
+	}
+
+	second, err := listen("tcp6", net.JoinHostPort("::1", strconv.Itoa(port)))
+	switch {
+	case first == nil:
+		return second, err
+	case errors.Is(err, syscall.EADDRNOTAVAIL), errors.Is(err, syscall.EAFNOSUPPORT):
+		return first, nil
+	case err != nil:
+		first.Close()
+		return nil, err
+	}
+	return newMultiListener(first, second), nil
+}
+
+// multiListener accepts connections from several listeners
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// acceptResult is the outcome of one Accept on an underlying listener
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// newMultiListener starts accepting on every listener
+func newMultiListener(listeners ...net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.acceptFrom(l)
+	}
+	return m
+}
+
+// acceptFrom passes l's connections and errors to Accept until l is closed
+func (m *multiListener) acceptFrom(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case m.accepted <- acceptResult{conn, err}:
+		case <-m.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+// Accept implements net.Listener
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.accepted:
+		return r.conn, r.err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener, closing every listener
+func (m *multiListener) Close() error {
+	var errs []error
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		for _, l := range m.listeners {
+			errs = append(errs, l.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr implements net.Listener, returning the first listener's address
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// Addrs returns the addresses the server is listening on, one per listener
+func (s *FastAGIServer) Addrs() []net.Addr {
+	if m, ok := s.listener.(*multiListener); ok {
+		addrs := make([]net.Addr, len(m.listeners))
+		for i, l := range m.listeners {
+			addrs[i] = l.Addr()
+		}
+		return addrs
+	}
+	return []net.Addr{s.listener.Addr()}
+}
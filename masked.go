@@ -0,0 +1,105 @@
+package agi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultFeedbackTone is the sound CollectMaskedDigits plays after each
+// digit unless MaskedDigitsOptions.FeedbackTone names another
+const DefaultFeedbackTone = "beep"
+
+// MaskedDigitsOptions configures CollectMaskedDigits
+type MaskedDigitsOptions struct {
+	// Length is how many digits to collect
+	Length int
+	// FeedbackTone is played after each digit. Defaults to
+	// DefaultFeedbackTone.
+	FeedbackTone string
+	// Timeout is how long to wait for each digit. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// SecretDigits holds digits a caller entered in confidence, such as a PIN.
+// It prints as one asterisk per digit, with fmt, as JSON and in slog
+// records alike, so it cannot end up in a log by accident; Reveal returns
+// the digits.
+type SecretDigits struct {
+	digits string
+}
+
+// Reveal returns the digits
+func (d SecretDigits) Reveal() string {
+	return d.digits
+}
+
+// Len returns how many digits were entered
+func (d SecretDigits) Len() int {
+	return len(d.digits)
+}
+
+// String returns an asterisk per digit
+func (d SecretDigits) String() string {
+	return strings.Repeat("*", len(d.digits))
+}
+
+// GoString returns the masked digits for %#v
+func (d SecretDigits) GoString() string {
+	return fmt.Sprintf("agi.SecretDigits(%q)", d.String())
+}
+
+// MarshalText implements encoding.TextMarshaler with the masked digits
+func (d SecretDigits) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// CollectMaskedDigits collects Length digits one at a time with
+// WaitForDigit, playing the feedback tone after each so the caller hears
+// that a key was taken, which GET DATA cannot do. A key pressed during the
+// tone is kept as the next digit. It returns fewer digits when the caller
+// stops typing for Timeout.
+//
+// The exchanges it sends are marked Exchange.Sensitive, so their responses
+// are masked in RecentExchanges, transcripts and debug output whatever the
+// session's exchange redactor does.
+func (s *AgiSession) CollectMaskedDigits(ctx context.Context, opts MaskedDigitsOptions) (SecretDigits, error) {
+	if opts.Length <= 0 {
+		return SecretDigits{}, fmt.Errorf("invalid length %d: must be positive", opts.Length)
+	}
+	if opts.FeedbackTone == "" {
+		opts.FeedbackTone = DefaultFeedbackTone
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	s.sensitive.Add(1)
+	defer s.sensitive.Add(-1)
+
+	var buf strings.Builder
+	var next string
+	for buf.Len() < opts.Length {
+		if err := ctx.Err(); err != nil {
+			return SecretDigits{buf.String()}, err
+		}
+		digit := next
+		if digit == "" {
+			var err error
+			if digit, err = s.WaitForDigit(int(opts.Timeout.Milliseconds())); err != nil {
+				return SecretDigits{buf.String()}, err
+			}
+			if digit == "" {
+				return SecretDigits{buf.String()}, nil
+			}
+		}
+		buf.WriteString(digit)
+
+		var err error
+		if next, err = s.streamFile(opts.FeedbackTone, getDataEscapeDigits); err != nil {
+			return SecretDigits{buf.String()}, err
+		}
+	}
+	return SecretDigits{buf.String()}, nil
+}
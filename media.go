@@ -0,0 +1,107 @@
+package agi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mediaVars names the dialplan functions and variables that control media
+// handling for one channel technology
+type mediaVars struct {
+	// directMedia allows or prevents the channel's media bypassing Asterisk
+	// once bridged
+	directMedia string
+	// codec restricts the codecs offered on calls the channel places
+	codec string
+}
+
+// channelMediaVars lists the technologies media control is available for.
+// chan_sip reads its directmedia setting through CHANNEL and its codec
+// through SIP_CODEC; PJSIP uses its own direct_media flag and
+// PJSIP_MEDIA_OFFER.
+var channelMediaVars = map[string]mediaVars{
+	"PJSIP": {directMedia: "CHANNEL(direct_media)", codec: "PJSIP_MEDIA_OFFER(audio)"},
+	"SIP":   {directMedia: "CHANNEL(directmedia)", codec: "SIP_CODEC"},
+}
+
+// mediaVarsFor returns the media variables for the session's channel, or
+// ErrUnsupportedChannelTech
+func (s *AgiSession) mediaVarsFor() (mediaVars, error) {
+	tech := s.ChannelTech()
+	vars, ok := channelMediaVars[strings.ToUpper(tech)]
+	if !ok {
+		return mediaVars{}, fmt.Errorf("%w: %q", ErrUnsupportedChannelTech, tech)
+	}
+	return vars, nil
+}
+
+// SetDirectMedia allows or prevents the channel's media flowing directly
+// between endpoints once bridged. Disabling it before Dial or Bridge keeps
+// the media path through Asterisk, as recording, DTMF detection and
+// transcoding require. ErrUnsupportedChannelTech is returned for channels
+// other than PJSIP and SIP.
+func (s *AgiSession) SetDirectMedia(enabled bool) error {
+	vars, err := s.mediaVarsFor()
+	if err != nil {
+		return err
+	}
+	value := "no"
+	if enabled {
+		value = "yes"
+	}
+	return s.SetVariable(vars.directMedia, value)
+}
+
+// DirectMedia reads the channel's direct media setting. set is false when
+// nothing has overridden the endpoint's configuration.
+func (s *AgiSession) DirectMedia() (enabled, set bool, err error) {
+	vars, err := s.mediaVarsFor()
+	if err != nil {
+		return false, false, err
+	}
+	value, err := s.GetVariable(vars.directMedia)
+	if err != nil || value == "" {
+		return false, false, err
+	}
+	switch strings.ToLower(value) {
+	case "no", "false", "0", "off":
+		return false, true, nil
+	default:
+		return true, true, nil
+	}
+}
+
+// ForceCodec restricts the codecs offered on calls the channel places, such
+// as "ulaw" or "g722,ulaw", so it is set before Dial. ErrUnsupportedChannelTech
+// is returned for channels other than PJSIP and SIP.
+func (s *AgiSession) ForceCodec(codec string) error {
+	if codec == "" {
+		return fmt.Errorf("force codec: codec must not be empty")
+	}
+	for _, c := range codec {
+		if !isCodecChar(c) {
+			return fmt.Errorf("force codec: invalid character %q in %q", c, codec)
+		}
+	}
+	vars, err := s.mediaVarsFor()
+	if err != nil {
+		return err
+	}
+	return s.SetVariable(vars.codec, codec)
+}
+
+// ForcedCodec reads the codecs set with ForceCodec, which is empty when none
+// have been forced
+func (s *AgiSession) ForcedCodec() (string, error) {
+	vars, err := s.mediaVarsFor()
+	if err != nil {
+		return "", err
+	}
+	return s.GetVariable(vars.codec)
+}
+
+// isCodecChar reports whether c may appear in a codec list such as "!all,ulaw"
+func isCodecChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '_' || c == ',' || c == '!'
+}
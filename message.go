@@ -0,0 +1,88 @@
+package agi
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxMessageLength is the longest message body SendMessage accepts, in
+// bytes of UTF-8. Longer bodies would not fit in one AGI command, and SIP
+// MESSAGE requests that large risk fragmentation over UDP.
+const MaxMessageLength = 1000
+
+// MessageStatus is the outcome reported in MESSAGE_SEND_STATUS
+type MessageStatus string
+
+const (
+	MessageSuccess         MessageStatus = "SUCCESS"
+	MessageFailure         MessageStatus = "FAILURE"
+	MessageInvalidProtocol MessageStatus = "INVALID_PROTOCOL"
+	MessageInvalidURI      MessageStatus = "INVALID_URI"
+	MessageUnknown         MessageStatus = "UNKNOWN"
+)
+
+// SendMessage sends body as a text message to to, such as
+// "pjsip:100@pbx", from from, which may be empty, with the MessageSend
+// application, and reports MESSAGE_SEND_STATUS. The body must be valid
+// UTF-8 of at most MaxMessageLength bytes. Quotes and backslashes are
+// escaped; a body with line breaks or other control characters, which an
+// AGI command cannot carry, is sent base64-encoded and decoded by
+// BASE64_DECODE on the Asterisk side.
+func (s *AgiSession) SendMessage(to, from, body string) (MessageStatus, error) {
+	switch {
+	case to == "":
+		return "", fmt.Errorf("send message: destination must not be empty")
+	case !utf8.ValidString(body):
+		return "", fmt.Errorf("send message: body is not valid UTF-8")
+	case len(body) > MaxMessageLength:
+		return "", fmt.Errorf("send message: body of %d bytes exceeds %d", len(body), MaxMessageLength)
+	}
+
+	if err := s.setMessageBody(body); err != nil {
+		return "", err
+	}
+	args := appArgEscaper.Replace(to)
+	if from != "" {
+		args += "," + appArgEscaper.Replace(from)
+	}
+	if _, err := s.execute(fmt.Sprintf("EXEC MessageSend \"%s\"", EscapeString(args))); err != nil {
+		return "", err
+	}
+
+	status, err := s.GetVariable("MESSAGE_SEND_STATUS")
+	if err != nil {
+		return "", err
+	}
+	return parseMessageStatus(status), nil
+}
+
+// setMessageBody writes MESSAGE(body). SET VARIABLE takes the value
+// literally, so a body with control characters is set instead by having
+// GET FULL VARIABLE evaluate SET with the decoded body, wrapped in LEN so
+// the response does not carry the line breaks back.
+func (s *AgiSession) setMessageBody(body string) error {
+	if !strings.ContainsFunc(body, isControl) {
+		_, err := s.execute(fmt.Sprintf("SET VARIABLE MESSAGE(body) \"%s\"", EscapeString(body)))
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	_, err := s.execute(fmt.Sprintf("GET FULL VARIABLE \"${LEN(${SET(MESSAGE(body)=${BASE64_DECODE(%s)})})}\"", encoded))
+	return err
+}
+
+// isControl reports whether r is an ASCII control character
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// parseMessageStatus maps a MESSAGE_SEND_STATUS value to its constant
+func parseMessageStatus(status string) MessageStatus {
+	switch s := MessageStatus(status); s {
+	case MessageSuccess, MessageFailure, MessageInvalidProtocol, MessageInvalidURI:
+		return s
+	default:
+		return MessageUnknown
+	}
+}
@@ -0,0 +1,38 @@
+package agi
+
+// PromptMetrics receives a report each time a prompt finishes playing, for
+// measuring how far into prompts callers barge in. Reports come from
+// StreamFile, GetOption and the helpers built on them, whenever Asterisk
+// returns the playback end position.
+type PromptMetrics interface {
+	// OnPromptComplete is called with the file played, the offset in
+	// samples where playback stopped, whether a digit ended it and that
+	// digit. For GetOption a digit pressed after playback also counts as an
+	// interruption, at the end of the file.
+	OnPromptComplete(file string, endposSamples int64, interrupted bool, digit string)
+}
+
+// SetPromptMetrics sets the hook that receives prompt playback reports.
+// A nil m disables reporting.
+func (s *AgiSession) SetPromptMetrics(m PromptMetrics) {
+	s.promptMetrics = m
+}
+
+// WithPromptMetrics sets the PromptMetrics hook of every session
+func WithPromptMetrics(m PromptMetrics) ServerOption {
+	return func(s *FastAGIServer) {
+		s.promptMetrics = m
+	}
+}
+
+// reportPrompt passes the outcome of playing file to the prompt metrics hook
+func (s *AgiSession) reportPrompt(file string, resp *AgiResponse) {
+	if s.promptMetrics == nil || !resp.HasEndPos {
+		return
+	}
+	var digit string
+	if resp.Result > 0 {
+		digit = string(rune(resp.Result))
+	}
+	s.promptMetrics.OnPromptComplete(file, int64(resp.EndPos), digit != "", digit)
+}
@@ -2,6 +2,8 @@ package agi
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 )
 
@@ -16,11 +18,22 @@ type MRCPRecog struct {
 
 // MRCPSynth represents an MRCP synthesis request
 type MRCPSynth struct {
-	Text      string
+	// Text is the plain text or SSML to speak. Line breaks are sent as spaces
+	// since an AGI command is a single line.
+	Text string
+	// Params are engine options sent in order, before any Options
+	Params []SpeechParam
+	// Options are engine options sent sorted by name
 	Options   map[string]string
 	ResultVar string
 }
 
+// SpeechParam is one name=value option of a speech request
+type SpeechParam struct {
+	Name  string
+	Value string
+}
+
 // SpeechCreate creates a speech object
 func (s *AgiSession) SpeechCreate() error {
 	_, err := s.execute("SPEECH CREATE")
@@ -99,26 +112,44 @@ func (s *AgiSession) SpeechSet(name, value string) error {
 	return err
 }
 
-// SpeechSpeak performs speech synthesis
+// ssmlLineBreaks flattens multi-line SSML onto the command line
+var ssmlLineBreaks = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// SpeechSpeak performs speech synthesis. The text is double-quoted with
+// embedded quotes escaped, so SSML may use either quote style.
 func (s *AgiSession) SpeechSpeak(synth *MRCPSynth) error {
 	if synth == nil {
 		return fmt.Errorf("synthesis request cannot be nil")
 	}
+	if strings.TrimSpace(synth.Text) == "" {
+		return fmt.Errorf("synthesis text cannot be empty")
+	}
+
+	params := slices.Clone(synth.Params)
+	for _, name := range slices.Sorted(maps.Keys(synth.Options)) {
+		params = append(params, SpeechParam{Name: name, Value: synth.Options[name]})
+	}
 
 	cmd := strings.Builder{}
 	cmd.WriteString("SPEECH SYNTHESIZE ")
-	cmd.WriteString(fmt.Sprintf("'%s' ", synth.Text))
+	cmd.WriteString(fmt.Sprintf("\"%s\"", EscapeString(ssmlLineBreaks.Replace(synth.Text))))
 
-	if synth.Options != nil {
-		for k, v := range synth.Options {
-			cmd.WriteString(fmt.Sprintf("%s=%s ", k, v))
+	for _, p := range params {
+		if p.Name == "" || strings.ContainsAny(p.Name, "= \t\"'") {
+			return fmt.Errorf("invalid synthesis option name %q", p.Name)
+		}
+		cmd.WriteString(" " + p.Name + "=")
+		if p.Value == "" || strings.ContainsAny(p.Value, " \t\"'\\") {
+			cmd.WriteString(fmt.Sprintf("\"%s\"", EscapeString(p.Value)))
+		} else {
+			cmd.WriteString(p.Value)
 		}
 	}
 
 	if synth.ResultVar != "" {
-		cmd.WriteString(fmt.Sprintf("'%s'", synth.ResultVar))
+		cmd.WriteString(fmt.Sprintf(" \"%s\"", EscapeString(synth.ResultVar)))
 	}
 
-	_, err := s.execute(strings.TrimSpace(cmd.String()))
+	_, err := s.execute(cmd.String())
 	return err
 }
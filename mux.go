@@ -0,0 +1,326 @@
+package agi
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Mux routes sessions to handlers by the path of the FastAGI URL, so a
+// dialplan AGI(agi://host/tts-menu) call runs the handler registered as
+// "tts-menu". A URL without a path, AGI(agi://host), runs the root route
+// registered as "" or "/". Process AGI sessions route by the script's file
+// name, so AGI(/var/lib/asterisk/agi-bin/tts-menu) runs "tts-menu" too.
+// Pass Handler() to NewFastAGIServer.
+type Mux struct {
+	mu       sync.RWMutex
+	routes   map[string]*route
+	notFound Handler
+}
+
+// route is one registered handler and its concurrency gate
+type route struct {
+	handler     Handler
+	limit       *routeLimit
+	errorPolicy *ErrorPolicy
+	autoAnswer  *bool
+
+	served atomic.Int64
+}
+
+// RouteOption configures a route registered with Mux.Handle
+type RouteOption func(*route)
+
+// NewMux returns an empty Mux
+func NewMux() *Mux {
+	return &Mux{routes: make(map[string]*route)}
+}
+
+// Handle registers h for the route name, replacing any handler registered
+// before. Leading and trailing slashes in name are ignored.
+func (m *Mux) Handle(name string, h Handler, opts ...RouteOption) {
+	r := &route{handler: h}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes[strings.Trim(name, "/")] = r
+}
+
+// HandleFunc registers fn for the route name
+func (m *Mux) HandleFunc(name string, fn func(ctx context.Context, s *AgiSession) error, opts ...RouteOption) {
+	m.Handle(name, HandlerFunc(fn), opts...)
+}
+
+// NotFound sets the handler for requests matching no route. By default they
+// fail with ErrRouteNotFound.
+func (m *Mux) NotFound(h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notFound = h
+}
+
+// Handler returns the Handler serving the mux's routes. A server built with
+// it reports each route's counters in ServerStats.Routes.
+func (m *Mux) Handler() Handler {
+	return muxHandler{m}
+}
+
+// muxHandler adapts a Mux to Handler, whose method name Mux.Handle takes
+type muxHandler struct {
+	mux *Mux
+}
+
+// Handle runs the route for the session's request
+func (h muxHandler) Handle(ctx context.Context, s *AgiSession) error {
+	return h.mux.serve(ctx, s)
+}
+
+// serve runs the route for the session's request
+func (m *Mux) serve(ctx context.Context, s *AgiSession) error {
+	name := RouteName(s.env)
+
+	m.mu.RLock()
+	r, ok := m.routes[name]
+	notFound := m.notFound
+	m.mu.RUnlock()
+
+	if !ok {
+		if notFound != nil {
+			return notFound.Handle(ctx, s)
+		}
+		if name == "" {
+			return fmt.Errorf("%w: the request has no path and no root route is registered", ErrRouteNotFound)
+		}
+		return fmt.Errorf("%w: %q", ErrRouteNotFound, name)
+	}
+	if r.errorPolicy != nil {
+		s.errorPolicy = *r.errorPolicy
+	}
+	if r.limit == nil {
+		r.served.Add(1)
+		return r.handler.Handle(ctx, s)
+	}
+	return r.limit.run(ctx, s, name, r)
+}
+
+// autoAnswer returns the WithRouteAutoAnswer setting of the route the
+// session's environment asks for, ok false when the route has none
+func (m *Mux) autoAnswer(env map[string]string) (enabled, ok bool) {
+	m.mu.RLock()
+	r, found := m.routes[RouteName(env)]
+	m.mu.RUnlock()
+	if !found || r.autoAnswer == nil {
+		return false, false
+	}
+	return *r.autoAnswer, true
+}
+
+// RouteName returns the route a session's environment asks for: the path of
+// agi_network_script, or of the agi_request URL, without slashes or query.
+// It is "" for a FastAGI URL without a path. For process AGI, which has no
+// agi_network, it is the file name of the script in agi_request.
+func RouteName(env map[string]string) string {
+	script := env["agi_network_script"]
+	if script == "" {
+		if u, err := url.Parse(env["agi_request"]); err == nil {
+			script = u.Path
+			if env["agi_network"] != "yes" && u.Host == "" && script != "" {
+				script = path.Base(script)
+			}
+		}
+	}
+	script, _, _ = strings.Cut(script, "?")
+	return strings.Trim(script, "/")
+}
+
+// RequestURL returns agi_request parsed as a URL. A FastAGI request without
+// a path, such as agi://pbx:4573, has an empty Path; a process AGI request
+// is the script's file path.
+func (s *AgiSession) RequestURL() (*url.URL, error) {
+	return url.Parse(s.env["agi_request"])
+}
+
+// rootRequest reports whether env is a FastAGI request without a path
+func rootRequest(env map[string]string) bool {
+	return env["agi_network"] == "yes" && RouteName(env) == ""
+}
+
+// RouteStats is a snapshot of one route's counters
+type RouteStats struct {
+	// Served counts sessions the route's handler ran for
+	Served int64
+	// Limit is the WithRouteConcurrency limit, zero when unlimited
+	Limit int
+	// Active is how many sessions hold a slot, Waiting how many are waiting
+	// for one
+	Active  int
+	Waiting int
+	// Busy counts sessions turned away at the limit, and Fallbacks those of
+	// them passed to the fallback handler
+	Busy      int64
+	Fallbacks int64
+}
+
+// validate reports routes that could never serve a call
+func (m *Mux) validate() []error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var errs []error
+	if len(m.routes) == 0 && m.notFound == nil {
+		errs = append(errs, fmt.Errorf("%w: mux has no routes and no NotFound handler", ErrNoRoutes))
+	}
+	for _, name := range slices.Sorted(maps.Keys(m.routes)) {
+		r := m.routes[name]
+		if r.handler == nil {
+			errs = append(errs, fmt.Errorf("%w: route %q", ErrNilHandler, name))
+		}
+		if r.limit != nil && r.limit.limit < 1 {
+			errs = append(errs, fmt.Errorf("%w: route %q: WithRouteConcurrency(%d) must be at least 1", ErrInvalidLimit, name, r.limit.limit))
+		}
+	}
+	return errs
+}
+
+// stats returns a snapshot of every route's counters
+func (m *Mux) stats() map[string]RouteStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := make(map[string]RouteStats, len(m.routes))
+	for name, r := range m.routes {
+		rs := RouteStats{Served: r.served.Load()}
+		if l := r.limit; l != nil {
+			rs.Limit = cap(l.slots)
+			rs.Active = len(l.slots)
+			rs.Waiting = int(l.waiting.Load())
+			rs.Busy = l.busy.Load()
+			rs.Fallbacks = l.fallbacks.Load()
+		}
+		stats[name] = rs
+	}
+	return stats
+}
+
+// LimitOption sets what happens to sessions over a route's concurrency limit
+type LimitOption func(*routeLimit)
+
+// routeLimit gates a route to a fixed number of concurrent sessions
+type routeLimit struct {
+	limit    int
+	slots    chan struct{}
+	wait     time.Duration
+	prompt   string
+	fallback Handler
+
+	waiting   atomic.Int32
+	busy      atomic.Int64
+	fallbacks atomic.Int64
+}
+
+// WithRouteConcurrency limits the route to limit concurrent sessions, for
+// handlers that use scarce resources such as TTS channels. Sessions over the
+// limit are handled as the LimitOptions say: by default they are hung up at
+// once and the route returns ErrRouteBusy.
+func WithRouteConcurrency(limit int, opts ...LimitOption) RouteOption {
+	return func(r *route) {
+		l := &routeLimit{limit: limit, slots: make(chan struct{}, max(limit, 1))}
+		for _, opt := range opts {
+			opt(l)
+		}
+		r.limit = l
+	}
+}
+
+// OnLimitWait makes sessions over the limit wait up to d for a slot before
+// being turned away
+func OnLimitWait(d time.Duration) LimitOption {
+	return func(l *routeLimit) {
+		l.wait = d
+	}
+}
+
+// OnLimitBusyPrompt plays prompt to sessions turned away at the limit before
+// hanging up, after which the route returns nil
+func OnLimitBusyPrompt(prompt string) LimitOption {
+	return func(l *routeLimit) {
+		l.prompt = prompt
+	}
+}
+
+// OnLimitFallback passes sessions turned away at the limit to h, such as a
+// simpler menu without TTS. It takes precedence over OnLimitBusyPrompt.
+func OnLimitFallback(h Handler) LimitOption {
+	return func(l *routeLimit) {
+		l.fallback = h
+	}
+}
+
+// run runs the route's handler once a slot is free, or turns the session
+// away
+func (l *routeLimit) run(ctx context.Context, s *AgiSession, name string, r *route) error {
+	if !l.acquire(ctx, s.clock()) {
+		return l.turnAway(ctx, s, name)
+	}
+	defer func() { <-l.slots }()
+
+	r.served.Add(1)
+	return r.handler.Handle(ctx, s)
+}
+
+// acquire takes a slot, waiting up to the configured time on clock for one
+func (l *routeLimit) acquire(ctx context.Context, clock Clock) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+	timer := clock.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C():
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// turnAway handles a session the route has no slot for
+func (l *routeLimit) turnAway(ctx context.Context, s *AgiSession, name string) error {
+	l.busy.Add(1)
+	if l.fallback != nil {
+		l.fallbacks.Add(1)
+		return l.fallback.Handle(ctx, s)
+	}
+
+	if l.prompt != "" {
+		if err := s.StreamFile(l.prompt, ""); err != nil {
+			return err
+		}
+	}
+	if err := s.Hangup(); err != nil {
+		return err
+	}
+	if l.prompt != "" {
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrRouteBusy, name)
+}
@@ -0,0 +1,254 @@
+// Package notify handles outbound notification calls, such as appointment
+// reminders, originated into a FastAGI context: it tells a person from an
+// answering machine, plays the right message, asks the person to confirm and
+// reports the outcome.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// Status is the final outcome of a notification call
+type Status int
+
+const (
+	// Failed means the call could not be completed, for example because the
+	// message could not be resolved or a prompt was missing
+	Failed Status = iota
+	// Confirmed means a person heard the message and pressed the confirm digit
+	Confirmed
+	// PlayedToMachine means the message was left on an answering machine
+	PlayedToMachine
+	// NoInput means a person heard the message but did not confirm
+	NoInput
+	// Hangup means the callee hung up before the flow finished
+	Hangup
+)
+
+// String returns the status name
+func (s Status) String() string {
+	switch s {
+	case Confirmed:
+		return "Confirmed"
+	case PlayedToMachine:
+		return "PlayedToMachine"
+	case NoInput:
+		return "NoInput"
+	case Hangup:
+		return "Hangup"
+	default:
+		return "Failed"
+	}
+}
+
+// Message is what to play on one call
+type Message struct {
+	// ID identifies the notification, such as an appointment number, and is
+	// passed back in the Outcome
+	ID string
+	// Prompts are played to a person, before asking for confirmation
+	Prompts []string
+	// MachinePrompts are left on an answering machine. Prompts are used when
+	// it is empty.
+	MachinePrompts []string
+}
+
+// Resolver returns the message for a call, typically looked up by
+// agi_uniqueid or by an ID passed as an AGI argument
+type Resolver func(ctx context.Context, s *agi.AgiSession) (Message, error)
+
+// AMDOptions are the AMD application settings. Zero values use the defaults
+// from amd.conf.
+type AMDOptions struct {
+	// Skip treats every callee as a person without running AMD
+	Skip                 bool
+	InitialSilence       time.Duration
+	Greeting             time.Duration
+	AfterGreetingSilence time.Duration
+	TotalAnalysisTime    time.Duration
+}
+
+// args returns the AMD arguments, leaving unset ones empty
+func (o AMDOptions) args() []string {
+	durations := []time.Duration{o.InitialSilence, o.Greeting, o.AfterGreetingSilence, o.TotalAnalysisTime}
+	args := make([]string, len(durations))
+	last := -1
+	for i, d := range durations {
+		if d > 0 {
+			args[i] = strconv.FormatInt(d.Milliseconds(), 10)
+			last = i
+		}
+	}
+	return args[:last+1]
+}
+
+// Prompts are the prompts played around the message
+type Prompts struct {
+	// Confirm asks a person to confirm, such as "press 1 to confirm"
+	Confirm string
+	// ConfirmDigit is the key that confirms, "1" when empty
+	ConfirmDigit string
+	// Timeout is how long to wait for the confirm digit, 5 seconds when zero
+	Timeout time.Duration
+	// Retries is how many more times Confirm is played without an answer
+	Retries int
+	// Confirmed is played once the person confirms
+	Confirmed string
+	// NoInput is played when the person never confirms
+	NoInput string
+	// Goodbye is played at the end of every call a person answered
+	Goodbye string
+}
+
+// Outcome describes how a notification call ended
+type Outcome struct {
+	Status   Status
+	UniqueID string
+	// MessageID is the resolved Message.ID
+	MessageID string
+	// AMDStatus and AMDCause are the AMD results, empty when AMD was skipped
+	AMDStatus string
+	AMDCause  string
+	// Err is the error behind Failed and Hangup outcomes
+	Err error
+}
+
+// NotificationHandler returns a handler that plays the message resolve
+// returns for each call. It runs AMD with amd, leaves the message on answering
+// machines and asks people to confirm with prompts. onOutcome is called
+// exactly once per call with the final status, even when the callee hangs up
+// or the handler panics, with a context that is not cancelled with the call
+// so the outcome can still be stored.
+func NotificationHandler(resolve Resolver, amd AMDOptions, prompts Prompts, onOutcome func(ctx context.Context, o Outcome)) agi.Handler {
+	if prompts.ConfirmDigit == "" {
+		prompts.ConfirmDigit = "1"
+	}
+	if prompts.Timeout <= 0 {
+		prompts.Timeout = 5 * time.Second
+	}
+
+	return agi.HandlerFunc(func(ctx context.Context, s *agi.AgiSession) (err error) {
+		outcome := Outcome{Status: Failed, UniqueID: s.GetEnv("agi_uniqueid")}
+		defer func() {
+			r := recover()
+			if r != nil {
+				outcome.Status = Failed
+				outcome.Err = fmt.Errorf("notify: panic: %v", r)
+			}
+			if onOutcome != nil {
+				onOutcome(context.WithoutCancel(ctx), outcome)
+			}
+			if r != nil {
+				panic(r)
+			}
+		}()
+
+		outcome.Status, err = notify(ctx, s, resolve, amd, prompts, &outcome)
+		if err != nil {
+			outcome.Status = Failed
+			if errors.Is(err, agi.ErrHangup) || s.HungUp() {
+				outcome.Status = Hangup
+			}
+			outcome.Err = err
+		}
+		return err
+	})
+}
+
+// notify runs one notification call and returns its status
+func notify(ctx context.Context, s *agi.AgiSession, resolve Resolver, amd AMDOptions, prompts Prompts, outcome *Outcome) (Status, error) {
+	msg, err := resolve(ctx, s)
+	if err != nil {
+		return Failed, fmt.Errorf("notify: resolve message: %w", err)
+	}
+	outcome.MessageID = msg.ID
+	if len(msg.Prompts) == 0 {
+		return Failed, fmt.Errorf("notify: message %q: %w", msg.ID, agi.ErrNoPrompts)
+	}
+
+	if !amd.Skip {
+		if err := s.Execute("AMD", amd.args()...); err != nil {
+			return Failed, err
+		}
+		if outcome.AMDStatus, err = s.GetVariable("AMDSTATUS"); err != nil {
+			return Failed, err
+		}
+		if outcome.AMDCause, err = s.GetVariable("AMDCAUSE"); err != nil {
+			return Failed, err
+		}
+		switch outcome.AMDStatus {
+		case "HANGUP":
+			return Hangup, nil
+		case "MACHINE":
+			machine := msg.MachinePrompts
+			if len(machine) == 0 {
+				machine = msg.Prompts
+			}
+			if err := play(s, machine...); err != nil {
+				return Failed, err
+			}
+			return PlayedToMachine, nil
+		}
+	}
+
+	if err := play(s, msg.Prompts...); err != nil {
+		return Failed, err
+	}
+	status, err := confirm(ctx, s, prompts)
+	if err != nil {
+		return Failed, err
+	}
+
+	// The outcome is settled, so hanging up during the closing prompts does
+	// not change it
+	closing := prompts.NoInput
+	if status == Confirmed {
+		closing = prompts.Confirmed
+	}
+	if err := play(s, closing, prompts.Goodbye); err != nil && !errors.Is(err, agi.ErrHangup) {
+		return Failed, err
+	}
+	return status, nil
+}
+
+// confirm asks the person to press the confirm digit
+func confirm(ctx context.Context, s *agi.AgiSession, prompts Prompts) (Status, error) {
+	if prompts.Confirm == "" {
+		return NoInput, nil
+	}
+	for attempt := 0; attempt <= prompts.Retries; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return Failed, err
+		}
+		digit, err := s.GetOption(prompts.Confirm, prompts.ConfirmDigit, prompts.Timeout)
+		if err != nil {
+			return Failed, err
+		}
+		if digit == prompts.ConfirmDigit {
+			return Confirmed, nil
+		}
+		if s.HungUp() {
+			return Failed, agi.ErrHangup
+		}
+	}
+	return NoInput, nil
+}
+
+// play streams each non-empty file in turn without escape digits
+func play(s *agi.AgiSession, files ...string) error {
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if err := s.StreamFile(file, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agitest"
+)
+
+var reminder = Message{
+	ID:             "appt-42",
+	Prompts:        []string{"reminder-intro", "reminder-details"},
+	MachinePrompts: []string{"reminder-voicemail"},
+}
+
+var prompts = Prompts{
+	Confirm:   "press-1-to-confirm",
+	Retries:   1,
+	Confirmed: "thank-you-confirmed",
+	NoInput:   "we-will-call-again",
+	Goodbye:   "goodbye",
+}
+
+// runNotification runs the handler against a fake answering with responses
+// and returns the outcomes reported, the handler error and the commands sent
+func runNotification(t *testing.T, resolve Resolver, amd AMDOptions, responses ...string) ([]Outcome, error, []string) {
+	t.Helper()
+	var outcomes []Outcome
+	handler := NotificationHandler(resolve, amd, prompts, func(ctx context.Context, o Outcome) {
+		outcomes = append(outcomes, o)
+	})
+
+	fake := agitest.NewFake(responses)
+	session, err := fake.Session(context.Background())
+	require.NoError(t, err)
+	defer fake.Close()
+
+	err = handler.Handle(context.Background(), session)
+	return outcomes, err, fake.Commands()
+}
+
+func resolveReminder(context.Context, *agi.AgiSession) (Message, error) {
+	return reminder, nil
+}
+
+func TestNotificationHandler(t *testing.T) {
+	amd := AMDOptions{InitialSilence: 2500 * time.Millisecond, Greeting: 1500 * time.Millisecond}
+
+	t.Run("person confirms", func(t *testing.T) {
+		outcomes, err, commands := runNotification(t, resolveReminder, amd,
+			"200 result=0",                 // AMD
+			"200 result=1 (HUMAN)",         // AMDSTATUS
+			"200 result=1 (HUMAN-500-500)", // AMDCAUSE
+			"200 result=0 endpos=8000",     // reminder-intro
+			"200 result=0 endpos=8000",     // reminder-details
+			"200 result=49 endpos=2000",    // press-1-to-confirm
+			"200 result=0 endpos=8000",     // thank-you-confirmed
+			"200 result=0 endpos=8000",     // goodbye
+		)
+		require.NoError(t, err)
+		require.Len(t, outcomes, 1)
+		assert.Equal(t, Confirmed, outcomes[0].Status)
+		assert.Equal(t, "appt-42", outcomes[0].MessageID)
+		assert.Equal(t, "1700000000.1", outcomes[0].UniqueID)
+		assert.Equal(t, "HUMAN", outcomes[0].AMDStatus)
+		assert.Equal(t, []string{
+			`EXEC AMD "2500,1500"`,
+			"GET VARIABLE AMDSTATUS",
+			"GET VARIABLE AMDCAUSE",
+			`STREAM FILE reminder-intro ""`,
+			`STREAM FILE reminder-details ""`,
+			`GET OPTION press-1-to-confirm "1" 5000`,
+			`STREAM FILE thank-you-confirmed ""`,
+			`STREAM FILE goodbye ""`,
+		}, commands)
+	})
+
+	t.Run("answering machine", func(t *testing.T) {
+		outcomes, err, commands := runNotification(t, resolveReminder, amd,
+			"200 result=0",
+			"200 result=1 (MACHINE)",
+			"200 result=1 (LONGGREETING-2000-1500)",
+			"200 result=0 endpos=16000",
+		)
+		require.NoError(t, err)
+		require.Len(t, outcomes, 1)
+		assert.Equal(t, PlayedToMachine, outcomes[0].Status)
+		assert.Equal(t, "LONGGREETING-2000-1500", outcomes[0].AMDCause)
+		assert.Equal(t, `STREAM FILE reminder-voicemail ""`, commands[len(commands)-1])
+		assert.NotContains(t, commands, `GET OPTION press-1-to-confirm "1" 5000`)
+	})
+
+	t.Run("no input", func(t *testing.T) {
+		outcomes, err, commands := runNotification(t, resolveReminder, AMDOptions{Skip: true},
+			"200 result=0 endpos=8000",
+			"200 result=0 endpos=8000",
+			"200 result=0 endpos=2000",
+			"200 result=0 endpos=2000",
+			"200 result=0 endpos=8000",
+			"200 result=0 endpos=8000",
+		)
+		require.NoError(t, err)
+		require.Len(t, outcomes, 1)
+		assert.Equal(t, NoInput, outcomes[0].Status)
+		assert.Empty(t, outcomes[0].AMDStatus)
+		assert.Equal(t, `STREAM FILE we-will-call-again ""`, commands[4])
+	})
+
+	t.Run("hangup during message", func(t *testing.T) {
+		outcomes, err, _ := runNotification(t, resolveReminder, AMDOptions{Skip: true},
+			"200 result=0 endpos=8000",
+			"HANGUP\n200 result=-1 endpos=1200",
+		)
+		assert.True(t, errors.Is(err, agi.ErrHangup))
+		require.Len(t, outcomes, 1)
+		assert.Equal(t, Hangup, outcomes[0].Status)
+		assert.True(t, errors.Is(outcomes[0].Err, agi.ErrHangup))
+	})
+
+	t.Run("hangup during analysis", func(t *testing.T) {
+		outcomes, err, _ := runNotification(t, resolveReminder, amd,
+			"200 result=0",
+			"200 result=1 (HANGUP)",
+			"200 result=1 (HANGUP-1500)",
+		)
+		require.NoError(t, err)
+		require.Len(t, outcomes, 1)
+		assert.Equal(t, Hangup, outcomes[0].Status)
+	})
+
+	t.Run("confirmed before hangup", func(t *testing.T) {
+		outcomes, _, _ := runNotification(t, resolveReminder, AMDOptions{Skip: true},
+			"200 result=0 endpos=8000",
+			"200 result=0 endpos=8000",
+			"200 result=49 endpos=2000",
+			"HANGUP\n200 result=-1 endpos=400",
+		)
+		require.Len(t, outcomes, 1)
+		assert.Equal(t, Confirmed, outcomes[0].Status)
+	})
+
+	t.Run("resolver failure", func(t *testing.T) {
+		boom := errors.New("appointment not found")
+		outcomes, err, commands := runNotification(t, func(context.Context, *agi.AgiSession) (Message, error) {
+			return Message{}, boom
+		}, amd)
+		assert.True(t, errors.Is(err, boom))
+		require.Len(t, outcomes, 1)
+		assert.Equal(t, Failed, outcomes[0].Status)
+		assert.Empty(t, commands)
+	})
+
+	t.Run("panic still reports", func(t *testing.T) {
+		var outcomes []Outcome
+		handler := NotificationHandler(func(context.Context, *agi.AgiSession) (Message, error) {
+			panic("resolver bug")
+		}, amd, prompts, func(ctx context.Context, o Outcome) {
+			outcomes = append(outcomes, o)
+		})
+		fake := agitest.NewFake(nil)
+		session, err := fake.Session(context.Background())
+		require.NoError(t, err)
+		defer fake.Close()
+
+		assert.PanicsWithValue(t, "resolver bug", func() {
+			handler.Handle(context.Background(), session)
+		})
+		require.Len(t, outcomes, 1)
+		assert.Equal(t, Failed, outcomes[0].Status)
+		assert.ErrorContains(t, outcomes[0].Err, "resolver bug")
+	})
+}
@@ -0,0 +1,137 @@
+package agi
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OriginateStatus is the outcome reported in ORIGINATE_STATUS
+type OriginateStatus string
+
+const (
+	OriginateSuccess     OriginateStatus = "SUCCESS"
+	OriginateFailed      OriginateStatus = "FAILED"
+	OriginateBusy        OriginateStatus = "BUSY"
+	OriginateCongestion  OriginateStatus = "CONGESTION"
+	OriginateNoAnswer    OriginateStatus = "NOANSWER"
+	OriginateChanUnavail OriginateStatus = "CHANUNAVAIL"
+	OriginateUnknown     OriginateStatus = "UNKNOWN"
+)
+
+// OriginateOptions describes a call started with the Originate application
+type OriginateOptions struct {
+	// TechData is the channel to call, such as "PJSIP/supervisor"
+	TechData string
+	// Type is "exten" to connect the call to Arg1 context, Arg2 extension and
+	// Arg3 priority, or "app" to run application Arg1 with data Arg2
+	Type string
+	Arg1 string
+	Arg2 string
+	Arg3 string
+	// Timeout is how long to wait for an answer, rounded to seconds
+	Timeout time.Duration
+	// CallerID sets the caller ID number of the new call
+	CallerID string
+	// Variables are set on the new channel
+	Variables map[string]string
+	// Async returns as soon as the call is started instead of waiting for it
+	// to be answered
+	Async bool
+}
+
+// OriginateResult is the outcome of Originate
+type OriginateResult struct {
+	Status OriginateStatus
+}
+
+// Originate starts a second call from within the session using the
+// Originate dialplan application and reports ORIGINATE_STATUS
+func (s *AgiSession) Originate(opts OriginateOptions) (OriginateResult, error) {
+	if opts.TechData == "" {
+		return OriginateResult{}, fmt.Errorf("originate: tech data must not be empty")
+	}
+	if opts.Type != "exten" && opts.Type != "app" {
+		return OriginateResult{}, fmt.Errorf("originate: type must be \"exten\" or \"app\", got %q", opts.Type)
+	}
+
+	if _, err := s.execute(fmt.Sprintf("EXEC Originate \"%s\"", EscapeString(originateArgs(opts)))); err != nil {
+		return OriginateResult{}, err
+	}
+
+	status, err := s.GetVariable("ORIGINATE_STATUS")
+	if err != nil {
+		return OriginateResult{}, err
+	}
+	return OriginateResult{Status: parseOriginateStatus(status)}, nil
+}
+
+// appArgEscaper escapes the characters dialplan application argument
+// parsers treat specially: commas, carets and parentheses
+var appArgEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "^", `\^`, "(", `\(`, ")", `\)`)
+
+// originateArgs builds the application arguments for Originate. Commas,
+// carets and parentheses inside values are escaped with a backslash so that
+// the application's argument parser keeps them.
+func originateArgs(opts OriginateOptions) string {
+	escape := appArgEscaper.Replace
+
+	args := []string{
+		escape(opts.TechData),
+		opts.Type,
+		escape(opts.Arg1),
+		escape(opts.Arg2),
+		escape(opts.Arg3),
+	}
+	if opts.Timeout > 0 {
+		args = append(args, strconv.Itoa(int(opts.Timeout.Seconds())))
+	} else {
+		args = append(args, "")
+	}
+
+	var flags strings.Builder
+	if opts.Async {
+		flags.WriteString("a")
+	}
+	if opts.CallerID != "" {
+		fmt.Fprintf(&flags, "c(%s)", escape(opts.CallerID))
+	}
+	if len(opts.Variables) > 0 {
+		names := make([]string, 0, len(opts.Variables))
+		for name := range opts.Variables {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		vars := make([]string, len(names))
+		for i, name := range names {
+			vars[i] = escape(name) + "=" + escape(opts.Variables[name])
+		}
+		fmt.Fprintf(&flags, "v(%s)", strings.Join(vars, "^"))
+	}
+	args = append(args, flags.String())
+
+	return joinAppArgs(args)
+}
+
+// joinAppArgs joins escaped application arguments with commas, leaving out
+// the empty trailing ones. Trimming the joined string instead would also
+// strip the comma of a trailing \, escape.
+func joinAppArgs(args []string) string {
+	for len(args) > 0 && args[len(args)-1] == "" {
+		args = args[:len(args)-1]
+	}
+	return strings.Join(args, ",")
+}
+
+// parseOriginateStatus maps an ORIGINATE_STATUS value to its constant
+func parseOriginateStatus(status string) OriginateStatus {
+	switch s := OriginateStatus(status); s {
+	case OriginateSuccess, OriginateFailed, OriginateBusy, OriginateCongestion, OriginateNoAnswer, OriginateChanUnavail:
+		return s
+	default:
+		return OriginateUnknown
+	}
+}
@@ -0,0 +1,219 @@
+package agi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// unbounded marks a pattern element or Pattern with no maximum length
+const unbounded = -1
+
+// patternElem is one position of a compiled pattern, matching between min
+// and max keys from set
+type patternElem struct {
+	set      string
+	min, max int
+}
+
+// Pattern is a compiled dialplan-style digit pattern. The zero value is not
+// usable; create patterns with CompilePattern.
+type Pattern struct {
+	source string
+	elems  []patternElem
+	minLen int
+	maxLen int
+}
+
+// CompilePattern parses a digit pattern in the notation of Asterisk
+// extension patterns, with an optional leading underscore:
+//
+//	N       any digit 2-9
+//	X       any digit 0-9
+//	Z       any digit 1-9
+//	[15-7]  any listed digit or range
+//	.       one or more of any key
+//	!       zero or more of any key
+//	{m,n}   the preceding element repeated m to n times; {m} exactly m times
+//
+// Digits, * and # match themselves, so "1NXXNXXXXXX" matches a NANP number
+// with its leading 1 and "X{4,6}" matches four to six digits. Errors wrap
+// ErrInvalidPattern.
+func CompilePattern(pattern string) (*Pattern, error) {
+	p := &Pattern{source: pattern}
+	src := strings.TrimPrefix(pattern, "_")
+	if src == "" {
+		return nil, fmt.Errorf("%w: empty pattern", ErrInvalidPattern)
+	}
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == 'N' || c == 'n':
+			p.elems = append(p.elems, patternElem{set: "23456789", min: 1, max: 1})
+		case c == 'X' || c == 'x':
+			p.elems = append(p.elems, patternElem{set: "0123456789", min: 1, max: 1})
+		case c == 'Z' || c == 'z':
+			p.elems = append(p.elems, patternElem{set: "123456789", min: 1, max: 1})
+		case c == '.':
+			p.elems = append(p.elems, patternElem{set: "0123456789*#", min: 1, max: unbounded})
+		case c == '!':
+			p.elems = append(p.elems, patternElem{set: "0123456789*#", min: 0, max: unbounded})
+		case c == '[':
+			end := strings.IndexByte(src[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: %q: unterminated [ at %d", ErrInvalidPattern, pattern, i)
+			}
+			set, err := parseCharSet(src[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q: %v", ErrInvalidPattern, pattern, err)
+			}
+			p.elems = append(p.elems, patternElem{set: set, min: 1, max: 1})
+			i += end
+		case c == '{':
+			end := strings.IndexByte(src[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: %q: unterminated { at %d", ErrInvalidPattern, pattern, i)
+			}
+			if len(p.elems) == 0 {
+				return nil, fmt.Errorf("%w: %q: repetition at %d has nothing to repeat", ErrInvalidPattern, pattern, i)
+			}
+			last := &p.elems[len(p.elems)-1]
+			if last.min != 1 || last.max != 1 {
+				return nil, fmt.Errorf("%w: %q: repetition at %d follows a wildcard or repetition", ErrInvalidPattern, pattern, i)
+			}
+			least, most, err := parseRepeat(src[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q: %v", ErrInvalidPattern, pattern, err)
+			}
+			last.min, last.max = least, most
+			i += end
+		case isKey(c):
+			p.elems = append(p.elems, patternElem{set: string(c), min: 1, max: 1})
+		default:
+			return nil, fmt.Errorf("%w: %q: unexpected %q at %d", ErrInvalidPattern, pattern, c, i)
+		}
+	}
+
+	for _, e := range p.elems {
+		p.minLen += e.min
+		if e.max == unbounded || p.maxLen == unbounded {
+			p.maxLen = unbounded
+			continue
+		}
+		p.maxLen += e.max
+	}
+	return p, nil
+}
+
+// MustCompilePattern is like CompilePattern but panics on an invalid
+// pattern, for patterns held in package-level variables
+func MustCompilePattern(pattern string) *Pattern {
+	p, err := CompilePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// MatchPattern reports whether digits match pattern; see CompilePattern for
+// the notation. An invalid pattern matches nothing.
+func MatchPattern(pattern, digits string) bool {
+	p, err := CompilePattern(pattern)
+	if err != nil {
+		return false
+	}
+	return p.Match(digits)
+}
+
+// Match reports whether the whole of digits matches the pattern
+func (p *Pattern) Match(digits string) bool {
+	if len(digits) < p.minLen || (p.maxLen != unbounded && len(digits) > p.maxLen) {
+		return false
+	}
+	return matchElems(p.elems, digits)
+}
+
+// String returns the pattern as it was given to CompilePattern
+func (p *Pattern) String() string {
+	return p.source
+}
+
+// matchElems matches digits against elems, trying each allowed repeat count
+// of the first element in turn. Patterns are short, so backtracking is cheap.
+func matchElems(elems []patternElem, digits string) bool {
+	if len(elems) == 0 {
+		return digits == ""
+	}
+	e := elems[0]
+	most := e.max
+	if most == unbounded || most > len(digits) {
+		most = len(digits)
+	}
+
+	n := 0
+	for n < e.min {
+		if n >= len(digits) || !strings.ContainsRune(e.set, rune(digits[n])) {
+			return false
+		}
+		n++
+	}
+	for {
+		if matchElems(elems[1:], digits[n:]) {
+			return true
+		}
+		if n >= most || !strings.ContainsRune(e.set, rune(digits[n])) {
+			return false
+		}
+		n++
+	}
+}
+
+// parseCharSet expands the contents of a [...] element, such as "15-7"
+func parseCharSet(spec string) (string, error) {
+	if spec == "" {
+		return "", fmt.Errorf("empty []")
+	}
+	var set strings.Builder
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		if !isKey(c) {
+			return "", fmt.Errorf("unexpected %q in []", c)
+		}
+		if i+2 < len(spec) && spec[i+1] == '-' {
+			hi := spec[i+2]
+			if c < '0' || c > '9' || hi < c || hi > '9' {
+				return "", fmt.Errorf("invalid range %c-%c", c, hi)
+			}
+			for d := c; d <= hi; d++ {
+				set.WriteByte(d)
+			}
+			i += 2
+			continue
+		}
+		set.WriteByte(c)
+	}
+	return set.String(), nil
+}
+
+// parseRepeat parses the contents of a {m,n} or {m} repetition
+func parseRepeat(spec string) (int, int, error) {
+	lo, hi, ranged := strings.Cut(spec, ",")
+	least, err := strconv.Atoi(lo)
+	if err != nil || least < 0 {
+		return 0, 0, fmt.Errorf("invalid repetition {%s}", spec)
+	}
+	if !ranged {
+		hi = lo
+	}
+	most, err := strconv.Atoi(hi)
+	if err != nil || most < least || most == 0 {
+		return 0, 0, fmt.Errorf("invalid repetition {%s}", spec)
+	}
+	return least, most, nil
+}
+
+// isKey reports whether c is a key on a telephone keypad
+func isKey(c byte) bool {
+	return (c >= '0' && c <= '9') || c == '*' || c == '#'
+}
@@ -0,0 +1,62 @@
+package agi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PlaybackOptions are the options of the Playback dialplan application
+type PlaybackOptions struct {
+	// Skip plays nothing, instead of answering, when the channel is not
+	// answered yet
+	Skip bool
+	// NoAnswer plays the files without answering the channel, as early media
+	NoAnswer bool
+	// SayMode speaks each file name as text through say.conf instead of
+	// playing it as a sound file
+	SayMode bool
+}
+
+// Playback plays files one after another with the Playback dialplan
+// application and fails with ErrPlaybackFailed when PLAYBACKSTATUS reports
+// that one could not be played. Unlike StreamFile it cannot be interrupted
+// by DTMF and, with NoAnswer, plays to a channel that is not answered, such
+// as an announcement before Dial.
+func (s *AgiSession) Playback(files []string, opts PlaybackOptions) error {
+	if len(files) == 0 {
+		return ErrNoPrompts
+	}
+
+	if _, err := s.execute(fmt.Sprintf("EXEC Playback \"%s\"", EscapeString(playbackArgs(files, opts)))); err != nil {
+		return err
+	}
+
+	status, err := s.GetVariable("PLAYBACKSTATUS")
+	if err != nil {
+		return err
+	}
+	if status == "FAILED" {
+		return fmt.Errorf("%w: %s", ErrPlaybackFailed, strings.Join(files, "&"))
+	}
+	return nil
+}
+
+// playbackArgs builds the application arguments for Playback: the files
+// joined with ampersands and the comma-separated option names
+func playbackArgs(files []string, opts PlaybackOptions) string {
+	escaped := make([]string, len(files))
+	for i, file := range files {
+		escaped[i] = appArgEscaper.Replace(file)
+	}
+	args := []string{strings.Join(escaped, "&")}
+	if opts.Skip {
+		args = append(args, "skip")
+	}
+	if opts.NoAnswer {
+		args = append(args, "noanswer")
+	}
+	if opts.SayMode {
+		args = append(args, "say")
+	}
+	return strings.Join(args, ",")
+}
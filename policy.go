@@ -0,0 +1,216 @@
+package agi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PolicyCommand describes a command about to be sent, for a CommandPolicy,
+// or one a dry run received
+type PolicyCommand struct {
+	// Verb is the AGI command verb in upper case, such as "SET CONTEXT"
+	Verb string
+	// App is the application name of an EXEC command in upper case, such
+	// as "SYSTEM", and empty for other verbs
+	App string
+	// Args is the rest of the command line after the verb and application,
+	// as sent
+	Args string
+	// Class is the verb's class from VerbClasses, except that GET VARIABLE
+	// and GET FULL VARIABLE are mutating when they call a dialplan function
+	// with side effects, such as SET or SHELL, since Asterisk evaluates it
+	Class VerbClass
+	// Command is the full command line
+	Command string
+}
+
+// Name returns the verb, followed by the application for EXEC commands, as
+// matched by AllowCommands and DenyCommands
+func (c PolicyCommand) Name() string {
+	if c.App != "" {
+		return c.Verb + " " + c.App
+	}
+	return c.Verb
+}
+
+// Matches reports whether the command is name, which is matched as in
+// DenyCommands
+func (c PolicyCommand) Matches(name string) bool {
+	name = normalizeCommandName(name)
+	return name == c.Verb || name == c.Name()
+}
+
+// CommandPolicy decides whether a session may send a command. A non-nil
+// error blocks it; the session returns it wrapped in ErrCommandDenied.
+type CommandPolicy func(s *AgiSession, cmd PolicyCommand) error
+
+// DenyCommands returns a policy blocking the named commands and allowing
+// everything else. Names are matched without regard to case and are either
+// a verb, such as "SET CONTEXT", or "EXEC" followed by an application, such
+// as "EXEC System". "EXEC" alone blocks every application.
+func DenyCommands(names ...string) CommandPolicy {
+	denied := commandSet(names)
+	return func(_ *AgiSession, cmd PolicyCommand) error {
+		if denied[cmd.Verb] || denied[cmd.Name()] {
+			return fmt.Errorf("%s is denied", cmd.Name())
+		}
+		return nil
+	}
+}
+
+// AllowCommands returns a policy allowing only the named commands, matched
+// as in DenyCommands. "EXEC" alone allows every application.
+func AllowCommands(names ...string) CommandPolicy {
+	allowed := commandSet(names)
+	return func(_ *AgiSession, cmd PolicyCommand) error {
+		if allowed[cmd.Verb] || allowed[cmd.Name()] {
+			return nil
+		}
+		return fmt.Errorf("%s is not allowed", cmd.Name())
+	}
+}
+
+// DenyMutatingCommands returns a policy blocking every command VerbClasses
+// does not list as read-only or media, and reads that call a dialplan
+// function with side effects, for handlers that must only look at the call
+func DenyMutatingCommands() CommandPolicy {
+	return func(_ *AgiSession, cmd PolicyCommand) error {
+		if cmd.Class == VerbMutating {
+			return fmt.Errorf("%s changes the call", cmd.Name())
+		}
+		return nil
+	}
+}
+
+// commandSet normalizes command names into a lookup set
+func commandSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[normalizeCommandName(name)] = true
+	}
+	return set
+}
+
+// normalizeCommandName upper-cases name and collapses its spacing
+func normalizeCommandName(name string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(name), " "))
+}
+
+// ParseCommand splits a command line into its verb, EXEC application name
+// and arguments, and classifies it
+func ParseCommand(command string) PolicyCommand {
+	verb := commandVerb(command)
+	cmd := PolicyCommand{Verb: strings.ToUpper(verb), Command: command}
+	cmd.Class = ClassifyVerb(cmd.Verb)
+	_, rest := commandFields(command, max(len(strings.Fields(verb)), 1))
+	if cmd.Verb == "EXEC" {
+		var app []string
+		app, rest = commandFields(rest, 1)
+		if len(app) > 0 {
+			cmd.App = strings.ToUpper(app[0])
+		}
+	}
+	cmd.Args = rest
+	if callsFunction(cmd) {
+		cmd.Class = VerbMutating
+	}
+	return cmd
+}
+
+// sideEffectFunctions are the dialplan functions that change something when
+// read: they run commands, write variables, the database or realtime
+// storage, take locks, or evaluate a string that could call any of them
+var sideEffectFunctions = map[string]bool{
+	"SHELL":            true,
+	"SET":              true,
+	"EVAL":             true,
+	"DB_DELETE":        true,
+	"REALTIME_DESTROY": true,
+	"ODBC_FETCH":       true,
+	"CURL":             true,
+	"INC":              true,
+	"DEC":              true,
+	"POP":              true,
+	"SHIFT":            true,
+	"LOCK":             true,
+	"TRYLOCK":          true,
+	"UNLOCK":           true,
+}
+
+// callsFunction reports whether cmd reads a variable through a dialplan
+// function in sideEffectFunctions. Reads through other functions, such as
+// CALLERID(num) or CHANNEL(language), stay read-only.
+func callsFunction(cmd PolicyCommand) bool {
+	switch cmd.Verb {
+	case "GET VARIABLE", "GET FULL VARIABLE":
+	default:
+		return false
+	}
+	args := cmd.Args
+	for {
+		i := strings.IndexByte(args, '(')
+		if i < 0 {
+			return false
+		}
+		name := args[:i]
+		if j := strings.LastIndexFunc(name, func(r rune) bool { return !isFunctionNameRune(r) }); j >= 0 {
+			name = name[j+1:]
+		}
+		if sideEffectFunctions[strings.ToUpper(name)] {
+			return true
+		}
+		args = args[i+1:]
+	}
+}
+
+// isFunctionNameRune reports whether r can appear in a dialplan function name
+func isFunctionNameRune(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+// SetCommandPolicy restricts the commands the session may send. Blocked
+// commands are not sent and return an error wrapping ErrCommandDenied. It
+// applies on top of any WithCommandPolicy policy, which it cannot relax. A
+// nil policy removes the session's own policy.
+func (s *AgiSession) SetCommandPolicy(policy CommandPolicy) {
+	s.commandPolicy = policy
+}
+
+// checkPolicy applies the server's and then the session's command policy to
+// command
+func (s *AgiSession) checkPolicy(command string) error {
+	if s.serverPolicy == nil && s.commandPolicy == nil {
+		return nil
+	}
+	cmd := ParseCommand(command)
+	for _, policy := range []CommandPolicy{s.serverPolicy, s.commandPolicy} {
+		if policy == nil {
+			continue
+		}
+		if err := policy(s, cmd); err != nil {
+			if s.onCommandDenied != nil {
+				s.onCommandDenied(s, cmd)
+			}
+			return fmt.Errorf("%w: %v", ErrCommandDenied, err)
+		}
+	}
+	return nil
+}
+
+// WithCommandPolicy applies policy to every session, for servers running
+// handlers that must not issue some commands. Handlers cannot remove it, but
+// may add their own with SetCommandPolicy.
+func WithCommandPolicy(policy CommandPolicy) ServerOption {
+	return func(s *FastAGIServer) {
+		s.commandPolicy = policy
+	}
+}
+
+// WithCommandDeniedHandler sets a function called with every command a
+// policy blocks, for auditing. Denials are also counted in
+// ServerStats.CommandsDenied.
+func WithCommandDeniedHandler(fn func(s *AgiSession, cmd PolicyCommand)) ServerOption {
+	return func(s *FastAGIServer) {
+		s.deniedHandler = fn
+	}
+}
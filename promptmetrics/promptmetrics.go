@@ -0,0 +1,123 @@
+// Package promptmetrics summarizes where in each prompt callers barge in,
+// using the reports sessions send to an agi.PromptMetrics hook.
+package promptmetrics
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// DefaultSampleRate is the sample rate of the 8kHz audio most prompts use
+const DefaultSampleRate = 8000
+
+// Summary describes every play of one prompt
+type Summary struct {
+	File        string
+	Plays       int
+	Interrupted int
+	// MeanInterrupt is the average position callers pressed a digit at
+	MeanInterrupt time.Duration
+	// EarliestInterrupt is the earliest position a caller pressed a digit at
+	EarliestInterrupt time.Duration
+	// Length is the longest position reached by an uninterrupted play,
+	// which approximates the prompt's length
+	Length time.Duration
+	// Digits counts the digits callers interrupted with
+	Digits map[string]int
+}
+
+// InterruptRate returns the fraction of plays a caller interrupted
+func (s Summary) InterruptRate() float64 {
+	if s.Plays == 0 {
+		return 0
+	}
+	return float64(s.Interrupted) / float64(s.Plays)
+}
+
+// Aggregator collects prompt reports and summarizes them per prompt. It
+// implements agi.PromptMetrics and is safe for concurrent use by many
+// sessions.
+type Aggregator struct {
+	sampleRate int
+
+	mu      sync.Mutex
+	prompts map[string]*prompt
+}
+
+type prompt struct {
+	summary Summary
+	total   time.Duration
+}
+
+var _ agi.PromptMetrics = (*Aggregator)(nil)
+
+// NewAggregator creates an aggregator converting sample offsets at
+// sampleRate samples per second, or DefaultSampleRate when not positive
+func NewAggregator(sampleRate int) *Aggregator {
+	if sampleRate <= 0 {
+		sampleRate = DefaultSampleRate
+	}
+	return &Aggregator{
+		sampleRate: sampleRate,
+		prompts:    make(map[string]*prompt),
+	}
+}
+
+// OnPromptComplete implements agi.PromptMetrics
+func (a *Aggregator) OnPromptComplete(file string, endposSamples int64, interrupted bool, digit string) {
+	pos := a.Duration(endposSamples)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	p, ok := a.prompts[file]
+	if !ok {
+		p = &prompt{summary: Summary{File: file, Digits: make(map[string]int)}}
+		a.prompts[file] = p
+	}
+	p.summary.Plays++
+	if !interrupted {
+		p.summary.Length = max(p.summary.Length, pos)
+		return
+	}
+
+	p.summary.Interrupted++
+	p.summary.Digits[digit]++
+	p.total += pos
+	p.summary.MeanInterrupt = p.total / time.Duration(p.summary.Interrupted)
+	if p.summary.Interrupted == 1 || pos < p.summary.EarliestInterrupt {
+		p.summary.EarliestInterrupt = pos
+	}
+}
+
+// Duration converts a sample offset to a duration at the aggregator's rate
+func (a *Aggregator) Duration(samples int64) time.Duration {
+	return time.Duration(samples) * time.Second / time.Duration(a.sampleRate)
+}
+
+// Summaries returns a summary of every prompt reported, sorted by file
+func (a *Aggregator) Summaries() []Summary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := make([]Summary, 0, len(a.prompts))
+	for _, p := range a.prompts {
+		s := p.summary
+		s.Digits = maps.Clone(s.Digits)
+		out = append(out, s)
+	}
+	slices.SortFunc(out, func(x, y Summary) int { return strings.Compare(x.File, y.File) })
+	return out
+}
+
+// Reset discards every report collected so far
+func (a *Aggregator) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	clear(a.prompts)
+}
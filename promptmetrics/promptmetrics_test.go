@@ -0,0 +1,64 @@
+package promptmetrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agitest"
+)
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator(0)
+	a.OnPromptComplete("main-menu", 40000, false, "")
+	a.OnPromptComplete("main-menu", 16000, true, "1")
+	a.OnPromptComplete("main-menu", 8000, true, "1")
+	a.OnPromptComplete("main-menu", 24000, true, "2")
+	a.OnPromptComplete("goodbye", 12000, false, "")
+
+	summaries := a.Summaries()
+	require.Len(t, summaries, 2)
+	assert.Equal(t, Summary{File: "goodbye", Plays: 1, Length: 1500 * time.Millisecond, Digits: map[string]int{}}, summaries[0])
+
+	menu := summaries[1]
+	assert.Equal(t, "main-menu", menu.File)
+	assert.Equal(t, 4, menu.Plays)
+	assert.Equal(t, 3, menu.Interrupted)
+	assert.InDelta(t, 0.75, menu.InterruptRate(), 1e-9)
+	assert.Equal(t, 2*time.Second, menu.MeanInterrupt)
+	assert.Equal(t, time.Second, menu.EarliestInterrupt)
+	assert.Equal(t, 5*time.Second, menu.Length)
+	assert.Equal(t, map[string]int{"1": 2, "2": 1}, menu.Digits)
+
+	a.Reset()
+	assert.Empty(t, a.Summaries())
+}
+
+func TestSampleRate(t *testing.T) {
+	a := NewAggregator(16000)
+	assert.Equal(t, 500*time.Millisecond, a.Duration(8000))
+}
+
+func TestSessionHook(t *testing.T) {
+	fake := agitest.NewFake([]string{
+		"200 result=0 endpos=32000",
+		"200 result=49 endpos=12000",
+	})
+	session, err := fake.Session(context.Background())
+	require.NoError(t, err)
+	defer fake.Close()
+
+	a := NewAggregator(DefaultSampleRate)
+	session.SetPromptMetrics(a)
+	require.NoError(t, session.StreamFile("welcome", "1"))
+	require.NoError(t, session.StreamFile("welcome", "1"))
+
+	summaries := a.Summaries()
+	require.Len(t, summaries, 1)
+	assert.Equal(t, 2, summaries[0].Plays)
+	assert.Equal(t, 1500*time.Millisecond, summaries[0].MeanInterrupt)
+	assert.Equal(t, 4*time.Second, summaries[0].Length)
+}
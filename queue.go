@@ -0,0 +1,138 @@
+package agi
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// queueMemberSpecs are the QUEUE_MEMBER options QueueMemberCount accepts
+var queueMemberSpecs = []string{"logged", "free", "ready", "count", "paused"}
+
+// QueueInfo is a snapshot of a queue read by QueueVariables
+type QueueInfo struct {
+	Queue   string
+	Exists  bool
+	Waiting int
+	// Member counts from QUEUE_MEMBER
+	Logged int
+	Free   int
+	Ready  int
+	Paused int
+	Total  int
+	// Missing names the functions that returned nothing, usually because
+	// the running Asterisk version does not have them. Their fields are zero.
+	Missing []string
+}
+
+// queueField is one function read by QueueVariables
+type queueField struct {
+	name string
+	expr string
+	set  func(info *QueueInfo, n int)
+}
+
+// queueFields lists the functions QueueVariables reads, in order
+func queueFields(queue string) []queueField {
+	member := func(spec string, set func(info *QueueInfo, n int)) queueField {
+		return queueField{"QUEUE_MEMBER(" + spec + ")", fmt.Sprintf("${QUEUE_MEMBER(%s,%s)}", queue, spec), set}
+	}
+	return []queueField{
+		{"QUEUE_EXISTS", fmt.Sprintf("${QUEUE_EXISTS(%s)}", queue), func(info *QueueInfo, n int) { info.Exists = n == 1 }},
+		{"QUEUE_WAITING_COUNT", fmt.Sprintf("${QUEUE_WAITING_COUNT(%s)}", queue), func(info *QueueInfo, n int) { info.Waiting = n }},
+		member("logged", func(info *QueueInfo, n int) { info.Logged = n }),
+		member("free", func(info *QueueInfo, n int) { info.Free = n }),
+		member("ready", func(info *QueueInfo, n int) { info.Ready = n }),
+		member("paused", func(info *QueueInfo, n int) { info.Paused = n }),
+		member("count", func(info *QueueInfo, n int) { info.Total = n }),
+	}
+}
+
+// QueueWaitingCount returns how many callers are waiting in queue
+func (s *AgiSession) QueueWaitingCount(queue string) (int, error) {
+	if err := validateDialplanName("queue", queue, contextChars); err != nil {
+		return 0, err
+	}
+	return s.queueCount(fmt.Sprintf("${QUEUE_WAITING_COUNT(%s)}", queue))
+}
+
+// QueueMemberCount returns a member count of queue from QUEUE_MEMBER, where
+// spec is one of logged, free, ready, paused or count
+func (s *AgiSession) QueueMemberCount(queue, spec string) (int, error) {
+	if err := validateDialplanName("queue", queue, contextChars); err != nil {
+		return 0, err
+	}
+	if !slices.Contains(queueMemberSpecs, spec) {
+		return 0, fmt.Errorf("invalid queue member spec %q: must be one of %s", spec, strings.Join(queueMemberSpecs, ", "))
+	}
+	return s.queueCount(fmt.Sprintf("${QUEUE_MEMBER(%s,%s)}", queue, spec))
+}
+
+// queueCount evaluates a queue function returning a number
+func (s *AgiSession) queueCount(expr string) (int, error) {
+	value, err := s.GetFullVariable(expr)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s returned %q", ErrInvalidResponse, expr, value)
+	}
+	return n, nil
+}
+
+// QueueVariables reads the common queue functions for queue in a single
+// GET FULL VARIABLE. Functions that return nothing are listed in
+// QueueInfo.Missing rather than failing the read.
+func (s *AgiSession) QueueVariables(queue string) (QueueInfo, error) {
+	if err := validateDialplanName("queue", queue, contextChars); err != nil {
+		return QueueInfo{}, err
+	}
+
+	fields := queueFields(queue)
+	exprs := make([]string, len(fields))
+	for i, f := range fields {
+		exprs[i] = f.expr
+	}
+	value, err := s.GetFullVariable(strings.Join(exprs, "|"))
+	if err != nil {
+		return QueueInfo{}, err
+	}
+
+	info := QueueInfo{Queue: queue}
+	values := strings.Split(value, "|")
+	for i, f := range fields {
+		if i >= len(values) {
+			info.Missing = append(info.Missing, f.name)
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(values[i]))
+		if err != nil {
+			info.Missing = append(info.Missing, f.name)
+			continue
+		}
+		f.set(&info, n)
+	}
+	return info, nil
+}
+
+// AnnounceQueuePosition tells a caller about to join queue how many callers
+// are ahead of them, using the queue prompts shipped with Asterisk
+func (s *AgiSession) AnnounceQueuePosition(queue string) error {
+	waiting, err := s.QueueWaitingCount(queue)
+	if err != nil {
+		return err
+	}
+	if waiting == 0 {
+		return s.StreamFile("queue-youarenext", "")
+	}
+
+	if err := s.StreamFile("queue-thereare", ""); err != nil {
+		return err
+	}
+	if _, err := s.SayNumber(waiting, ""); err != nil {
+		return err
+	}
+	return s.StreamFile("queue-callswaiting", "")
+}
@@ -0,0 +1,142 @@
+package agi
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadCacheStats counts the reads answered by a session's read cache and
+// those sent to Asterisk
+type ReadCacheStats struct {
+	Hits   int
+	Misses int
+}
+
+// readCache holds the values of the variables configured with SetReadCache
+type readCache struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	ttl     time.Duration
+	entries map[string]cachedRead
+	stats   ReadCacheStats
+}
+
+// cachedRead is a cached variable value and when it was read
+type cachedRead struct {
+	value string
+	read  time.Time
+}
+
+// SetReadCache makes GetVariable, and GetFullVariable of "${name}", read
+// each of names from Asterisk once and answer later reads from the
+// session, for idempotent values that helper layers read over and over,
+// such as CALLERID(num) or CHANNEL(language). A name set through the
+// session with SET VARIABLE, or a CALLERID name after SET CALLERID, is read
+// again next time. Values the dialplan or an EXEC may change expire after
+// ttl; zero keeps them for the whole session. Without names, the default,
+// nothing is cached.
+func (s *AgiSession) SetReadCache(ttl time.Duration, names ...string) {
+	s.readCache = newReadCache(ttl, names)
+}
+
+// WithReadCache sets the read cache of every session
+func WithReadCache(ttl time.Duration, names ...string) ServerOption {
+	return func(s *FastAGIServer) {
+		s.readCacheTTL, s.readCacheNames = ttl, names
+	}
+}
+
+// newReadCache returns a cache for names, or nil when there are none
+func newReadCache(ttl time.Duration, names []string) *readCache {
+	if len(names) == 0 {
+		return nil
+	}
+	c := &readCache{names: make(map[string]bool, len(names)), ttl: ttl, entries: make(map[string]cachedRead)}
+	for _, name := range names {
+		c.names[name] = true
+	}
+	return c
+}
+
+// ReadCacheStats returns the hits and misses of the session's read cache
+func (s *AgiSession) ReadCacheStats() ReadCacheStats {
+	if s.readCache == nil {
+		return ReadCacheStats{}
+	}
+	s.readCache.mu.Lock()
+	defer s.readCache.mu.Unlock()
+	return s.readCache.stats
+}
+
+// cachedVariable returns the cached value of name, or reads it with read
+// and caches it when name is cached at all
+func (s *AgiSession) cachedVariable(name string, read func() (string, error)) (string, error) {
+	c := s.readCache
+	if c == nil || !c.names[name] {
+		return read()
+	}
+
+	now := s.clock().Now()
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	if ok && (c.ttl <= 0 || now.Sub(entry.read) < c.ttl) {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return entry.value, nil
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	value, err := read()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.entries[name] = cachedRead{value: value, read: now}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// invalidateReads drops the cached values command may change
+func (s *AgiSession) invalidateReads(command string) {
+	c := s.readCache
+	if c == nil {
+		return
+	}
+	var changed func(name string) bool
+	switch verb := commandVerb(command); verb {
+	case "SET VARIABLE":
+		args := SplitCommand(command)
+		if len(args) < 3 {
+			return
+		}
+		changed = func(name string) bool { return name == args[2] }
+	case "SET CALLERID":
+		changed = func(name string) bool { return strings.HasPrefix(name, "CALLERID(") }
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.entries {
+		if changed(name) {
+			delete(c.entries, name)
+		}
+	}
+}
+
+// fullVariableName returns the variable an expression such as "${NAME}"
+// reads, if that is all it does
+func fullVariableName(expression string) (string, bool) {
+	name, ok := strings.CutPrefix(expression, "${")
+	if !ok {
+		return "", false
+	}
+	name, ok = strings.CutSuffix(name, "}")
+	if !ok || strings.ContainsAny(name, "${}") {
+		return "", false
+	}
+	return name, true
+}
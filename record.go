@@ -0,0 +1,258 @@
+package agi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRenameCommand is the shell command RecordFileAtomic runs on the
+// Asterisk host through the System application. {part} and {final} are
+// replaced with the temporary and final file paths including the format
+// extension, shell-quoted when they contain anything but letters, digits and
+// / . _ - + = : @ characters.
+const DefaultRenameCommand = "mv {part} {final}"
+
+// RecordOptions configures RecordFileAtomic
+type RecordOptions struct {
+	// Format is the file format and extension. Defaults to "wav".
+	Format string
+	// EscapeDigits are the digits that end the recording
+	EscapeDigits string
+	// Timeout is the maximum recording length. Zero means no limit.
+	Timeout time.Duration
+	// Offset is the sample offset to start recording at
+	Offset int
+	// Beep plays a beep before recording starts
+	Beep bool
+	// Silence ends the recording after this much silence. Zero disables it.
+	Silence time.Duration
+	// RenameCommand overrides DefaultRenameCommand
+	RenameCommand string
+	// ProgressInterval is how often RecordFileWithProgress reports progress.
+	// Defaults to DefaultProgressInterval.
+	ProgressInterval time.Duration
+}
+
+// DefaultProgressInterval is how often RecordFileWithProgress reports
+// progress unless RecordOptions.ProgressInterval is set
+const DefaultProgressInterval = time.Second
+
+// RecordError reports a recording that could not be completed. PartialFile
+// names the temporary file left on the Asterisk host, without extension.
+type RecordError struct {
+	PartialFile string
+	Err         error
+}
+
+// Error implements the error interface
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("recording %s: %v", e.PartialFile, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Code implements Coder with the code of the underlying error, or
+// "record_failed"
+func (e *RecordError) Code() string {
+	if code := ErrorCode(e.Err); code != CodeUnknown {
+		return code
+	}
+	return "record_failed"
+}
+
+// RecordFileAtomic records to finalName+".part" and renames the file to
+// finalName once the recording completes, so anything watching for finalName
+// never sees a file Asterisk is still writing. The rename runs on the Asterisk
+// host through EXEC System and is confirmed with SYSTEMSTATUS.
+//
+// When the recording itself fails, for example because the caller hung up,
+// a *RecordError naming the .part file is returned. When only the rename fails
+// the error wraps ErrRenameFailed.
+func (s *AgiSession) RecordFileAtomic(finalName string, opts RecordOptions) (string, error) {
+	if opts.Format == "" {
+		opts.Format = "wav"
+	}
+	if opts.RenameCommand == "" {
+		opts.RenameCommand = DefaultRenameCommand
+	}
+
+	part := finalName + ".part"
+	resp, err := s.execute(recordCommand(part, opts))
+	if err != nil {
+		return "", &RecordError{PartialFile: part, Err: err}
+	}
+	if resp.Result == -1 {
+		if resp.Annotation == AnnotationHangup {
+			return "", &RecordError{PartialFile: part, Err: ErrHangup}
+		}
+		return "", &RecordError{PartialFile: part, Err: ErrRecordFailed}
+	}
+
+	rename := strings.NewReplacer(
+		"{part}", shellQuote(part+"."+opts.Format),
+		"{final}", shellQuote(finalName+"."+opts.Format),
+	).Replace(opts.RenameCommand)
+	resp, err = s.execute(fmt.Sprintf("EXEC System \"%s\"", EscapeString(rename)))
+	if err == nil {
+		err = execResult("System", resp)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrRenameFailed, err)
+	}
+
+	status, err := s.GetVariable("SYSTEMSTATUS")
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrRenameFailed, err)
+	}
+	if status != "SUCCESS" {
+		return "", fmt.Errorf("%w: SYSTEMSTATUS=%s", ErrRenameFailed, status)
+	}
+
+	return finalName, nil
+}
+
+// shellQuote returns s as a single word for /bin/sh, single-quoted unless
+// every character is safe unquoted
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("/._-+=:@", r))
+	}) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// RecordFileWithProgress records to filename like RecordFile, calling
+// onProgress with the time since recording started every ProgressInterval
+// while the RECORD FILE command runs. It returns the digit that ended the
+// recording, or "" when it ended by timeout or silence.
+//
+// Asterisk cannot be queried while RECORD FILE is in progress, so the elapsed
+// time is measured on the local clock rather than from the recording itself.
+// Progress stops when ctx is done or once the command returns, and
+// onProgress is never called after RecordFileWithProgress returns. A done ctx
+// does not interrupt the recording; it ends when the caller presses an escape
+// digit, stays silent, hangs up or reaches the timeout. The response is
+// awaited for opts.Timeout plus DeadlineGrace, or without limit when
+// opts.Timeout is zero, rather than the session timeout.
+func (s *AgiSession) RecordFileWithProgress(ctx context.Context, filename string, opts RecordOptions, onProgress func(elapsed time.Duration)) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if s.HungUp() {
+		return "", ErrHangup
+	}
+	if opts.Format == "" {
+		opts.Format = "wav"
+	}
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	if onProgress != nil {
+		s.escaped.Store(true)
+		clock := s.clock()
+		start := clock.Now()
+		ticker := clock.NewTicker(interval)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ctx.Done():
+					return
+				case <-ticker.C():
+					// The command may have returned or ctx ended while the
+					// tick was pending; check again so a late tick is dropped
+					select {
+					case <-stop:
+						return
+					case <-ctx.Done():
+						return
+					default:
+					}
+					onProgress(since(clock, start))
+				}
+			}
+		}()
+	}
+
+	resp, err := s.execute(recordCommand(filename, opts))
+	close(stop)
+	wg.Wait()
+
+	if err != nil {
+		return "", err
+	}
+	if resp.Result == -1 {
+		if resp.Annotation == AnnotationHangup {
+			return "", ErrHangup
+		}
+		return "", ErrRecordFailed
+	}
+	if resp.Result == 0 {
+		return "", nil
+	}
+	return string(rune(resp.Result)), nil
+}
+
+// recordCommand builds a RECORD FILE command from opts
+func recordCommand(filename string, opts RecordOptions) string {
+	timeout := int64(-1)
+	if opts.Timeout > 0 {
+		timeout = opts.Timeout.Milliseconds()
+	}
+
+	cmd := fmt.Sprintf("RECORD FILE %s %s \"%s\" %d %d",
+		filename, opts.Format, opts.EscapeDigits, timeout, opts.Offset)
+	if opts.Beep {
+		cmd += " BEEP"
+	}
+	if opts.Silence > 0 {
+		cmd += fmt.Sprintf(" s=%d", int(opts.Silence.Seconds()))
+	}
+	return cmd
+}
+
+// MixMonitorOptions configures MixMonitorStart
+type MixMonitorOptions struct {
+	// Filename is the recording file including its format extension, such
+	// as "calls/1700000000.1.wav"
+	Filename string
+	// Options are MixMonitor option letters, such as "b" to record only
+	// while bridged
+	Options string
+	// Command runs on the Asterisk host once the recording ends
+	Command string
+}
+
+// MixMonitorStart starts recording both directions of the call in the
+// background with the MixMonitor application
+func (s *AgiSession) MixMonitorStart(opts MixMonitorOptions) error {
+	if opts.Filename == "" {
+		return fmt.Errorf("mixmonitor: filename must not be empty")
+	}
+
+	args := []string{appArgEscaper.Replace(opts.Filename), opts.Options, appArgEscaper.Replace(opts.Command)}
+	cmd := fmt.Sprintf("EXEC MixMonitor \"%s\"", EscapeString(joinAppArgs(args)))
+	_, err := s.execute(cmd)
+	return err
+}
+
+// MixMonitorStop stops a recording started with MixMonitorStart
+func (s *AgiSession) MixMonitorStop() error {
+	_, err := s.execute("EXEC StopMixMonitor")
+	return err
+}
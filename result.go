@@ -0,0 +1,82 @@
+package agi
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// DefaultResultPrefix is the prefix of the channel variables SetResult
+// writes unless the server sets another with WithResultPrefix
+const DefaultResultPrefix = "AGIRESULT_"
+
+// StageResult records a value for the dialplan to read once the handler
+// returns, written as the channel variable prefix+key. On a server
+// configured with WithResultPrefix staged values are written automatically
+// after the handler returns; otherwise call SetResult.
+func (s *AgiSession) StageResult(key, value string) {
+	if s.staged == nil {
+		s.staged = make(map[string]string)
+	}
+	s.staged[key] = value
+}
+
+// SetResult writes result and any staged values as channel variables named
+// with the result prefix, in sorted key order, so the dialplan can act on
+// what the handler decided. Entries in result replace staged values with the
+// same key. Once written, staged values are cleared.
+func (s *AgiSession) SetResult(result map[string]string) error {
+	values := maps.Clone(s.staged)
+	if values == nil {
+		values = make(map[string]string, len(result))
+	}
+	maps.Copy(values, result)
+
+	for key := range values {
+		if !isVariableName(key) {
+			return fmt.Errorf("set result: invalid key %q", key)
+		}
+	}
+
+	prefix := s.resultPrefix
+	if prefix == "" {
+		prefix = DefaultResultPrefix
+	}
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		if err := s.SetVariable(prefix+key, values[key]); err != nil {
+			return err
+		}
+		delete(s.staged, key)
+	}
+	return nil
+}
+
+// WithResultPrefix writes the values each handler stages with StageResult as
+// channel variables named prefix+key once it returns, unless the channel has
+// hung up
+func WithResultPrefix(prefix string) ServerOption {
+	return func(s *FastAGIServer) {
+		s.resultPrefix = prefix
+	}
+}
+
+// flushResult writes staged values left by the handler
+func (s *AgiSession) flushResult() error {
+	if len(s.staged) == 0 || s.HungUp() {
+		return nil
+	}
+	return s.SetResult(nil)
+}
+
+// isVariableName reports whether name is usable in a channel variable name
+func isVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package agi
+
+import (
+	"strconv"
+	"strings"
+)
+
+// RTPStats is a call quality snapshot read from the channel's RTP statistics.
+// Jitter and round trip times are in seconds as reported by Asterisk. Raw
+// holds every field received, including ones without a typed counterpart.
+type RTPStats struct {
+	RxJitter     float64
+	TxJitter     float64
+	RxCount      int
+	TxCount      int
+	RxPacketLoss int
+	TxPacketLoss int
+	RTT          float64
+	Raw          map[string]string
+}
+
+// RTPStats reads the RTP quality statistics for the channel. PJSIP channels
+// are read through CHANNEL(rtcp,all); chan_sip channels use RTPAUDIOQOS,
+// which Asterisk sets at hangup, falling back to CHANNEL(rtpqos,audio,all)
+// while the call is up. ErrNoStats is returned for channels without RTP and
+// when no statistics are available yet.
+func (s *AgiSession) RTPStats() (RTPStats, error) {
+	var sources []string
+	switch strings.ToUpper(s.ChannelTech()) {
+	case "PJSIP":
+		sources = []string{"CHANNEL(rtcp,all)"}
+	case "SIP":
+		sources = []string{"RTPAUDIOQOS", "CHANNEL(rtpqos,audio,all)"}
+	default:
+		return RTPStats{}, ErrNoStats
+	}
+
+	for _, name := range sources {
+		value, err := s.GetVariable(name)
+		if err != nil {
+			return RTPStats{}, err
+		}
+		if value != "" {
+			return ParseRTPStats(value)
+		}
+	}
+
+	return RTPStats{}, ErrNoStats
+}
+
+// ParseRTPStats parses an RTP quality string in the format used by
+// RTPAUDIOQOS and CHANNEL(rtcp,all), such as
+// "ssrc=1;themssrc=2;lp=0;rxjitter=0.001;rxcount=100;txjitter=0.002;txcount=98;rlp=1;rtt=0.020"
+func ParseRTPStats(value string) (RTPStats, error) {
+	stats := RTPStats{Raw: make(map[string]string)}
+	for _, field := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || key == "" {
+			continue
+		}
+		stats.Raw[key] = val
+	}
+	if len(stats.Raw) == 0 {
+		return RTPStats{}, ErrNoStats
+	}
+
+	stats.RxJitter = parseFloatField(stats.Raw, "rxjitter")
+	stats.TxJitter = parseFloatField(stats.Raw, "txjitter")
+	stats.RTT = parseFloatField(stats.Raw, "rtt")
+	stats.RxCount = parseIntField(stats.Raw, "rxcount")
+	stats.TxCount = parseIntField(stats.Raw, "txcount")
+	stats.RxPacketLoss = parseIntField(stats.Raw, "lp")
+	stats.TxPacketLoss = parseIntField(stats.Raw, "rlp")
+	return stats, nil
+}
+
+// parseFloatField returns fields[key] as a float, or zero
+func parseFloatField(fields map[string]string, key string) float64 {
+	v, _ := strconv.ParseFloat(fields[key], 64)
+	return v
+}
+
+// parseIntField returns fields[key] as an int, or zero
+func parseIntField(fields map[string]string, key string) int {
+	v, _ := strconv.Atoi(fields[key])
+	return v
+}
+
+// ChannelTech returns the channel technology, such as "PJSIP", "SIP" or
+// "DAHDI", from agi_type or the agi_channel name
+func (s *AgiSession) ChannelTech() string {
+	if tech := s.env["agi_type"]; tech != "" {
+		return tech
+	}
+	tech, _, _ := strings.Cut(s.env["agi_channel"], "/")
+	return tech
+}
@@ -0,0 +1,114 @@
+package agi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// DefaultRunVerboseLevel is the verbose level Run logs handler errors to
+// Asterisk at
+const DefaultRunVerboseLevel = 1
+
+// RunOption configures Run
+type RunOption func(*runConfig)
+
+// runConfig is the configuration of Run
+type runConfig struct {
+	errorPolicy  ErrorPolicy
+	verboseLevel int
+	stderr       io.Writer
+}
+
+// WithRunErrorPolicy sets what Run does with the channel when the handler
+// fails, as WithErrorPolicy does for the FastAGI server
+func WithRunErrorPolicy(p ErrorPolicy) RunOption {
+	return func(c *runConfig) {
+		c.errorPolicy = p
+	}
+}
+
+// WithRunVerboseLevel sets the verbose level Run logs handler errors to
+// Asterisk at. A negative level only writes them to stderr.
+func WithRunVerboseLevel(level int) RunOption {
+	return func(c *runConfig) {
+		c.verboseLevel = level
+	}
+}
+
+// Run serves the call of a process AGI script, started by Asterisk with
+// AGI() or EAGI(), with h and exits. It reads the session from stdin and
+// stdout and calls h with a context cancelled with cause ErrHangup when
+// Asterisk sends SIGHUP for a hangup. When h fails, the error is written to
+// stderr and logged to Asterisk with VERBOSE, and the WithRunErrorPolicy
+// policy is applied. Deferred commands run and the session is closed before
+// the process exits with status 1 if h failed, or could not be called, and
+// 0 otherwise, a hangup and the control flow errors exempt from error
+// policies counting as success. Run does not return.
+func Run(h Handler, opts ...RunOption) {
+	cfg := runConfig{verboseLevel: DefaultRunVerboseLevel, stderr: os.Stderr}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	code := runProcess(context.Background(), h, cfg, os.Stdin, os.Stdout, hangups)
+	signal.Stop(hangups)
+	os.Exit(code)
+}
+
+// RunFunc is Run for a handler function
+func RunFunc(fn func(ctx context.Context, s *AgiSession) error, opts ...RunOption) {
+	Run(HandlerFunc(fn), opts...)
+}
+
+// runProcess serves the session read from r and written to w with h and
+// returns the exit status. A value on hangups marks the channel hung up.
+func runProcess(ctx context.Context, h Handler, cfg runConfig, r io.Reader, w io.Writer, hangups <-chan os.Signal) int {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	session, err := NewSession(ctx, r, w)
+	if err != nil {
+		fmt.Fprintf(cfg.stderr, "agi: %v\n", err)
+		return 1
+	}
+	defer session.Close()
+	session.openEAGIAudio()
+	session.errorPolicy = cfg.errorPolicy
+
+	go func() {
+		select {
+		case <-hangups:
+			session.hungUp.Store(true)
+			cancel(ErrHangup)
+		case <-ctx.Done():
+		}
+	}()
+
+	failure := runHandler(session.Context(), h, session)
+	failed := failure != nil && !isControlError(failure) && !session.HungUp()
+	if failed {
+		fmt.Fprintf(cfg.stderr, "agi: %s: handler error: %v\n", session.Info().Script, failure)
+		if cfg.verboseLevel >= 0 {
+			// A panic's stack trace would end the command at its first line
+			message, _, _ := strings.Cut(failure.Error(), "\n")
+			session.Verbose(EscapeString("handler error: "+message), cfg.verboseLevel)
+		}
+	}
+	if err := session.runDeferred(); err != nil {
+		fmt.Fprintf(cfg.stderr, "agi: %v\n", err)
+	}
+	if failed {
+		if err := session.applyErrorPolicy(failure); err != nil {
+			fmt.Fprintf(cfg.stderr, "agi: %v\n", err)
+		}
+		return 1
+	}
+	return 0
+}
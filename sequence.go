@@ -0,0 +1,159 @@
+package agi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultInterDigit is how long CollectSequence waits for each digit when
+// SequenceOptions.InterDigit is zero
+const DefaultInterDigit = 2 * time.Second
+
+// MatchState is how a partial digit sequence compares with the sequences a
+// caller may dial
+type MatchState int
+
+const (
+	// NoMatch means no sequence starts with the digits
+	NoMatch MatchState = iota
+	// PartialMatch means the digits start a sequence but are not one yet
+	PartialMatch
+	// ExactMatch means the digits are a sequence and no longer sequence
+	// starts with them
+	ExactMatch
+	// AmbiguousMatch means the digits are a sequence but also start a longer
+	// one, such as "*9" when "*98" is also a feature code
+	AmbiguousMatch
+)
+
+// String returns a readable name for the match state
+func (m MatchState) String() string {
+	switch m {
+	case NoMatch:
+		return "no match"
+	case PartialMatch:
+		return "partial"
+	case ExactMatch:
+		return "exact"
+	case AmbiguousMatch:
+		return "ambiguous"
+	default:
+		return "unknown"
+	}
+}
+
+// SequenceOptions configures CollectSequence
+type SequenceOptions struct {
+	// InterDigit is how long to wait for each digit. Defaults to
+	// DefaultInterDigit.
+	InterDigit time.Duration
+	// Max ends collection once this many digits arrived. Zero means no
+	// limit.
+	Max int
+	// Match classifies the digits collected so far, such as the function
+	// FeatureCodes returns. It is required; CollectSequence fails before
+	// collecting anything without it.
+	Match func(partial string) MatchState
+	// Timings records when each digit arrived in SequenceResult.Timings,
+	// for SuspiciouslyUniform
+	Timings bool
+}
+
+// SequenceResult is the outcome of CollectSequence
+type SequenceResult struct {
+	Digits string
+	// State is ExactMatch when Digits is a complete sequence and NoMatch
+	// otherwise
+	State MatchState
+	// Timings holds, when SequenceOptions.Timings is set, the time each
+	// digit arrived after collection began
+	Timings []time.Duration
+}
+
+// CollectSequence collects digits with WaitForDigit until they form a
+// complete sequence, such as a feature code dialed mid-call, or no sequence
+// can match any more. It returns as soon as Match reports ExactMatch or
+// NoMatch. On AmbiguousMatch it waits up to InterDigit for a longer
+// sequence and returns the ambiguous one if no digit arrives; a digit that
+// then matches nothing ends collection with NoMatch and every digit dialed.
+// Timeouts and Max end collection too, with ExactMatch only if the digits
+// are a sequence.
+func (s *AgiSession) CollectSequence(ctx context.Context, opts SequenceOptions) (SequenceResult, error) {
+	if opts.Match == nil {
+		return SequenceResult{}, fmt.Errorf("sequence match function cannot be nil")
+	}
+	if opts.InterDigit <= 0 {
+		opts.InterDigit = DefaultInterDigit
+	}
+
+	timer := s.digitTimer(opts.Timings)
+	result, err := s.collectSequence(ctx, opts, timer)
+	result.Timings = timer.result()
+	return result, err
+}
+
+// collectSequence runs the collection loop for CollectSequence
+func (s *AgiSession) collectSequence(ctx context.Context, opts SequenceOptions, timer *digitTimer) (SequenceResult, error) {
+	var buf strings.Builder
+	state := NoMatch
+	for {
+		if err := ctx.Err(); err != nil {
+			return SequenceResult{Digits: buf.String()}, err
+		}
+
+		digit, err := s.WaitForDigit(int(opts.InterDigit.Milliseconds()))
+		if err != nil {
+			return SequenceResult{Digits: buf.String()}, err
+		}
+		if digit == "" {
+			return sequenceResult(buf.String(), state), nil
+		}
+		timer.mark()
+
+		buf.WriteString(digit)
+		state = opts.Match(buf.String())
+		switch {
+		case state == ExactMatch, state == NoMatch:
+			return SequenceResult{Digits: buf.String(), State: state}, nil
+		case opts.Max > 0 && buf.Len() >= opts.Max:
+			return sequenceResult(buf.String(), state), nil
+		}
+	}
+}
+
+// sequenceResult is the result for digits whose collection ended in state
+// before Match settled it
+func sequenceResult(digits string, state MatchState) SequenceResult {
+	if state == AmbiguousMatch {
+		return SequenceResult{Digits: digits, State: ExactMatch}
+	}
+	return SequenceResult{Digits: digits, State: NoMatch}
+}
+
+// FeatureCodes returns a SequenceOptions.Match function for the literal
+// codes, reporting AmbiguousMatch for a code that starts another
+func FeatureCodes(codes ...string) func(partial string) MatchState {
+	exact := make(map[string]bool, len(codes))
+	prefixes := make(map[string]bool)
+	for _, code := range codes {
+		exact[code] = true
+		for i := 1; i < len(code); i++ {
+			prefixes[code[:i]] = true
+		}
+	}
+
+	return func(partial string) MatchState {
+		switch {
+		case exact[partial] && prefixes[partial]:
+			return AmbiguousMatch
+		case exact[partial]:
+			return ExactMatch
+		case prefixes[partial]:
+			return PartialMatch
+		default:
+			return NoMatch
+		}
+	}
+}
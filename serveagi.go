@@ -0,0 +1,44 @@
+package agi
+
+import "context"
+
+// Session is the small set of session methods most call flows need. Code
+// written against it instead of *AgiSession can be tested with a mock, such
+// as agitest.MockSession, and shared between projects using other AGI
+// libraries by implementing it over their session types. Methods are only
+// ever added to it in a new major version.
+type Session interface {
+	Answer() error
+	Hangup() error
+	StreamFile(filename string, escapeDigits string) error
+	GetData(filename string, timeout, maxDigits int) (string, error)
+	GetVariable(name string) (string, error)
+	SetVariable(name, value string) error
+	Verbose(message string, level int) error
+	GetEnv(key string) string
+}
+
+var _ Session = (*AgiSession)(nil)
+
+// SessionHandler handles a call through the Session interface, following
+// the ServeAGI convention handler ecosystems in other AGI libraries share
+type SessionHandler interface {
+	ServeAGI(ctx context.Context, s Session) error
+}
+
+// SessionHandlerFunc is an adapter to allow the use of ordinary functions as
+// SessionHandlers
+type SessionHandlerFunc func(ctx context.Context, s Session) error
+
+// ServeAGI calls f(ctx, s)
+func (f SessionHandlerFunc) ServeAGI(ctx context.Context, s Session) error {
+	return f(ctx, s)
+}
+
+// Adapt returns a Handler serving calls with h, so a SessionHandler can be
+// passed to NewFastAGIServer, a Mux or Sequence
+func Adapt(h SessionHandler) Handler {
+	return HandlerFunc(func(ctx context.Context, s *AgiSession) error {
+		return h.ServeAGI(ctx, s)
+	})
+}
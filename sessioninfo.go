@@ -0,0 +1,109 @@
+package agi
+
+import (
+	"net"
+	"time"
+)
+
+// SessionInfo summarizes a FastAGI session for billing or operations
+// records
+type SessionInfo struct {
+	Start time.Time
+	// End is zero until the session has finished
+	End        time.Time
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// Script is agi_network_script, or agi_request when that is empty
+	Script   string
+	UniqueID string
+	CallerID string
+	// RootRequest reports a FastAGI URL without a path, such as
+	// AGI(agi://pbx:4573), which a Mux sends to its root route
+	RootRequest bool
+	// Tenant is the session's tenant; see WithTenantResolver
+	Tenant string
+	// Flags are the feature flags evaluated for the session; see
+	// WithFeatureFlags
+	Flags map[string]bool
+	// EnvTransformed reports that WithEnvTransformer changed the environment
+	EnvTransformed bool
+	// Err is why the session failed: the error reading the environment,
+	// auto-answering or writing staged results, the handler's error, or a
+	// recovered panic wrapping ErrHandlerPanic
+	Err error
+	// ErrCode is ErrorCode(Err), for counting failures by class
+	ErrCode string
+	// RecentExchanges are the session's last exchanges, redacted as by
+	// AgiSession.RecentExchanges, when Err is set
+	RecentExchanges []Exchange
+	// ErrorPolicy is the error policy applied to the channel after the
+	// handler failed, nil when none was
+	ErrorPolicy *ErrorPolicy
+	// Commands counts the commands sent to Asterisk
+	Commands int
+	// CommandsRejected counts the commands refused by
+	// WithMaxCommandsPerSession and WithMaxCommandRate
+	CommandsRejected int
+	// BytesRead and BytesWritten count the bytes received from and sent to
+	// Asterisk, including the environment
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Info returns what is known about the session so far. Fields taken from
+// the environment are empty until it has been read.
+func (s *AgiSession) Info() SessionInfo {
+	script := s.env["agi_network_script"]
+	if script == "" {
+		script = s.env["agi_request"]
+	}
+	return SessionInfo{
+		Start:            s.start,
+		RemoteAddr:       s.remoteAddr,
+		LocalAddr:        s.localAddr,
+		Script:           script,
+		UniqueID:         s.env["agi_uniqueid"],
+		CallerID:         s.env["agi_callerid"],
+		RootRequest:      rootRequest(s.env),
+		Tenant:           s.tenant,
+		Flags:            s.Flags(),
+		EnvTransformed:   s.envTransformed,
+		ErrorPolicy:      s.appliedErrorPolicy,
+		Commands:         s.sent,
+		CommandsRejected: s.limits.rejected,
+		BytesRead:        s.bytesRead.Load(),
+		BytesWritten:     s.bytesWritten.Load(),
+	}
+}
+
+// WithSessionCompleted calls fn exactly once for every FastAGI session once
+// it ends, whether the handler returned, panicked or was never run because
+// the environment could not be read, in which case the info holds whatever
+// arrived. Connections closed without sending anything, such as health
+// probes, are not sessions and are only counted in ServerStats.Probes.
+func WithSessionCompleted(fn func(SessionInfo)) ServerOption {
+	return func(s *FastAGIServer) {
+		s.sessionCompleted = fn
+	}
+}
+
+// countingConn counts the bytes a session reads from and writes to its
+// connection
+type countingConn struct {
+	net.Conn
+	session *AgiSession
+}
+
+// Read implements io.Reader
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.session.bytesRead.Add(int64(n))
+	return n, err
+}
+
+// Write implements io.Writer
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.session.bytesWritten.Add(int64(n))
+	return n, err
+}
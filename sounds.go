@@ -0,0 +1,198 @@
+package agi
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// DefaultSoundsDir is where Asterisk keeps sound files in a default install
+const DefaultSoundsDir = "/var/lib/asterisk/sounds"
+
+// DefaultSoundFormats are the file formats SoundExists looks for
+var DefaultSoundFormats = []string{"wav", "gsm", "ulaw", "alaw", "sln", "g722"}
+
+// SetSoundsDir sets the directory SoundExists looks for relative sound
+// names in. An empty dir restores DefaultSoundsDir.
+func (s *AgiSession) SetSoundsDir(dir string) {
+	s.soundsDir = dir
+	clear(s.soundCache)
+}
+
+// SetSoundFormats sets the file extensions SoundExists tries. Calling it
+// without formats restores DefaultSoundFormats.
+func (s *AgiSession) SetSoundFormats(formats ...string) {
+	s.soundFormats = formats
+	clear(s.soundCache)
+}
+
+// SetStrictPrompts makes StreamFile, GetOption and GetData check each file
+// with SoundExists before playing it and fail with ErrPromptNotFound when it
+// is missing, instead of letting the caller hear silence
+func (s *AgiSession) SetStrictPrompts(enabled bool) {
+	s.strictPrompts = enabled
+}
+
+// WithStrictPrompts enables SetStrictPrompts on every session
+func WithStrictPrompts(enabled bool) ServerOption {
+	return func(s *FastAGIServer) {
+		s.strictPrompts = enabled
+	}
+}
+
+// SoundExists reports whether Asterisk can find the sound file name, as
+// StreamFile would look for it: in the directory for the channel's language
+// first and then in the sounds directory itself, with any of the configured
+// formats. Absolute names are checked as given.
+//
+// The check is a single GET FULL VARIABLE evaluating the STAT function on the
+// PBX, so it costs one round trip and plays nothing to the caller, but it
+// only sees files on the Asterisk host and cannot know about formats outside
+// SetSoundFormats. Results are cached for the rest of the session.
+func (s *AgiSession) SoundExists(name string) (bool, error) {
+	if name == "" || strings.ContainsAny(name, "$(){}[],|\"\\ \t") {
+		return false, fmt.Errorf("invalid sound name %q", name)
+	}
+	if exists, ok := s.soundCache[name]; ok {
+		return exists, nil
+	}
+
+	value, err := s.GetFullVariable(s.soundExpression(name))
+	if err != nil {
+		return false, err
+	}
+	exists := value == "1"
+
+	if s.soundCache == nil {
+		s.soundCache = make(map[string]bool)
+	}
+	s.soundCache[name] = exists
+	return exists, nil
+}
+
+// soundExpression builds an expression that is 1 when any candidate file
+// for name exists and 0 otherwise
+func (s *AgiSession) soundExpression(name string) string {
+	dir := s.soundsDir
+	if dir == "" {
+		dir = DefaultSoundsDir
+	}
+	formats := s.soundFormats
+	if len(formats) == 0 {
+		formats = DefaultSoundFormats
+	}
+
+	var bases []string
+	if path.IsAbs(name) {
+		bases = []string{name}
+	} else {
+		language := s.language
+		if language == "" {
+			language = s.env["agi_language"]
+		}
+		if language != "" {
+			bases = append(bases, path.Join(dir, language, name))
+		}
+		bases = append(bases, path.Join(dir, name))
+	}
+
+	var checks []string
+	for _, base := range bases {
+		for _, format := range formats {
+			checks = append(checks, fmt.Sprintf("${STAT(e,%s.%s)}", base, format))
+		}
+	}
+	return "$[" + strings.Join(checks, " | ") + "]"
+}
+
+// PromptResolver returns the files to try, in order, for the prompt name in
+// a language, such as "es/welcome" and then "welcome"
+type PromptResolver func(name, language string) []string
+
+// DefaultPromptResolver tries name in the language's directory first and then
+// name itself. Absolute names and sessions without a language get name only.
+func DefaultPromptResolver(name, language string) []string {
+	if language == "" || path.IsAbs(name) {
+		return []string{name}
+	}
+	return []string{path.Join(language, name), name}
+}
+
+// FallbackLanguages returns a resolver trying the caller's language, then
+// each of languages in turn, then name itself
+func FallbackLanguages(languages ...string) PromptResolver {
+	return func(name, language string) []string {
+		if path.IsAbs(name) {
+			return []string{name}
+		}
+		var candidates []string
+		for _, lang := range append([]string{language}, languages...) {
+			if lang == "" {
+				continue
+			}
+			if file := path.Join(lang, name); !slices.Contains(candidates, file) {
+				candidates = append(candidates, file)
+			}
+		}
+		return append(candidates, name)
+	}
+}
+
+// SetPromptResolver makes StreamFile, GetOption and GetData try each file r
+// returns for a prompt until one exists, instead of relying on Asterisk's own
+// language fallback. With strict prompts missing candidates are skipped with
+// the SoundExists check; otherwise a STREAM FILE or GET OPTION that stops at
+// offset 0 without a digit counts as missing, which GET DATA cannot report.
+// When no candidate exists the call fails with ErrPromptNotFound. Prompt
+// metrics report the candidate played. A nil r plays names as given.
+func (s *AgiSession) SetPromptResolver(r PromptResolver) {
+	s.promptResolver = r
+}
+
+// WithPromptResolver sets the PromptResolver of every session
+func WithPromptResolver(r PromptResolver) ServerOption {
+	return func(s *FastAGIServer) {
+		s.promptResolver = r
+	}
+}
+
+// promptCommand sends the command build returns for the first candidate of
+// name that exists and reports its playback. Missing candidates are found
+// with the strict prompts check and, when endpos is set, by playback ending
+// at offset 0.
+func (s *AgiSession) promptCommand(name string, endpos bool, build func(file string) string) (*AgiResponse, error) {
+	candidates := []string{name}
+	if s.promptResolver != nil {
+		language := s.language
+		if language == "" {
+			language = s.env["agi_language"]
+		}
+		if resolved := s.promptResolver(name, language); len(resolved) > 0 {
+			candidates = resolved
+		}
+	}
+
+	for _, file := range candidates {
+		if s.strictPrompts {
+			exists, err := s.SoundExists(file)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+		}
+
+		resp, err := s.execute(build(file))
+		if err != nil {
+			return nil, err
+		}
+		if endpos && s.promptResolver != nil && resp.Result == 0 && resp.HasEndPos && resp.EndPos == 0 {
+			continue
+		}
+		s.reportPrompt(file, resp)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrPromptNotFound, strings.Join(candidates, ", "))
+}
@@ -0,0 +1,336 @@
+// Package survey runs post-call surveys: a fixed list of questions, each
+// answered with one digit, yes or no, or a recording, with the answers
+// handed to a persistence callback as they are given.
+package survey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+)
+
+// Kind is how a question is answered
+type Kind string
+
+const (
+	// Digit questions are answered with one digit between Min and Max
+	Digit Kind = "digit"
+	// YesNo questions are answered with 1 for yes or 2 for no
+	YesNo Kind = "yesno"
+	// Recording questions are answered by speaking after the beep
+	Recording Kind = "recording"
+)
+
+// Values of YesNo answers
+const (
+	Yes = "yes"
+	No  = "no"
+)
+
+// Defaults applied to questions that leave the setting zero
+const (
+	DefaultTimeout      = 5 * time.Second
+	DefaultRetries      = 2
+	DefaultMaxRecording = 60 * time.Second
+	// DefaultRecordingName names recordings on the Asterisk host; {survey},
+	// {uniqueid} and {question} are replaced
+	DefaultRecordingName = "survey-{survey}-{uniqueid}-{question}"
+)
+
+// Condition limits a question to callers whose earlier answer to Question
+// is one of In
+type Condition struct {
+	Question string   `json:"question"`
+	In       []string `json:"in"`
+}
+
+// Question is one survey question
+type Question struct {
+	ID     string `json:"id"`
+	Prompt string `json:"prompt"`
+	Kind   Kind   `json:"kind"`
+	// Min and Max bound the digit accepted by Digit questions
+	Min int `json:"min,omitempty"`
+	Max int `json:"max,omitempty"`
+	// TimeoutMS is how long to wait for a digit, DefaultTimeout when zero
+	TimeoutMS int `json:"timeout_ms,omitempty"`
+	// Retries is how many more times the question is asked after no or an
+	// invalid answer, DefaultRetries when zero; negative asks only once
+	Retries int `json:"retries,omitempty"`
+	// InvalidPrompt is played before asking again
+	InvalidPrompt string `json:"invalid_prompt,omitempty"`
+	// MaxRecordingMS limits Recording answers, DefaultMaxRecording when zero
+	MaxRecordingMS int `json:"max_recording_ms,omitempty"`
+	// When, if set, asks the question only if an earlier answer matches
+	When *Condition `json:"when,omitempty"`
+}
+
+// Survey is a list of questions with optional prompts around them. Surveys
+// are usually loaded from configuration with Parse.
+type Survey struct {
+	Name      string     `json:"name"`
+	Intro     string     `json:"intro,omitempty"`
+	Questions []Question `json:"questions"`
+	Goodbye   string     `json:"goodbye,omitempty"`
+	// RecordingFormat is the format of Recording answers, "wav" when empty
+	RecordingFormat string `json:"recording_format,omitempty"`
+	// RecordingName overrides DefaultRecordingName
+	RecordingName string `json:"recording_name,omitempty"`
+
+	// Persist is called with the results so far after every answer and
+	// once more when the survey ends, with Complete set if it finished,
+	// so answers given before a hangup are not lost. The final call's
+	// context is not cancelled with the call. An error stops the survey.
+	Persist func(ctx context.Context, r Results) error `json:"-"`
+}
+
+// Answer is the caller's answer to one question
+type Answer struct {
+	Question string `json:"question"`
+	// Value is the digit, Yes or No, or the recording's file name
+	Value string    `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+// Results are the answers collected by Run
+type Results struct {
+	Survey   string   `json:"survey"`
+	UniqueID string   `json:"uniqueid"`
+	Answers  []Answer `json:"answers"`
+	// Unanswered lists questions asked without a valid answer
+	Unanswered []string `json:"unanswered,omitempty"`
+	// Skipped lists questions left out by their When condition
+	Skipped  []string `json:"skipped,omitempty"`
+	Complete bool     `json:"complete"`
+}
+
+// Answer returns the answer to question, if it was given
+func (r Results) Answer(question string) (Answer, bool) {
+	for _, a := range r.Answers {
+		if a.Question == question {
+			return a, true
+		}
+	}
+	return Answer{}, false
+}
+
+// Parse reads a survey definition from JSON and validates it
+func Parse(data []byte) (*Survey, error) {
+	var sv Survey
+	if err := json.Unmarshal(data, &sv); err != nil {
+		return nil, fmt.Errorf("survey: %w", err)
+	}
+	if err := sv.Validate(); err != nil {
+		return nil, err
+	}
+	return &sv, nil
+}
+
+// Validate checks that every question is well formed and that conditions
+// only refer to earlier questions
+func (sv *Survey) Validate() error {
+	if len(sv.Questions) == 0 {
+		return fmt.Errorf("survey %q: no questions", sv.Name)
+	}
+	seen := make(map[string]bool, len(sv.Questions))
+	for i, q := range sv.Questions {
+		if q.ID == "" {
+			return fmt.Errorf("survey %q: question %d has no id", sv.Name, i+1)
+		}
+		if seen[q.ID] {
+			return fmt.Errorf("survey %q: duplicate question %q", sv.Name, q.ID)
+		}
+		if q.Prompt == "" {
+			return fmt.Errorf("survey %q: question %q has no prompt", sv.Name, q.ID)
+		}
+		switch q.Kind {
+		case Digit:
+			if q.Min < 0 || q.Max > 9 || q.Min > q.Max {
+				return fmt.Errorf("survey %q: question %q: invalid range %d-%d", sv.Name, q.ID, q.Min, q.Max)
+			}
+		case YesNo, Recording:
+		default:
+			return fmt.Errorf("survey %q: question %q: unknown kind %q", sv.Name, q.ID, q.Kind)
+		}
+		if q.When != nil && !seen[q.When.Question] {
+			return fmt.Errorf("survey %q: question %q depends on %q, which is not an earlier question", sv.Name, q.ID, q.When.Question)
+		}
+		seen[q.ID] = true
+	}
+	return nil
+}
+
+// Run asks each question in turn and returns the answers. When the caller
+// hangs up or ctx ends part way, the answers given so far are returned with
+// the error.
+func (sv *Survey) Run(ctx context.Context, s *agi.AgiSession) (Results, error) {
+	results := Results{Survey: sv.Name, UniqueID: s.GetEnv("agi_uniqueid")}
+	if err := sv.Validate(); err != nil {
+		return results, err
+	}
+
+	err := sv.run(ctx, s, &results)
+	results.Complete = err == nil
+	// The final results are saved even when ctx ended with the call
+	if perr := sv.persist(context.WithoutCancel(ctx), results); perr != nil && err == nil {
+		err = perr
+	}
+	return results, err
+}
+
+// run plays the survey, adding answers to results as they are given
+func (sv *Survey) run(ctx context.Context, s *agi.AgiSession, results *Results) error {
+	if sv.Intro != "" {
+		if err := s.StreamFile(sv.Intro, ""); err != nil {
+			return err
+		}
+	}
+
+	for _, q := range sv.Questions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !results.matches(q.When) {
+			results.Skipped = append(results.Skipped, q.ID)
+			continue
+		}
+
+		value, err := sv.ask(ctx, s, results.UniqueID, q)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			results.Unanswered = append(results.Unanswered, q.ID)
+			continue
+		}
+		results.Answers = append(results.Answers, Answer{Question: q.ID, Value: value, Time: time.Now()})
+		if err := sv.persist(ctx, *results); err != nil {
+			return err
+		}
+	}
+
+	if sv.Goodbye != "" {
+		return s.StreamFile(sv.Goodbye, "")
+	}
+	return nil
+}
+
+// matches reports whether the answers so far satisfy cond
+func (r *Results) matches(cond *Condition) bool {
+	if cond == nil {
+		return true
+	}
+	answer, ok := r.Answer(cond.Question)
+	if !ok {
+		return false
+	}
+	for _, v := range cond.In {
+		if strings.EqualFold(v, answer.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ask puts one question to the caller, retrying on no or an invalid answer,
+// and returns the answer or "" when none was given
+func (sv *Survey) ask(ctx context.Context, s *agi.AgiSession, uniqueID string, q Question) (string, error) {
+	if q.Kind == Recording {
+		return sv.record(ctx, s, uniqueID, q)
+	}
+
+	digits := "12"
+	if q.Kind == Digit {
+		var b strings.Builder
+		for d := q.Min; d <= q.Max; d++ {
+			b.WriteString(strconv.Itoa(d))
+		}
+		digits = b.String()
+	}
+	timeout := DefaultTimeout
+	if q.TimeoutMS > 0 {
+		timeout = time.Duration(q.TimeoutMS) * time.Millisecond
+	}
+	retries := q.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+
+	for attempt := 0; attempt <= max(retries, 0); attempt++ {
+		if attempt > 0 && q.InvalidPrompt != "" {
+			if err := s.StreamFile(q.InvalidPrompt, ""); err != nil {
+				return "", err
+			}
+		}
+		digit, err := s.GetOption(q.Prompt, digits, timeout)
+		if err != nil {
+			return "", err
+		}
+		if s.HungUp() {
+			return "", agi.ErrHangup
+		}
+		if digit == "" || !strings.Contains(digits, digit) {
+			continue
+		}
+		if q.Kind == YesNo {
+			if digit == "1" {
+				return Yes, nil
+			}
+			return No, nil
+		}
+		return digit, nil
+	}
+	return "", nil
+}
+
+// record plays the question and records the caller's spoken answer
+func (sv *Survey) record(ctx context.Context, s *agi.AgiSession, uniqueID string, q Question) (string, error) {
+	if err := s.StreamFile(q.Prompt, ""); err != nil {
+		return "", err
+	}
+
+	name := sv.RecordingName
+	if name == "" {
+		name = DefaultRecordingName
+	}
+	name = strings.NewReplacer("{survey}", sv.Name, "{uniqueid}", uniqueID, "{question}", q.ID).Replace(name)
+	limit := DefaultMaxRecording
+	if q.MaxRecordingMS > 0 {
+		limit = time.Duration(q.MaxRecordingMS) * time.Millisecond
+	}
+
+	_, err := s.RecordFileWithProgress(ctx, name, agi.RecordOptions{
+		Format:       sv.RecordingFormat,
+		EscapeDigits: "#",
+		Timeout:      limit,
+		Beep:         true,
+		Silence:      3 * time.Second,
+	}, nil)
+	if errors.Is(err, agi.ErrRecordFailed) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// persist passes the results to the Persist callback, if any
+func (sv *Survey) persist(ctx context.Context, r Results) error {
+	if sv.Persist == nil {
+		return nil
+	}
+	r.Answers = append([]Answer(nil), r.Answers...)
+	r.Unanswered = append([]string(nil), r.Unanswered...)
+	r.Skipped = append([]string(nil), r.Skipped...)
+	if err := sv.Persist(ctx, r); err != nil {
+		return fmt.Errorf("survey %q: persist: %w", sv.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package survey
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	agi "github.com/Shubham-Thakur06/go-asterisk-agi"
+	"github.com/Shubham-Thakur06/go-asterisk-agi/agitest"
+)
+
+const definition = `{
+	"name": "csat",
+	"intro": "survey-intro",
+	"questions": [
+		{"id": "score", "prompt": "survey-rate", "kind": "digit", "min": 1, "max": 5, "invalid_prompt": "survey-invalid"},
+		{"id": "resolved", "prompt": "survey-resolved", "kind": "yesno"},
+		{"id": "why", "prompt": "survey-tell-us", "kind": "recording", "max_recording_ms": 30000,
+		 "when": {"question": "score", "in": ["1", "2"]}},
+		{"id": "recommend", "prompt": "survey-recommend", "kind": "yesno"}
+	],
+	"goodbye": "survey-thanks"
+}`
+
+// runSurvey runs sv against a fake answering with responses and returns the
+// results, error, fake commands and every persisted snapshot
+func runSurvey(t *testing.T, sv *Survey, responses ...string) (Results, error, []string, []Results) {
+	t.Helper()
+	var saved []Results
+	sv.Persist = func(_ context.Context, r Results) error {
+		saved = append(saved, r)
+		return nil
+	}
+
+	fake := agitest.NewFake(responses)
+	session, err := fake.Session(context.Background())
+	require.NoError(t, err)
+	defer fake.Close()
+
+	results, err := sv.Run(context.Background(), session)
+	return results, err, fake.Commands(), saved
+}
+
+func TestParse(t *testing.T) {
+	sv, err := Parse([]byte(definition))
+	require.NoError(t, err)
+	assert.Equal(t, "csat", sv.Name)
+	require.Len(t, sv.Questions, 4)
+	assert.Equal(t, Digit, sv.Questions[0].Kind)
+	assert.Equal(t, &Condition{Question: "score", In: []string{"1", "2"}}, sv.Questions[2].When)
+
+	invalid := []string{
+		`{"name": "x", "questions": []}`,
+		`{"name": "x", "questions": [{"id": "a", "prompt": "p", "kind": "essay"}]}`,
+		`{"name": "x", "questions": [{"id": "a", "prompt": "p", "kind": "digit", "min": 3, "max": 12}]}`,
+		`{"name": "x", "questions": [{"id": "a", "prompt": "p", "kind": "yesno"}, {"id": "a", "prompt": "p", "kind": "yesno"}]}`,
+		`{"name": "x", "questions": [{"id": "a", "prompt": "p", "kind": "yesno", "when": {"question": "b", "in": ["yes"]}}]}`,
+	}
+	for _, def := range invalid {
+		_, err := Parse([]byte(def))
+		assert.Error(t, err, def)
+	}
+}
+
+func TestRunSkipsConditionalQuestion(t *testing.T) {
+	sv, err := Parse([]byte(definition))
+	require.NoError(t, err)
+
+	results, err, commands, saved := runSurvey(t, sv,
+		"200 result=0 endpos=8000",  // intro
+		"200 result=52 endpos=4000", // score: 4
+		"200 result=49 endpos=4000", // resolved: yes
+		"200 result=50 endpos=4000", // recommend: no
+		"200 result=0 endpos=8000",  // goodbye
+	)
+	require.NoError(t, err)
+	assert.True(t, results.Complete)
+	assert.Equal(t, []string{"why"}, results.Skipped)
+	values := map[string]string{}
+	for _, a := range results.Answers {
+		values[a.Question] = a.Value
+	}
+	assert.Equal(t, map[string]string{"score": "4", "resolved": Yes, "recommend": No}, values)
+
+	assert.Equal(t, []string{
+		`STREAM FILE survey-intro ""`,
+		`GET OPTION survey-rate "12345" 5000`,
+		`GET OPTION survey-resolved "12" 5000`,
+		`GET OPTION survey-recommend "12" 5000`,
+		`STREAM FILE survey-thanks ""`,
+	}, commands)
+	require.Len(t, saved, 4)
+	assert.False(t, saved[2].Complete)
+	assert.True(t, saved[3].Complete)
+}
+
+func TestRunAsksConditionalQuestion(t *testing.T) {
+	sv, err := Parse([]byte(definition))
+	require.NoError(t, err)
+
+	results, err, commands, _ := runSurvey(t, sv,
+		"200 result=0 endpos=8000",          // intro
+		"200 result=0 endpos=4000",          // score: no answer
+		"200 result=0 endpos=4000",          // invalid prompt
+		"200 result=50 endpos=4000",         // score: 2
+		"200 result=49 endpos=4000",         // resolved: yes
+		"200 result=0 endpos=8000",          // why prompt
+		"200 result=35 (dtmf) endpos=64000", // why recording
+		"200 result=0 endpos=4000",          // recommend: no answer
+		"200 result=0 endpos=4000",          // invalid prompt
+		"200 result=0 endpos=4000",          // recommend: no answer
+		"200 result=0 endpos=4000",          // invalid prompt
+		"200 result=0 endpos=4000",          // recommend: no answer
+		"200 result=0 endpos=8000",          // goodbye
+	)
+	require.NoError(t, err)
+	why, ok := results.Answer("why")
+	require.True(t, ok)
+	assert.Equal(t, "survey-csat-1700000000.1-why", why.Value)
+	assert.Equal(t, []string{"recommend"}, results.Unanswered)
+	assert.Contains(t, commands, `RECORD FILE survey-csat-1700000000.1-why wav "#" 30000 0 BEEP s=3`)
+	assert.Equal(t, `STREAM FILE survey-invalid ""`, commands[2])
+}
+
+func TestRunHangupAfterQuestionTwo(t *testing.T) {
+	sv, err := Parse([]byte(definition))
+	require.NoError(t, err)
+
+	results, err, commands, saved := runSurvey(t, sv,
+		"200 result=0 endpos=8000",       // intro
+		"200 result=49 endpos=4000",      // score: 1
+		"200 result=50 endpos=4000",      // resolved: no
+		"HANGUP\n200 result=-1 endpos=0", // why prompt: hangup
+	)
+	assert.True(t, errors.Is(err, agi.ErrHangup))
+	assert.False(t, results.Complete)
+	assert.Len(t, results.Answers, 2)
+	assert.NotContains(t, commands, "GET OPTION survey-recommend \"12\" 5000")
+
+	// Each answer was saved as it was given, then the partial results once more
+	require.Len(t, saved, 3)
+	assert.Len(t, saved[0].Answers, 1)
+	assert.Len(t, saved[1].Answers, 2)
+	assert.Equal(t, results, saved[2])
+}
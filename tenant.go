@@ -0,0 +1,185 @@
+package agi
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"sync/atomic"
+)
+
+// TenantConfig is the configuration of one tenant of a server shared by
+// several customers, applied to each of its sessions before the handler
+// runs. Zero fields leave the server's own configuration in place.
+type TenantConfig struct {
+	// SoundPrefix is the directory of the tenant's own prompts. Relative
+	// prompt names are tried under it first and then as the session's
+	// PromptResolver gives them, so shared prompts need not be copied.
+	SoundPrefix string
+	// Language is set as CHANNEL(language) with SetLanguage
+	Language string
+	// Flags are added to the session's feature flags, replacing those
+	// WithFeatureFlags evaluated under the same names
+	Flags map[string]bool
+	// MaxCommands and CommandRate replace WithMaxCommandsPerSession and
+	// WithMaxCommandRate for the tenant's sessions
+	MaxCommands int
+	CommandRate float64
+}
+
+// TenantStats is a snapshot of one tenant's counters
+type TenantStats struct {
+	// Sessions counts sessions resolved to the tenant
+	Sessions int64
+	// Failures counts those of them that ended with an error
+	Failures int64
+}
+
+// tenant is a registered tenant and its counters
+type tenant struct {
+	config   TenantConfig
+	sessions atomic.Int64
+	failures atomic.Int64
+}
+
+// tenantKey is the context key of the session's tenant
+type tenantKey struct{}
+
+// WithTenantResolver names the tenant of every session with fn, evaluated
+// once the environment is read and transformed and feature flags are
+// evaluated. The configuration registered for the tenant with WithTenant
+// is applied before the session is answered and the handler runs. A
+// session whose tenant is not registered, including one fn names with an
+// empty string, is passed to the WithUnknownTenantHandler handler, or
+// fails with ErrUnknownTenant without reaching the server's handler. An
+// error from fn fails the session.
+func WithTenantResolver(fn func(s *AgiSession) (string, error)) ServerOption {
+	return func(s *FastAGIServer) {
+		s.tenantResolver = fn
+	}
+}
+
+// WithTenant registers the configuration of a tenant named by the
+// WithTenantResolver function
+func WithTenant(name string, config TenantConfig) ServerOption {
+	return func(s *FastAGIServer) {
+		if s.tenants == nil {
+			s.tenants = make(map[string]*tenant)
+		}
+		s.tenants[name] = &tenant{config: config}
+	}
+}
+
+// WithUnknownTenantHandler sets the handler for sessions whose tenant is
+// not registered, in place of failing them, such as one playing an
+// announcement or ContinueDialplanAt a priority that rejects the call
+func WithUnknownTenantHandler(h Handler) ServerOption {
+	return func(s *FastAGIServer) {
+		s.unknownTenant = h
+	}
+}
+
+// TenantFromQuery returns a tenant resolver reading the query parameter
+// param of the FastAGI URL, so agi://host/ivr?tenant=acme resolves to acme
+func TenantFromQuery(param string) func(s *AgiSession) (string, error) {
+	return func(s *AgiSession) (string, error) {
+		return requestQuery(s.env).Get(param), nil
+	}
+}
+
+// TenantFromVariable returns a tenant resolver reading the channel
+// variable name, such as one set in the dialplan before AGI() is called.
+// It costs one GET VARIABLE per session.
+func TenantFromVariable(name string) func(s *AgiSession) (string, error) {
+	return func(s *AgiSession) (string, error) {
+		return s.GetVariable(name)
+	}
+}
+
+// Tenant returns the session's tenant, or an empty string when the server
+// has no WithTenantResolver
+func (s *AgiSession) Tenant() string {
+	return s.tenant
+}
+
+// TenantFromContext returns the tenant of the session ctx was derived
+// from, such as the context passed to the handler
+func TenantFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(tenantKey{}).(string)
+	return name
+}
+
+// resolveTenant names the session's tenant and returns its registration,
+// nil when the tenant is unknown
+func (s *FastAGIServer) resolveTenant(session *AgiSession) (*tenant, error) {
+	name, err := s.tenantResolver(session)
+	if err != nil {
+		return nil, fmt.Errorf("resolve tenant: %w", err)
+	}
+	session.tenant = name
+	t := s.tenants[name]
+	if t == nil {
+		s.stats.unknownTenants.Add(1)
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTenant, name)
+	}
+	t.sessions.Add(1)
+	return t, nil
+}
+
+// tenantStats returns a snapshot of every tenant's counters
+func (s *FastAGIServer) tenantStats() map[string]TenantStats {
+	stats := make(map[string]TenantStats, len(s.tenants))
+	for name, t := range s.tenants {
+		stats[name] = TenantStats{Sessions: t.sessions.Load(), Failures: t.failures.Load()}
+	}
+	return stats
+}
+
+// applyTenant configures session for its tenant
+func (s *AgiSession) applyTenant(config TenantConfig) error {
+	if config.MaxCommands != 0 {
+		s.limits.max = config.MaxCommands
+	}
+	if config.CommandRate != 0 {
+		s.limits.rate = config.CommandRate
+	}
+	if len(config.Flags) > 0 {
+		if s.flags == nil {
+			s.flags = make(map[string]bool, len(config.Flags))
+		}
+		maps.Copy(s.flags, config.Flags)
+	}
+	if config.SoundPrefix != "" {
+		s.promptResolver = prefixedPrompts(config.SoundPrefix, s.promptResolver)
+	}
+	if config.Language != "" {
+		return s.SetLanguage(config.Language)
+	}
+	return nil
+}
+
+// prefixedPrompts returns a resolver trying each candidate of r, or name
+// itself when r is nil, under prefix before trying the candidates as given
+func prefixedPrompts(prefix string, r PromptResolver) PromptResolver {
+	return func(name, language string) []string {
+		candidates := []string{name}
+		if r != nil {
+			if resolved := r(name, language); len(resolved) > 0 {
+				candidates = resolved
+			}
+		}
+		var files []string
+		for _, file := range candidates {
+			if !path.IsAbs(file) {
+				files = append(files, path.Join(prefix, file))
+			}
+		}
+		for _, file := range candidates {
+			if !slices.Contains(files, file) {
+				files = append(files, file)
+			}
+		}
+		return files
+	}
+}
@@ -0,0 +1,62 @@
+package agi
+
+import "time"
+
+// UniformDigitSpread is how much the gaps between digits may vary for
+// SuspiciouslyUniform to report them. People pressing keys vary by far more
+// than this from one digit to the next, while scripted senders and some
+// dialers space every digit identically, such as exactly 100ms apart.
+const UniformDigitSpread = 15 * time.Millisecond
+
+// MinUniformDigits is how many digits SuspiciouslyUniform needs before it
+// reports anything, since two or three evenly spaced digits are common
+const MinUniformDigits = 4
+
+// SuspiciouslyUniform reports whether digits arrived at intervals too even
+// to come from a person: at least MinUniformDigits timings, as in
+// CollectResult.Timings, whose consecutive gaps differ by no more than
+// UniformDigitSpread. The wait for the first digit is not a gap, so the
+// caller's reaction to the prompt does not matter.
+func SuspiciouslyUniform(timings []time.Duration) bool {
+	if len(timings) < MinUniformDigits {
+		return false
+	}
+	shortest, longest := timings[1]-timings[0], timings[1]-timings[0]
+	for i := 2; i < len(timings); i++ {
+		gap := timings[i] - timings[i-1]
+		shortest, longest = min(shortest, gap), max(longest, gap)
+	}
+	return longest-shortest <= UniformDigitSpread
+}
+
+// digitTimer records when digits arrive during a collection, measured from
+// its start. A nil digitTimer records nothing.
+type digitTimer struct {
+	clock   Clock
+	start   time.Time
+	timings []time.Duration
+}
+
+// digitTimer returns a timer started now, or nil unless enabled
+func (s *AgiSession) digitTimer(enabled bool) *digitTimer {
+	if !enabled {
+		return nil
+	}
+	c := s.clock()
+	return &digitTimer{clock: c, start: c.Now()}
+}
+
+// mark records a digit received now
+func (t *digitTimer) mark() {
+	if t != nil {
+		t.timings = append(t.timings, since(t.clock, t.start))
+	}
+}
+
+// result returns the recorded timings
+func (t *digitTimer) result() []time.Duration {
+	if t == nil {
+		return nil
+	}
+	return t.timings
+}
@@ -0,0 +1,156 @@
+package agi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TranscriptFormat selects how transcripts are written
+type TranscriptFormat int
+
+const (
+	// TranscriptText writes two lines per exchange: the command prefixed
+	// with ">" and the response prefixed with "<", or "!" and the error
+	TranscriptText TranscriptFormat = iota
+	// TranscriptJSON writes one TranscriptRecord per line as JSON
+	TranscriptJSON
+)
+
+// TranscriptTimeFormat is the timestamp layout of text transcripts
+const TranscriptTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// TranscriptRecord is one exchange in a JSON transcript. Its field names are
+// part of the format and do not change.
+type TranscriptRecord struct {
+	Time     time.Time `json:"time"`
+	UniqueID string    `json:"uniqueid"`
+	// Direction is "out" for commands the session sent to Asterisk
+	Direction string `json:"direction"`
+	Verb      string `json:"verb"`
+	Args      string `json:"args"`
+	// Code is the response status code, such as 200, or zero without a response
+	Code int `json:"code"`
+	// Result is the value after "result=" and Data the rest of the response
+	Result     string  `json:"result"`
+	Data       string  `json:"data"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// NewTranscriptRecord builds the record for an exchange. Redact it first if
+// it may hold caller data.
+func NewTranscriptRecord(uniqueID string, e Exchange) TranscriptRecord {
+	verb := commandVerb(e.Command)
+	r := TranscriptRecord{
+		Time:       e.Time.UTC(),
+		UniqueID:   uniqueID,
+		Direction:  "out",
+		Verb:       verb,
+		Args:       strings.TrimSpace(e.Command[min(len(verb), len(e.Command)):]),
+		DurationMS: float64(e.Elapsed.Microseconds()) / 1000,
+	}
+	if e.Err != nil {
+		r.Error = e.Err.Error()
+	}
+
+	code, rest, _ := strings.Cut(e.Response, " ")
+	if n, err := strconv.Atoi(code); err == nil {
+		r.Code = n
+		rest = strings.TrimPrefix(rest, "result=")
+		r.Result, r.Data, _ = strings.Cut(rest, " ")
+	}
+	return r
+}
+
+// Exchange converts the record back to the exchange it describes
+func (r TranscriptRecord) Exchange() Exchange {
+	e := Exchange{
+		Time:    r.Time,
+		Command: strings.TrimSpace(r.Verb + " " + r.Args),
+		Elapsed: time.Duration(r.DurationMS * float64(time.Millisecond)),
+	}
+	if r.Error != "" {
+		e.Err = fmt.Errorf("%s", r.Error)
+	}
+	if r.Code != 0 {
+		e.Response = fmt.Sprintf("%d result=%s", r.Code, r.Result)
+		if r.Data != "" {
+			e.Response += " " + r.Data
+		}
+	}
+	return e
+}
+
+// transcript writes exchanges to a writer shared by many sessions, one
+// whole record at a time
+type transcript struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format TranscriptFormat
+}
+
+// write appends the exchange to the transcript. Write errors are ignored so
+// a failing log destination never fails the call.
+func (t *transcript) write(uniqueID string, e Exchange) {
+	var line []byte
+	switch t.format {
+	case TranscriptJSON:
+		line, _ = json.Marshal(NewTranscriptRecord(uniqueID, e))
+		line = append(line, '\n')
+	default:
+		if uniqueID == "" {
+			uniqueID = "-"
+		}
+		prefix := fmt.Sprintf("%s %s %v", e.Time.UTC().Format(TranscriptTimeFormat), uniqueID, e.Elapsed.Round(time.Microsecond))
+		line = fmt.Appendf(nil, "%s > %s\n", prefix, e.Command)
+		if e.Err != nil {
+			line = fmt.Appendf(line, "%s ! %v\n", prefix, e.Err)
+		} else {
+			line = fmt.Appendf(line, "%s < %s\n", prefix, e.Response)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.w.Write(line)
+}
+
+// SetTranscript writes every exchange of the session to w in the given
+// format, after applying the session's exchange redactor. A nil w stops the
+// transcript.
+func (s *AgiSession) SetTranscript(w io.Writer, format TranscriptFormat) {
+	if w == nil {
+		s.transcript = nil
+		return
+	}
+	s.transcript = &transcript{w: w, format: format}
+}
+
+// WithTranscript writes the exchanges of every session to w, which is
+// written one whole record at a time so sessions do not interleave
+func WithTranscript(w io.Writer) ServerOption {
+	return func(s *FastAGIServer) {
+		s.transcriptWriter = w
+	}
+}
+
+// WithTranscriptFormat sets the format WithTranscript writes, TranscriptText
+// by default
+func WithTranscriptFormat(format TranscriptFormat) ServerOption {
+	return func(s *FastAGIServer) {
+		s.transcriptFormat = format
+	}
+}
+
+// writeTranscript adds an exchange to the session's transcript, if any
+func (s *AgiSession) writeTranscript(e Exchange) {
+	if s.transcript == nil {
+		return
+	}
+	s.transcript.write(s.env["agi_uniqueid"], s.redact(e))
+}
@@ -0,0 +1,93 @@
+package agi
+
+import "fmt"
+
+// TransferStatus is the outcome reported in TRANSFERSTATUS
+type TransferStatus string
+
+const (
+	TransferSuccess      TransferStatus = "SUCCESS"
+	TransferFailure      TransferStatus = "FAILURE"
+	TransferUnsupported  TransferStatus = "UNSUPPORTED"
+	TransferNotPermitted TransferStatus = "NOTPERMITTED"
+	TransferUnknown      TransferStatus = "UNKNOWN"
+)
+
+// TransferResult is the outcome of Transfer
+type TransferResult struct {
+	Status TransferStatus
+	// Protocol is the channel driver's response from
+	// TRANSFERSTATUSPROTOCOL, such as the SIP status code, when it set one
+	Protocol string
+}
+
+// TransferInfo describes a transfer of this channel by the far end, read
+// from the BLINDTRANSFER and ATTENDEDTRANSFER variables Asterisk sets on the
+// transferred channel
+type TransferInfo struct {
+	Blind    bool
+	Attended bool
+	// By is the name of the channel that performed the transfer
+	By string
+}
+
+// Transferred reports whether the channel was transferred at all
+func (t TransferInfo) Transferred() bool {
+	return t.Blind || t.Attended
+}
+
+// Transfer asks the channel driver to transfer the caller to dest, such as
+// "PJSIP/1000" or a SIP URI, using the Transfer application, and reports
+// TRANSFERSTATUS
+func (s *AgiSession) Transfer(dest string) (TransferResult, error) {
+	if dest == "" {
+		return TransferResult{}, fmt.Errorf("transfer: destination must not be empty")
+	}
+
+	cmd := fmt.Sprintf("EXEC Transfer \"%s\"", EscapeString(appArgEscaper.Replace(dest)))
+	if _, err := s.execute(cmd); err != nil {
+		return TransferResult{}, err
+	}
+
+	status, err := s.GetVariable("TRANSFERSTATUS")
+	if err != nil {
+		return TransferResult{}, err
+	}
+	protocol, err := s.GetVariable("TRANSFERSTATUSPROTOCOL")
+	if err != nil {
+		return TransferResult{}, err
+	}
+	return TransferResult{Status: parseTransferStatus(status), Protocol: protocol}, nil
+}
+
+// TransferInfo reports whether this channel was the target of a blind or
+// attended transfer and which channel transferred it. It is typically called
+// from the h extension once the call has ended.
+func (s *AgiSession) TransferInfo() (TransferInfo, error) {
+	blind, err := s.GetVariable("BLINDTRANSFER")
+	if err != nil {
+		return TransferInfo{}, err
+	}
+	if blind != "" {
+		return TransferInfo{Blind: true, By: blind}, nil
+	}
+
+	attended, err := s.GetVariable("ATTENDEDTRANSFER")
+	if err != nil {
+		return TransferInfo{}, err
+	}
+	if attended != "" {
+		return TransferInfo{Attended: true, By: attended}, nil
+	}
+	return TransferInfo{}, nil
+}
+
+// parseTransferStatus maps a TRANSFERSTATUS value to its constant
+func parseTransferStatus(status string) TransferStatus {
+	switch s := TransferStatus(status); s {
+	case TransferSuccess, TransferFailure, TransferUnsupported, TransferNotPermitted:
+		return s
+	default:
+		return TransferUnknown
+	}
+}
@@ -2,6 +2,7 @@ package agi
 
 import (
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -20,6 +21,44 @@ func UnescapeString(s string) string {
 	return s
 }
 
+// controlEscaper writes control characters as backslash sequences
+var controlEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\t", "\\t", "\r", "\\r")
+
+// escapeControl escapes backslashes, newlines, tabs and carriage returns
+func escapeControl(s string) string {
+	return controlEscaper.Replace(s)
+}
+
+// unescapeControl reverses escapeControl, keeping any other backslash as is
+func unescapeControl(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+	}
+	return b.String()
+}
+
 // ParseAGIResult parses an AGI result string
 func ParseAGIResult(s string) (int, string, error) {
 	if !strings.HasPrefix(s, "200") {
@@ -50,27 +89,25 @@ func ParseAGIResult(s string) (int, string, error) {
 	return result, data, nil
 }
 
-// ParseAGIEnv parses AGI environment variables
+// ParseAGIEnv parses an AGI environment block with the rules sessions use
+// reading it from Asterisk: blank lines before the block and malformed lines
+// are skipped, and parsing stops at the blank line ending the block or at
+// the end of input.
 func ParseAGIEnv(input string) map[string]string {
 	env := make(map[string]string)
-	lines := strings.Split(input, "\n")
+	lines := strings.SplitAfter(input, "\n")
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		if strings.HasPrefix(line, "agi_") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-				env[key] = value
-			}
+	next := func() (string, error) {
+		if len(lines) == 0 || (len(lines) == 1 && lines[0] == "") {
+			return "", io.EOF
 		}
+		line := lines[0]
+		lines = lines[1:]
+		return line, nil
 	}
 
+	// Malformed lines and a missing terminator are what the leniency is for
+	_ = readEnvBlock(next, func(key, value string) { env[key] = value })
 	return env
 }
 
@@ -94,12 +131,18 @@ func FormatDateTime(format string) string {
 	return result
 }
 
-// SplitCommand splits an AGI command into its components
+// SplitCommand splits an AGI command into its components, separated by
+// spaces and tabs as Asterisk separates them. A quoted empty
+// string, such as the escape digits in STREAM FILE welcome "", is kept as an
+// empty component.
 func SplitCommand(cmd string) []string {
 	var parts []string
 	var current strings.Builder
 	inQuotes := false
 	escaped := false
+	// started is set once the current component has begun, even if it is
+	// an empty quoted string
+	started := false
 
 	for _, c := range cmd {
 		if escaped {
@@ -111,32 +154,38 @@ func SplitCommand(cmd string) []string {
 		switch c {
 		case '\\':
 			escaped = true
+			started = true
 		case '"':
 			inQuotes = !inQuotes
-		case ' ':
+			started = true
+		case ' ', '\t':
 			if inQuotes {
 				current.WriteRune(c)
-			} else if current.Len() > 0 {
+			} else if started {
 				parts = append(parts, current.String())
 				current.Reset()
+				started = false
 			}
 		default:
 			current.WriteRune(c)
+			started = true
 		}
 	}
 
-	if current.Len() > 0 {
+	if started {
 		parts = append(parts, current.String())
 	}
 
 	return parts
 }
 
-// JoinCommand joins command parts with proper escaping
+// JoinCommand joins command parts with proper escaping. Empty parts and
+// parts containing spaces, quotes or backslashes are quoted, so
+// SplitCommand returns parts unchanged.
 func JoinCommand(parts []string) string {
 	escaped := make([]string, len(parts))
 	for i, part := range parts {
-		if strings.ContainsAny(part, " \"") {
+		if part == "" || strings.ContainsAny(part, " \t\"\\") {
 			escaped[i] = fmt.Sprintf("\"%s\"", EscapeString(part))
 		} else {
 			escaped[i] = part
@@ -144,3 +193,51 @@ func JoinCommand(parts []string) string {
 	}
 	return strings.Join(escaped, " ")
 }
+
+// NormalizeE164 validates number as an E.164 number: a plus sign followed by
+// a country code and up to 15 digits in total. With lenient set, spaces,
+// dashes, dots, slashes and parentheses are removed first, so
+// "+1 (555) 010-0100" becomes "+15550100100".
+func NormalizeE164(number string, lenient bool) (string, error) {
+	if lenient {
+		number = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(" -./()", r) {
+				return -1
+			}
+			return r
+		}, number)
+	}
+
+	digits, ok := strings.CutPrefix(number, "+")
+	if !ok {
+		return "", fmt.Errorf("invalid E.164 number %q: must start with +", number)
+	}
+	if len(digits) < 2 || len(digits) > 15 {
+		return "", fmt.Errorf("invalid E.164 number %q: must have 2 to 15 digits", number)
+	}
+	if digits[0] == '0' {
+		return "", fmt.Errorf("invalid E.164 number %q: country code cannot start with 0", number)
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("invalid E.164 number %q: unexpected character %q", number, c)
+		}
+	}
+	return number, nil
+}
+
+// FormatCallerID formats a caller ID name and number as "Name" <number>, the
+// form accepted by SetCallerID. Double quotes and line breaks are removed from
+// the name. An empty name yields just <number>.
+func FormatCallerID(name, number string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '"' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" {
+		return fmt.Sprintf("<%s>", number)
+	}
+	return fmt.Sprintf("\"%s\" <%s>", name, number)
+}
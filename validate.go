@@ -0,0 +1,73 @@
+package agi
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ValidateCommand checks that Asterisk splits command into the arguments it
+// appears to have: it must be a single line, its quotes must be closed and
+// no escape may be left dangling, and joining its arguments again with
+// JoinCommand must give the same arguments. Errors wrap ErrMalformedCommand.
+func ValidateCommand(command string) error {
+	if strings.ContainsAny(command, "\r\n") {
+		return fmt.Errorf("%w: %q contains a line break", ErrMalformedCommand, command)
+	}
+
+	inQuotes, escaped := false, false
+	for _, c := range command {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		}
+	}
+	switch {
+	case escaped:
+		return fmt.Errorf("%w: %q ends with an escape", ErrMalformedCommand, command)
+	case inQuotes:
+		return fmt.Errorf("%w: %q has an unclosed quote", ErrMalformedCommand, command)
+	}
+
+	args := SplitCommand(command)
+	if rejoined := SplitCommand(JoinCommand(args)); !slices.Equal(args, rejoined) {
+		return fmt.Errorf("%w: %q splits into %q but %q when joined again", ErrMalformedCommand, command, args, rejoined)
+	}
+	return nil
+}
+
+// SetCommandValidation runs every command through ValidateCommand before it
+// is sent and calls fn with the commands that fail, which are then sent
+// anyway. PanicOnMalformedCommand turns quoting bugs into test failures;
+// in production fn typically logs. A nil fn, the default, disables
+// validation.
+func (s *AgiSession) SetCommandValidation(fn func(s *AgiSession, command string, err error)) {
+	s.commandValidation = fn
+}
+
+// WithCommandValidation sets the command validation of every session
+func WithCommandValidation(fn func(s *AgiSession, command string, err error)) ServerOption {
+	return func(s *FastAGIServer) {
+		s.commandValidation = fn
+	}
+}
+
+// PanicOnMalformedCommand is a command validation function for tests that
+// panics with the validation error
+func PanicOnMalformedCommand(_ *AgiSession, _ string, err error) {
+	panic(err)
+}
+
+// validateCommand applies the session's command validation to command
+func (s *AgiSession) validateCommand(command string) {
+	if s.commandValidation == nil {
+		return
+	}
+	if err := ValidateCommand(command); err != nil {
+		s.commandValidation(s, command, err)
+	}
+}
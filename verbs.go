@@ -0,0 +1,46 @@
+package agi
+
+import "strings"
+
+// VerbClass says whether an AGI command can change the call
+type VerbClass int
+
+const (
+	// VerbMutating commands change the channel, the dialplan position or
+	// the Asterisk database, such as ANSWER, EXEC or SET VARIABLE. Verbs
+	// missing from VerbClasses are treated as mutating.
+	VerbMutating VerbClass = iota
+	// VerbReadOnly commands only read state, such as GET VARIABLE
+	VerbReadOnly
+	// VerbMedia commands play prompts or collect input without changing the
+	// call, such as STREAM FILE or GET DATA
+	VerbMedia
+)
+
+// MarshalText implements encoding.TextMarshaler with the class name
+func (c VerbClass) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// String returns a readable name for the class
+func (c VerbClass) String() string {
+	switch c {
+	case VerbReadOnly:
+		return "read-only"
+	case VerbMedia:
+		return "media"
+	default:
+		return "mutating"
+	}
+}
+
+// VerbClasses classifies the AGI command verbs, starting from the classes
+// in the Commands catalog. It is shared by command policies such as
+// DenyMutatingCommands and by agitest dry runs; add to it before sessions
+// start, not while they run.
+var VerbClasses = commandSpecClasses()
+
+// ClassifyVerb returns the class of verb, such as "GET VARIABLE"
+func ClassifyVerb(verb string) VerbClass {
+	return VerbClasses[strings.ToUpper(verb)]
+}
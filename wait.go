@@ -0,0 +1,173 @@
+package agi
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// DefaultVariablePoll is how often WaitForVariable polls when no interval
+// is given
+const DefaultVariablePoll = 100 * time.Millisecond
+
+// WaitVariableOptions configures WaitForVariableWith
+type WaitVariableOptions struct {
+	// Poll is the delay before the second attempt. Defaults to
+	// DefaultVariablePoll.
+	Poll time.Duration
+	// Backoff multiplies the delay after each attempt when greater than one
+	Backoff float64
+	// MaxPoll caps the delay when Backoff is set. Zero means no cap.
+	MaxPoll time.Duration
+	// MaxAttempts stops polling after this many GET VARIABLE commands.
+	// Zero means poll until the context is done.
+	MaxAttempts int
+	// Full evaluates name with GET FULL VARIABLE, so it may be an
+	// expression such as "${SHARED(ROUTE)}"
+	Full bool
+}
+
+// WaitForVariable polls GET VARIABLE every poll interval until name is set
+// to a non-empty value, for variables the dialplan sets asynchronously
+// around the time the script starts. It returns ErrTimeout when ctx is done
+// first and ErrHangup as soon as the channel hangs up.
+func (s *AgiSession) WaitForVariable(ctx context.Context, name string, poll time.Duration) (string, error) {
+	return s.WaitForVariableWith(ctx, name, WaitVariableOptions{Poll: poll})
+}
+
+// WaitForVariableWith is WaitForVariable with backoff, an attempt limit and
+// expression support; see WaitVariableOptions. Reaching MaxAttempts also
+// returns ErrTimeout.
+func (s *AgiSession) WaitForVariableWith(ctx context.Context, name string, opts WaitVariableOptions) (string, error) {
+	delay := opts.Poll
+	if delay <= 0 {
+		delay = DefaultVariablePoll
+	}
+	get := s.GetVariable
+	if opts.Full {
+		get = s.GetFullVariable
+	}
+
+	for attempt := 1; ; attempt++ {
+		if s.HungUp() {
+			return "", ErrHangup
+		}
+		if err := ctx.Err(); err != nil {
+			return "", fmt.Errorf("%w: %s not set: %w", ErrTimeout, name, err)
+		}
+
+		value, err := get(name)
+		if err != nil {
+			return "", err
+		}
+		if value != "" {
+			return value, nil
+		}
+		if opts.MaxAttempts > 0 && attempt >= opts.MaxAttempts {
+			return "", fmt.Errorf("%w: %s not set after %d attempts", ErrTimeout, name, attempt)
+		}
+
+		timer := s.clock().NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if s.HungUp() {
+				return "", ErrHangup
+			}
+			return "", fmt.Errorf("%w: %s not set: %w", ErrTimeout, name, ctx.Err())
+		case <-timer.C():
+		}
+
+		if opts.Backoff > 1 {
+			delay = time.Duration(float64(delay) * opts.Backoff)
+			if opts.MaxPoll > 0 && delay > opts.MaxPoll {
+				delay = opts.MaxPoll
+			}
+		}
+	}
+}
+
+// DefaultWatchMaxInterval caps the delay between WatchVariable polls when
+// WatchOptions.MaxInterval is zero
+const DefaultWatchMaxInterval = 5 * time.Second
+
+// WatchOptions configures WatchVariable
+type WatchOptions struct {
+	// Interval is the delay before the second poll, doubling after each
+	// poll. Defaults to DefaultVariablePoll.
+	Interval time.Duration
+	// MaxInterval caps the delay. Defaults to DefaultWatchMaxInterval.
+	MaxInterval time.Duration
+	// Jitter randomizes each delay between half and all of its value, so
+	// many calls waiting on the same backend do not poll in step
+	Jitter bool
+}
+
+// Equals returns a WatchVariable predicate matching want
+func Equals(want string) func(string) bool {
+	return func(value string) bool { return value == want }
+}
+
+// WatchVariable polls GET VARIABLE with exponential backoff until predicate
+// accepts the value of name, and returns that value. A nil predicate
+// accepts any non-empty value. It returns ErrTimeout when ctx is done first
+// and ErrHangup as soon as the channel hangs up; combined with
+// WithMusicOnHold, either also stops the music:
+//
+//	err := s.WithMusicOnHold("", func() error {
+//		_, err := s.WatchVariable(ctx, "PROCESSING_DONE", agi.Equals("1"), agi.WatchOptions{})
+//		return err
+//	})
+func (s *AgiSession) WatchVariable(ctx context.Context, name string, predicate func(string) bool, opts WatchOptions) (string, error) {
+	s.escaped.Store(true)
+	if predicate == nil {
+		predicate = func(value string) bool { return value != "" }
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultVariablePoll
+	}
+	if opts.MaxInterval <= 0 {
+		opts.MaxInterval = DefaultWatchMaxInterval
+	}
+
+	interval := opts.Interval
+	for {
+		if s.HungUp() {
+			return "", ErrHangup
+		}
+		if err := ctx.Err(); err != nil {
+			return "", fmt.Errorf("%w: watching %s: %w", ErrTimeout, name, err)
+		}
+
+		value, err := s.GetVariable(name)
+		if err != nil {
+			return "", err
+		}
+		if predicate(value) {
+			return value, nil
+		}
+
+		timer := s.clock().NewTimer(watchDelay(interval, opts.Jitter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if s.HungUp() {
+				return "", ErrHangup
+			}
+			return "", fmt.Errorf("%w: watching %s: %w", ErrTimeout, name, ctx.Err())
+		case <-timer.C():
+		}
+		interval = min(2*interval, opts.MaxInterval)
+	}
+}
+
+// watchDelay returns interval, or a random duration between half of it and
+// all of it with jitter
+func watchDelay(interval time.Duration, jitter bool) time.Duration {
+	if !jitter || interval < 2 {
+		return interval
+	}
+	half := interval / 2
+	return half + rand.N(interval-half)
+}
@@ -0,0 +1,111 @@
+package agi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WarmParallelism is how many prompts WarmPrompts warms at once. Commands
+// share one AGI connection, so more workers would only queue more probes
+// ahead of the handler's own commands.
+const WarmParallelism = 4
+
+// PromptWarmer loads a prompt into the PBX's file cache ahead of playback,
+// for prompts on slow storage such as NFS
+type PromptWarmer interface {
+	WarmPrompt(ctx context.Context, s *AgiSession, file string) error
+}
+
+// PromptWarmerFunc adapts a function to PromptWarmer
+type PromptWarmerFunc func(ctx context.Context, s *AgiSession, file string) error
+
+// WarmPrompt calls f(ctx, s, file)
+func (f PromptWarmerFunc) WarmPrompt(ctx context.Context, s *AgiSession, file string) error {
+	return f(ctx, s, file)
+}
+
+// StatWarmer is the default PromptWarmer. It evaluates STAT on every file
+// SoundExists would look for, which makes the PBX read their directory
+// entries and attributes without playing anything.
+type StatWarmer struct{}
+
+// WarmPrompt implements PromptWarmer
+func (StatWarmer) WarmPrompt(_ context.Context, s *AgiSession, file string) error {
+	_, err := s.GetFullVariable(s.soundExpression(file))
+	return err
+}
+
+// PromptWarmMetrics is implemented by PromptMetrics hooks that also want
+// WarmPrompts' report for each file: how long warming took and its error
+type PromptWarmMetrics interface {
+	OnPromptWarmed(file string, latency time.Duration, err error)
+}
+
+// SetPromptWarmer sets how WarmPrompts warms each file. A nil w restores
+// StatWarmer.
+func (s *AgiSession) SetPromptWarmer(w PromptWarmer) {
+	s.promptWarmer = w
+}
+
+// WithPromptWarmer sets the PromptWarmer of every session
+func WithPromptWarmer(w PromptWarmer) ServerOption {
+	return func(s *FastAGIServer) {
+		s.promptWarmer = w
+	}
+}
+
+// WarmPrompts warms files with the session's PromptWarmer, WarmParallelism
+// at a time, and returns once all are done or ctx is. It is meant to run in
+// its own goroutine while the handler does other setup:
+//
+//	warmed := make(chan error, 1)
+//	go func() { warmed <- s.WarmPrompts(ctx, files) }()
+//
+// Warming commands queue with the handler's in the order they were issued,
+// so a prompt played meanwhile waits for at most WarmParallelism probes. The
+// latency of each file is reported to the PromptMetrics hook when it
+// implements PromptWarmMetrics. Failures are joined into the returned error.
+func (s *AgiSession) WarmPrompts(ctx context.Context, files []string) error {
+	s.escaped.Store(true)
+	warmer := s.promptWarmer
+	if warmer == nil {
+		warmer = StatWarmer{}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	slots := make(chan struct{}, WarmParallelism)
+	for _, file := range files {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			wg.Wait()
+			return errors.Join(append(errs, err)...)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			start := s.clock().Now()
+			err := warmer.WarmPrompt(ctx, s, file)
+			if m, ok := s.promptMetrics.(PromptWarmMetrics); ok {
+				m.OnPromptWarmed(file, since(s.clock(), start), err)
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("warming %s: %w", file, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}